@@ -0,0 +1,114 @@
+package bbolt
+
+// The nodes a writable transaction decodes from pages, and their inodes, are
+// garbage once it closes. With Options.UseArena they are carved from slabs
+// owned by an arena, which the transaction returns to its database on close
+// for the next transaction to reuse, instead of being allocated one by one.
+// Read-only transactions read pages in place and do not decode nodes.
+
+const (
+	// arenaNodeSlab and arenaInodeSlab are the number of nodes and inodes
+	// allocated at once by an arena. Larger inode requests are allocated
+	// separately and not reused.
+	arenaNodeSlab  = 64
+	arenaInodeSlab = 4096
+)
+
+// arena hands out nodes and inodes from slabs which are reused after reset.
+type arena struct {
+	nodes  [][]node
+	inodes [][]inode
+
+	// node and inode are the index of the slab in use, and nodeOff and
+	// inodeOff the number of its elements handed out.
+	node, nodeOff   int
+	inode, inodeOff int
+}
+
+// newNode returns a zeroed node.
+func (a *arena) newNode() *node {
+	if len(a.nodes) == 0 {
+		a.nodes = append(a.nodes, make([]node, arenaNodeSlab))
+	} else if a.nodeOff == arenaNodeSlab {
+		if a.node == len(a.nodes)-1 {
+			a.nodes = append(a.nodes, make([]node, arenaNodeSlab))
+		}
+		a.node, a.nodeOff = a.node+1, 0
+	}
+	n := &a.nodes[a.node][a.nodeOff]
+	a.nodeOff++
+	return n
+}
+
+// newInodes returns n zeroed inodes. The capacity of the slice is limited to
+// n, so that appending to it does not overwrite the inodes handed out next.
+func (a *arena) newInodes(n int) inodes {
+	if n > arenaInodeSlab {
+		return make(inodes, n)
+	}
+	if len(a.inodes) == 0 {
+		a.inodes = append(a.inodes, make([]inode, arenaInodeSlab))
+	} else if a.inodeOff+n > arenaInodeSlab {
+		if a.inode == len(a.inodes)-1 {
+			a.inodes = append(a.inodes, make([]inode, arenaInodeSlab))
+		}
+		a.inode, a.inodeOff = a.inode+1, 0
+	}
+	s := a.inodes[a.inode][a.inodeOff : a.inodeOff+n : a.inodeOff+n]
+	a.inodeOff += n
+	return s
+}
+
+// reset zeroes the nodes and inodes handed out, which must no longer be
+// used, so that they can be handed out again and do not keep the pages and
+// buckets they reference alive.
+func (a *arena) reset() {
+	for i := 0; i < len(a.nodes) && i <= a.node; i++ {
+		s := a.nodes[i]
+		if i == a.node {
+			s = s[:a.nodeOff]
+		}
+		for j := range s {
+			s[j] = node{}
+		}
+	}
+	for i := 0; i < len(a.inodes) && i <= a.inode; i++ {
+		s := a.inodes[i]
+		if i == a.inode {
+			s = s[:a.inodeOff]
+		}
+		for j := range s {
+			s[j] = inode{}
+		}
+	}
+	a.node, a.nodeOff = 0, 0
+	a.inode, a.inodeOff = 0, 0
+}
+
+// newNode returns a zeroed node for the transaction, from its arena if the
+// database uses one.
+func (tx *Tx) newNode() *node {
+	if tx.arena == nil {
+		return &node{}
+	}
+	return tx.arena.newNode()
+}
+
+// newInodes returns n zeroed inodes for the transaction, from its arena if
+// the database uses one.
+func (tx *Tx) newInodes(n int) inodes {
+	if tx.arena == nil {
+		return make(inodes, n)
+	}
+	return tx.arena.newInodes(n)
+}
+
+// releaseArena returns the arena of the closing transaction to its database.
+func (tx *Tx) releaseArena() {
+	if tx.arena == nil {
+		return
+	}
+	tx.arena.reset()
+	tx.db.arenas.Put(tx.arena)
+	tx.arena = nil
+}
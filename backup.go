@@ -0,0 +1,431 @@
+package bbolt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// incrementalMagic identifies a stream written by Tx.WriteIncrementalTo.
+const incrementalMagic uint32 = 0xED0CDAEE
+
+// incrementalEnd marks the end of the pages in an incremental backup stream.
+const incrementalEnd = ^uint64(0)
+
+// incrementalHeader is written at the start of an incremental backup stream.
+type incrementalHeader struct {
+	Magic    uint32
+	PageSize uint32
+	BaseTxid uint64 // txid of the backup the stream applies to
+	Txid     uint64 // txid of the backup after applying the stream
+	Pgid     uint64 // high water mark after applying the stream
+}
+
+// WriteIncrementalTo writes the pages which changed since the backup of
+// transaction baseTxid to w, in a form which ApplyIncremental replays onto
+// that backup. baseTxid is the ID of the transaction that wrote the previous
+// backup, either with WriteTo or WriteIncrementalTo.
+//
+// The database must be opened with Options.TrackChanges, or
+// ErrChangesNotTracked is returned. The pages written by every commit are
+// only tracked in memory since the database was opened, so baseTxid must not
+// be older than the transaction which was current when the database was
+// opened, even if the backup was taken by an earlier process.
+// ErrIncrementalBaseTooOld is returned otherwise, in which case a full backup
+// has to be taken with WriteTo.
+func (tx *Tx) WriteIncrementalTo(w io.Writer, baseTxid int) (n int64, err error) {
+	db := tx.db
+	if !db.options.TrackChanges {
+		return 0, ErrChangesNotTracked
+	}
+	if baseTxid > tx.ID() {
+		return 0, fmt.Errorf("base txid %d is newer than tx %d", baseTxid, tx.ID())
+	}
+
+	// Collect the pages written after the base transaction. Pages beyond the
+	// high water mark of this transaction are not part of its snapshot.
+	db.changedlock.Lock()
+	if txid(baseTxid) < db.changedSince {
+		db.changedlock.Unlock()
+		return 0, ErrIncrementalBaseTooOld
+	}
+	var ids pgids
+	for id, t := range db.changed {
+		if t > txid(baseTxid) && id > 1 && id < tx.meta.pgid {
+			ids = append(ids, id)
+		}
+	}
+	db.changedlock.Unlock()
+	sort.Sort(ids)
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	defer func() { n = cw.n }()
+
+	hdr := incrementalHeader{
+		Magic:    incrementalMagic,
+		PageSize: uint32(db.pageSize),
+		BaseTxid: uint64(baseTxid),
+		Txid:     uint64(tx.meta.txid),
+		Pgid:     uint64(tx.meta.pgid),
+	}
+	if err := binary.Write(bw, binary.BigEndian, &hdr); err != nil {
+		return 0, err
+	}
+
+	// Write each changed page preceded by its id.
+	for _, id := range ids {
+		buf := unsafeByteSlice(unsafe.Pointer(db.rawPage(id)), 0, 0, db.pageSize)
+		if err := writeIncrementalPage(bw, uint64(id), buf); err != nil {
+			return 0, err
+		}
+	}
+
+	// Write the meta pages the same way WriteTo does.
+	buf := make([]byte, db.pageSize)
+	page := (*page)(unsafe.Pointer(&buf[0]))
+	page.flags = metaPageFlag
+	*page.meta() = *tx.meta
+	for id := pgid(0); id <= 1; id++ {
+		page.id = id
+		if id == 1 {
+			page.meta().txid -= 1
+		}
+		page.meta().checksum = page.meta().sum64()
+		if err := writeIncrementalPage(bw, uint64(id), buf); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := binary.Write(bw, binary.BigEndian, incrementalEnd); err != nil {
+		return 0, err
+	}
+	return 0, bw.Flush()
+}
+
+// ChangedKeysSince calls fn for the keys which may have been written by the
+// transactions committed after baseTxid, up to this one, so that a change
+// feed or index can be updated without walking the whole database. path holds
+// the names of the buckets leading to the bucket which contains k, and is nil
+// for top-level buckets. Keys are passed depth first and in sorted order.
+//
+// Changes are tracked per page, like for WriteIncrementalTo, so every key on
+// a page written after baseTxid is passed, whether it changed or not. Deleted
+// keys are not reported; callers needing them must diff against the keys
+// they saw before. Since pages are copied on write, the pages which did not
+// change are skipped along with everything below them. Changes which are not
+// committed yet are not reported.
+//
+// As for WriteIncrementalTo, the database must be opened with
+// Options.TrackChanges, and baseTxid must not be older than the transaction
+// which was current when the database was opened. ErrChangesNotTracked and
+// ErrIncrementalBaseTooOld are returned otherwise.
+func (tx *Tx) ChangedKeysSince(baseTxid uint64, fn func(path [][]byte, k []byte)) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	db := tx.db
+	if !db.options.TrackChanges {
+		return ErrChangesNotTracked
+	}
+
+	db.changedlock.Lock()
+	if txid(baseTxid) < db.changedSince {
+		db.changedlock.Unlock()
+		return ErrIncrementalBaseTooOld
+	}
+	changed := make(map[pgid]bool)
+	for id, t := range db.changed {
+		if t > txid(baseTxid) && id < tx.meta.pgid {
+			changed[id] = true
+		}
+	}
+	db.changedlock.Unlock()
+
+	tx.changedKeys(tx.meta.root.root, nil, changed, fn)
+	return nil
+}
+
+// resetChanges forgets the pages written up to transaction id, from which
+// incremental backups and change feeds can start.
+func (db *DB) resetChanges(id txid) {
+	db.changedlock.Lock()
+	if db.options.TrackChanges {
+		db.changed = make(map[pgid]txid)
+	}
+	db.changedSince = id
+	db.changedlock.Unlock()
+}
+
+// changedKeys calls fn for the keys on the changed leaf pages under page id,
+// which belongs to the bucket at path.
+func (tx *Tx) changedKeys(id pgid, path [][]byte, changed map[pgid]bool, fn func(path [][]byte, k []byte)) {
+	if !changed[id] {
+		return
+	}
+
+	p := tx.page(id)
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			tx.changedKeys(p.branchPageElement(uint16(i)).pgid, path, changed, fn)
+		}
+		return
+	}
+
+	for i := 0; i < int(p.count); i++ {
+		elem := p.leafPageElement(uint16(i))
+		fn(path, elem.key())
+		if (elem.flags & bucketLeafFlag) == 0 {
+			continue
+		}
+
+		// The pages of a nested bucket are checked like the ones of its
+		// parent, but an inline bucket is part of the changed page.
+		child := tx.root.openBucket(elem.value())
+		childPath := append(path[:len(path):len(path)], elem.key())
+		if child.root != 0 {
+			tx.changedKeys(child.root, childPath, changed, fn)
+			continue
+		}
+		for j := 0; j < int(child.page.count); j++ {
+			fn(childPath, child.page.leafPageElement(uint16(j)).key())
+		}
+	}
+}
+
+// writeIncrementalPage writes the page with the given id to w.
+func writeIncrementalPage(w io.Writer, id uint64, buf []byte) error {
+	if err := binary.Write(w, binary.BigEndian, id); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ApplyIncremental replays an incremental backup written by
+// Tx.WriteIncrementalTo onto the backup file at path. The file must hold the
+// backup the incremental one was based on, otherwise ErrIncrementalMismatch
+// is returned and the file is left unchanged. The file must not be open as a
+// DB while it is updated. If applying fails part way through, the file may no
+// longer hold a consistent database.
+func ApplyIncremental(path string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	var hdr incrementalHeader
+	if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+		return err
+	} else if hdr.Magic != incrementalMagic || hdr.PageSize == 0 {
+		return ErrInvalid
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	// Ensure the file holds the base backup.
+	pageSize := int(hdr.PageSize)
+	buf := make([]byte, pageSize)
+	var current txid
+	for id := 0; id <= 1; id++ {
+		if _, err := f.ReadAt(buf, int64(id*pageSize)); err != nil {
+			return err
+		}
+		if m := (*page)(unsafe.Pointer(&buf[0])).meta(); m.validate() == nil && m.txid > current {
+			current = m.txid
+		}
+	}
+	if current != txid(hdr.BaseTxid) {
+		return ErrIncrementalMismatch
+	}
+
+	// Write the meta pages only once the data pages they reference are
+	// synced.
+	var metas [2][]byte
+	for {
+		var id uint64
+		if err := binary.Read(br, binary.BigEndian, &id); err != nil {
+			return err
+		} else if id == incrementalEnd {
+			break
+		} else if id >= hdr.Pgid {
+			return fmt.Errorf("page %d beyond high water mark %d", id, hdr.Pgid)
+		}
+
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return err
+		}
+		if id <= 1 {
+			metas[id] = append([]byte(nil), buf...)
+			continue
+		}
+		if _, err := f.WriteAt(buf, int64(id)*int64(pageSize)); err != nil {
+			return err
+		}
+	}
+	if metas[0] == nil || metas[1] == nil {
+		return fmt.Errorf("incremental backup is missing meta pages")
+	}
+
+	if err := f.Truncate(int64(hdr.Pgid) * int64(pageSize)); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	for id, meta := range metas {
+		if _, err := f.WriteAt(meta, int64(id*pageSize)); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// CopyBucketRange writes a standalone database to w which holds the keys in
+// [min, max) of the bucket at bucketPath, along with the buckets leading to
+// it. Nested buckets within the range are copied with all their contents. A
+// nil min or max leaves the range unbounded on that side.
+//
+// The database is built in a temporary file which is removed on return. It
+// orders keys with the same Options.KeyComparator as tx's database, and is
+// encrypted with the same Options.EncryptionKey.
+func (tx *Tx) CopyBucketRange(bucketPath [][]byte, min, max []byte, w io.Writer) error {
+	if len(bucketPath) == 0 {
+		return ErrBucketNameRequired
+	}
+	src := tx.Bucket(bucketPath[0])
+	for _, name := range bucketPath[1:] {
+		if src == nil {
+			break
+		}
+		src = src.Bucket(name)
+	}
+	if src == nil {
+		return ErrBucketNotFound
+	}
+
+	f, err := ioutil.TempFile("", "bolt-range-")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	defer func() { _ = os.Remove(path) }()
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	db, err := Open(path, 0600, &Options{PageSize: tx.db.pageSize, NoSync: true, KeyComparator: tx.db.compare, EncryptionKey: tx.db.encryptionKey})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	// Recreate the buckets leading to the range, then copy it like Compact.
+	c := &compactor{dst: db}
+	if err := c.begin(); err != nil {
+		return err
+	}
+	defer c.rollback()
+	srcParent := &tx.root
+	for i, name := range bucketPath {
+		srcParent = srcParent.Bucket(name)
+		if err := c.walk(bucketPath[:i], name, nil, srcParent); err != nil {
+			return err
+		}
+	}
+	if err := src.ForEachRange(min, max, func(k, v []byte) error {
+		if v != nil {
+			return c.walk(bucketPath, k, v, nil)
+		}
+		return walkBucket(src.Bucket(k), bucketPath, k, c.walk)
+	}); err != nil {
+		return err
+	}
+	if err := c.tx.Commit(); err != nil {
+		return err
+	}
+
+	return db.View(func(tx *Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// WriteToWithChecksum writes the entire database to w like WriteTo, followed
+// by the SHA-256 checksum of everything written before it. VerifyBackup checks
+// such a stream. A file holding the stream can be opened as a database as is,
+// since the checksum lies beyond the pages of the database.
+func (tx *Tx) WriteToWithChecksum(w io.Writer) (n int64, err error) {
+	h := sha256.New()
+	if n, err = tx.WriteTo(io.MultiWriter(w, h)); err != nil {
+		return n, err
+	}
+	nn, err := w.Write(h.Sum(nil))
+	return n + int64(nn), err
+}
+
+// VerifyBackup reads a stream written by Tx.WriteToWithChecksum from r and
+// verifies its checksum, without opening the database. It returns
+// ErrChecksum if the stream is corrupted and io.ErrUnexpectedEOF if it is
+// truncated.
+func VerifyBackup(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	// The first meta page holds the page size and the high water mark, which
+	// give the size of the database in the stream.
+	hdr, err := br.Peek(int(pageHeaderSize + unsafe.Sizeof(meta{})))
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	buf := make([]byte, len(hdr))
+	copy(buf, hdr)
+	m := (*page)(unsafe.Pointer(&buf[0])).meta()
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size := int64(m.pgid) * int64(m.pageSize)
+	if _, err := io.CopyN(h, br, size); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(br, sum); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return ErrChecksum
+	}
+	if _, err := br.ReadByte(); err == nil {
+		return fmt.Errorf("unexpected data after backup checksum")
+	} else if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
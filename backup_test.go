@@ -0,0 +1,414 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that an incremental backup brings a full backup up to date.
+func TestTx_WriteIncrementalTo(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{TrackChanges: true})
+	defer db.MustClose()
+
+	put := func(start, end int) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := start; i < end; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(0, 1000)
+
+	// Take a full backup.
+	path := tempfile()
+	defer os.Remove(path)
+	var base int
+	if err := db.View(func(tx *bolt.Tx) error {
+		base = tx.ID()
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the database, growing it and freeing pages.
+	put(1000, 5000)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 500; i++ {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var size int64
+	if err := db.View(func(tx *bolt.Tx) error {
+		n, err := tx.WriteIncrementalTo(&buf, base)
+		if n != int64(buf.Len()) {
+			t.Fatalf("unexpected size: %d, expected %d", n, buf.Len())
+		}
+		size = tx.Size()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if int64(buf.Len()) >= size {
+		t.Fatalf("expected incremental backup of %d bytes to be smaller than %d", buf.Len(), size)
+	}
+
+	stream := buf.Bytes()
+	if err := bolt.ApplyIncremental(path, bytes.NewReader(stream)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Applying the same stream again must fail as the base has moved on.
+	if err := bolt.ApplyIncremental(path, bytes.NewReader(stream)); err != bolt.ErrIncrementalMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	backup, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if err := backup.View(func(btx *bolt.Tx) error {
+		for err := range btx.Check() {
+			t.Fatal(err)
+		}
+		return db.View(func(tx *bolt.Tx) error {
+			if btx.ID() != tx.ID() {
+				t.Fatalf("unexpected txid: %d, expected %d", btx.ID(), tx.ID())
+			}
+			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				return compareBuckets(t, b, btx.Bucket(name))
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that an incremental backup cannot be based on a transaction from
+// before the database was opened.
+func TestTx_WriteIncrementalTo_BaseTooOld(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{TrackChanges: true})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var base int
+	if err := db.View(func(tx *bolt.Tx) error {
+		base = tx.ID()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, err := tx.WriteIncrementalTo(&bytes.Buffer{}, base); err != bolt.ErrIncrementalBaseTooOld {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.WriteIncrementalTo(&bytes.Buffer{}, tx.ID()); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that incremental backups require Options.TrackChanges.
+func TestTx_WriteIncrementalTo_NotTracked(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, err := tx.WriteIncrementalTo(&bytes.Buffer{}, tx.ID()); err != bolt.ErrChangesNotTracked {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := tx.ChangedKeysSince(uint64(tx.ID()), func([][]byte, []byte) {}); err != bolt.ErrChangesNotTracked {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that ChangedKeysSince reports the keys on the pages written since
+// the base transaction.
+func TestTx_ChangedKeysSince(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{TrackChanges: true})
+	defer db.MustClose()
+
+	var base int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.CreateBucket([]byte("woojits")); err != nil {
+			return err
+		}
+		base = tx.ID()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Put(u64tob(500), []byte("changed")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("woojits")).Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		changed := make(map[string]bool)
+		if err := tx.ChangedKeysSince(uint64(base), func(path [][]byte, k []byte) {
+			changed[string(bytes.Join(append(path, k), []byte("/")))] = true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"widgets", "woojits", "widgets/" + string(u64tob(500)), "woojits/foo"} {
+			if !changed[k] {
+				t.Fatalf("expected %q to be reported as changed", k)
+			}
+		}
+		if changed["widgets/"+string(u64tob(0))] {
+			t.Fatal("expected key on an unchanged page to be skipped")
+		}
+
+		if err := tx.ChangedKeysSince(uint64(tx.ID()), func(path [][]byte, k []byte) {
+			t.Fatalf("unexpected change: %q", k)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if err := tx.ChangedKeysSince(uint64(base), func([][]byte, []byte) {}); err != bolt.ErrIncrementalBaseTooOld {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a range of a nested bucket can be exported as a database.
+func TestTx_CopyBucketRange(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		parent, err := tx.CreateBucket([]byte("parent"))
+		if err != nil {
+			return err
+		}
+		b, err := parent.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if i == 150 {
+				continue
+			}
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		child, err := b.CreateBucketIfNotExistsWithOptions(u64tob(150), &bolt.BucketOptions{FillPercent: 0.9})
+		if err != nil {
+			return err
+		}
+		return child.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyBucketRange([][]byte{[]byte("parent"), []byte("widgets")}, u64tob(100), u64tob(200), f)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if err := out.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		b := tx.Bucket([]byte("parent")).Bucket([]byte("widgets"))
+		if v := b.Sequence(); v != 42 {
+			t.Fatalf("unexpected sequence: %d", v)
+		}
+		var n int
+		if err := b.ForEach(func(k, v []byte) error {
+			if k := binary.BigEndian.Uint64(k); k < 100 || k >= 200 {
+				t.Fatalf("unexpected key: %d", k)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 100 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		child := b.Bucket(u64tob(150))
+		if v := child.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v", v)
+		} else if child.FillPercent != 0.9 {
+			t.Fatalf("unexpected fill percent: %v", child.FillPercent)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyBucketRange([][]byte{[]byte("missing")}, nil, nil, ioutil.Discard)
+	}); err != bolt.ErrBucketNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a checksummed backup can be verified and opened.
+func TestTx_WriteToWithChecksum(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.View(func(tx *bolt.Tx) error {
+		n, err := tx.WriteToWithChecksum(&buf)
+		if n != int64(buf.Len()) || n != tx.Size()+32 {
+			t.Fatalf("unexpected size: %d, buffered %d", n, buf.Len())
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if err := bolt.VerifyBackup(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that truncated and corrupted backups are detected.
+	if err := bolt.VerifyBackup(bytes.NewReader(data[:len(data)-4096])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := bolt.VerifyBackup(bytes.NewReader(data[:16])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err := bolt.VerifyBackup(bytes.NewReader(corrupted)); err != bolt.ErrChecksum {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ensure that the backup opens as a database with the checksum in place.
+	path := tempfile()
+	defer os.Remove(path)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if err := backup.View(func(btx *bolt.Tx) error {
+		for err := range btx.Check() {
+			t.Fatal(err)
+		}
+		return db.View(func(tx *bolt.Tx) error {
+			return compareBuckets(t, tx.Bucket([]byte("widgets")), btx.Bucket([]byte("widgets")))
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
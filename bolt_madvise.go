@@ -0,0 +1,17 @@
+// +build !windows,!plan9
+
+package bbolt
+
+import "syscall"
+
+// accessAdvice returns the madvise advice for an access pattern.
+func accessAdvice(p AccessPattern) int {
+	switch p {
+	case AccessNormal:
+		return syscall.MADV_NORMAL
+	case AccessSequential:
+		return syscall.MADV_SEQUENTIAL
+	default:
+		return syscall.MADV_RANDOM
+	}
+}
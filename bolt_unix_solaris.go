@@ -1,7 +1,9 @@
 package bbolt
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"syscall"
 	"time"
 	"unsafe"
@@ -9,8 +11,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+// flock acquires an advisory lock on a file descriptor. It returns ErrTimeout
+// or a *lockedError if the lock is still held by another process once timeout has
+// passed or ctx is done.
+func flock(ctx context.Context, db *DB, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
@@ -38,7 +42,11 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 		}
 
 		// Wait for a bit and try again.
-		time.Sleep(flockRetryTimeout)
+		select {
+		case <-ctx.Done():
+			return &lockedError{ctx.Err()}
+		case <-time.After(flockRetryTimeout):
+		}
 	}
 }
 
@@ -52,6 +60,20 @@ func funlock(db *DB) error {
 	return syscall.FcntlFlock(uintptr(db.file.Fd()), syscall.F_SETLK, &lock)
 }
 
+// syncDir flushes the entries of the directory at path, so that a file
+// renamed into it survives a power failure.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
+
 // mmap memory maps a DB's data file.
 func mmap(db *DB, sz int) error {
 	// Map the data file to memory.
@@ -60,8 +82,8 @@ func mmap(db *DB, sz int) error {
 		return err
 	}
 
-	// Advise the kernel that the mmap is accessed randomly.
-	if err := unix.Madvise(b, syscall.MADV_RANDOM); err != nil {
+	// Advise the kernel how the mmap is accessed.
+	if err := unix.Madvise(b, accessAdvice(db.AccessPattern)); err != nil {
 		return fmt.Errorf("madvise: %s", err)
 	}
 
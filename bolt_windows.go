@@ -1,6 +1,7 @@
 package bbolt
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"syscall"
@@ -45,8 +46,10 @@ func fdatasync(db *DB) error {
 	return db.file.Sync()
 }
 
-// flock acquires an advisory lock on a file descriptor.
-func flock(db *DB, exclusive bool, timeout time.Duration) error {
+// flock acquires an advisory lock on a file descriptor. It returns ErrTimeout
+// or a *lockedError if the lock is still held by another process once timeout has
+// passed or ctx is done.
+func flock(ctx context.Context, db *DB, exclusive bool, timeout time.Duration) error {
 	var t time.Time
 	if timeout != 0 {
 		t = time.Now()
@@ -76,7 +79,11 @@ func flock(db *DB, exclusive bool, timeout time.Duration) error {
 		}
 
 		// Wait for a bit and try again.
-		time.Sleep(flockRetryTimeout)
+		select {
+		case <-ctx.Done():
+			return &lockedError{ctx.Err()}
+		case <-time.After(flockRetryTimeout):
+		}
 	}
 }
 
@@ -90,6 +97,12 @@ func funlock(db *DB) error {
 	return err
 }
 
+// syncDir does nothing, since directories cannot be opened for syncing on
+// Windows.
+func syncDir(path string) error {
+	return nil
+}
+
 // mmap memory maps a DB's data file.
 // Based on: https://github.com/edsrzf/mmap-go
 func mmap(db *DB, sz int) error {
@@ -3,6 +3,8 @@ package bbolt
 import (
 	"bytes"
 	"fmt"
+	"math"
+	"sort"
 	"unsafe"
 )
 
@@ -25,6 +27,11 @@ const (
 // This value can be changed by setting Bucket.FillPercent.
 const DefaultFillPercent = 0.5
 
+// DefaultRebalanceThreshold is the fraction of the page size below which
+// nodes are merged with a sibling. This value can be changed by setting
+// DB.RebalanceThreshold.
+const DefaultRebalanceThreshold = 0.25
+
 // Bucket represents a collection of key/value pairs inside the database.
 type Bucket struct {
 	*bucket
@@ -38,8 +45,13 @@ type Bucket struct {
 	// the bucket will fill to 50% but it can be useful to increase this
 	// amount if you know that your write workloads are mostly append-only.
 	//
-	// This is non-persisted across transactions so it must be set in every Tx.
+	// This is non-persisted across transactions so it must be set in every Tx,
+	// unless it is persisted with SetFillPercent.
 	FillPercent float64
+
+	fillPercent uint32 // persisted fill percent in percent, 0 if not set
+	noInline    bool   // persisted BucketOptions.NoInline
+	snapshot    bool   // read-only view returned by Snapshot
 }
 
 // bucket represents the on-file representation of a bucket.
@@ -61,27 +73,70 @@ func newBucket(tx *Tx) Bucket {
 	return b
 }
 
-// Tx returns the tx of the bucket.
+// Tx returns the tx of the bucket, so that code given only a bucket can open
+// sibling buckets within the same transaction. It is valid for as long as the
+// bucket is.
 func (b *Bucket) Tx() *Tx {
 	return b.tx
 }
 
-// Root returns the root of the bucket.
-func (b *Bucket) Root() pgid {
-	return b.root
+// Root returns the id of the root page of the bucket, which Tx.Check reports
+// as CheckError.PageID for inconsistencies found on it. It is zero for an
+// inline bucket, which is stored within the value of its parent, and may
+// change whenever the bucket is modified.
+func (b *Bucket) Root() uint64 {
+	return uint64(b.root)
 }
 
 // Writable returns whether the bucket is writable.
 func (b *Bucket) Writable() bool {
-	return b.tx.writable
+	return b.tx.writable && !b.snapshot
+}
+
+// Snapshot returns a read-only view of the bucket as it was at the start of
+// the transaction. Puts and deletes made in the transaction, before or after
+// the snapshot is taken, are not visible through it, so a writable transaction
+// can iterate the snapshot while modifying the bucket itself. Nested buckets
+// retrieved from the snapshot are snapshots too, and buckets created in the
+// transaction are empty in their snapshot.
+//
+// The snapshot is only valid for the lifetime of the transaction. Modifying it
+// returns ErrTxNotWritable.
+func (b *Bucket) Snapshot() (*Bucket, error) {
+	if b.tx.db == nil {
+		return nil, ErrTxClosed
+	}
+
+	// Pages are not modified until the transaction commits, so reading them
+	// directly, without the materialized nodes, gives the original contents.
+	var s = Bucket{
+		tx:          b.tx,
+		bucket:      &bucket{},
+		page:        b.page,
+		FillPercent: b.FillPercent,
+		fillPercent: b.fillPercent,
+		noInline:    b.noInline,
+		snapshot:    true,
+	}
+	*s.bucket = *b.bucket
+	if b.tx.writable {
+		s.buckets = make(map[string]*Bucket)
+	}
+	return &s, nil
 }
 
 // Cursor creates a cursor associated with the bucket.
 // The cursor is only valid as long as the transaction is open.
 // Do not use a cursor after the transaction is closed.
+//
+// The cursors of a read-only transaction are independent of each other, so
+// goroutines may each use their own cursor over the same bucket at the same
+// time, for example to scan disjoint key ranges in parallel. A cursor must
+// not be used by several goroutines at once, and the cursors of a writable
+// transaction must all be used by a single goroutine.
 func (b *Bucket) Cursor() *Cursor {
 	// Update transaction statistics.
-	b.tx.stats.CursorCount++
+	b.tx.countCursor()
 
 	// Allocate and return a cursor.
 	return &Cursor{
@@ -101,27 +156,52 @@ func (b *Bucket) Bucket(name []byte) *Bucket {
 	}
 
 	// Move cursor to key.
-	c := b.Cursor()
-	k, v, flags := c.seek(name)
+	k, v, flags := b.seekOnce(name)
 
 	// Return nil if the key doesn't exist or it is not a bucket.
-	if !bytes.Equal(name, k) || (flags&bucketLeafFlag) == 0 {
+	if !b.tx.sameKey(name, k) || (flags&bucketLeafFlag) == 0 {
 		return nil
 	}
 
+	// Buckets are cached under their stored name, which a KeyComparator may
+	// consider the same as a different name.
+	if b.buckets != nil {
+		if child := b.buckets[string(k)]; child != nil {
+			return child
+		}
+	}
+
 	// Otherwise create a bucket and cache it.
 	var child = b.openBucket(v)
+	if fp := (flags & bucketFillPercentMask) >> bucketFillPercentShift; fp != 0 {
+		child.fillPercent = fp
+		child.FillPercent = float64(fp) / 100
+	}
+	child.noInline = (flags & bucketNoInlineFlag) != 0
 	if b.buckets != nil {
-		b.buckets[string(name)] = child
+		b.buckets[string(k)] = child
 	}
 
 	return child
 }
 
+// HasBucket reports whether a nested bucket exists, without opening it.
+func (b *Bucket) HasBucket(name []byte) bool {
+	if b.buckets != nil {
+		if child := b.buckets[string(name)]; child != nil {
+			return true
+		}
+	}
+
+	k, _, flags := b.seekOnce(name)
+	return b.tx.sameKey(name, k) && (flags&bucketLeafFlag) != 0
+}
+
 // Helper method that re-interprets a sub-bucket value
 // from a parent into a Bucket
 func (b *Bucket) openBucket(value []byte) *Bucket {
 	var child = newBucket(b.tx)
+	child.snapshot = b.snapshot
 
 	// Unaligned access requires a copy to be made.
 	const unalignedMask = unsafe.Alignof(struct {
@@ -154,25 +234,13 @@ func (b *Bucket) openBucket(value []byte) *Bucket {
 // Returns an error if the key already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
 func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
-	if b.tx.db == nil {
-		return nil, ErrTxClosed
-	} else if !b.tx.writable {
-		return nil, ErrTxNotWritable
-	} else if len(key) == 0 {
-		return nil, ErrBucketNameRequired
+	if err := b.CanCreateBucket(key); err != nil {
+		return nil, err
 	}
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
-
-	// Return an error if there is an existing key.
-	if bytes.Equal(key, k) {
-		if (flags & bucketLeafFlag) != 0 {
-			return nil, ErrBucketExists
-		}
-		return nil, ErrIncompatibleValue
-	}
+	c.seek(key)
 
 	// Create empty, inline bucket.
 	var bucket = Bucket{
@@ -194,6 +262,32 @@ func (b *Bucket) CreateBucket(key []byte) (*Bucket, error) {
 	return b.Bucket(key), nil
 }
 
+// CanCreateBucket returns the error CreateBucket would return for key, without
+// creating the bucket. It returns nil if the bucket can be created.
+//
+// Only the current state of the transaction is checked. To validate a
+// sequence of operations which depend on each other, perform them after
+// Tx.Savepoint and undo them with Tx.RollbackTo.
+func (b *Bucket) CanCreateBucket(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	} else if len(key) == 0 {
+		return ErrBucketNameRequired
+	}
+
+	// Return an error if there is an existing key.
+	k, _, flags := b.seekOnce(key)
+	if b.tx.sameKey(key, k) {
+		if (flags & bucketLeafFlag) != 0 {
+			return ErrBucketExists
+		}
+		return ErrIncompatibleValue
+	}
+	return nil
+}
+
 // CreateBucketIfNotExists creates a new bucket if it doesn't already exist and returns a reference to it.
 // Returns an error if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
@@ -207,25 +301,56 @@ func (b *Bucket) CreateBucketIfNotExists(key []byte) (*Bucket, error) {
 	return child, nil
 }
 
+// BucketOptions configures a bucket created by
+// CreateBucketIfNotExistsWithOptions. The options are persisted with the
+// bucket, so later transactions do not have to set them again.
+type BucketOptions struct {
+	// FillPercent is persisted as by Bucket.SetFillPercent. If zero,
+	// DefaultFillPercent is used.
+	FillPercent float64
+
+	// NoInline stores the bucket on its own pages from the start, instead of
+	// inline in the page of its parent while it is small. This avoids moving
+	// the bucket out of its parent once it grows, at the cost of a page.
+	NoInline bool
+}
+
+// CreateBucketIfNotExistsWithOptions creates a new bucket configured by opts
+// if it doesn't already exist and returns a reference to it. An existing
+// bucket is returned as is, without applying opts. A nil opts is the same as
+// CreateBucketIfNotExists. Returns ErrFillPercent if opts.FillPercent is out
+// of range, and the errors of CreateBucketIfNotExists otherwise.
+func (b *Bucket) CreateBucketIfNotExistsWithOptions(key []byte, opts *BucketOptions) (*Bucket, error) {
+	if opts == nil {
+		return b.CreateBucketIfNotExists(key)
+	} else if opts.FillPercent != 0 && (opts.FillPercent < minFillPercent || opts.FillPercent > maxFillPercent) {
+		return nil, ErrFillPercent
+	}
+
+	child, err := b.CreateBucket(key)
+	if err == ErrBucketExists {
+		return b.Bucket(key), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := child.SetFillPercent(opts.FillPercent); err != nil {
+		return nil, err
+	}
+	child.noInline = opts.NoInline
+	return child, nil
+}
+
 // DeleteBucket deletes a bucket at the given key.
 // Returns an error if the bucket does not exist, or if the key represents a non-bucket value.
 func (b *Bucket) DeleteBucket(key []byte) error {
-	if b.tx.db == nil {
-		return ErrTxClosed
-	} else if !b.Writable() {
-		return ErrTxNotWritable
+	if err := b.CanDeleteBucket(key); err != nil {
+		return err
 	}
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
-
-	// Return an error if bucket doesn't exist or is not a bucket.
-	if !bytes.Equal(key, k) {
-		return ErrBucketNotFound
-	} else if (flags & bucketLeafFlag) == 0 {
-		return ErrIncompatibleValue
-	}
+	k, _, _ := c.seek(key)
+	name := string(k)
 
 	// Recursively delete all child buckets.
 	child := b.Bucket(key)
@@ -242,7 +367,7 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 	}
 
 	// Remove cached copy.
-	delete(b.buckets, string(key))
+	delete(b.buckets, name)
 
 	// Release all bucket pages to freelist.
 	child.nodes = nil
@@ -255,11 +380,202 @@ func (b *Bucket) DeleteBucket(key []byte) error {
 	return nil
 }
 
+// CanDeleteBucket returns the error DeleteBucket would return for key,
+// without deleting the bucket. It returns nil if the bucket can be deleted.
+// See CanCreateBucket for validating sequences of operations.
+func (b *Bucket) CanDeleteBucket(key []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Return an error if bucket doesn't exist or is not a bucket.
+	k, _, flags := b.seekOnce(key)
+	if !b.tx.sameKey(key, k) {
+		return ErrBucketNotFound
+	} else if (flags & bucketLeafFlag) == 0 {
+		return ErrIncompatibleValue
+	}
+	return nil
+}
+
+// RenameBucket moves the nested bucket at oldKey to newKey. Only the entry
+// in this bucket is rewritten; the pages of the nested bucket are kept, so
+// the cost does not depend on its size. Buckets obtained under oldKey earlier
+// in the transaction remain valid. Whether the bucket is stored inline is
+// decided on commit as usual, since it does not depend on its name.
+// Returns ErrBucketNotFound if oldKey does not exist, ErrBucketExists if
+// newKey does, and ErrIncompatibleValue if either holds a non-bucket value.
+func (b *Bucket) RenameBucket(oldKey, newKey []byte) error {
+	if b.tx.sameKey(oldKey, newKey) {
+		// Only report whether the bucket exists.
+		return b.moveBucket(oldKey, nil, nil, false)
+	}
+	return b.moveBucket(oldKey, b, newKey, false)
+}
+
+// MoveBucket moves the nested bucket at key to dst, under the same key. Like
+// RenameBucket it only rewrites the entries in this bucket and in dst, and
+// buckets obtained under key earlier in the transaction remain valid. dst
+// must belong to the same transaction.
+// Returns ErrBucketNotFound if key does not exist, ErrBucketExists if it
+// exists in dst, ErrIncompatibleValue if either holds a non-bucket value, and
+// ErrBucketMoveCycle if dst is the bucket being moved or nested within it.
+func (b *Bucket) MoveBucket(key []byte, dst *Bucket) error {
+	if dst.tx != b.tx {
+		return fmt.Errorf("destination bucket belongs to another transaction")
+	}
+	return b.moveBucket(key, dst, key, false)
+}
+
+// CanMoveBucket returns the error MoveBucket would return for key and dst,
+// without moving the bucket. It returns nil if the bucket can be moved.
+// See CanCreateBucket for validating sequences of operations.
+func (b *Bucket) CanMoveBucket(key []byte, dst *Bucket) error {
+	if dst.tx != b.tx {
+		return fmt.Errorf("destination bucket belongs to another transaction")
+	}
+	return b.moveBucket(key, dst, key, true)
+}
+
+// moveBucket moves the nested bucket at oldKey to newKey in dst. If dst is
+// nil, it only checks that oldKey holds a bucket. If check is set, it
+// returns before changing anything once the move is known to succeed.
+func (b *Bucket) moveBucket(oldKey []byte, dst *Bucket, newKey []byte, check bool) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() || (dst != nil && !dst.Writable()) {
+		return ErrTxNotWritable
+	} else if dst != nil && len(newKey) == 0 {
+		return ErrBucketNameRequired
+	} else if b.keyTooLarge(len(newKey)) {
+		return ErrKeyTooLarge
+	}
+
+	c := b.Cursor()
+	k, v, flags := c.seek(oldKey)
+	if !b.tx.sameKey(oldKey, k) {
+		return ErrBucketNotFound
+	} else if (flags & bucketLeafFlag) == 0 {
+		return ErrIncompatibleValue
+	} else if dst == nil {
+		return nil
+	}
+	value, oldName := cloneBytes(v), string(k)
+
+	dc := dst.Cursor()
+	if k, _, newFlags := dc.seek(newKey); dst.tx.sameKey(newKey, k) {
+		if (newFlags & bucketLeafFlag) != 0 {
+			return ErrBucketExists
+		}
+		return ErrIncompatibleValue
+	}
+
+	// Buckets are cached once opened in a writable transaction, so dst can
+	// only be nested within the moved bucket if it is in the cached copy.
+	child := b.buckets[oldName]
+	if child != nil && child.contains(dst) {
+		return ErrBucketMoveCycle
+	} else if check {
+		return nil
+	}
+
+	// Move the cached copy, whose changes are written under the new key
+	// when the transaction spills.
+	if child != nil {
+		delete(b.buckets, oldName)
+		dst.buckets[string(newKey)] = child
+	}
+
+	c.seek(oldKey)
+	c.node().del(oldKey)
+	newKey = cloneBytes(newKey)
+	dc.seek(newKey)
+	dc.node().put(newKey, newKey, value, 0, flags)
+
+	// As in CreateBucket, a bucket holding a nested bucket is no longer
+	// inline.
+	dst.page = nil
+	return nil
+}
+
+// contains returns whether other is b or one of the buckets opened within it.
+func (b *Bucket) contains(other *Bucket) bool {
+	if b == other {
+		return true
+	}
+	for _, child := range b.buckets {
+		if child.contains(other) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clear removes all keys and nested buckets from the bucket and releases its
+// pages to the freelist. The bucket's sequence is preserved.
+// Returns an error if the bucket was created from a read-only transaction.
+func (b *Bucket) Clear() error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	// Recursively delete all child buckets.
+	err := b.ForEach(func(k, v []byte) error {
+		if _, _, flags := b.Cursor().seek(k); (flags & bucketLeafFlag) != 0 {
+			if err := b.DeleteBucket(k); err != nil {
+				return fmt.Errorf("delete bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Release all bucket pages to freelist.
+	b.nodes = nil
+	b.rootNode = nil
+	b.free()
+
+	// Reset to an empty, inline root.
+	b.page = nil
+	b.nodes = make(map[pgid]*node)
+	b.rootNode = &node{bucket: b, isLeaf: true}
+
+	return nil
+}
+
 // Get retrieves the value for a key in the bucket.
 // Returns a nil value if the key does not exist or if the key is a nested bucket.
-// The returned value is only valid for the life of the transaction.
+//
+// The returned value is not copied: it points into the memory map, or into
+// memory owned by the transaction for values written by it. It is only valid
+// for the life of the transaction and must not be modified. Once the
+// transaction is closed, its memory may hold another page or be unmapped, in
+// which case accessing it panics. Use GetCopy to retain a value, and
+// DB.ValueSafetyChecks to catch values used after their transaction.
 func (b *Bucket) Get(key []byte) []byte {
-	k, v, flags := b.Cursor().seek(key)
+	return b.tx.lend(b.get(key))
+}
+
+// GetCopy retrieves a copy of the value for a key in the bucket, which stays
+// valid after the transaction is closed and may be modified.
+// Returns a nil value if the key does not exist or if the key is a nested bucket.
+func (b *Bucket) GetCopy(key []byte) []byte {
+	v := b.get(key)
+	if v == nil {
+		return nil
+	}
+	return append([]byte{}, v...)
+}
+
+// get retrieves the value for a key in the bucket without copying it.
+func (b *Bucket) get(key []byte) []byte {
+	k, v, flags := b.seekOnce(key)
 
 	// Return nil if this is a bucket.
 	if (flags & bucketLeafFlag) != 0 {
@@ -267,24 +583,184 @@ func (b *Bucket) Get(key []byte) []byte {
 	}
 
 	// If our target node isn't the same key as what's passed in then return nil.
-	if !bytes.Equal(key, k) {
+	if !b.tx.sameKey(key, k) {
 		return nil
 	}
+	v, _ = b.liveValue(v, flags)
 	return v
 }
 
+// GetValue retrieves the value for a key in the bucket like Get, but also
+// reports whether the key exists. This distinguishes a missing key from a key
+// holding an empty value, for which a non-nil, empty value is returned.
+// Nested buckets are reported as not found.
+// The returned value is only valid for the life of the transaction.
+func (b *Bucket) GetValue(key []byte) (value []byte, found bool) {
+	k, v, flags := b.seekOnce(key)
+	if k == nil || (flags&bucketLeafFlag) != 0 || !b.tx.sameKey(key, k) {
+		return nil, false
+	}
+	if v, found = b.liveValue(v, flags); !found {
+		return nil, false
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return b.tx.lend(v), true
+}
+
+// GetMulti retrieves the values for several keys in the bucket. The values
+// are returned in the order of keys, with a nil value for each key which does
+// not exist or is a nested bucket, just like Get.
+//
+// The keys are looked up in sorted order with a single cursor, so that keys
+// on the same page only require a search of that page.
+// The returned values are only valid for the life of the transaction.
+func (b *Bucket) GetMulti(keys [][]byte) [][]byte {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return b.tx.compareKeys(keys[order[i]], keys[order[j]]) < 0
+	})
+
+	values := make([][]byte, len(keys))
+	c := b.Cursor()
+	for _, i := range order {
+		k, v, flags := c.seekNear(keys[i])
+		if (flags&bucketLeafFlag) == 0 && b.tx.sameKey(keys[i], k) {
+			v, _ = b.liveValue(v, flags)
+			values[i] = b.tx.lend(v)
+		}
+	}
+	return values
+}
+
 // Put sets the value for a key in the bucket.
 // If the key exist then its previous value will be overwritten.
 // Supplied value must remain valid for the life of the transaction.
+// Values from DB.CompressionThreshold bytes are compressed if DB.Compression
+// is set.
 // Returns an error if the bucket was created from a read-only transaction, if the key is blank, if the key is too large, or if the value is too large.
 func (b *Bucket) Put(key []byte, value []byte) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if b.valueTooLarge(len(value)) {
+		return ErrValueTooLarge
+	}
+	value, flags := b.compressValue(value)
+	return b.put(key, value, flags)
+}
+
+// KV is a key/value pair passed to PutMulti.
+type KV struct {
+	Key, Value []byte
+}
+
+// PutError is returned by PutMulti when one of the pairs cannot be put.
+type PutError struct {
+	// Index is the position of the pair in the slice passed to PutMulti.
+	Index int
+
+	// Key is the key of the pair.
+	Key []byte
+
+	// Err is the error Put would have returned for the pair.
+	Err error
+}
+
+// Error returns a description of the pair and why it failed.
+func (e *PutError) Error() string {
+	return fmt.Sprintf("pair %d (key %x): %s", e.Index, e.Key, e.Err)
+}
+
+// PutMulti sets the values for several keys in the bucket, like calling Put
+// for each pair in turn: if a key appears more than once, the last pair wins.
+//
+// The pairs are put in sorted order with a single cursor, so that keys on
+// the same leaf only require a search of that leaf, which makes putting
+// many pairs much faster than calling Put for each of them. Unlike
+// BulkLoad, the keys may be in any order and may already exist.
+//
+// Every pair is validated before any is put, and a failure is returned as a
+// *PutError identifying the pair. Only a key holding a nested bucket is
+// detected while putting, in which case the pairs whose keys sort before it
+// remain in the bucket. Values must remain valid for the life of the
+// transaction.
+func (b *Bucket) PutMulti(pairs []KV) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	for i, kv := range pairs {
+		var err error
+		if len(kv.Key) == 0 {
+			err = ErrKeyRequired
+		} else if b.keyTooLarge(len(kv.Key)) {
+			err = ErrKeyTooLarge
+		} else if b.valueTooLarge(len(kv.Value)) {
+			err = ErrValueTooLarge
+		}
+		if err != nil {
+			return &PutError{Index: i, Key: cloneBytes(kv.Key), Err: err}
+		}
+	}
+
+	order := make([]int, len(pairs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return b.tx.compareKeys(pairs[order[i]].Key, pairs[order[j]].Key) < 0
+	})
+
+	c := b.Cursor()
+	for _, i := range order {
+		key := pairs[i].Key
+		k, _, oldFlags := c.seekNear(key)
+		if b.tx.sameKey(key, k) && (oldFlags&bucketLeafFlag) != 0 {
+			return &PutError{Index: i, Key: cloneBytes(key), Err: ErrIncompatibleValue}
+		}
+
+		// Keep the leaf node on the stack, so that the following keys on
+		// the same leaf are found without descending from the root.
+		n := c.node()
+		c.stack[len(c.stack)-1] = elemRef{node: n}
+
+		value, flags := b.compressValue(pairs[i].Value)
+		key = cloneBytes(key)
+		n.put(key, key, value, 0, flags)
+		b.tx.meta.flags |= elementFeatures(flags)
+	}
+	return nil
+}
+
+// keyTooLarge reports whether a key of n bytes exceeds MaxKeySize or the
+// limit set by DB.MaxKeySize.
+func (b *Bucket) keyTooLarge(n int) bool {
+	limit := b.tx.db.MaxKeySize
+	return n > MaxKeySize || (limit > 0 && n > limit)
+}
+
+// valueTooLarge reports whether a value of n bytes exceeds MaxValueSize or
+// the limit set by DB.MaxValueSize.
+func (b *Bucket) valueTooLarge(n int) bool {
+	limit := b.tx.db.MaxValueSize
+	return int64(n) > MaxValueSize || (limit > 0 && n > limit)
+}
+
+// put sets the value for a key in the bucket with the given element flags.
+func (b *Bucket) put(key []byte, value []byte, flags uint32) error {
 	if b.tx.db == nil {
 		return ErrTxClosed
 	} else if !b.Writable() {
 		return ErrTxNotWritable
 	} else if len(key) == 0 {
 		return ErrKeyRequired
-	} else if len(key) > MaxKeySize {
+	} else if b.keyTooLarge(len(key)) {
 		return ErrKeyTooLarge
 	} else if int64(len(value)) > MaxValueSize {
 		return ErrValueTooLarge
@@ -292,20 +768,95 @@ func (b *Bucket) Put(key []byte, value []byte) error {
 
 	// Move cursor to correct position.
 	c := b.Cursor()
-	k, _, flags := c.seek(key)
+	k, _, oldFlags := c.seek(key)
 
 	// Return an error if there is an existing key with a bucket value.
-	if bytes.Equal(key, k) && (flags&bucketLeafFlag) != 0 {
+	if b.tx.sameKey(key, k) && (oldFlags&bucketLeafFlag) != 0 {
 		return ErrIncompatibleValue
 	}
 
 	// Insert into node.
 	key = cloneBytes(key)
-	c.node().put(key, key, value, 0, 0)
+	c.node().put(key, key, value, 0, flags)
+	b.tx.meta.flags |= elementFeatures(flags)
 
 	return nil
 }
 
+// BulkLoad inserts the keys and values returned by src until it returns false.
+// Keys must be strictly ascending and sort after every key already in the
+// bucket, otherwise ErrKeysOutOfOrder is returned. Since every key belongs at
+// the end of the bucket, they are appended to its last leaf without searching
+// the tree for each of them, and split into pages when the transaction is
+// committed. Keys and values are copied, so src may reuse its buffers.
+//
+// Keys loaded before an error is returned remain in the bucket.
+func (b *Bucket) BulkLoad(src func() (k, v []byte, ok bool)) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	}
+
+	c := b.Cursor()
+	last, _ := c.Last()
+	n := c.node()
+	if last == nil && len(c.stack) > 1 {
+		// The last leaf was emptied in this transaction, so the separator
+		// leading to it may be larger than the keys being loaded. Fall back to
+		// inserting them one at a time.
+		last, _ = c.Prev()
+		n = nil
+	}
+
+	for {
+		k, v, ok := src()
+		if !ok {
+			return nil
+		}
+		if len(k) == 0 {
+			return ErrKeyRequired
+		} else if b.keyTooLarge(len(k)) {
+			return ErrKeyTooLarge
+		} else if b.valueTooLarge(len(v)) {
+			return ErrValueTooLarge
+		} else if last != nil && b.tx.compareKeys(last, k) >= 0 {
+			return ErrKeysOutOfOrder
+		}
+
+		k, v = cloneBytes(k), cloneBytes(v)
+		if n == nil {
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		} else {
+			v, flags := b.compressValue(v)
+			n.inodes = append(n.inodes, inode{flags: flags, key: k, value: v})
+			b.tx.meta.flags |= elementFeatures(flags)
+		}
+		last = k
+	}
+}
+
+// PutReserve sets the value for a key in the bucket to size zero bytes and
+// returns the value, so that the caller can write it in place instead of
+// assembling it in a separate buffer first. The returned slice must be filled
+// in before the transaction is committed and must not be used afterwards.
+// The value is never compressed, since it is only filled in later.
+// Errors are returned as for Put.
+func (b *Bucket) PutReserve(key []byte, size int) ([]byte, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("negative value size %d", size)
+	} else if b.valueTooLarge(size) {
+		return nil, ErrValueTooLarge
+	}
+	value := make([]byte, size)
+	if err := b.put(key, value, 0); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
 // Delete removes a key from the bucket.
 // If the key does not exist then nothing is done and a nil error is returned.
 // Returns an error if the bucket was created from a read-only transaction.
@@ -321,7 +872,7 @@ func (b *Bucket) Delete(key []byte) error {
 	k, _, flags := c.seek(key)
 
 	// Return nil if the key doesn't exist.
-	if !bytes.Equal(key, k) {
+	if !b.tx.sameKey(key, k) {
 		return nil
 	}
 
@@ -336,6 +887,51 @@ func (b *Bucket) Delete(key []byte) error {
 	return nil
 }
 
+// DeleteRange removes the keys within [min, max) from the bucket and returns
+// the number of keys removed. A nil min or max leaves the range unbounded on
+// that side. Nested buckets within the range are not removed.
+//
+// Each leaf is visited once and all of its keys in the range are removed
+// together. Leaves emptied this way are freed when the transaction commits.
+// Returns an error if the bucket was created from a read-only transaction.
+func (b *Bucket) DeleteRange(min, max []byte) (deleted int, err error) {
+	if b.tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, ErrTxNotWritable
+	}
+
+	c := b.Cursor()
+	k, _ := c.First()
+	if min != nil {
+		k, _, _ = c.seek(min)
+	}
+	for {
+		// Move to the next leaf if the seek ended beyond the current one.
+		if k == nil {
+			if k, _, _ = c.next(); k == nil {
+				break
+			}
+		}
+		if max != nil && b.tx.compareKeys(k, max) >= 0 {
+			break
+		}
+
+		// Remove the range from the leaf, keeping its last key so that the
+		// following leaf can be found again.
+		n := c.node()
+		last := cloneBytes(n.inodes[len(n.inodes)-1].key)
+		deleted += n.delRange(min, max)
+
+		// Branches are not updated until commit, so last still leads to the
+		// same leaf. Step past its end to the following leaf.
+		c.seek(last)
+		c.stack[len(c.stack)-1].index = c.stack[len(c.stack)-1].count()
+		k = nil
+	}
+	return deleted, nil
+}
+
 // Sequence returns the current integer for the bucket without incrementing it.
 func (b *Bucket) Sequence() uint64 { return b.bucket.sequence }
 
@@ -358,6 +954,36 @@ func (b *Bucket) SetSequence(v uint64) error {
 	return nil
 }
 
+// SetFillPercent sets FillPercent and persists it with the bucket, so that
+// later transactions use it without having to set FillPercent themselves.
+// The value is stored rounded to a whole percent and must be between 0.1 and
+// 1.0. A value of zero removes the persisted fill percent, so that later
+// transactions use DefaultFillPercent again.
+func (b *Bucket) SetFillPercent(fillPercent float64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if !b.Writable() {
+		return ErrTxNotWritable
+	} else if fillPercent != 0 && (fillPercent < minFillPercent || fillPercent > maxFillPercent) {
+		return ErrFillPercent
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	if fillPercent == 0 {
+		b.fillPercent = 0
+		b.FillPercent = DefaultFillPercent
+		return nil
+	}
+	b.fillPercent = uint32(math.Round(fillPercent * 100))
+	b.FillPercent = float64(b.fillPercent) / 100
+	return nil
+}
+
 // NextSequence returns an autoincrementing integer for the bucket.
 func (b *Bucket) NextSequence() (uint64, error) {
 	if b.tx.db == nil {
@@ -377,6 +1003,30 @@ func (b *Bucket) NextSequence() (uint64, error) {
 	return b.bucket.sequence, nil
 }
 
+// NextSequenceBatch reserves n consecutive integers for the bucket and
+// returns the first and last of them. It is equivalent to calling
+// NextSequence n times.
+// Returns ErrSequenceBatchSize if n is zero or the sequence would overflow.
+func (b *Bucket) NextSequenceBatch(n uint64) (first, last uint64, err error) {
+	if b.tx.db == nil {
+		return 0, 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, 0, ErrTxNotWritable
+	} else if n == 0 || b.bucket.sequence > math.MaxUint64-n {
+		return 0, 0, ErrSequenceBatchSize
+	}
+
+	// Materialize the root node if it hasn't been already so that the
+	// bucket will be saved during commit.
+	if b.rootNode == nil {
+		_ = b.node(b.root, nil)
+	}
+
+	first = b.bucket.sequence + 1
+	b.bucket.sequence += n
+	return first, b.bucket.sequence, nil
+}
+
 // ForEach executes a function for each key/value pair in a bucket.
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller. The provided function must not modify
@@ -394,8 +1044,133 @@ func (b *Bucket) ForEach(fn func(k, v []byte) error) error {
 	return nil
 }
 
+// ReverseForEach executes a function for each key/value pair in a bucket, in
+// reverse key order. If the provided function returns an error then the
+// iteration is stopped and the error is returned to the caller. The provided
+// function must not modify the bucket; this will result in undefined behavior.
+func (b *Bucket) ReverseForEach(fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachBucket executes a function for each nested bucket in a bucket,
+// skipping regular key/value pairs. If the provided function returns an
+// error then the iteration is stopped and the error is returned to the caller.
+// The provided function must not modify the bucket; this will result in
+// undefined behavior.
+func (b *Bucket) ForEachBucket(fn func(k []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	return b.forEachElement(func(k, _ []byte, flags uint32) error {
+		if (flags & bucketLeafFlag) == 0 {
+			return nil
+		}
+		return fn(k)
+	})
+}
+
+// forEachElement calls fn for each element of the bucket in key order with
+// its value and flags as stored, including expired values, and stops at the
+// first error. Values are neither decompressed nor stripped of their expiry
+// time.
+func (b *Bucket) forEachElement(fn func(k, v []byte, flags uint32) error) error {
+	// Position the cursor like First, since nil need not sort first with a
+	// custom KeyComparator.
+	c := b.Cursor()
+	p, n := b.pageNode(b.root)
+	c.stack = append(c.stack, elemRef{page: p, node: n})
+	c.first()
+	if c.stack[len(c.stack)-1].count() == 0 {
+		c.next()
+	}
+	for k, v, flags := c.keyValue(); k != nil; k, v, flags = c.next() {
+		if err := fn(k, v, flags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachRange executes a function for each key/value pair in a bucket whose
+// key falls within [min, max), in sorted order. A nil min or max leaves the
+// range unbounded on that side. Iteration stops at the first key at or
+// beyond max. If the provided function returns an error then the iteration
+// is stopped and the error is returned to the caller. The provided function
+// must not modify the bucket; this will result in undefined behavior.
+func (b *Bucket) ForEachRange(min, max []byte, fn func(k, v []byte) error) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	}
+	c := b.Cursor()
+	k, v := c.First()
+	if min != nil {
+		k, v = c.Seek(min)
+	}
+	for ; k != nil && (max == nil || b.tx.compareKeys(k, max) < 0); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachPrefix executes a function for each key/value pair in a bucket whose
+// key starts with prefix, in sorted order. Iteration stops at the first key
+// without the prefix, except with an Options.KeyComparator, under which every
+// key of the bucket is checked. If the provided function returns an error then
+// the iteration is stopped and the error is returned to the caller. The
+// provided function must not modify the bucket; this will result in undefined
+// behavior.
+func (b *Bucket) ForEachPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	if b.tx.customOrder() {
+		return b.ForEachRange(nil, nil, func(k, v []byte) error {
+			if !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			return fn(k, v)
+		})
+	}
+	return b.ForEachRange(prefix, prefixEnd(prefix), fn)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or nil if there is none because prefix is empty or all 0xff bytes.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := cloneBytes(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
 // Stat returns stats on a bucket.
+//
+// Stats are computed from the committed pages of the bucket. The stats of
+// buckets with their own root page are cached for the rest of the transaction,
+// so collecting the stats of a bucket and its nested buckets walks each of
+// them only once.
 func (b *Bucket) Stats() BucketStats {
+	if b.root != 0 {
+		b.tx.cursorlock.Lock()
+		s, ok := b.tx.bucketStats[b.root]
+		b.tx.cursorlock.Unlock()
+		if ok {
+			return s
+		}
+	}
+
 	var s, subStats BucketStats
 	pageSize := b.tx.db.pageSize
 	s.BucketN += 1
@@ -422,6 +1197,24 @@ func (b *Bucket) Stats() BucketStats {
 				used += uintptr(lastElement.pos + lastElement.ksize + lastElement.vsize)
 			}
 
+			// Sizes of compressed values are taken from their headers, so
+			// that they need not be decompressed.
+			for i := uint16(0); i < p.count; i++ {
+				e := p.leafPageElement(i)
+				if (e.flags & compressedValueFlag) == 0 {
+					continue
+				}
+				v := e.value()
+				if (e.flags & expiringValueFlag) != 0 {
+					v = v[expiryPrefixSize:]
+				}
+				s.CompressedValueN++
+				s.CompressedInuse += len(v)
+				if size, _, err := compressedValueSize(v); err == nil {
+					s.CompressedValueSize += size
+				}
+			}
+
 			if b.root == 0 {
 				// For inlined bucket just update the inline stats
 				s.InlineBucketInuse += int(used)
@@ -473,9 +1266,90 @@ func (b *Bucket) Stats() BucketStats {
 	s.Depth += subStats.Depth
 	// Add the stats for all sub-buckets
 	s.Add(subStats)
+
+	if b.root != 0 {
+		b.tx.cursorlock.Lock()
+		if b.tx.bucketStats == nil {
+			b.tx.bucketStats = make(map[pgid]BucketStats)
+		}
+		b.tx.bucketStats[b.root] = s
+		b.tx.cursorlock.Unlock()
+	}
 	return s
 }
 
+// estimateSampleN is the maximum number of pages EstimatedKeyN reads on each
+// level of the b+tree.
+const estimateSampleN = 16
+
+// EstimatedKeyN returns an estimate of the number of keys in the bucket,
+// including the keys of nested buckets but not their contents.
+//
+// Unlike Stats, it does not visit every page. It descends the b+tree one level
+// at a time, reading at most a few evenly spaced pages per level, and
+// multiplies their average number of elements by the estimated number of
+// pages on that level. Small buckets are counted exactly.
+func (b *Bucket) EstimatedKeyN() int64 {
+	pages := 1.0
+	sample := []pgid{b.root}
+	for {
+		var total int
+		var leaf bool
+		var children []pgid
+		for _, id := range sample {
+			p, n := b.pageNode(id)
+			if n != nil {
+				leaf = n.isLeaf
+				total += len(n.inodes)
+				if !leaf {
+					for _, inode := range n.inodes {
+						children = append(children, inode.pgid)
+					}
+				}
+				continue
+			}
+			leaf = (p.flags & leafPageFlag) != 0
+			total += int(p.count)
+			if !leaf {
+				for i := uint16(0); i < p.count; i++ {
+					children = append(children, p.branchPageElement(i).pgid)
+				}
+			}
+		}
+
+		// Every page on a level has the same type, so the sample tells
+		// whether the leaves have been reached.
+		avg := float64(total) / float64(len(sample))
+		if leaf || len(children) == 0 {
+			return int64(math.Round(pages * avg))
+		}
+		pages *= avg
+
+		// Spread the sample of the next level over all children read so far.
+		sample = sample[:0]
+		if len(children) <= estimateSampleN {
+			sample = append(sample, children...)
+		} else {
+			for i := 0; i < estimateSampleN; i++ {
+				sample = append(sample, children[i*len(children)/estimateSampleN])
+			}
+		}
+	}
+}
+
+// dirtyNodes returns the number of nodes materialized in this bucket and its
+// nested buckets, except for those of buckets which will be written inline.
+func (b *Bucket) dirtyNodes() int {
+	var n int
+	if b.root != 0 || !b.inlineable() {
+		n = len(b.nodes)
+	}
+	for _, child := range b.buckets {
+		n += child.dirtyNodes()
+	}
+	return n
+}
+
 // forEachPage iterates over every page in a bucket, including inline pages.
 func (b *Bucket) forEachPage(fn func(*page, int)) {
 	// If we have an inline page then just use that.
@@ -552,13 +1426,13 @@ func (b *Bucket) spill() error {
 		// Update parent node.
 		var c = b.Cursor()
 		k, _, flags := c.seek([]byte(name))
-		if !bytes.Equal([]byte(name), k) {
+		if !b.tx.sameKey([]byte(name), k) {
 			panic(fmt.Sprintf("misplaced bucket header: %x -> %x", []byte(name), k))
 		}
 		if flags&bucketLeafFlag == 0 {
 			panic(fmt.Sprintf("unexpected bucket header flag: %x", flags))
 		}
-		c.node().put([]byte(name), []byte(name), value, 0, bucketLeafFlag)
+		c.node().put([]byte(name), []byte(name), value, 0, child.flags())
 	}
 
 	// Ignore if there's not a materialized root node.
@@ -587,7 +1461,7 @@ func (b *Bucket) inlineable() bool {
 	var n = b.rootNode
 
 	// Bucket must only contain a single leaf node.
-	if n == nil || !n.isLeaf {
+	if n == nil || !n.isLeaf || b.noInline {
 		return false
 	}
 
@@ -607,6 +1481,16 @@ func (b *Bucket) inlineable() bool {
 	return true
 }
 
+// flags returns the flags of the leaf element which holds the bucket, which
+// persist its fill percent and whether it may be inlined.
+func (b *Bucket) flags() uint32 {
+	flags := bucketLeafFlag | b.fillPercent<<bucketFillPercentShift
+	if b.noInline {
+		flags |= bucketNoInlineFlag
+	}
+	return flags
+}
+
 // Returns the maximum total size of a bucket to make it a candidate for inlining.
 func (b *Bucket) maxInlineBucketSize() uintptr {
 	return uintptr(b.tx.db.pageSize / 4)
@@ -649,7 +1533,8 @@ func (b *Bucket) node(pgid pgid, parent *node) *node {
 	}
 
 	// Otherwise create a node and cache it.
-	n := &node{bucket: b, parent: parent}
+	n := b.tx.newNode()
+	n.bucket, n.parent = b, parent
 	if parent == nil {
 		b.rootNode = n
 	} else {
@@ -660,6 +1545,7 @@ func (b *Bucket) node(pgid pgid, parent *node) *node {
 	var p = b.page
 	if p == nil {
 		p = b.tx.page(pgid)
+		b.tx.verifyPage(p)
 	}
 
 	// Read the page into the node and cache it.
@@ -723,7 +1609,9 @@ func (b *Bucket) pageNode(id pgid) (*page, *node) {
 	}
 
 	// Finally lookup the page from the transaction if no node is materialized.
-	return b.tx.page(id), nil
+	p := b.tx.page(id)
+	b.tx.verifyPage(p)
+	return p, nil
 }
 
 // BucketStats records statistics about resources used by a bucket.
@@ -748,6 +1636,11 @@ type BucketStats struct {
 	BucketN           int // total number of buckets including the top bucket
 	InlineBucketN     int // total number on inlined buckets
 	InlineBucketInuse int // bytes used for inlined buckets (also accounted for in LeafInuse)
+
+	// Compression statistics
+	CompressedValueN    int // number of compressed values
+	CompressedInuse     int // bytes used for compressed values (also accounted for in LeafInuse)
+	CompressedValueSize int // total size of the compressed values when uncompressed
 }
 
 func (s *BucketStats) Add(other BucketStats) {
@@ -767,6 +1660,10 @@ func (s *BucketStats) Add(other BucketStats) {
 	s.BucketN += other.BucketN
 	s.InlineBucketN += other.InlineBucketN
 	s.InlineBucketInuse += other.InlineBucketInuse
+
+	s.CompressedValueN += other.CompressedValueN
+	s.CompressedInuse += other.CompressedInuse
+	s.CompressedValueSize += other.CompressedValueSize
 }
 
 // cloneBytes returns a copy of a given slice.
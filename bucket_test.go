@@ -6,12 +6,15 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 	"testing/quick"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -80,63 +83,46 @@ func TestBucket_Get_IncompatibleValue(t *testing.T) {
 	}
 }
 
-// Ensure that a slice returned from a bucket has a capacity equal to its length.
-// This also allows slices to be appended to since it will require a realloc by Go.
-//
-// https://github.com/boltdb/bolt/issues/544
-func TestBucket_Get_Capacity(t *testing.T) {
+// Ensure that GetValue distinguishes missing keys from empty values.
+func TestBucket_GetValue(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
-	// Write key to a bucket.
 	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("bucket"))
+		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
-			return err
+			t.Fatal(err)
 		}
-		return b.Put([]byte("key"), []byte("val"))
-	}); err != nil {
-		t.Fatal(err)
-	}
-
-	// Retrieve value and attempt to append to it.
-	if err := db.Update(func(tx *bolt.Tx) error {
-		k, v := tx.Bucket([]byte("bucket")).Cursor().First()
-
-		// Verify capacity.
-		if len(k) != cap(k) {
-			t.Fatalf("unexpected key slice capacity: %d", cap(k))
-		} else if len(v) != cap(v) {
-			t.Fatalf("unexpected value slice capacity: %d", cap(v))
+		if v, found := b.GetValue([]byte("foo")); found || v != nil {
+			t.Fatalf("unexpected value in empty bucket: %v, %v", v, found)
+		}
+		if err := b.Put([]byte("empty"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			t.Fatal(err)
 		}
-
-		// Ensure slice can be appended to without a segfault.
-		k = append(k, []byte("123")...)
-		v = append(v, []byte("123")...)
-		_, _ = k, v // to pass ineffassign
-
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-}
 
-// Ensure that a bucket can write a key/value.
-func TestBucket_Put(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
-	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("widgets"))
-		if err != nil {
-			t.Fatal(err)
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v, found := b.GetValue([]byte("empty")); !found || v == nil || len(v) != 0 {
+			t.Fatalf("unexpected empty value: %v, %v", v, found)
 		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
+		if v, found := b.GetValue([]byte("foo")); !found || !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v, %v", v, found)
 		}
-
-		v := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
-		if !bytes.Equal([]byte("bar"), v) {
-			t.Fatalf("unexpected value: %v", v)
+		if v, found := b.GetValue([]byte("missing")); found || v != nil {
+			t.Fatalf("unexpected missing value: %v, %v", v, found)
+		}
+		if v, found := b.GetValue([]byte("child")); found || v != nil {
+			t.Fatalf("unexpected bucket value: %v, %v", v, found)
 		}
 		return nil
 	}); err != nil {
@@ -144,25 +130,50 @@ func TestBucket_Put(t *testing.T) {
 	}
 }
 
-// Ensure that a bucket can rewrite a key in the same transaction.
-func TestBucket_Put_Repeat(t *testing.T) {
+// Ensure that GetMulti returns the same values as Get in the order of the keys.
+func TestBucket_GetMulti(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
+
+	keys := [][]byte{u64tob(5000), u64tob(7), []byte("child"), u64tob(7), u64tob(1)}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, u64tob(uint64(rand.Intn(4000))))
+	}
+	check := func(tx *bolt.Tx) {
+		b := tx.Bucket([]byte("widgets"))
+		values := b.GetMulti(keys)
+		if len(values) != len(keys) {
+			t.Fatalf("unexpected value count: %d", len(values))
+		}
+		for i, k := range keys {
+			if exp := b.Get(k); !bytes.Equal(values[i], exp) || (values[i] == nil) != (exp == nil) {
+				t.Fatalf("unexpected value for %x: %x, expected %x", k, values[i], exp)
+			}
+		}
+	}
+
 	if err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
+		for i := 0; i < 3000; i += 2 {
+			if err := b.Put(u64tob(uint64(i)), []byte(fmt.Sprint(i))); err != nil {
+				t.Fatal(err)
+			}
 		}
-		if err := b.Put([]byte("foo"), []byte("baz")); err != nil {
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
 			t.Fatal(err)
 		}
-
-		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
-		if !bytes.Equal([]byte("baz"), value) {
-			t.Fatalf("unexpected value: %v", value)
+		check(tx)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		check(tx)
+		if v := tx.Bucket([]byte("widgets")).GetMulti(nil); len(v) != 0 {
+			t.Fatalf("unexpected values: %v", v)
 		}
 		return nil
 	}); err != nil {
@@ -170,89 +181,91 @@ func TestBucket_Put_Repeat(t *testing.T) {
 	}
 }
 
-// Ensure that a bucket can write a bunch of large values.
-func TestBucket_Put_Large(t *testing.T) {
+// Ensure that several pairs can be put at once, in any order.
+func TestBucket_PutMulti(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
-	count, factor := 100, 200
+	want := make(map[string]string)
 	if err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		for i := 1; i < count; i++ {
-			if err := b.Put([]byte(strings.Repeat("0", i*factor)), []byte(strings.Repeat("X", (count-i)*factor))); err != nil {
+		for i := 0; i < 3000; i += 2 {
+			k, v := u64tob(uint64(i)), []byte(fmt.Sprint(i))
+			if err := b.Put(k, v); err != nil {
 				t.Fatal(err)
 			}
+			want[string(k)] = string(v)
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("widgets"))
-		for i := 1; i < count; i++ {
-			value := b.Get([]byte(strings.Repeat("0", i*factor)))
-			if !bytes.Equal(value, []byte(strings.Repeat("X", (count-i)*factor))) {
-				t.Fatalf("unexpected value: %v", value)
-			}
-		}
-		return nil
+	var pairs []bolt.KV
+	for i := 0; i < 2000; i++ {
+		k, v := u64tob(uint64(rand.Intn(6000))), []byte(fmt.Sprint("new", i))
+		pairs = append(pairs, bolt.KV{Key: k, Value: v})
+		want[string(k)] = string(v)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).PutMulti(pairs)
 	}); err != nil {
 		t.Fatal(err)
 	}
-}
-
-// Ensure that a database can perform multiple large appends safely.
-func TestDB_Put_VeryLarge(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-
-	n, batchN := 400000, 200000
-	ksize, vsize := 8, 500
-
-	db := MustOpenDB()
-	defer db.MustClose()
 
-	for i := 0; i < n; i += batchN {
-		if err := db.Update(func(tx *bolt.Tx) error {
-			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
-			if err != nil {
-				t.Fatal(err)
-			}
-			for j := 0; j < batchN; j++ {
-				k, v := make([]byte, ksize), make([]byte, vsize)
-				binary.BigEndian.PutUint32(k, uint32(i+j))
-				if err := b.Put(k, v); err != nil {
-					t.Fatal(err)
-				}
-			}
+	if err := db.View(func(tx *bolt.Tx) error {
+		got := make(map[string]string)
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			got[string(k)] = string(v)
 			return nil
 		}); err != nil {
 			t.Fatal(err)
 		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("unexpected contents: %d keys, expected %d", len(got), len(want))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-// Ensure that a setting a value on a key with a bucket value returns an error.
-func TestBucket_Put_IncompatibleValue(t *testing.T) {
+// Ensure that PutMulti reports which pair failed.
+func TestBucket_PutMulti_Error(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		b0, err := tx.CreateBucket([]byte("widgets"))
+		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		if _, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("foo")); err != nil {
+		if _, err := b.CreateBucket([]byte("m")); err != nil {
 			t.Fatal(err)
 		}
-		if err := b0.Put([]byte("foo"), []byte("bar")); err != bolt.ErrIncompatibleValue {
-			t.Fatalf("unexpected error: %s", err)
+
+		err = b.PutMulti([]bolt.KV{{Key: []byte("a")}, {Key: nil}, {Key: []byte("b")}})
+		if perr, ok := err.(*bolt.PutError); !ok || perr.Index != 1 || perr.Err != bolt.ErrKeyRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v := b.Get([]byte("a")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		}
+
+		err = b.PutMulti([]bolt.KV{{Key: []byte("z"), Value: []byte("1")}, {Key: []byte("a"), Value: []byte("2")}, {Key: []byte("m")}})
+		if perr, ok := err.(*bolt.PutError); !ok || perr.Index != 2 || perr.Err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if !bytes.Equal(perr.Key, []byte("m")) {
+			t.Fatalf("unexpected key: %q", perr.Key)
+		}
+		if v := b.Get([]byte("a")); v == nil {
+			t.Fatal("expected key sorting before the failed one")
+		}
+		if v := b.Get([]byte("z")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
 		}
 		return nil
 	}); err != nil {
@@ -260,57 +273,93 @@ func TestBucket_Put_IncompatibleValue(t *testing.T) {
 	}
 }
 
-// Ensure that a setting a value while the transaction is closed returns an error.
-func TestBucket_Put_Closed(t *testing.T) {
+// Ensure that a slice returned from a bucket has a capacity equal to its length.
+// This also allows slices to be appended to since it will require a realloc by Go.
+//
+// https://github.com/boltdb/bolt/issues/544
+func TestBucket_Get_Capacity(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
-	tx, err := db.Begin(true)
-	if err != nil {
-		t.Fatal(err)
-	}
 
-	b, err := tx.CreateBucket([]byte("widgets"))
-	if err != nil {
+	// Write key to a bucket.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("bucket"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("key"), []byte("val"))
+	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := tx.Rollback(); err != nil {
-		t.Fatal(err)
-	}
+	// Retrieve value and attempt to append to it.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		k, v := tx.Bucket([]byte("bucket")).Cursor().First()
 
-	if err := b.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxClosed {
-		t.Fatalf("unexpected error: %s", err)
+		// Verify capacity.
+		if len(k) != cap(k) {
+			t.Fatalf("unexpected key slice capacity: %d", cap(k))
+		} else if len(v) != cap(v) {
+			t.Fatalf("unexpected value slice capacity: %d", cap(v))
+		}
+
+		// Ensure slice can be appended to without a segfault.
+		k = append(k, []byte("123")...)
+		v = append(v, []byte("123")...)
+		_, _ = k, v // to pass ineffassign
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-// Ensure that setting a value on a read-only bucket returns an error.
-func TestBucket_Put_ReadOnly(t *testing.T) {
+// Ensure that a value retrieved with GetCopy stays valid after the transaction.
+func TestBucket_GetCopy(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
 			t.Fatal(err)
 		}
-		return nil
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
 	}); err != nil {
 		t.Fatal(err)
 	}
 
+	var v []byte
 	if err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("widgets"))
-		if err := b.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxNotWritable {
-			t.Fatalf("unexpected error: %s", err)
+		if b.GetCopy([]byte("missing")) != nil {
+			t.Fatal("expected nil value for missing key")
+		} else if b.GetCopy([]byte("sub")) != nil {
+			t.Fatal("expected nil value for nested bucket")
 		}
+		v = b.GetCopy([]byte("foo"))
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("foo"), []byte("baz"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(v, []byte("bar")) {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	v[0] = 'c'
 }
 
-// Ensure that a bucket can delete an existing key.
-func TestBucket_Delete(t *testing.T) {
-	db := MustOpenDB()
+// Ensure that values used after their transaction are poisoned when
+// ValueSafetyChecks is set.
+func TestBucket_Get_ValueSafetyChecks(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{ValueSafetyChecks: true})
 	defer db.MustClose()
 
 	if err := db.Update(func(tx *bolt.Tx) error {
@@ -321,58 +370,102 @@ func TestBucket_Delete(t *testing.T) {
 		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Delete([]byte("foo")); err != nil {
-			t.Fatal(err)
-		}
-		if v := b.Get([]byte("foo")); v != nil {
-			t.Fatalf("unexpected value: %v", v)
+		return b.Put([]byte("empty"), []byte{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var got, value, empty []byte
+	var multi [][]byte
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		got = b.Get([]byte("foo"))
+		value, _ = b.GetValue([]byte("foo"))
+		empty, _ = b.GetValue([]byte("empty"))
+		multi = b.GetMulti([][]byte{[]byte("foo"), []byte("missing")})
+		if !bytes.Equal(got, []byte("bar")) || !bytes.Equal(value, []byte("bar")) || !bytes.Equal(multi[0], []byte("bar")) {
+			t.Fatal("unexpected value within the transaction")
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
+
+	poisoned := bytes.Repeat([]byte{0xDB}, 3)
+	for _, v := range [][]byte{got, value, multi[0]} {
+		if !bytes.Equal(v, poisoned) {
+			t.Fatalf("expected poisoned value, got %q", v)
+		}
+	}
+	if empty == nil || len(empty) != 0 || multi[1] != nil {
+		t.Fatal("unexpected empty or missing value")
+	}
 }
 
-// Ensure that deleting a large set of keys will work correctly.
-func TestBucket_Delete_Large(t *testing.T) {
-	db := MustOpenDB()
+// Ensure that large values are compressed when DB.Compression is set and
+// read back unchanged.
+func TestBucket_Put_Compression(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{Compression: bolt.CompressionFlate, CompressionThreshold: 100})
 	defer db.MustClose()
 
+	large := bytes.Repeat([]byte(`{"name":"widget","size":42}`), 100)
 	if err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		for i := 0; i < 100; i++ {
-			if err := b.Put([]byte(strconv.Itoa(i)), []byte(strings.Repeat("*", 1024))); err != nil {
-				t.Fatal(err)
-			}
+		if err := b.Put([]byte("large"), large); err != nil {
+			t.Fatal(err)
 		}
-
-		return nil
+		if err := b.PutWithTTL([]byte("expiring"), large, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		return b.Put([]byte("small"), []byte("bar"))
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := db.Update(func(tx *bolt.Tx) error {
+	if err := db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("widgets"))
-		for i := 0; i < 100; i++ {
-			if err := b.Delete([]byte(strconv.Itoa(i))); err != nil {
-				t.Fatal(err)
+		if v := b.Get([]byte("large")); !bytes.Equal(v, large) {
+			t.Fatalf("unexpected value of %d bytes", len(v))
+		} else if v, _ := b.GetValue([]byte("expiring")); !bytes.Equal(v, large) {
+			t.Fatalf("unexpected expiring value of %d bytes", len(v))
+		} else if v := b.Get([]byte("small")); string(v) != "bar" {
+			t.Fatalf("unexpected small value: %q", v)
+		}
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if string(k) != "small" && !bytes.Equal(v, large) {
+				t.Fatalf("unexpected value of %d bytes for %q", len(v), k)
 			}
 		}
+
+		s := b.Stats()
+		if s.CompressedValueN != 2 {
+			t.Fatalf("unexpected compressed value count: %d", s.CompressedValueN)
+		} else if s.CompressedValueSize != 2*len(large) {
+			t.Fatalf("unexpected uncompressed size: %d", s.CompressedValueSize)
+		} else if s.CompressedInuse >= len(large) {
+			t.Fatalf("values not compressed: %d bytes in use", s.CompressedInuse)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := db.View(func(tx *bolt.Tx) error {
+	// Values stay readable once compression is turned off.
+	db.Compression = bolt.CompressionNone
+	if err := db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte("widgets"))
-		for i := 0; i < 100; i++ {
-			if v := b.Get([]byte(strconv.Itoa(i))); v != nil {
-				t.Fatalf("unexpected value: %v, i=%d", v, i)
-			}
+		if err := b.Put([]byte("plain"), large); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("large")); !bytes.Equal(v, large) {
+			t.Fatalf("unexpected value of %d bytes", len(v))
+		}
+		if n := b.Stats().CompressedValueN; n != 2 {
+			t.Fatalf("unexpected compressed value count: %d", n)
 		}
 		return nil
 	}); err != nil {
@@ -380,13 +473,767 @@ func TestBucket_Delete_Large(t *testing.T) {
 	}
 }
 
-// Deleting a very large list of keys will cause the freelist to use overflow.
-func TestBucket_Delete_FreelistOverflow(t *testing.T) {
-	if testing.Short() {
-		t.Skip("skipping test in short mode.")
-	}
-
-	db := MustOpenDB()
+// Ensure that a bucket can write a key/value.
+func TestBucket_Put(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		v := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		if !bytes.Equal([]byte("bar"), v) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can rewrite a key in the same transaction.
+func TestBucket_Put_Repeat(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("baz")); err != nil {
+			t.Fatal(err)
+		}
+
+		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		if !bytes.Equal([]byte("baz"), value) {
+			t.Fatalf("unexpected value: %v", value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a value reserved with PutReserve can be written in place.
+func TestBucket_PutReserve(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := b.PutReserve([]byte("foo"), 10000)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(v) != 10000 {
+			t.Fatalf("unexpected length: %d", len(v))
+		}
+		for i := range v {
+			v[i] = byte(i)
+		}
+		if _, err := b.PutReserve(nil, 1); err != bolt.ErrKeyRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		if len(v) != 10000 {
+			t.Fatalf("unexpected length: %d", len(v))
+		}
+		for i := range v {
+			if v[i] != byte(i) {
+				t.Fatalf("unexpected byte at %d: %d", i, v[i])
+			}
+		}
+		if _, err := tx.Bucket([]byte("widgets")).PutReserve([]byte("bar"), 1); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that keys put with a TTL are hidden once expired and removed by Expire.
+func TestBucket_PutWithTTL(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("a"), []byte("1"), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("b"), []byte("2"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("c"), []byte("3")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("d"), []byte("4"), time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.PutWithTTL([]byte("e"), []byte("5"), 0); err == nil {
+			t.Fatal("expected error")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("a")); !bytes.Equal(v, []byte("1")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("b")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if _, ok := b.GetValue([]byte("d")); ok {
+			t.Fatal("expected key to have expired")
+		}
+
+		var keys []string
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			keys = append(keys, string(k)+"="+string(v))
+		}
+		if !reflect.DeepEqual(keys, []string{"a=1", "c=3"}) {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		if k, _ := c.Last(); !bytes.Equal(k, []byte("c")) {
+			t.Fatalf("unexpected key: %q", k)
+		} else if k, _ := c.Prev(); !bytes.Equal(k, []byte("a")) {
+			t.Fatalf("unexpected key: %q", k)
+		} else if k, _ := c.Seek([]byte("b")); !bytes.Equal(k, []byte("c")) {
+			t.Fatalf("unexpected key: %q", k)
+		} else if k, _ := c.Seek([]byte("d")); k != nil {
+			t.Fatalf("unexpected key: %q", k)
+		}
+
+		if at, ok := b.ExpiresAt([]byte("a")); !ok || time.Until(at) <= 0 || time.Until(at) > time.Hour {
+			t.Fatalf("unexpected expiry: %v, %v", at, ok)
+		} else if _, ok := b.ExpiresAt([]byte("b")); ok {
+			t.Fatal("expected no expiry")
+		} else if _, ok := b.ExpiresAt([]byte("c")); ok {
+			t.Fatal("expected no expiry")
+		}
+		if _, err := b.Expire(time.Now()); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compacting keeps the expiry of the keys which are still live.
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if err := bolt.Compact(dst.DB, db.DB, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if _, ok := b.ExpiresAt([]byte("a")); !ok {
+			t.Fatal("expected expiry")
+		} else if n := b.Stats().KeyN; n != 2 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n, err := b.Expire(time.Now()); err != nil {
+			t.Fatal(err)
+		} else if n != 2 {
+			t.Fatalf("unexpected expired count: %d", n)
+		}
+		if n, err := b.Expire(time.Now().Add(2 * time.Hour)); err != nil {
+			t.Fatal(err)
+		} else if n != 1 {
+			t.Fatalf("unexpected expired count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that sorted keys can be bulk loaded into a bucket and appended to later.
+func TestBucket_BulkLoad(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// source returns the keys in [min, max) with a reused buffer.
+	source := func(min, max int) func() ([]byte, []byte, bool) {
+		i := min
+		buf := make([]byte, 8)
+		return func() ([]byte, []byte, bool) {
+			if i >= max {
+				return nil, nil, false
+			}
+			binary.BigEndian.PutUint64(buf, uint64(i))
+			i++
+			return buf, buf, true
+		}
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.BulkLoad(source(0, 5000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.BulkLoad(source(4999, 5001)); err != bolt.ErrKeysOutOfOrder {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return b.BulkLoad(source(5000, 10000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var n int
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			if i := binary.BigEndian.Uint64(k); int(i) != n {
+				t.Fatalf("unexpected key %d at %d", i, n)
+			} else if !bytes.Equal(k, v) {
+				t.Fatalf("unexpected value for key %d: %x", i, v)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 10000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that BulkLoad rejects keys which are not strictly ascending.
+func TestBucket_BulkLoad_OutOfOrder(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := [][]byte{[]byte("a"), []byte("b"), []byte("b")}
+		if err := b.BulkLoad(func() ([]byte, []byte, bool) {
+			if len(keys) == 0 {
+				return nil, nil, false
+			}
+			k := keys[0]
+			keys = keys[1:]
+			return k, []byte("v"), true
+		}); err != bolt.ErrKeysOutOfOrder {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if v := b.Get([]byte("b")); !bytes.Equal(v, []byte("v")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that BulkLoad appends correctly after the end of the bucket was
+// deleted in the same transaction.
+func TestBucket_BulkLoad_AfterDelete(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 5000; i++ {
+			if err := b.Put(u64tob(uint64(i)), []byte("0")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 2000; i < 5000; i++ {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		i := 3000
+		if err := b.BulkLoad(func() ([]byte, []byte, bool) {
+			if i >= 6000 {
+				return nil, nil, false
+			}
+			i++
+			return u64tob(uint64(i - 1)), []byte("1"), true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get(u64tob(3500)); !bytes.Equal(v, []byte("1")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 5000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that BulkLoad returns an error on a read-only transaction.
+func TestBucket_BulkLoad_ReadOnly(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte("widgets")).BulkLoad(func() ([]byte, []byte, bool) { return nil, nil, false })
+		if err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can write a bunch of large values.
+func TestBucket_Put_Large(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	count, factor := 100, 200
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < count; i++ {
+			if err := b.Put([]byte(strings.Repeat("0", i*factor)), []byte(strings.Repeat("X", (count-i)*factor))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 1; i < count; i++ {
+			value := b.Get([]byte(strings.Repeat("0", i*factor)))
+			if !bytes.Equal(value, []byte(strings.Repeat("X", (count-i)*factor))) {
+				t.Fatalf("unexpected value: %v", value)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a database can perform multiple large appends safely.
+func TestDB_Put_VeryLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	n, batchN := 400000, 200000
+	ksize, vsize := 8, 500
+
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	for i := 0; i < n; i += batchN {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < batchN; j++ {
+				k, v := make([]byte, ksize), make([]byte, vsize)
+				binary.BigEndian.PutUint32(k, uint32(i+j))
+				if err := b.Put(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Ensure that a setting a value on a key with a bucket value returns an error.
+func TestBucket_Put_IncompatibleValue(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b0, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tx.Bucket([]byte("widgets")).CreateBucket([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b0.Put([]byte("foo"), []byte("bar")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a setting a value while the transaction is closed returns an error.
+func TestBucket_Put_Closed(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that setting a value on a read-only bucket returns an error.
+func TestBucket_Put_ReadOnly(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can delete an existing key.
+func TestBucket_Delete(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte("foo")); err != nil {
+			t.Fatal(err)
+		}
+		if v := b.Get([]byte("foo")); v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a range of keys can be deleted at once.
+func TestBucket_DeleteRange(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	const count = 3000
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			if i == 1000 {
+				if _, err := b.CreateBucket(u64tob(uint64(i))); err != nil {
+					t.Fatal(err)
+				}
+				continue
+			}
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for _, r := range []struct {
+			min, max []byte
+			exp      int
+		}{
+			{u64tob(500), u64tob(2500), 1999},
+			{nil, u64tob(100), 100},
+			{u64tob(2900), nil, 100},
+			{u64tob(600), u64tob(700), 0},
+			{u64tob(50), u64tob(150), 50},
+		} {
+			if n, err := b.DeleteRange(r.min, r.max); err != nil {
+				t.Fatal(err)
+			} else if n != r.exp {
+				t.Fatalf("unexpected deleted count for [%x, %x): %d, expected %d", r.min, r.max, n, r.exp)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		b := tx.Bucket([]byte("widgets"))
+		var keys []uint64
+		if err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, binary.BigEndian.Uint64(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 751 || keys[0] != 150 || keys[349] != 499 || keys[350] != 1000 || keys[351] != 2500 || keys[750] != 2899 {
+			t.Fatalf("unexpected keys: %d keys", len(keys))
+		}
+
+		if _, err := b.DeleteRange(nil, nil); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket snapshot iterates the contents of the bucket at the
+// start of the transaction while the bucket is modified.
+func TestBucket_Snapshot(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), []byte("foo")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return child.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if err := b.Put(u64tob(5000), []byte("before")); err != nil {
+			t.Fatal(err)
+		}
+		s, err := b.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Rewrite every key seen through the snapshot while iterating it.
+		var n int
+		if err := s.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			n++
+			if string(v) != "foo" {
+				t.Fatalf("unexpected value: %q", v)
+			}
+			if err := b.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+			return b.Put(append(k, 'x'), []byte("bar"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+
+		if err := b.Bucket([]byte("child")).Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		child := s.Bucket([]byte("child"))
+		if v := child.Get([]byte("baz")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := child.Get([]byte("foo")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+
+		if err := s.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := child.Put([]byte("foo"), []byte("bar")); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get(u64tob(999)); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get(append(u64tob(999), 'x')); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get(u64tob(5000)); string(v) != "before" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that deleting a large set of keys will work correctly.
+func TestBucket_Delete_Large(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(strconv.Itoa(i)), []byte(strings.Repeat("*", 1024))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 100; i++ {
+			if err := b.Delete([]byte(strconv.Itoa(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 100; i++ {
+			if v := b.Get([]byte(strconv.Itoa(i))); v != nil {
+				t.Fatalf("unexpected value: %v, i=%d", v, i)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Deleting a very large list of keys will cause the freelist to use overflow.
+func TestBucket_Delete_FreelistOverflow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode.")
+	}
+
+	db := MustOpenDB()
 	defer db.MustClose()
 
 	k := make([]byte, 16)
@@ -765,6 +1612,236 @@ func TestBucket_DeleteBucket_Large(t *testing.T) {
 	}
 }
 
+// Ensure that a bucket can be renamed along with its contents.
+func TestBucket_RenameBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			t.Fatal(err)
+		}
+		small, err := tx.CreateBucket([]byte("small"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := small.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("value"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.RenameBucket([]byte("widgets"), []byte("gadgets")); err != nil {
+			t.Fatal(err)
+		}
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected old bucket to be gone")
+		}
+		b := tx.Bucket([]byte("gadgets"))
+		if n := b.Stats().KeyN; n != 1002 {
+			t.Fatalf("unexpected key count: %d", n)
+		} else if b.Bucket([]byte("child")) == nil {
+			t.Fatal("expected nested bucket")
+		}
+
+		if err := tx.RenameBucket([]byte("widgets"), []byte("foo")); err != bolt.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := tx.RenameBucket([]byte("gadgets"), []byte("small")); err != bolt.ErrBucketExists {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := b.RenameBucket([]byte("value"), []byte("foo")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := b.RenameBucket([]byte("child"), []byte("value")); err != bolt.ErrIncompatibleValue {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := tx.RenameBucket([]byte("gadgets"), nil); err != bolt.ErrBucketNameRequired {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// A bucket obtained before the rename keeps working, and its changes
+		// are written under the new name.
+		small := tx.Bucket([]byte("small"))
+		if err := small.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.RenameBucket([]byte("small"), []byte("tiny")); err != nil {
+			t.Fatal(err)
+		}
+		return small.Put([]byte("x"), []byte("y"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("small")) != nil {
+			t.Fatal("expected old bucket to be gone")
+		}
+		b := tx.Bucket([]byte("tiny"))
+		for _, k := range []string{"foo", "baz", "x"} {
+			if b.Get([]byte(k)) == nil {
+				t.Fatalf("expected key %q", k)
+			}
+		}
+		if v := tx.Bucket([]byte("gadgets")).Get(u64tob(999)); len(v) != 100 {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can be moved under another parent.
+func TestBucket_MoveBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		src, err := tx.CreateBucket([]byte("src"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := src.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := child.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := child.CreateBucket([]byte("grandchild")); err != nil {
+			t.Fatal(err)
+		}
+		// The destination starts out inline.
+		dst, err := tx.CreateBucket([]byte("dst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dst.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		src := tx.Bucket([]byte("src"))
+		child := src.Bucket([]byte("child"))
+		grandchild := child.Bucket([]byte("grandchild"))
+		if err := src.MoveBucket([]byte("child"), child); err != bolt.ErrBucketMoveCycle {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := src.MoveBucket([]byte("child"), grandchild); err != bolt.ErrBucketMoveCycle {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := src.MoveBucket([]byte("missing"), tx.Bucket([]byte("dst"))); err != bolt.ErrBucketNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		} else if err := tx.MoveBucket([]byte("src"), tx.Bucket([]byte("dst"))); err != nil {
+			t.Fatal(err)
+		}
+
+		// Move the child back up next to its former parent.
+		dst := tx.Bucket([]byte("dst"))
+		if tx.Bucket([]byte("src")) != nil {
+			t.Fatal("expected bucket to be moved")
+		}
+		if err := dst.Bucket([]byte("src")).MoveBucket([]byte("child"), dst); err != nil {
+			t.Fatal(err)
+		}
+		if err := grandchild.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		dst := tx.Bucket([]byte("dst"))
+		if v := dst.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if dst.Bucket([]byte("src")).Bucket([]byte("child")) != nil {
+			t.Fatal("expected child to be moved")
+		}
+		child := dst.Bucket([]byte("child"))
+		if n := child.Stats().KeyN; n != 1002 {
+			t.Fatalf("unexpected key count: %d", n)
+		} else if v := child.Bucket([]byte("grandchild")).Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that bucket operations can be validated without performing them.
+func TestBucket_CanCreateBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sub, err := widgets.CreateBucket([]byte("sub"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := widgets.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range []struct {
+			err  error
+			want error
+		}{
+			{tx.CanCreateBucket([]byte("gadgets")), nil},
+			{tx.CanCreateBucket([]byte("widgets")), bolt.ErrBucketExists},
+			{tx.CanCreateBucket(nil), bolt.ErrBucketNameRequired},
+			{widgets.CanCreateBucket([]byte("foo")), bolt.ErrIncompatibleValue},
+			{tx.CanDeleteBucket([]byte("widgets")), nil},
+			{tx.CanDeleteBucket([]byte("gadgets")), bolt.ErrBucketNotFound},
+			{widgets.CanDeleteBucket([]byte("foo")), bolt.ErrIncompatibleValue},
+			{widgets.CanMoveBucket([]byte("sub"), tx.Cursor().Bucket()), nil},
+			{tx.CanMoveBucket([]byte("widgets"), sub), bolt.ErrBucketMoveCycle},
+			{widgets.CanMoveBucket([]byte("missing"), sub), bolt.ErrBucketNotFound},
+		} {
+			if tt.err != tt.want {
+				t.Fatalf("unexpected error: %v, want %v", tt.err, tt.want)
+			}
+		}
+
+		// Nothing was changed by the checks.
+		if tx.Bucket([]byte("gadgets")) != nil || tx.Bucket([]byte("sub")) != nil {
+			t.Fatal("unexpected bucket")
+		} else if widgets.Bucket([]byte("sub")) == nil {
+			t.Fatal("expected bucket to stay in place")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if err := tx.CanCreateBucket([]byte("gadgets")); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a simple value retrieved via Bucket() returns a nil.
 func TestBucket_Bucket_IncompatibleValue(t *testing.T) {
 	db := MustOpenDB()
@@ -788,6 +1865,101 @@ func TestBucket_Bucket_IncompatibleValue(t *testing.T) {
 	}
 }
 
+// Ensure that HasBucket reports only nested buckets which exist.
+func TestBucket_HasBucket(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.CreateBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if !tx.HasBucket([]byte("widgets")) || !b.HasBucket([]byte("sub")) {
+			t.Fatal("expected bucket created in the transaction to exist")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if !tx.HasBucket([]byte("widgets")) || tx.HasBucket([]byte("missing")) {
+			t.Fatal("unexpected top-level bucket existence")
+		}
+		if !b.HasBucket([]byte("sub")) {
+			t.Fatal("expected nested bucket to exist")
+		} else if b.HasBucket([]byte("foo")) {
+			t.Fatal("expected key not to be reported as a bucket")
+		} else if b.HasBucket([]byte("su")) {
+			t.Fatal("expected prefix not to be reported as a bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).DeleteBucket([]byte("sub")); err != nil {
+			t.Fatal(err)
+		}
+		if tx.Bucket([]byte("widgets")).HasBucket([]byte("sub")) {
+			t.Fatal("expected deleted bucket not to exist")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket leads back to its transaction and database, and
+// reports its root page.
+func TestBucket_Tx(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.Tx() != tx || b.Tx().DB() != db.DB {
+			t.Fatal("unexpected tx or db")
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		inline, err := b.CreateBucket([]byte("inline"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inline.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b.Root() == 0 {
+			t.Fatal("expected a root page")
+		} else if root := b.Bucket([]byte("inline")).Root(); root != 0 {
+			t.Fatalf("unexpected root of inline bucket: %d", root)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that creating a bucket on an existing non-bucket key returns an error.
 func TestBucket_CreateBucket_IncompatibleValue(t *testing.T) {
 	db := MustOpenDB()
@@ -832,6 +2004,95 @@ func TestBucket_DeleteBucket_IncompatibleValue(t *testing.T) {
 	}
 }
 
+// Ensure that a bucket can be cleared while keeping its sequence.
+func TestBucket_Clear(t *testing.T) {
+	for _, n := range []int{3, 1000} {
+		t.Run(fmt.Sprintf("%d", n), func(t *testing.T) {
+			db := MustOpenDB()
+			defer db.MustClose()
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				widgets, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := widgets.SetSequence(42); err != nil {
+					t.Fatal(err)
+				}
+				child, err := widgets.CreateBucket([]byte("child"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < n; i++ {
+					if err := widgets.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+						t.Fatal(err)
+					}
+					if err := child.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+						t.Fatal(err)
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				widgets := tx.Bucket([]byte("widgets"))
+				if err := widgets.Clear(); err != nil {
+					t.Fatal(err)
+				}
+				if err := widgets.Put([]byte("foo"), []byte("bar")); err != nil {
+					t.Fatal(err)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.View(func(tx *bolt.Tx) error {
+				widgets := tx.Bucket([]byte("widgets"))
+				if v := widgets.Sequence(); v != 42 {
+					t.Fatalf("unexpected sequence: %d", v)
+				}
+				if widgets.Bucket([]byte("child")) != nil {
+					t.Fatal("expected child bucket to be deleted")
+				}
+				if n := widgets.Stats().KeyN; n != 1 {
+					t.Fatalf("unexpected key count: %d", n)
+				}
+				if v := widgets.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+					t.Fatalf("unexpected value: %v", v)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Ensure that clearing a bucket on a read-only transaction returns an error.
+func TestBucket_Clear_ReadOnly(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket([]byte("widgets")).Clear(); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure bucket can set and update its sequence number.
 func TestBucket_Sequence(t *testing.T) {
 	db := MustOpenDB()
@@ -874,6 +2135,80 @@ func TestBucket_Sequence(t *testing.T) {
 	}
 }
 
+// Ensure that a persisted fill percent is used by later transactions.
+func TestBucket_SetFillPercent(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetFillPercent(0.9); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.SetFillPercent(2); err != bolt.ErrFillPercent {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, err := tx.CreateBucket([]byte("other")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the bucket in order and ensure the pages are filled to 90%.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if b.FillPercent != 0.9 {
+			t.Fatalf("unexpected fill percent: %v", b.FillPercent)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if fp := tx.Bucket([]byte("widgets")).FillPercent; fp != 0.9 {
+			t.Fatalf("unexpected fill percent: %v", fp)
+		}
+		if fp := tx.Bucket([]byte("other")).FillPercent; fp != bolt.DefaultFillPercent {
+			t.Fatalf("unexpected fill percent: %v", fp)
+		}
+		if s := tx.Bucket([]byte("widgets")).Stats(); s.LeafInuse < s.LeafPageN*db.Info().PageSize*8/10 {
+			t.Fatalf("unexpected leaf usage: %d bytes in %d pages", s.LeafInuse, s.LeafPageN)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ensure that the persisted fill percent can be removed.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).SetFillPercent(0)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if fp := tx.Bucket([]byte("widgets")).FillPercent; fp != bolt.DefaultFillPercent {
+			t.Fatalf("unexpected fill percent: %v", fp)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a bucket can return an autoincrementing sequence.
 func TestBucket_NextSequence(t *testing.T) {
 	db := MustOpenDB()
@@ -978,28 +2313,265 @@ func TestBucket_NextSequence_ReadOnly(t *testing.T) {
 	}
 }
 
-// Ensure that retrieving the next sequence for a bucket on a closed database return an error.
-func TestBucket_NextSequence_Closed(t *testing.T) {
+// Ensure that retrieving the next sequence for a bucket on a closed database return an error.
+func TestBucket_NextSequence_Closed(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.NextSequence(); err != bolt.ErrTxClosed {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can reserve a block of sequence numbers which persists.
+func TestBucket_NextSequenceBatch(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.NextSequence(); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		first, last, err := tx.Bucket([]byte("widgets")).NextSequenceBatch(100)
+		if err != nil {
+			t.Fatal(err)
+		} else if first != 2 || last != 101 {
+			t.Fatalf("unexpected range: %d-%d", first, last)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if seq, err := b.NextSequence(); err != nil {
+			t.Fatal(err)
+		} else if seq != 102 {
+			t.Fatalf("unexpected sequence: %d", seq)
+		}
+		if _, _, err := b.NextSequenceBatch(0); err != bolt.ErrSequenceBatchSize {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, _, err := b.NextSequenceBatch(math.MaxUint64 - 101); err != bolt.ErrSequenceBatchSize {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if first, last, err := b.NextSequenceBatch(math.MaxUint64 - 102); err != nil {
+			t.Fatal(err)
+		} else if first != 103 || last != math.MaxUint64 {
+			t.Fatalf("unexpected range: %d-%d", first, last)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, _, err := tx.Bucket([]byte("widgets")).NextSequenceBatch(1); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a user can loop over all key/value pairs in a bucket.
+func TestBucket_ForEach(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("0001")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("bar"), []byte("0002")); err != nil {
+			t.Fatal(err)
+		}
+
+		var index int
+		if err := b.ForEach(func(k, v []byte) error {
+			switch index {
+			case 0:
+				if !bytes.Equal(k, []byte("bar")) {
+					t.Fatalf("unexpected key: %v", k)
+				} else if !bytes.Equal(v, []byte("0002")) {
+					t.Fatalf("unexpected value: %v", v)
+				}
+			case 1:
+				if !bytes.Equal(k, []byte("baz")) {
+					t.Fatalf("unexpected key: %v", k)
+				} else if !bytes.Equal(v, []byte("0001")) {
+					t.Fatalf("unexpected value: %v", v)
+				}
+			case 2:
+				if !bytes.Equal(k, []byte("foo")) {
+					t.Fatalf("unexpected key: %v", k)
+				} else if !bytes.Equal(v, []byte("0000")) {
+					t.Fatalf("unexpected value: %v", v)
+				}
+			}
+			index++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if index != 3 {
+			t.Fatalf("unexpected index: %d", index)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a bucket can iterate over its key/value pairs in reverse.
+func TestBucket_ReverseForEach(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), u64tob(uint64(i*2))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		i := 999
+		if err := tx.Bucket([]byte("widgets")).ReverseForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, u64tob(uint64(i))) {
+				t.Fatalf("unexpected key: %v", k)
+			} else if !bytes.Equal(v, u64tob(uint64(i*2))) {
+				t.Fatalf("unexpected value: %v", v)
+			}
+			i--
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if i != -1 {
+			t.Fatalf("unexpected index: %d", i)
+		}
+
+		marker := errors.New("marker")
+		var n int
+		if err := tx.Bucket([]byte("widgets")).ReverseForEach(func(k, v []byte) error {
+			n++
+			return marker
+		}); err != marker {
+			t.Fatalf("unexpected error: %s", err)
+		} else if n != 1 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure a database can stop iteration early.
+func TestBucket_ForEach_ShortCircuit(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("bar"), []byte("0000")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("0000")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
+			t.Fatal(err)
+		}
+
+		var index int
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			index++
+			if bytes.Equal(k, []byte("baz")) {
+				return errors.New("marker")
+			}
+			return nil
+		}); err == nil || err.Error() != "marker" {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if index != 2 {
+			t.Fatalf("unexpected index: %d", index)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that looping over a bucket on a closed database returns an error.
+func TestBucket_ForEach_Closed(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
+
 	tx, err := db.Begin(true)
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	b, err := tx.CreateBucket([]byte("widgets"))
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	if err := tx.Rollback(); err != nil {
 		t.Fatal(err)
 	}
-	if _, err := b.NextSequence(); err != bolt.ErrTxClosed {
-		t.Fatal(err)
+
+	if err := b.ForEach(func(k, v []byte) error { return nil }); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %s", err)
 	}
 }
 
-// Ensure a user can loop over all key/value pairs in a bucket.
-func TestBucket_ForEach(t *testing.T) {
+// Ensure that a bucket can iterate over its nested buckets only.
+func TestBucket_ForEachBucket(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
@@ -1008,75 +2580,107 @@ func TestBucket_ForEach(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("baz"), []byte("0001")); err != nil {
-			t.Fatal(err)
+		for _, k := range []string{"bar", "foo"} {
+			if err := b.Put([]byte(k), []byte("0000")); err != nil {
+				t.Fatal(err)
+			}
 		}
-		if err := b.Put([]byte("bar"), []byte("0002")); err != nil {
-			t.Fatal(err)
+		for _, k := range []string{"baz", "qux"} {
+			if _, err := b.CreateBucket([]byte(k)); err != nil {
+				t.Fatal(err)
+			}
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-		var index int
-		if err := b.ForEach(func(k, v []byte) error {
-			switch index {
-			case 0:
-				if !bytes.Equal(k, []byte("bar")) {
-					t.Fatalf("unexpected key: %v", k)
-				} else if !bytes.Equal(v, []byte("0002")) {
-					t.Fatalf("unexpected value: %v", v)
-				}
-			case 1:
-				if !bytes.Equal(k, []byte("baz")) {
-					t.Fatalf("unexpected key: %v", k)
-				} else if !bytes.Equal(v, []byte("0001")) {
-					t.Fatalf("unexpected value: %v", v)
-				}
-			case 2:
-				if !bytes.Equal(k, []byte("foo")) {
-					t.Fatalf("unexpected key: %v", k)
-				} else if !bytes.Equal(v, []byte("0000")) {
-					t.Fatalf("unexpected value: %v", v)
-				}
-			}
-			index++
+	if err := db.View(func(tx *bolt.Tx) error {
+		var keys []string
+		if err := tx.Bucket([]byte("widgets")).ForEachBucket(func(k []byte) error {
+			keys = append(keys, string(k))
 			return nil
 		}); err != nil {
 			t.Fatal(err)
 		}
-
-		if index != 3 {
-			t.Fatalf("unexpected index: %d", index)
+		if strings.Join(keys, ",") != "baz,qux" {
+			t.Fatalf("unexpected keys: %v", keys)
 		}
-
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 }
 
-// Ensure a database can stop iteration early.
-func TestBucket_ForEach_ShortCircuit(t *testing.T) {
+// Ensure that a bucket can iterate over the keys within a range.
+func TestBucket_ForEachRange(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
+
 	if err := db.Update(func(tx *bolt.Tx) error {
 		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("bar"), []byte("0000")); err != nil {
-			t.Fatal(err)
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
 		}
-		if err := b.Put([]byte("baz"), []byte("0000")); err != nil {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		min, max   []byte
+		start, end uint64
+	}{
+		{min: u64tob(100), max: u64tob(200), start: 100, end: 200},
+		{min: nil, max: u64tob(10), start: 0, end: 10},
+		{min: u64tob(990), max: nil, start: 990, end: 1000},
+		{min: nil, max: nil, start: 0, end: 1000},
+		{min: u64tob(500), max: u64tob(500), start: 500, end: 500},
+		{min: u64tob(2000), max: nil, start: 1000, end: 1000},
+	} {
+		if err := db.View(func(tx *bolt.Tx) error {
+			next := tc.start
+			if err := tx.Bucket([]byte("widgets")).ForEachRange(tc.min, tc.max, func(k, v []byte) error {
+				if !bytes.Equal(k, u64tob(next)) {
+					t.Fatalf("unexpected key: %x, expected %x", k, u64tob(next))
+				}
+				next++
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if next != tc.end {
+				t.Fatalf("unexpected end: %d, expected %d", next, tc.end)
+			}
+			return nil
+		}); err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("0000")); err != nil {
+	}
+}
+
+// Ensure that iterating over a range can be stopped by returning an error.
+func TestBucket_ForEachRange_ShortCircuit(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
 			t.Fatal(err)
 		}
+		for _, k := range []string{"bar", "baz", "foo"} {
+			if err := b.Put([]byte(k), []byte("0000")); err != nil {
+				t.Fatal(err)
+			}
+		}
 
 		var index int
-		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+		if err := b.ForEachRange([]byte("bar"), nil, func(k, v []byte) error {
 			index++
 			if bytes.Equal(k, []byte("baz")) {
 				return errors.New("marker")
@@ -1088,35 +2692,57 @@ func TestBucket_ForEach_ShortCircuit(t *testing.T) {
 		if index != 2 {
 			t.Fatalf("unexpected index: %d", index)
 		}
-
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 }
 
-// Ensure that looping over a bucket on a closed database returns an error.
-func TestBucket_ForEach_Closed(t *testing.T) {
+// Ensure that ForEachPrefix only visits keys with the prefix, including
+// prefixes made up of 0xff bytes which have no upper bound.
+func TestBucket_ForEachPrefix(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
-
-	tx, err := db.Begin(true)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	b, err := tx.CreateBucket([]byte("widgets"))
-	if err != nil {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range [][]byte{{0x01}, {0x01, 0xff}, {0x01, 0xff, 0x00}, {0x02}, {0xfe, 0xff}, {0xff}, {0xff, 0x00}, {0xff, 0xff}} {
+			if err := b.Put(k, []byte{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := tx.Rollback(); err != nil {
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for prefix, exp := range map[string]string{
+			"\x01":     "01,01ff,01ff00",
+			"\x01\xff": "01ff,01ff00",
+			"\xfe":     "feff",
+			"\xff":     "ff,ff00,ffff",
+			"\xff\xff": "ffff",
+			"\x03":     "",
+		} {
+			var keys []string
+			if err := b.ForEachPrefix([]byte(prefix), func(k, v []byte) error {
+				keys = append(keys, fmt.Sprintf("%x", k))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if s := strings.Join(keys, ","); s != exp {
+				t.Fatalf("unexpected keys for prefix %x: %s, expected %s", prefix, s, exp)
+			}
+		}
+		return nil
+	}); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := b.ForEach(func(k, v []byte) error { return nil }); err != bolt.ErrTxClosed {
-		t.Fatalf("unexpected error: %s", err)
-	}
 }
 
 // Ensure that an error is returned when inserting with an empty key.
@@ -1183,6 +2809,41 @@ func TestBucket_Put_ValueTooLarge(t *testing.T) {
 	}
 }
 
+// Ensure that the size limits set by Options.MaxKeySize and MaxValueSize are
+// enforced.
+func TestBucket_Put_SizeLimits(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{MaxKeySize: 8, MaxValueSize: 16})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put(make([]byte, 8), make([]byte, 16)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := b.Put(make([]byte, 9), []byte("bar")); err != bolt.ErrKeyTooLarge {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := b.Put([]byte("foo"), make([]byte, 17)); err != bolt.ErrValueTooLarge {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := b.PutWithTTL([]byte("foo"), make([]byte, 17), time.Hour); err != bolt.ErrValueTooLarge {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if _, err := b.PutReserve([]byte("foo"), 17); err != bolt.ErrValueTooLarge {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if b.Get([]byte("foo")) != nil {
+			t.Fatal("expected no value")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure a bucket can calculate stats.
 func TestBucket_Stats(t *testing.T) {
 	db := MustOpenDB()
@@ -1564,6 +3225,123 @@ func TestBucket_Stats_Nested(t *testing.T) {
 	}
 }
 
+// Ensure that stats of nested buckets are the same whether or not the stats of
+// their children were already computed in the transaction.
+func TestBucket_Stats_Cached(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			child, err := b.CreateBucket([]byte(fmt.Sprintf("%02d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for j := 0; j < 100; j++ {
+				if err := child.Put([]byte(fmt.Sprintf("%04d", j)), make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var expected bolt.BucketStats
+	if err := db.View(func(tx *bolt.Tx) error {
+		expected = tx.Bucket([]byte("foo")).Stats()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("foo"))
+		for i := 0; i < 10; i += 2 {
+			if s := b.Bucket([]byte(fmt.Sprintf("%02d", i))).Stats(); s.KeyN != 100 {
+				t.Fatalf("unexpected KeyN: %d", s.KeyN)
+			}
+		}
+		if s := b.Stats(); !reflect.DeepEqual(s, expected) {
+			t.Fatalf("unexpected stats: %+v, expected %+v", s, expected)
+		}
+		if s := b.Stats(); !reflect.DeepEqual(s, expected) {
+			t.Fatalf("unexpected stats: %+v, expected %+v", s, expected)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that the estimated key count is exact for small buckets and close for
+// large ones.
+func TestBucket_EstimatedKeyN(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("small"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if err := b.Put(u64tob(uint64(i)), []byte("bar")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := b.EstimatedKeyN(); n != 10 {
+			t.Fatalf("unexpected estimate of inline bucket: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const keyN = 20000
+	for _, perm := range [][]int{nil, rand.Perm(keyN)} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if err := tx.DeleteBucket([]byte("large")); err != nil && err != bolt.ErrBucketNotFound {
+				t.Fatal(err)
+			}
+			b, err := tx.CreateBucket([]byte("large"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < keyN; i++ {
+				k := i
+				if perm != nil {
+					k = perm[i]
+				}
+				if err := b.Put(u64tob(uint64(k)), make([]byte, 20)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.View(func(tx *bolt.Tx) error {
+			n := tx.Bucket([]byte("large")).EstimatedKeyN()
+			if n < keyN*9/10 || n > keyN*11/10 {
+				t.Fatalf("unexpected estimate: %d", n)
+			}
+			if n := tx.Bucket([]byte("small")).EstimatedKeyN(); n != 10 {
+				t.Fatalf("unexpected estimate of small bucket: %d", n)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // Ensure a large bucket can calculate stats.
 func TestBucket_Stats_Large(t *testing.T) {
 	if testing.Short() {
@@ -1808,6 +3586,45 @@ func TestBucket_Delete_Quick(t *testing.T) {
 	}
 }
 
+// Measures point lookups in a read transaction, which should not allocate.
+func BenchmarkBucket_Get(b *testing.B) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100000; i++ {
+			if err := bkt.Put(u64tob(uint64(i)), make([]byte, 10)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte("widgets"))
+		keys := make([][]byte, 1000)
+		for i := range keys {
+			keys[i] = u64tob(uint64(rand.Intn(100000)))
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if v := bkt.Get(keys[i%len(keys)]); v == nil {
+				b.Fatal("expected value")
+			}
+		}
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+}
+
 func ExampleBucket_Put() {
 	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
@@ -0,0 +1,245 @@
+package bbolt
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Compact copies every bucket and key of src into dst. Keys are written in
+// sorted order, which packs them densely and may reclaim space that src no
+// longer has use for. Bucket sequences, fill percents and the expiry of keys
+// are preserved, while expired keys are dropped.
+//
+// txMaxSize limits the total size of the keys and values written by a single
+// transaction on dst, so that large databases can be compacted without
+// holding all changes in memory. Once the limit would be exceeded, the
+// current transaction is committed and a new one is started. A txMaxSize of
+// zero copies everything in a single transaction.
+//
+// dst should be empty. If an error occurs, dst may hold a partial copy.
+func Compact(dst, src *DB, txMaxSize int64) error {
+	return src.View(func(srcTx *Tx) error {
+		return compactTx(dst, srcTx, txMaxSize)
+	})
+}
+
+// WriteToCompacted writes a compacted copy of the database, as seen by the
+// transaction, to a writer. The copy holds the same buckets and keys as Compact
+// would write, without free pages, so it is usually smaller than the output of
+// WriteTo. The copy keeps the settings of the database, such as compression,
+// and the copy of an encrypted database is encrypted with the same key.
+//
+// The copy is built in a temporary file before it is written, in the
+// directory of the data file, or in os.TempDir for databases without one. It
+// needs about as much free disk space as the compacted database, but memory
+// is bounded by the size of the transactions building it.
+func (tx *Tx) WriteToCompacted(w io.Writer) (int64, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	}
+	dir := os.TempDir()
+	if tx.db.file != nil {
+		dir = filepath.Dir(tx.db.path)
+	}
+	f, err := ioutil.TempFile(dir, "bbolt-compact-")
+	if err != nil {
+		return 0, err
+	}
+	path := f.Name()
+	defer func() { _ = os.Remove(path) }()
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	db, err := tx.compactTo(path, 0600, compactedTxMaxSize)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = db.Close() }()
+
+	var n int64
+	err = db.View(func(tx *Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// compactedTxMaxSize bounds the transactions building the copy written by
+// WriteToCompacted, which is the memory it needs.
+const compactedTxMaxSize = 16 * 1024 * 1024
+
+// compactTx copies every bucket and key seen by srcTx into dst, as described
+// by Compact.
+func compactTx(dst *DB, srcTx *Tx, txMaxSize int64) error {
+	c := &compactor{dst: dst, txMaxSize: txMaxSize}
+	if err := c.begin(); err != nil {
+		return err
+	}
+	defer c.rollback()
+
+	if err := srcTx.ForEach(func(name []byte, b *Bucket) error {
+		return walkBucket(b, nil, name, c.walk)
+	}); err != nil {
+		return err
+	}
+	return c.tx.Commit()
+}
+
+// compactor copies the entries visited by walkBucket into dst, under the
+// same path, preserving the settings of buckets and the expiry of keys.
+type compactor struct {
+	dst       *DB
+	tx        *Tx
+	txMaxSize int64
+	size      int64
+
+	// srcBuckets holds the bucket being walked at each depth, which is
+	// where the values at that depth are read from.
+	srcBuckets []*Bucket
+}
+
+// begin starts the transaction the entries are copied in.
+func (c *compactor) begin() (err error) {
+	c.tx, err = c.dst.Begin(true)
+	c.size = 0
+	return err
+}
+
+// rollback discards the changes not committed yet.
+func (c *compactor) rollback() {
+	if c.tx != nil {
+		_ = c.tx.Rollback()
+	}
+}
+
+// walk copies an entry visited by walkBucket, committing and starting a new
+// transaction first if it would exceed txMaxSize.
+func (c *compactor) walk(path [][]byte, k, v []byte, child *Bucket) error {
+	if child != nil {
+		c.srcBuckets = append(c.srcBuckets[:len(path)], child)
+	}
+
+	sz := int64(len(k) + len(v))
+	if c.txMaxSize != 0 && c.size > 0 && c.size+sz > c.txMaxSize {
+		if err := c.tx.Commit(); err != nil {
+			return err
+		}
+		if err := c.begin(); err != nil {
+			return err
+		}
+	}
+	c.size += sz
+
+	// Find the parent bucket on the current transaction.
+	var parent *Bucket
+	if len(path) > 0 {
+		parent = c.tx.Bucket(path[0])
+		for _, name := range path[1:] {
+			parent = parent.Bucket(name)
+		}
+	}
+
+	if child == nil {
+		return copyValue(parent, c.srcBuckets[len(path)-1], k, v)
+	}
+
+	var b *Bucket
+	var err error
+	if parent == nil {
+		b, err = c.tx.CreateBucket(k)
+	} else {
+		b, err = parent.CreateBucket(k)
+	}
+	if err != nil {
+		return err
+	}
+	b.FillPercent = child.FillPercent
+	b.fillPercent = child.fillPercent
+	b.noInline = child.noInline
+	return b.SetSequence(child.Sequence())
+}
+
+// DefragFreelist moves the pages at the end of the data file into the free
+// pages before them, so that the free pages coalesce into a single run at the
+// end of the file. Unlike Compact it works in place, in one write
+// transaction, and rewrites only the pages it moves and their ancestors.
+//
+// The result is best effort: the ancestors of moved pages and the freelist
+// need free pages too, and pages with overflow only move if a long enough run
+// of free pages is available. The pages moved from are released by a second,
+// empty transaction, unless read transactions still use them. Compare
+// Stats().FreePageLargestSpan before and after to measure the effect.
+func (db *DB) DefragFreelist() error {
+	if err := db.Update(func(tx *Tx) error {
+		// Once defragmented, the free pages make up the end of the file.
+		freeN := len(db.freelist.getFreePageIDs())
+		if freeN == 0 {
+			return nil
+		}
+		d := &defragger{boundary: tx.meta.pgid - pgid(freeN), moves: make(map[pgid]bool)}
+		d.bucket(&tx.root)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return db.Update(func(*Tx) error { return nil })
+}
+
+// defragger materializes the nodes of the pages at or beyond boundary, along
+// with their ancestors, so that spilling moves them to lower free pages.
+type defragger struct {
+	boundary pgid
+	moves    map[pgid]bool // whether a page or one of its descendants moves
+}
+
+// bucket moves the pages of b and of its nested buckets.
+func (d *defragger) bucket(b *Bucket) {
+	if b.root == 0 {
+		return
+	}
+	var children [][]byte
+	if d.scan(b, b.root, &children) {
+		d.materialize(b, b.root, nil)
+	}
+	for _, name := range children {
+		d.bucket(b.Bucket(name))
+	}
+}
+
+// scan records which pages under id have to move and collects the names of
+// the nested buckets of b. It returns whether any of them moves.
+func (d *defragger) scan(b *Bucket, id pgid, children *[][]byte) bool {
+	p := b.tx.page(id)
+	move := id+pgid(p.overflow) >= d.boundary
+	if (p.flags & branchPageFlag) != 0 {
+		for i := 0; i < int(p.count); i++ {
+			if d.scan(b, p.branchPageElement(uint16(i)).pgid, children) {
+				move = true
+			}
+		}
+	} else {
+		for i := 0; i < int(p.count); i++ {
+			if elem := p.leafPageElement(uint16(i)); (elem.flags & bucketLeafFlag) != 0 {
+				*children = append(*children, elem.key())
+			}
+		}
+	}
+	d.moves[id] = move
+	return move
+}
+
+// materialize creates the node of page id and of its descendants which move.
+func (d *defragger) materialize(b *Bucket, id pgid, parent *node) {
+	n := b.node(id, parent)
+	if n.isLeaf {
+		return
+	}
+	for _, inode := range n.inodes {
+		if d.moves[inode.pgid] {
+			d.materialize(b, inode.pgid, n)
+		}
+	}
+}
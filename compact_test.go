@@ -0,0 +1,247 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that Compact copies every bucket, key and sequence and shrinks the
+// database.
+func TestCompact(t *testing.T) {
+	src := MustOpenDB()
+	defer src.MustClose()
+
+	if err := src.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 3; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket%d", i)))
+			if err != nil {
+				return err
+			}
+			if err := b.SetSequence(uint64(i + 10)); err != nil {
+				return err
+			}
+			child, err := b.CreateBucket([]byte("child"))
+			if err != nil {
+				return err
+			}
+			if err := child.SetSequence(uint64(i + 20)); err != nil {
+				return err
+			}
+			for j := 0; j < 1000; j++ {
+				if err := b.Put(u64tob(uint64(j)), make([]byte, 100)); err != nil {
+					return err
+				}
+				if err := child.Put(u64tob(uint64(j)), []byte("value")); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete most keys so that compaction has space to reclaim.
+	if err := src.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			for j := 0; j < 900; j++ {
+				if err := b.Delete(u64tob(uint64(j))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+
+	if err := bolt.Compact(dst.DB, src.DB, 4096); err != nil {
+		t.Fatal(err)
+	}
+
+	var srcSize, dstSize int64
+	if err := src.View(func(srcTx *bolt.Tx) error {
+		srcSize = srcTx.Size()
+		return dst.View(func(dstTx *bolt.Tx) error {
+			dstSize = dstTx.Size()
+			return srcTx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				return compareBuckets(t, b, dstTx.Bucket(name))
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if dstSize >= srcSize {
+		t.Fatalf("expected compacted size %d to be below %d", dstSize, srcSize)
+	}
+}
+
+// Ensure that WriteToCompacted writes a compacted copy which can be opened.
+func TestTx_WriteToCompacted(t *testing.T) {
+	src := MustOpenDB()
+	defer src.MustClose()
+
+	if err := src.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket([]byte("widgets")).DeleteRange(nil, u64tob(900))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	if err := src.View(func(tx *bolt.Tx) error {
+		var buf bytes.Buffer
+		n, err := tx.WriteToCompacted(&buf)
+		if err != nil {
+			t.Fatal(err)
+		} else if n != int64(buf.Len()) {
+			t.Fatalf("unexpected byte count: %d, wrote %d", n, buf.Len())
+		} else if n >= tx.Size() {
+			t.Fatalf("expected compacted size %d to be below %d", n, tx.Size())
+		}
+		return ioutil.WriteFile(path, buf.Bytes(), 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temporary copy next to the data file is removed.
+	if matches, err := filepath.Glob(filepath.Join(filepath.Dir(src.Path()), "bbolt-compact-*")); err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Fatalf("unexpected files: %v", matches)
+	}
+
+	dst, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := src.View(func(srcTx *bolt.Tx) error {
+		return dst.View(func(dstTx *bolt.Tx) error {
+			for err := range dstTx.Check() {
+				t.Fatal(err)
+			}
+			return compareBuckets(t, srcTx.Bucket([]byte("widgets")), dstTx.Bucket([]byte("widgets")))
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// compareBuckets fails the test if the contents or sequences of a and b differ.
+func compareBuckets(t *testing.T, a, b *bolt.Bucket) error {
+	if b == nil {
+		t.Fatal("expected bucket")
+	}
+	if a.Sequence() != b.Sequence() {
+		t.Fatalf("unexpected sequence: %d, expected %d", b.Sequence(), a.Sequence())
+	}
+	if a.Stats().KeyN != b.Stats().KeyN {
+		t.Fatalf("unexpected key count: %d, expected %d", b.Stats().KeyN, a.Stats().KeyN)
+	}
+	return a.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return compareBuckets(t, a.Bucket(k), b.Bucket(k))
+		}
+		if got := b.Get(k); !bytes.Equal(got, v) {
+			t.Fatalf("unexpected value for %x: %x, expected %x", k, got, v)
+		}
+		return nil
+	})
+}
+
+// Ensure that DefragFreelist coalesces free pages without losing keys.
+func TestDB_DefragFreelist(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 500)); err != nil {
+				t.Fatal(err)
+			}
+			if err := child.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Punch holes throughout the file.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 2000; i++ {
+			if (i/40)%2 == 0 {
+				if err := b.Delete(u64tob(uint64(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(*bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	before := db.Stats().FreePageLargestSpan
+	if err := db.DefragFreelist(); err != nil {
+		t.Fatal(err)
+	}
+	after := db.Stats().FreePageLargestSpan
+	if after <= before {
+		t.Fatalf("expected a longer free span: %d <= %d", after, before)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n := b.Stats().KeyN; n != 1000+1+2000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if v := b.Bucket([]byte("child")).Get(u64tob(1999)); len(v) != 100 {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
@@ -0,0 +1,123 @@
+package bbolt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compression selects how values are compressed when they are written. See
+// DB.Compression.
+type Compression int
+
+const (
+	// CompressionNone stores values as they are. This is the default.
+	CompressionNone Compression = iota
+
+	// CompressionFlate compresses values with DEFLATE at its fastest level.
+	CompressionFlate
+)
+
+// DefaultCompressionThreshold is the size from which values are compressed
+// when DB.CompressionThreshold is zero.
+const DefaultCompressionThreshold = 1024
+
+// A value of an element marked with compressedValueFlag starts with the
+// Compression it was compressed with, followed by its uncompressed size as a
+// uvarint and the compressed data. The header comes after the expiry time of
+// an expiring value.
+
+var (
+	flateWriterPool sync.Pool
+	flateReaderPool sync.Pool
+)
+
+// compressValue returns value compressed as configured for the database and
+// the element flag to store it with, or value itself and no flag if it is
+// below the threshold or does not shrink.
+func (b *Bucket) compressValue(value []byte) ([]byte, uint32) {
+	db := b.tx.db
+	threshold := db.CompressionThreshold
+	if threshold <= 0 {
+		threshold = DefaultCompressionThreshold
+	}
+	if db.Compression != CompressionFlate || len(value) < threshold {
+		return value, 0
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(byte(CompressionFlate))
+	var size [binary.MaxVarintLen64]byte
+	buf.Write(size[:binary.PutUvarint(size[:], uint64(len(value)))])
+
+	w, _ := flateWriterPool.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(&buf, flate.BestSpeed)
+	} else {
+		w.Reset(&buf)
+	}
+	_, err := w.Write(value)
+	if err == nil {
+		err = w.Close()
+	}
+	flateWriterPool.Put(w)
+	if err != nil || buf.Len() >= len(value) {
+		return value, 0
+	}
+	return buf.Bytes(), compressedValueFlag
+}
+
+// compressedValueSize parses the header of a compressed value and returns
+// its uncompressed size and the compressed data.
+func compressedValueSize(v []byte) (int, []byte, error) {
+	if len(v) == 0 {
+		return 0, nil, errors.New("missing compression header")
+	} else if Compression(v[0]) != CompressionFlate {
+		return 0, nil, fmt.Errorf("unknown compression %d", v[0])
+	}
+	size, n := binary.Uvarint(v[1:])
+	if n <= 0 || size > MaxValueSize {
+		return 0, nil, errors.New("invalid uncompressed size")
+	}
+	return int(size), v[1+n:], nil
+}
+
+// decompressValue returns the uncompressed value of a compressed value.
+func decompressValue(v []byte) ([]byte, error) {
+	size, data, err := compressedValueSize(v)
+	if err != nil {
+		return nil, err
+	}
+
+	r, _ := flateReaderPool.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(data))
+	} else {
+		_ = r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	}
+	defer flateReaderPool.Put(r)
+
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("decompress: %s", err)
+	}
+	var extra [1]byte
+	if n, _ := r.Read(extra[:]); n != 0 {
+		return nil, fmt.Errorf("decompress: longer than %d bytes", size)
+	}
+	return value, nil
+}
+
+// mustDecompressValue returns the uncompressed value of a compressed value,
+// and panics if it is corrupted like accessing a corrupted page does.
+func mustDecompressValue(v []byte) []byte {
+	value, err := decompressValue(v)
+	if err != nil {
+		panic(fmt.Sprintf("corrupted compressed value: %s", err))
+	}
+	return value
+}
@@ -3,11 +3,13 @@ package bbolt
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"sort"
+	"sync"
 )
 
 // Cursor represents an iterator that can traverse over all key/value pairs in a bucket in sorted order.
-// Cursors see nested buckets with value == nil.
+// Cursors see nested buckets with value == nil, and skip keys which expired.
 // Cursors can be obtained from a transaction and are valid as long as the transaction is open.
 //
 // Keys and values returned from the cursor are only valid for the life of the transaction.
@@ -16,8 +18,9 @@ import (
 // and return unexpected keys and/or values. You must reposition your cursor
 // after mutating data.
 type Cursor struct {
-	bucket *Bucket
-	stack  []elemRef
+	bucket  *Bucket
+	stack   []elemRef
+	deleted bool // the key under the cursor was removed by Delete
 }
 
 // Bucket returns the bucket that this cursor was created from.
@@ -30,6 +33,7 @@ func (c *Cursor) Bucket() *Bucket {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) First() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.deleted = false
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
 	c.stack = append(c.stack, elemRef{page: p, node: n, index: 0})
@@ -41,12 +45,7 @@ func (c *Cursor) First() (key []byte, value []byte) {
 		c.next()
 	}
 
-	k, v, flags := c.keyValue()
-	if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
-
+	return c.forward(c.keyValue())
 }
 
 // Last moves the cursor to the last item in the bucket and returns its key and value.
@@ -54,17 +53,14 @@ func (c *Cursor) First() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Last() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.deleted = false
 	c.stack = c.stack[:0]
 	p, n := c.bucket.pageNode(c.bucket.root)
 	ref := elemRef{page: p, node: n}
 	ref.index = ref.count() - 1
 	c.stack = append(c.stack, ref)
 	c.last()
-	k, v, flags := c.keyValue()
-	if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	return c.backward(c.keyValue())
 }
 
 // Next moves the cursor to the next item in the bucket and returns its key and value.
@@ -72,11 +68,18 @@ func (c *Cursor) Last() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Next() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
-	k, v, flags := c.next()
-	if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil
+
+	// After a Delete the cursor already points at the following key, unless
+	// it is beyond the end of its page.
+	var k, v []byte
+	var flags uint32
+	if ref := &c.stack[len(c.stack)-1]; c.deleted && ref.index < ref.count() {
+		k, v, flags = c.keyValue()
+	} else {
+		k, v, flags = c.next()
 	}
-	return k, v
+	c.deleted = false
+	return c.forward(k, v, flags)
 }
 
 // Prev moves the cursor to the previous item in the bucket and returns its key and value.
@@ -84,7 +87,14 @@ func (c *Cursor) Next() (key []byte, value []byte) {
 // The returned key and value are only valid for the life of the transaction.
 func (c *Cursor) Prev() (key []byte, value []byte) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
+	c.deleted = false
+	return c.backward(c.prev())
+}
 
+// prev moves to the previous leaf element and returns the key and value.
+// If the cursor is at the first leaf element then the stack is emptied and
+// nil is returned.
+func (c *Cursor) prev() (key []byte, value []byte, flags uint32) {
 	// Attempt to move back one element until we're successful.
 	// Move up the stack as we hit the beginning of each page in our stack.
 	for i := len(c.stack) - 1; i >= 0; i-- {
@@ -98,16 +108,12 @@ func (c *Cursor) Prev() (key []byte, value []byte) {
 
 	// If we've hit the end then return nil.
 	if len(c.stack) == 0 {
-		return nil, nil
+		return nil, nil, 0
 	}
 
 	// Move down the stack to find the last element of the last leaf under this branch.
 	c.last()
-	k, v, flags := c.keyValue()
-	if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil
-	}
-	return k, v
+	return c.keyValue()
 }
 
 // Seek moves the cursor to a given key and returns it.
@@ -121,17 +127,185 @@ func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
 	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
 		k, v, flags = c.next()
 	}
+	return c.forward(k, v, flags)
+}
 
+// SeekReverse moves the cursor to a given key and returns it.
+// If the key does not exist then the previous key is used. If no keys
+// precede it, a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekReverse(seek []byte) (key []byte, value []byte) {
+	k, v := c.Seek(seek)
 	if k == nil {
+		return c.Last()
+	} else if c.bucket.tx.sameKey(k, seek) {
+		return k, v
+	}
+	return c.Prev()
+}
+
+// SeekExact moves the cursor to a given key like Seek and returns it, along
+// with whether it is the key sought rather than the next one.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekExact(seek []byte) (key []byte, value []byte, exact bool) {
+	k, v := c.Seek(seek)
+	return k, v, k != nil && c.bucket.tx.sameKey(k, seek)
+}
+
+// FirstInRange moves the cursor to the smallest key greater than or equal to
+// min and returns it. A nil min moves to the first key. If no key follows min,
+// a nil key is returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) FirstInRange(min []byte) (key []byte, value []byte) {
+	if min == nil {
+		return c.First()
+	}
+	return c.Seek(min)
+}
+
+// LastInRange moves the cursor to the largest key less than max and returns
+// it, so that Prev continues a descending scan of the range ending before max.
+// A nil max moves to the last key. If no key precedes max, a nil key is
+// returned.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) LastInRange(max []byte) (key []byte, value []byte) {
+	if max == nil {
+		return c.Last()
+	}
+	if k, _ := c.Seek(max); k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// SeekPrefix moves the cursor to the first key starting with prefix and
+// returns it. If no key starts with prefix, a nil key is returned. With an
+// Options.KeyComparator, keys are checked one by one from the first.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekPrefix(prefix []byte) (key []byte, value []byte) {
+	if c.bucket.tx.customOrder() {
+		k, v := c.First()
+		for k != nil && !bytes.HasPrefix(k, prefix) {
+			k, v = c.Next()
+		}
+		return k, v
+	}
+	k, v := c.Seek(prefix)
+	if k == nil || !bytes.HasPrefix(k, prefix) {
 		return nil, nil
-	} else if (flags & uint32(bucketLeafFlag)) != 0 {
-		return k, nil
 	}
 	return k, v
 }
 
+// Count returns the number of keys in the cursor's bucket, including nested
+// buckets, as seen by the transaction. It sums the element counts of the leaf
+// pages without decoding any keys. The cursor position is not changed.
+func (c *Cursor) Count() int {
+	_assert(c.bucket.tx.db != nil, "tx closed")
+	return int(c.bucket.keyN(c.bucket.root))
+}
+
+// SeekIndex moves the cursor to the key at position n in the bucket, counting
+// from zero, and returns it. If n is negative or not less than Count, a nil
+// key is returned. Together with Count, it allows paging through a bucket by
+// offset.
+//
+// Pages do not record how many keys lie below them, so the first SeekIndex
+// or Count in a transaction reads the header of every leaf page of the
+// bucket. The counts of unchanged subtrees are kept for the rest of the
+// transaction, so that later calls only descend from the root, skipping
+// whole subtrees, and read O(log N) pages.
+//
+// Like Count, positions include expired keys. If the key at position n
+// expired, the cursor moves on to the next live key.
+// The returned key and value are only valid for the life of the transaction.
+func (c *Cursor) SeekIndex(n int64) (key []byte, value []byte) {
+	_assert(c.bucket.tx.db != nil, "tx closed")
+	if n < 0 {
+		n = math.MaxInt64
+	}
+	c.deleted = false
+	c.stack = c.stack[:0]
+	id := c.bucket.root
+	for {
+		p, nd := c.bucket.pageNode(id)
+		ref := elemRef{page: p, node: nd}
+		if ref.isLeaf() {
+			if n < int64(ref.count()) {
+				ref.index = int(n)
+			} else {
+				ref.index = ref.count()
+			}
+			c.stack = append(c.stack, ref)
+			break
+		}
+
+		// Skip the children before the one holding the key.
+		for ; ref.index < ref.count()-1; ref.index++ {
+			keyN := c.bucket.keyN(ref.childPgid(ref.index))
+			if n < keyN {
+				break
+			}
+			n -= keyN
+		}
+		c.stack = append(c.stack, ref)
+		id = ref.childPgid(ref.index)
+	}
+
+	k, v, flags := c.keyValue()
+
+	// If we ended up after the last element of a page then move to the next one.
+	if ref := &c.stack[len(c.stack)-1]; ref.index >= ref.count() {
+		k, v, flags = c.next()
+	}
+	return c.forward(k, v, flags)
+}
+
+// keyN returns the number of keys below page id of the bucket. The counts of
+// subtrees which are not materialized as nodes cannot change during the
+// transaction and are cached in it.
+func (b *Bucket) keyN(id pgid) int64 {
+	p, n := b.pageNode(id)
+	if n != nil {
+		if n.isLeaf {
+			return int64(len(n.inodes))
+		}
+		var keyN int64
+		for _, inode := range n.inodes {
+			keyN += b.keyN(inode.pgid)
+		}
+		return keyN
+	} else if (p.flags & leafPageFlag) != 0 {
+		return int64(p.count)
+	}
+
+	// Inline buckets all have page id 0 and are never branches, so only
+	// pages of the transaction are cached.
+	tx := b.tx
+	tx.cursorlock.Lock()
+	keyN, ok := tx.keyCounts[id]
+	tx.cursorlock.Unlock()
+	if ok {
+		return keyN
+	}
+	for i := 0; i < int(p.count); i++ {
+		keyN += b.keyN(p.branchPageElement(uint16(i)).pgid)
+	}
+	tx.cursorlock.Lock()
+	if tx.keyCounts == nil {
+		tx.keyCounts = make(map[pgid]int64)
+	}
+	tx.keyCounts[id] = keyN
+	tx.cursorlock.Unlock()
+	return keyN
+}
+
 // Delete removes the current key/value under the cursor from the bucket.
 // Delete fails if current key/value is a bucket or if the transaction is not writable.
+//
+// After Delete the cursor is positioned between the neighbours of the deleted
+// key, so that Next returns the key which followed it and Prev the key which
+// preceded it. This allows deleting keys while iterating over the bucket.
 func (c *Cursor) Delete() error {
 	if c.bucket.tx.db == nil {
 		return ErrTxClosed
@@ -139,22 +313,58 @@ func (c *Cursor) Delete() error {
 		return ErrTxNotWritable
 	}
 
+	// Nothing is left under the cursor after a previous Delete.
+	if c.deleted {
+		return nil
+	}
+
 	key, _, flags := c.keyValue()
 	// Return an error if current value is a bucket.
 	if (flags & bucketLeafFlag) != 0 {
 		return ErrIncompatibleValue
+	} else if key == nil {
+		return nil
 	}
+	key = cloneBytes(key)
 	c.node().del(key)
 
+	// The elements of the node have shifted, so move to the key which
+	// followed the deleted one for Next to return.
+	c.seek(key)
+	c.deleted = true
+
 	return nil
 }
 
+// forward returns the given element as seen by users if it is live, or
+// otherwise moves to the next live element and returns it.
+func (c *Cursor) forward(k, v []byte, flags uint32) ([]byte, []byte) {
+	for ; k != nil; k, v, flags = c.next() {
+		if v, ok := c.bucket.liveValue(v, flags); ok {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
+// backward returns the given element as seen by users if it is live, or
+// otherwise moves to the previous live element and returns it.
+func (c *Cursor) backward(k, v []byte, flags uint32) ([]byte, []byte) {
+	for ; k != nil; k, v, flags = c.prev() {
+		if v, ok := c.bucket.liveValue(v, flags); ok {
+			return k, v
+		}
+	}
+	return nil, nil
+}
+
 // seek moves the cursor to a given key and returns it.
 // If the key does not exist then the next key is used.
 func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	_assert(c.bucket.tx.db != nil, "tx closed")
 
 	// Start from root page/node and traverse to correct page.
+	c.deleted = false
 	c.stack = c.stack[:0]
 	c.search(seek, c.bucket.root)
 
@@ -162,6 +372,29 @@ func (c *Cursor) seek(seek []byte) (key []byte, value []byte, flags uint32) {
 	return c.keyValue()
 }
 
+// seekNear moves the cursor to a given key like seek, but only searches the
+// current leaf if the key is within its range instead of traversing from the
+// root. This makes seeking to keys in ascending order cheap when many of them
+// fall on the same leaf.
+func (c *Cursor) seekNear(seek []byte) (key []byte, value []byte, flags uint32) {
+	if len(c.stack) > 0 {
+		ref := &c.stack[len(c.stack)-1]
+		if n := ref.count(); ref.isLeaf() && n > 0 {
+			var first, last []byte
+			if ref.node != nil {
+				first, last = ref.node.inodes[0].key, ref.node.inodes[n-1].key
+			} else {
+				first, last = ref.page.leafPageElement(0).key(), ref.page.leafPageElement(uint16(n-1)).key()
+			}
+			if c.bucket.tx.compareKeys(seek, first) >= 0 && c.bucket.tx.compareKeys(seek, last) <= 0 {
+				c.nsearch(seek)
+				return c.keyValue()
+			}
+		}
+	}
+	return c.seek(seek)
+}
+
 // first moves the cursor to the first leaf element under the last page in the stack.
 func (c *Cursor) first() {
 	for {
@@ -270,7 +503,7 @@ func (c *Cursor) searchNode(key []byte, n *node) {
 	index := sort.Search(len(n.inodes), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(n.inodes[i].key, key)
+		ret := c.bucket.tx.compareKeys(n.inodes[i].key, key)
 		if ret == 0 {
 			exact = true
 		}
@@ -293,7 +526,7 @@ func (c *Cursor) searchPage(key []byte, p *page) {
 	index := sort.Search(int(p.count), func(i int) bool {
 		// TODO(benbjohnson): Optimize this range search. It's a bit hacky right now.
 		// sort.Search() finds the lowest index where f() != -1 but we need the highest index.
-		ret := bytes.Compare(inodes[i].key(), key)
+		ret := c.bucket.tx.compareKeys(inodes[i].key(), key)
 		if ret == 0 {
 			exact = true
 		}
@@ -316,7 +549,7 @@ func (c *Cursor) nsearch(key []byte) {
 	// If we have a node then search its inodes.
 	if n != nil {
 		index := sort.Search(len(n.inodes), func(i int) bool {
-			return bytes.Compare(n.inodes[i].key, key) != -1
+			return c.bucket.tx.compareKeys(n.inodes[i].key, key) >= 0
 		})
 		e.index = index
 		return
@@ -325,7 +558,7 @@ func (c *Cursor) nsearch(key []byte) {
 	// If we have a page then search its leaf elements.
 	inodes := p.leafPageElements()
 	index := sort.Search(int(p.count), func(i int) bool {
-		return bytes.Compare(inodes[i].key(), key) != -1
+		return c.bucket.tx.compareKeys(inodes[i].key(), key) >= 0
 	})
 	e.index = index
 }
@@ -372,6 +605,31 @@ func (c *Cursor) node() *node {
 	return n
 }
 
+// cursorStackPool recycles the stacks of the temporary cursors used for
+// single lookups such as Bucket.Get, which would otherwise allocate a cursor
+// and grow its stack on every call.
+var cursorStackPool = sync.Pool{
+	New: func() interface{} { return new([]elemRef) },
+}
+
+// seekOnce moves a temporary cursor over b to key and returns the key, value
+// and flags found there, like seek.
+func (b *Bucket) seekOnce(key []byte) (k []byte, v []byte, flags uint32) {
+	b.tx.countCursor()
+
+	stack := cursorStackPool.Get().(*[]elemRef)
+	c := Cursor{bucket: b, stack: (*stack)[:0]}
+	k, v, flags = c.seek(key)
+
+	// Drop the references to pages and nodes before recycling the stack.
+	for i := range c.stack {
+		c.stack[i] = elemRef{}
+	}
+	*stack = c.stack[:0]
+	cursorStackPool.Put(stack)
+	return k, v, flags
+}
+
 // elemRef represents a reference to an element on a given page/node.
 type elemRef struct {
 	page  *page
@@ -394,3 +652,11 @@ func (r *elemRef) count() int {
 	}
 	return int(r.page.count)
 }
+
+// childPgid returns the page id of the child at index i of a branch.
+func (r *elemRef) childPgid(i int) pgid {
+	if r.node != nil {
+		return r.node.inodes[i].pgid
+	}
+	return r.page.branchPageElement(uint16(i)).pgid
+}
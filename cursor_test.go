@@ -8,8 +8,10 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -103,6 +105,44 @@ func TestCursor_Seek(t *testing.T) {
 	}
 }
 
+// Ensure that SeekExact reports whether it found the key sought.
+func TestCursor_SeekExact(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"bar", "foo"} {
+			if err := b.Put([]byte(k), []byte(k+"-value")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := b.Cursor()
+		for _, tc := range []struct {
+			seek, key string
+			exact     bool
+		}{
+			{"bar", "bar", true},
+			{"baz", "foo", false},
+			{"foo", "foo", true},
+			{"zzz", "", false},
+		} {
+			k, v, exact := c.SeekExact([]byte(tc.seek))
+			if string(k) != tc.key || exact != tc.exact {
+				t.Fatalf("SeekExact(%q): unexpected key %q, exact %v", tc.seek, k, exact)
+			} else if k != nil && string(v) != tc.key+"-value" {
+				t.Fatalf("SeekExact(%q): unexpected value %q", tc.seek, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestCursor_Delete(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
@@ -161,6 +201,106 @@ func TestCursor_Delete(t *testing.T) {
 	}
 }
 
+// Ensure that Next and Prev return the neighbours of a key removed by
+// Cursor.Delete, including when the leaf has been materialized as a node and
+// when deletion empties pages which are rebalanced on commit.
+func TestCursor_Delete_Next(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	const count = 2000
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete every other key. Overwriting a key first materializes every
+	// node so that deleting shifts the elements under the cursor.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < count; i += 100 {
+			if err := b.Put(u64tob(uint64(i)), []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := b.Cursor()
+		var i uint64
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if n := binary.BigEndian.Uint64(k); n != i {
+				t.Fatalf("unexpected key: %d, expected %d", n, i)
+			}
+			if i%2 == 0 {
+				if err := c.Delete(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			i++
+		}
+		if i != count {
+			t.Fatalf("unexpected key count: %d", i)
+		}
+
+		// Ensure that Prev returns the key before a deleted key.
+		c.Seek(u64tob(501))
+		if err := c.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		if k, _ := c.Prev(); binary.BigEndian.Uint64(k) != 499 {
+			t.Fatalf("unexpected key: %x", k)
+		}
+		return b.Put(u64tob(501), []byte("x"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete the remaining keys, emptying every page.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		var n int
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if exp := uint64(2*n + 1); binary.BigEndian.Uint64(k) != exp {
+				t.Fatalf("unexpected key: %x, expected %d", k, exp)
+			}
+			if err := c.Delete(); err != nil {
+				t.Fatal(err)
+			}
+			n++
+		}
+		if n != count/2 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if k, _ := c.First(); k != nil {
+			t.Fatalf("unexpected key: %x", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 0 {
+			t.Fatalf("unexpected KeyN: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a Tx cursor can seek to the appropriate keys when there are a
 // large number of keys. This test also checks that seek will always move
 // forward to the next key.
@@ -229,6 +369,323 @@ func TestCursor_Seek_Large(t *testing.T) {
 	}
 }
 
+// Ensure that a cursor can seek to the greatest key at or before a key.
+func TestCursor_SeekReverse(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var count = 10000
+
+	// Insert every other key between 1 and $count.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < count; i += 2 {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, uint64(i))
+			if err := b.Put(k, make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for i := 0; i <= count; i++ {
+			seek := make([]byte, 8)
+			binary.BigEndian.PutUint64(seek, uint64(i))
+
+			k, _ := c.SeekReverse(seek)
+
+			// The first seek is before the start of the range so it should
+			// return nil.
+			if i == 0 {
+				if k != nil {
+					t.Fatal("expected nil key")
+				}
+				continue
+			}
+
+			// Otherwise we should seek to the exact key or the previous key.
+			num := binary.BigEndian.Uint64(k)
+			if i%2 == 1 {
+				if num != uint64(i) {
+					t.Fatalf("unexpected num: %d", num)
+				}
+			} else {
+				if num != uint64(i-1) {
+					t.Fatalf("unexpected num: %d", num)
+				}
+			}
+		}
+
+		// Iterating backwards from the seek position should visit the
+		// preceding keys in order.
+		seek := make([]byte, 8)
+		binary.BigEndian.PutUint64(seek, uint64(count/2))
+		var n int
+		for k, _ := c.SeekReverse(seek); k != nil && n < 10; k, _ = c.Prev() {
+			if num := binary.BigEndian.Uint64(k); num != uint64(count/2-1-2*n) {
+				t.Fatalf("unexpected num: %d", num)
+			}
+			n++
+		}
+		if n != 10 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor can seek to the first key with a prefix.
+func TestCursor_SeekPrefix(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"aa", "ab", "b", "ca"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for prefix, exp := range map[string]string{"a": "aa", "ab": "ab", "b": "b", "c": "ca", "": "aa", "ac": "", "bb": "", "d": ""} {
+			if k, v := c.SeekPrefix([]byte(prefix)); string(k) != exp || string(v) != exp {
+				t.Fatalf("unexpected key for prefix %q: %q=%q, expected %q", prefix, k, v, exp)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor can move to the first and last keys of a range,
+// including ranges whose bounds fall between pages.
+func TestCursor_FirstLastInRange(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Even keys only, spanning many pages.
+		for i := 0; i < 2000; i += 2 {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(k []byte) int {
+		if k == nil {
+			return -1
+		}
+		return int(binary.BigEndian.Uint64(k))
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("widgets")).Cursor()
+		for i := 0; i <= 2000; i++ {
+			first, last := i+i%2, i-2+i%2
+			if first >= 2000 {
+				first = -1
+			}
+			if last < 0 {
+				last = -1
+			}
+			if k, _ := c.FirstInRange(u64tob(uint64(i))); key(k) != first {
+				t.Fatalf("unexpected first key in range from %d: %d", i, key(k))
+			}
+			if k, _ := c.LastInRange(u64tob(uint64(i))); key(k) != last {
+				t.Fatalf("unexpected last key in range to %d: %d", i, key(k))
+			}
+		}
+
+		if k, _ := c.FirstInRange(nil); key(k) != 0 {
+			t.Fatalf("unexpected first key: %d", key(k))
+		}
+		if k, _ := c.LastInRange(nil); key(k) != 1998 {
+			t.Fatalf("unexpected last key: %d", key(k))
+		}
+
+		// A descending scan continues from the last key in range.
+		var n int
+		for k, _ := c.LastInRange(u64tob(1000)); k != nil; k, _ = c.Prev() {
+			n++
+		}
+		if n != 500 {
+			t.Fatalf("unexpected descending scan length: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor counts the keys of its bucket, including uncommitted
+// changes.
+func TestCursor_Count(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Cursor().Count(); n != 0 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		for i := 0; i < 3; i++ {
+			if err := b.Put(u64tob(uint64(i)), []byte{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := b.Cursor().Count(); n != 3 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 3; i < 10000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.CreateBucket([]byte("child")); err != nil {
+			t.Fatal(err)
+		}
+		if n := b.Cursor().Count(); n != 10001 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i < 5000; i++ {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := b.Cursor().Count(); n != 5001 {
+			t.Fatalf("unexpected count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n, exp := b.Cursor().Count(), b.Stats().KeyN; n != exp {
+			t.Fatalf("unexpected count: %d, expected %d", n, exp)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a cursor can be positioned by the index of a key.
+func TestCursor_SeekIndex(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k, _ := b.Cursor().SeekIndex(0); k != nil {
+			t.Fatalf("unexpected key: %x", k)
+		}
+		for i := 0; i < 10000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(b *bolt.Bucket, indexes []int64, keyAt func(int64) uint64, count int64) {
+		c := b.Cursor()
+		for _, i := range indexes {
+			k, _ := c.SeekIndex(i)
+			if i < 0 || i >= count {
+				if k != nil {
+					t.Fatalf("unexpected key at %d: %x", i, k)
+				}
+				continue
+			}
+			if want := keyAt(i); !bytes.Equal(k, u64tob(want)) {
+				t.Fatalf("unexpected key at %d: %x, want %d", i, k, want)
+			}
+			if i+1 < count {
+				if k, _ := c.Next(); !bytes.Equal(k, u64tob(keyAt(i+1))) {
+					t.Fatalf("unexpected next key after %d: %x", i, k)
+				}
+			}
+		}
+	}
+	indexes := []int64{-1, 0, 1, 99, 1000, 4999, 5000, 9998, 9999, 10000}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		check(b, indexes, func(i int64) uint64 { return uint64(i) }, 10000)
+		for i := int64(0); i < 10000; i += 37 {
+			check(b, []int64{i}, func(i int64) uint64 { return uint64(i) }, 10000)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Positions follow the changes made by the transaction.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		check(b, indexes, func(i int64) uint64 { return uint64(i) }, 10000)
+		for i := 0; i < 10000; i += 2 {
+			if err := b.Delete(u64tob(uint64(i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(b, indexes, func(i int64) uint64 { return uint64(2*i + 1) }, 5000)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a cursor can iterate over an empty bucket without error.
 func TestCursor_EmptyBucket(t *testing.T) {
 	db := MustOpenDB()
@@ -273,6 +730,11 @@ func TestCursor_EmptyBucketReverse(t *testing.T) {
 		} else if v != nil {
 			t.Fatalf("unexpected value: %v", v)
 		}
+		if k, v := c.SeekReverse([]byte("foo")); k != nil {
+			t.Fatalf("unexpected key: %v", k)
+		} else if v != nil {
+			t.Fatalf("unexpected value: %v", v)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
@@ -507,6 +969,67 @@ func TestCursor_First_EmptyPages(t *testing.T) {
 	}
 }
 
+// Ensure that cursors of a read-only transaction can scan a bucket in
+// parallel, including within SafeView, and collect its stats.
+func TestCursor_Concurrent(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{PageChecksums: true})
+	defer db.MustClose()
+
+	const count, workers = 10000, 4
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			if i%2 == 0 {
+				err = b.PutWithTTL(u64tob(uint64(i)), make([]byte, 100), time.Hour)
+			} else {
+				err = b.Put(u64tob(uint64(i)), make([]byte, 100))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.SafeView(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		counts := make([]int, workers)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				min, max := u64tob(uint64(w*count/workers)), u64tob(uint64((w+1)*count/workers))
+				c := b.Cursor()
+				for k, _ := c.Seek(min); k != nil && bytes.Compare(k, max) < 0; k, _ = c.Next() {
+					counts[w]++
+				}
+				if n := b.Stats().KeyN; n != count {
+					t.Errorf("unexpected stats key count: %d", n)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		for w, n := range counts {
+			if n != count/workers {
+				t.Fatalf("worker %d: unexpected key count: %d", w, n)
+			}
+		}
+		if n := tx.Stats().CursorCount; n < workers {
+			t.Fatalf("unexpected cursor count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that a Tx can iterate over all elements in a bucket.
 func TestCursor_QuickCheck(t *testing.T) {
 	f := func(items testdata) bool {
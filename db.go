@@ -1,12 +1,17 @@
 package bbolt
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"sync"
 	"time"
@@ -30,6 +35,13 @@ const pgidNoFreelist pgid = 0xffffffffffffffff
 // must be synchronized using the msync(2) syscall.
 const IgnoreNoSync = runtime.GOOS == "openbsd"
 
+// PreferMetaPage0 and PreferMetaPage1 set as Options.PreferMeta select the
+// meta page with MetaInfo.ID 0 or 1, whichever transaction wrote it.
+const (
+	PreferMetaPage0 = -1
+	PreferMetaPage1 = -2
+)
+
 // Default values if not set in a DB instance.
 const (
 	DefaultMaxBatchSize  int = 1000
@@ -53,6 +65,36 @@ const (
 	FreelistMapType = FreelistType("hashmap")
 )
 
+// AccessPattern describes how the data file is expected to be read, so that
+// the operating system can tune readahead for its memory map.
+type AccessPattern int
+
+const (
+	// AccessRandom disables readahead, which suits point lookups. This is
+	// the default.
+	AccessRandom AccessPattern = iota
+	// AccessNormal uses the default readahead of the operating system.
+	AccessNormal
+	// AccessSequential reads ahead aggressively, which suits full scans.
+	AccessSequential
+)
+
+// SyncMode selects how commits flush the data file to disk.
+type SyncMode int
+
+const (
+	// SyncData flushes the written data with fdatasync(2) where it is
+	// available, which skips metadata such as the modification time that is
+	// not needed to read the data back. It falls back to fsync(2) elsewhere.
+	// This is the default.
+	SyncData SyncMode = iota
+	// SyncFull flushes the data and all metadata with fsync(2).
+	SyncFull
+	// SyncNone does not flush commits, leaving it to the operating system,
+	// like NoSync. It is only suitable for data which can be rebuilt.
+	SyncNone
+)
+
 // DB represents a collection of buckets persisted to a file on disk.
 // All data access is performed through transactions which can be obtained through the DB.
 // All the functions on DB will return a ErrDatabaseNotOpen if accessed before Open() is called.
@@ -75,9 +117,32 @@ type DB struct {
 	// THIS IS UNSAFE. PLEASE USE WITH CAUTION.
 	NoSync bool
 
+	// SyncMode selects how commits flush the data file. Either way, the file
+	// is fully synced when it is grown, unless NoGrowSync is set, so SyncData
+	// does not risk losing the new size. SyncNone is equivalent to NoSync and
+	// is likewise ignored if IgnoreNoSync is true.
+	SyncMode SyncMode
+
+	// SyncInterval and SyncBytes enable group commit. When either is set,
+	// commits do not sync the file themselves. Instead it is synced once
+	// SyncInterval has passed since the first unsynced commit, or once
+	// SyncBytes have been written since the last sync, whichever comes first.
+	// Flush syncs the pending commits immediately. They are ignored if
+	// NoSync is set, and like NoSync they are ignored if IgnoreNoSync is true.
+	//
+	// Only the sync of the meta page is deferred: the pages written by a
+	// commit are still synced before its meta page is written, and pages
+	// freed since the last sync are not reused until the next one. A process
+	// crash loses no commits, and a power failure may lose the commits since
+	// the last sync but leaves the database consistent as of an earlier one.
+	SyncInterval time.Duration
+	SyncBytes    int
+
 	// When true, skips syncing freelist to disk. This improves the database
 	// write performance under normal operation, but requires a full database
 	// re-sync during recovery.
+	//
+	// Use SetNoFreelistSync to change this while transactions may be running.
 	NoFreelistSync bool
 
 	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
@@ -85,6 +150,9 @@ type DB struct {
 	// The alternative one is using hashmap, it is faster in almost all circumstances
 	// but it doesn't guarantee that it offers the smallest page id available. In normal case it is safe.
 	// The default type is array
+	//
+	// Both types persist the freelist in the same format, so a database may be
+	// reopened with a different type without any conversion.
 	FreelistType FreelistType
 
 	// When true, skips the truncate call when growing the database.
@@ -99,12 +167,89 @@ type DB struct {
 	// syscall.MAP_POPULATE on Linux 2.6.23+ for sequential read-ahead.
 	MmapFlags int
 
+	// AccessPattern is passed to madvise whenever the data file is mapped.
+	// It is ignored on Windows.
+	AccessPattern AccessPattern
+
+	// When CompactOnClose is set, Close compacts the database into a new
+	// file next to the data file if its free pages take up more than
+	// CompactThresholdBytes, and then renames the new file over the data
+	// file. Read-only and in-memory databases are never compacted.
+	//
+	// The database is compacted while Close holds the writer lock, so Close
+	// takes as long as copying the database. If compacting fails, the data
+	// file is left untouched and Close returns the error after closing the
+	// database. The new file replaces the data file while it is still locked,
+	// so that no other process can open the old file and commit to it in
+	// between. Windows does not allow replacing a file which is open, so
+	// Close returns the error of the rename there.
+	CompactOnClose        bool
+	CompactThresholdBytes int64
+
+	// When PageChecksums is set, commits store a checksum at the end of every
+	// branch and leaf page they write, which costs up to a page for pages
+	// that would otherwise fill their span. Pages with a checksum are
+	// verified the first time a transaction reads them, and a mismatch
+	// panics, so that corruption on disk is detected before a corrupted page
+	// is interpreted. Tx.Check verifies the checksums regardless of this
+	// setting.
+	//
+	// Only pages written while it is set carry a checksum, so it can be
+	// enabled on an existing database, whose pages gain checksums as they
+	// are rewritten.
+	PageChecksums bool
+
+	// When ValueSafetyChecks is set, Bucket.Get, GetValue and GetMulti
+	// return copies of the values instead of slices of the memory map, and
+	// the copies are overwritten with 0xDB bytes when the transaction is
+	// closed. A value used after its transaction then reads as garbage
+	// instead of as whatever the page holds by then, which catches such use
+	// in tests. Every value read is allocated, so it should only be used for
+	// debugging purposes.
+	ValueSafetyChecks bool
+
+	// Compression selects how values of at least CompressionThreshold bytes
+	// are compressed when they are put. Values are decompressed when read,
+	// so the setting can be changed at any time and only affects values put
+	// afterwards. Values which do not shrink, nested buckets and values put
+	// with Bucket.PutReserve are stored as they are. Decompressed values are
+	// allocated on every read instead of pointing into the memory map.
+	Compression Compression
+
+	// CompressionThreshold is the size from which values are compressed.
+	// DefaultCompressionThreshold is used if it is zero.
+	CompressionThreshold int
+
+	// MaxKeySize and MaxValueSize limit the size in bytes of the keys and
+	// values which can be put, below the hard limits of the package-level
+	// MaxKeySize and MaxValueSize. Larger keys and values are rejected with
+	// ErrKeyTooLarge and ErrValueTooLarge before they take up any space, so
+	// that a value stored by accident cannot make the database grow beyond
+	// what the application expects. Values are limited by their size before
+	// compression. There is no limit if they are zero.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// RebalanceThreshold is the fraction of the page size below which a node
+	// that lost keys in a transaction is merged with a sibling on commit. If
+	// zero, DefaultRebalanceThreshold is used.
+	//
+	// Raising it keeps pages fuller, which saves space and reads, but merges
+	// more often; a merged node that no longer fits a page is split again,
+	// so pages near the threshold may be rewritten on every commit. Lowering
+	// it leaves under-full pages alone, which suits large values that would
+	// otherwise be moved between pages repeatedly, at the cost of a larger
+	// file. Keep it below Bucket.FillPercent to avoid merging the pages
+	// that splitting produces.
+	RebalanceThreshold float64
+
 	// MaxBatchSize is the maximum size of a batch. Default value is
 	// copied from DefaultMaxBatchSize in Open.
 	//
 	// If <=0, disables batching.
 	//
-	// Do not change concurrently with calls to Batch.
+	// Do not change concurrently with calls to Batch; use SetBatchParams
+	// instead.
 	MaxBatchSize int
 
 	// MaxBatchDelay is the maximum delay before a batch starts.
@@ -112,7 +257,8 @@ type DB struct {
 	//
 	// If <=0, effectively disables batching.
 	//
-	// Do not change concurrently with calls to Batch.
+	// Do not change concurrently with calls to Batch; use SetBatchParams
+	// instead.
 	MaxBatchDelay time.Duration
 
 	// AllocSize is the amount of space allocated when the database
@@ -135,6 +281,10 @@ type DB struct {
 	txs      []*Tx
 	stats    Stats
 
+	// preferMeta selects the meta page to use instead of the latest valid
+	// one as described by Options.PreferMeta, or is 0.
+	preferMeta int
+
 	freelist     *freelist
 	freelistLoad sync.Once
 
@@ -148,13 +298,76 @@ type DB struct {
 	mmaplock sync.RWMutex // Protects mmap access during remapping.
 	statlock sync.RWMutex // Protects stats access.
 
+	// changed maps every page written since the database was opened to the
+	// txid which last wrote it, for incremental backups. It is only kept with
+	// Options.TrackChanges. changedSince is the txid which was current when
+	// the database was opened.
+	changedlock  sync.Mutex
+	changed      map[pgid]txid
+	changedSince txid
+
+	// txidlock protects the txid of the last committed transaction and
+	// txidChanged, which is closed to wake up WaitForTxID when it changes or
+	// the database is closed.
+	txidlock      sync.Mutex
+	committedTxid txid
+	txidChanged   chan struct{}
+	txidClosed    bool
+
 	ops struct {
 		writeAt func(b []byte, off int64) (n int, err error)
 	}
 
+	logger   Logger
+	observer Observer
+
+	// synclock protects the state of group commit.
+	synclock      sync.Mutex
+	unsyncedBytes int
+	syncTimer     *time.Timer
+
+	// syncedTxid is the txid of the last commit whose meta page was synced,
+	// while there are commits whose meta page was not.
+	syncedTxid txid
+
+	// useArena is set by Options.UseArena. arenas holds the arenas of closed
+	// writable transactions for reuse.
+	useArena bool
+	arenas   sync.Pool
+
+	// compare orders keys, see Options.KeyComparator. Nil for bytes.Compare.
+	compare func(a, b []byte) int
+
+	// readerAt serves page reads instead of the mmap for databases opened
+	// with OpenReaderAt. The pages read are kept in pageCache.
+	readerAt  io.ReaderAt
+	pagelock  sync.Mutex
+	pageCache map[pgid][]byte
+
+	// encryptionKey is the key set by Options.EncryptionKey, and cipher
+	// encrypts and decrypts the pages of an encrypted database. cipher is
+	// nil for databases which are not encrypted.
+	encryptionKey []byte
+	cipher        *pageCipher
+
+	// memory holds the data of databases opened with OpenInMemory, which have
+	// no file. It is replaced by a larger copy when the database grows.
+	memory []byte
+
+	// wal is the write-ahead log of databases opened with Options.WALMode.
+	wal *wal
+
 	// Read only mode.
 	// When true, Update() and Begin(true) return ErrDatabaseReadOnly immediately.
 	readOnly bool
+
+	// noLock and lockTimeout hold Options.NoLock and Options.Timeout, for
+	// locking the file again in Reopen.
+	noLock      bool
+	lockTimeout time.Duration
+
+	// options holds the options the database was opened with, for Options.
+	options Options
 }
 
 // Path returns the path to currently open database file.
@@ -176,6 +389,34 @@ func (db *DB) String() string {
 // If the file does not exist then it will be created automatically.
 // Passing in nil options will cause Bolt to open the database with the default options.
 func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
+	return OpenContext(context.Background(), path, mode, options)
+}
+
+// lockedError is returned by OpenContext when ctx is done before the lock on
+// the data file is acquired. It matches ErrLocked and wraps the error of ctx.
+type lockedError struct {
+	err error
+}
+
+// Error returns ErrLocked's message followed by the error of the context.
+func (e *lockedError) Error() string {
+	return ErrLocked.Error() + ": " + e.err.Error()
+}
+
+// Is reports whether target is ErrLocked.
+func (e *lockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Unwrap returns the error of the context.
+func (e *lockedError) Unwrap() error {
+	return e.err
+}
+
+// OpenContext is like Open, but stops waiting for the lock on the data file
+// once ctx is done. The error returned then matches both ErrLocked and the
+// error of ctx with errors.Is. Options.Timeout still applies.
+func OpenContext(ctx context.Context, path string, mode os.FileMode, options *Options) (*DB, error) {
 	db := &DB{
 		opened: true,
 	}
@@ -183,11 +424,32 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	if options == nil {
 		options = DefaultOptions
 	}
+	db.options = *options
 	db.NoSync = options.NoSync
+	db.SyncMode = options.SyncMode
+	db.SyncInterval = options.SyncInterval
+	db.SyncBytes = options.SyncBytes
 	db.NoGrowSync = options.NoGrowSync
 	db.MmapFlags = options.MmapFlags
+	db.AccessPattern = options.AccessPattern
+	db.CompactOnClose = options.CompactOnClose
+	db.CompactThresholdBytes = options.CompactThresholdBytes
+	db.RebalanceThreshold = options.RebalanceThreshold
+	db.PageChecksums = options.PageChecksums
+	db.ValueSafetyChecks = options.ValueSafetyChecks
+	db.Compression = options.Compression
+	db.CompressionThreshold = options.CompressionThreshold
+	db.MaxKeySize = options.MaxKeySize
+	db.MaxValueSize = options.MaxValueSize
 	db.NoFreelistSync = options.NoFreelistSync
 	db.FreelistType = options.FreelistType
+	db.logger = options.Logger
+	db.observer = options.Observer
+	db.compare = options.KeyComparator
+	db.useArena = options.UseArena
+	if err := db.setEncryptionKey(options.EncryptionKey); err != nil {
+		return nil, err
+	}
 
 	// Set default values for later DB operations.
 	db.MaxBatchSize = DefaultMaxBatchSize
@@ -198,7 +460,12 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	if options.ReadOnly {
 		flag = os.O_RDONLY
 		db.readOnly = true
+	} else if options.NoLock {
+		return nil, ErrNoLockWritable
+	} else if options.PreferMeta != 0 {
+		return nil, ErrPreferMetaWritable
 	}
+	db.preferMeta = options.PreferMeta
 
 	db.openFile = options.OpenFile
 	if db.openFile == nil {
@@ -220,9 +487,27 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	// if !options.ReadOnly.
 	// The database file is locked using the shared lock (more than one process may
 	// hold a lock at the same time) otherwise (options.ReadOnly is set).
-	if err := flock(db, !db.readOnly, options.Timeout); err != nil {
-		_ = db.close()
-		return nil, err
+	// Read-only databases are not locked at all if options.NoLock is set.
+	db.noLock, db.lockTimeout = options.NoLock, options.Timeout
+	if !options.NoLock {
+		if err := flock(ctx, db, !db.readOnly, options.Timeout); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
+	// Replay the commits which may not have reached the data file yet.
+	// Read-only databases cannot, so they refuse to open without them.
+	if db.readOnly {
+		if err := db.checkWAL(); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	} else if options.WALMode {
+		if err := db.openWAL(mode, options.WALCheckpointBytes); err != nil {
+			_ = db.close()
+			return nil, err
+		}
 	}
 
 	// Default values for test hooks
@@ -258,6 +543,10 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		// TODO: scan for next page
 		if bw, err := db.file.ReadAt(buf[:], 0); err == nil && bw == len(buf) {
 			if m := db.pageInBuffer(buf[:], 0).meta(); m.validate() == nil {
+				if options.PageSize != 0 && int(m.pageSize) != options.PageSize {
+					_ = db.close()
+					return nil, ErrPageSizeMismatch
+				}
 				db.pageSize = int(m.pageSize)
 			}
 		} else {
@@ -279,15 +568,26 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 		return nil, err
 	}
 
+	db.resetChanges(db.meta().txid)
+	db.committedTxid = db.changedSince
+
 	if db.readOnly {
 		return db, nil
 	}
 
+	if options.PreallocateFile {
+		if err := db.preallocate(options.InitialMmapSize); err != nil {
+			_ = db.close()
+			return nil, err
+		}
+	}
+
 	db.loadFreelist()
 
 	// Flush freelist when transitioning from no sync to sync so
 	// NoFreelistSync unaware boltdb can open the db later.
 	if !db.NoFreelistSync && !db.hasSyncedFreelist() {
+		db.Logger().Debugf("writing out freelist of %s which was not synced", db.path)
 		tx, err := db.Begin(true)
 		if tx != nil {
 			err = tx.Commit()
@@ -299,24 +599,207 @@ func Open(path string, mode os.FileMode, options *Options) (*DB, error) {
 	}
 
 	// Mark the database as opened and return.
+	db.Logger().Debugf("opened %s (page size %d, read-only %t)", db.path, db.pageSize, db.readOnly)
 	return db, nil
 }
 
+// OpenReaderAt opens a read-only database whose size bytes are read from r,
+// for example a database embedded in an archive or stored in a remote blob.
+// Pages are read through r when they are first accessed instead of being
+// memory mapped, and kept in memory until the database is closed. Only the
+// page size, PageChecksums, ValueSafetyChecks, PreferMeta, EncryptionKey,
+// Logger, Observer, KeyComparator and OpenFile options apply; OpenFile is used to create copies with Tx.CopyFile.
+//
+// Begin(true) and Update return ErrDatabaseReadOnly and Path returns an empty
+// string. Reads from r must not fail once the database is open: a failed read
+// of a page panics, like a failed access to a memory mapped file does.
+func OpenReaderAt(r io.ReaderAt, size int64, options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	db := &DB{
+		opened:    true,
+		readOnly:  true,
+		readerAt:  r,
+		pageCache: make(map[pgid][]byte),
+	}
+	db.options = *options
+	db.PageChecksums = options.PageChecksums
+	db.ValueSafetyChecks = options.ValueSafetyChecks
+	db.preferMeta = options.PreferMeta
+	db.logger = options.Logger
+	db.observer = options.Observer
+	db.compare = options.KeyComparator
+	if err := db.setEncryptionKey(options.EncryptionKey); err != nil {
+		return nil, err
+	}
+	db.openFile = options.OpenFile
+	if db.openFile == nil {
+		db.openFile = os.OpenFile
+	}
+	db.MaxBatchSize = DefaultMaxBatchSize
+	db.MaxBatchDelay = DefaultMaxBatchDelay
+	db.AllocSize = DefaultAllocSize
+
+	// Read the first meta page to determine the page size, like Open.
+	if db.pageSize = options.PageSize; db.pageSize == 0 {
+		db.pageSize = defaultPageSize
+	}
+	var buf [0x1000]byte
+	if size < int64(len(buf)) {
+		return nil, ErrInvalid
+	} else if _, err := r.ReadAt(buf[:], 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if m := db.pageInBuffer(buf[:], 0).meta(); m.validate() == nil {
+		if options.PageSize != 0 && int(m.pageSize) != options.PageSize {
+			return nil, ErrPageSizeMismatch
+		}
+		db.pageSize = int(m.pageSize)
+	}
+	if size < int64(db.pageSize*2) {
+		return nil, fmt.Errorf("file size too small")
+	}
+	db.datasz = int(size)
+
+	db.pagePool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, db.pageSize)
+		},
+	}
+
+	// The meta pages are read through r now, so an unreadable database is
+	// reported here rather than by a panic in the first transaction.
+	for id := pgid(0); id <= 1; id++ {
+		if _, err := db.readPage(id); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.loadMeta(); err != nil {
+		return nil, err
+	}
+
+	db.resetChanges(db.meta().txid)
+	db.committedTxid = db.changedSince
+
+	db.Logger().Debugf("opened database from reader (page size %d)", db.pageSize)
+	return db, nil
+}
+
+// OpenInMemory creates a database which is kept in memory instead of a file.
+// Its data is lost when it is closed, but it can be saved with Tx.WriteTo
+// and reopened from the copy with Open. Syncing is skipped. The page size,
+// InitialMmapSize, FreelistType, NoFreelistSync, RebalanceThreshold,
+// PageChecksums, ValueSafetyChecks, Compression, CompressionThreshold,
+// MaxKeySize, MaxValueSize, EncryptionKey, Logger, Observer, KeyComparator,
+// UseArena, TrackChanges and OpenFile options apply; OpenFile is used to create copies with Tx.CopyFile.
+//
+// As when a file is remapped, the data is copied to a larger buffer when the
+// database grows, so set InitialMmapSize to avoid copying large databases.
+func OpenInMemory(options *Options) (*DB, error) {
+	if options == nil {
+		options = DefaultOptions
+	}
+	db := &DB{
+		opened: true,
+		memory: []byte{},
+	}
+	db.options = *options
+	db.RebalanceThreshold = options.RebalanceThreshold
+	db.PageChecksums = options.PageChecksums
+	db.ValueSafetyChecks = options.ValueSafetyChecks
+	db.Compression = options.Compression
+	db.CompressionThreshold = options.CompressionThreshold
+	db.MaxKeySize = options.MaxKeySize
+	db.MaxValueSize = options.MaxValueSize
+	db.NoFreelistSync = options.NoFreelistSync
+	db.FreelistType = options.FreelistType
+	db.logger = options.Logger
+	db.observer = options.Observer
+	db.compare = options.KeyComparator
+	db.useArena = options.UseArena
+	if err := db.setEncryptionKey(options.EncryptionKey); err != nil {
+		return nil, err
+	}
+	db.openFile = options.OpenFile
+	if db.openFile == nil {
+		db.openFile = os.OpenFile
+	}
+	db.MaxBatchSize = DefaultMaxBatchSize
+	db.MaxBatchDelay = DefaultMaxBatchDelay
+	db.AllocSize = DefaultAllocSize
+	db.ops.writeAt = db.writeMemory
+
+	if db.pageSize = options.PageSize; db.pageSize == 0 {
+		db.pageSize = defaultPageSize
+	}
+	db.pagePool = sync.Pool{
+		New: func() interface{} {
+			return make([]byte, db.pageSize)
+		},
+	}
+
+	// Allocate the data, write the initial pages into it and load them.
+	minsz := options.InitialMmapSize
+	if minsz < db.pageSize*4 {
+		minsz = db.pageSize * 4
+	}
+	size, err := db.mmapSize(minsz)
+	if err != nil {
+		return nil, err
+	}
+	db.memory = make([]byte, size)
+	db.datasz = size
+	if err := db.init(); err != nil {
+		return nil, err
+	}
+	if err := db.loadMeta(); err != nil {
+		return nil, err
+	}
+
+	db.resetChanges(db.meta().txid)
+	db.committedTxid = db.changedSince
+	db.loadFreelist()
+
+	db.Logger().Debugf("opened in-memory database (page size %d)", db.pageSize)
+	return db, nil
+}
+
+// writeMemory writes b to the data of an in-memory database. The meta pages
+// are written under metalock so that transactions being started never copy a
+// partially written meta page.
+func (db *DB) writeMemory(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > int64(len(db.memory)) {
+		return 0, fmt.Errorf("write beyond end of in-memory database")
+	}
+	if off < int64(db.pageSize*2) {
+		db.metalock.Lock()
+		defer db.metalock.Unlock()
+	}
+	return copy(db.memory[off:], b), nil
+}
+
 // loadFreelist reads the freelist if it is synced, or reconstructs it
 // by scanning the DB if it is not synced. It assumes there are no
 // concurrent accesses being made to the freelist.
 func (db *DB) loadFreelist() {
-	db.freelistLoad.Do(func() {
-		db.freelist = newFreelist(db.FreelistType)
-		if !db.hasSyncedFreelist() {
-			// Reconstruct free list by scanning the DB.
-			db.freelist.readIDs(db.freepages())
-		} else {
-			// Read free list from freelist page.
-			db.freelist.read(db.page(db.meta().freelist))
-		}
-		db.stats.FreePageN = db.freelist.free_count()
-	})
+	db.freelistLoad.Do(db.readFreelist)
+}
+
+// readFreelist replaces the freelist with the one of the current meta page.
+func (db *DB) readFreelist() {
+	db.freelist = newFreelist(db.FreelistType)
+	if !db.hasSyncedFreelist() {
+		// Reconstruct free list by scanning the DB.
+		db.Logger().Debugf("freelist is not synced, rebuilding it by scanning %s", db.path)
+		db.freelist.readIDs(db.freepages())
+	} else {
+		// Read free list from freelist page.
+		db.freelist.read(db.page(db.meta().freelist))
+	}
+	db.stats.FreePageN = db.freelist.free_count()
+	spanN, largest := db.freelist.freeSpans()
+	db.stats.setFreeSpans(spanN, largest, db.stats.FreePageN)
 }
 
 func (db *DB) hasSyncedFreelist() bool {
@@ -329,23 +812,30 @@ func (db *DB) mmap(minsz int) error {
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
-	info, err := db.file.Stat()
-	if err != nil {
-		return fmt.Errorf("mmap stat error: %s", err)
-	} else if int(info.Size()) < db.pageSize*2 {
-		return fmt.Errorf("file size too small")
+	var size int
+	if db.memory != nil {
+		size = len(db.memory)
+	} else {
+		info, err := db.file.Stat()
+		if err != nil {
+			return fmt.Errorf("mmap stat error: %s", err)
+		} else if int(info.Size()) < db.pageSize*2 {
+			return fmt.Errorf("file size too small")
+		}
+		size = int(info.Size())
 	}
 
 	// Ensure the size is at least the minimum size.
-	var size = int(info.Size())
 	if size < minsz {
 		size = minsz
 	}
-	size, err = db.mmapSize(size)
+	size, err := db.mmapSize(size)
 	if err != nil {
 		return err
 	}
 
+	db.Logger().Debugf("mapping %d bytes of %s (previously %d bytes)", size, db.path, db.datasz)
+
 	// Dereference all mmap references before unmapping.
 	if db.rwtx != nil {
 		db.rwtx.root.dereference()
@@ -356,12 +846,27 @@ func (db *DB) mmap(minsz int) error {
 		return err
 	}
 
+	// Move the data of an in-memory database to a larger buffer, which is
+	// safe because no transaction but the writer references the old one.
+	if db.memory != nil {
+		memory := make([]byte, size)
+		copy(memory, db.memory)
+		db.memory = memory
+		db.datasz = size
+		return db.loadMeta()
+	}
+
 	// Memory-map the data file as a byte slice.
 	if err := mmap(db, size); err != nil {
+		db.Logger().Errorf("failed to map %d bytes of %s: %v", size, db.path, err)
 		return err
 	}
 
-	// Save references to the meta pages.
+	return db.loadMeta()
+}
+
+// loadMeta saves references to the meta pages and validates them.
+func (db *DB) loadMeta() error {
 	db.meta0 = db.page(0).meta()
 	db.meta1 = db.page(1).meta()
 
@@ -374,6 +879,53 @@ func (db *DB) mmap(minsz int) error {
 		return err0
 	}
 
+	// Report falling back to the older meta page here, rather than in meta,
+	// which runs for every transaction.
+	newer, errNewer, older := db.meta0, err0, db.meta1
+	if db.meta1.txid > db.meta0.txid {
+		newer, errNewer, older = db.meta1, err1, db.meta0
+	}
+	if errNewer != nil && db.preferMeta == 0 {
+		db.Logger().Warnf("meta page of txid %d is invalid (%v), falling back to txid %d", newer.txid, errNewer, older.txid)
+	}
+
+	// A preferred meta page must exist and be valid itself.
+	if db.preferMeta != 0 {
+		if m := db.preferredMeta(); m == nil {
+			return ErrMetaNotFound
+		}
+	}
+
+	// Refuse features this version does not support in either meta page,
+	// rather than falling back to the older one and overwriting the newer.
+	for _, m := range []*meta{db.meta0, db.meta1} {
+		if m.validate() == nil {
+			if err := m.checkFeatures(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Keys ordered by a KeyComparator cannot be found without it.
+	if db.meta().flags&featureCustomComparator != 0 && db.compare == nil {
+		return ErrKeyComparatorRequired
+	}
+
+	return db.loadEncryption()
+}
+
+// preferredMeta returns the valid meta page selected by Options.PreferMeta,
+// or nil if there is none.
+func (db *DB) preferredMeta() *meta {
+	for i, m := range []*meta{db.meta0, db.meta1} {
+		selected := m.txid == txid(db.preferMeta)
+		if db.preferMeta < 0 {
+			selected = db.preferMeta == PreferMetaPage0-i
+		}
+		if selected && m.validate() == nil {
+			return m
+		}
+	}
 	return nil
 }
 
@@ -424,6 +976,18 @@ func (db *DB) mmapSize(size int) (int, error) {
 
 // init creates a new database file and initializes its meta pages.
 func (db *DB) init() error {
+	// Encrypted databases get a new salt.
+	var enc encryption
+	if db.encryptionKey != nil {
+		var err error
+		if enc, err = newEncryption(db.encryptionKey); err != nil {
+			return err
+		}
+		if db.cipher, err = newPageCipher(db.encryptionKey, &enc); err != nil {
+			return err
+		}
+	}
+
 	// Create two meta pages on a buffer.
 	buf := make([]byte, db.pageSize*4)
 	for i := 0; i < 2; i++ {
@@ -440,6 +1004,15 @@ func (db *DB) init() error {
 		m.root = bucket{root: 3}
 		m.pgid = 4
 		m.txid = txid(i)
+		if db.cipher != nil {
+			m.version = featuresVersion
+			m.flags = featureEncryption
+			m.encryption = enc
+		}
+		if db.compare != nil {
+			m.version = featuresVersion
+			m.flags |= featureCustomComparator
+		}
 		m.checksum = m.sum64()
 	}
 
@@ -455,11 +1028,21 @@ func (db *DB) init() error {
 	p.flags = leafPageFlag
 	p.count = 0
 
+	// Encrypt the freelist and leaf pages.
+	for id := 2; id < 4; id++ {
+		data := buf[id*db.pageSize : (id+1)*db.pageSize]
+		sealed, err := db.sealPages(data)
+		if err != nil {
+			return err
+		}
+		copy(data, sealed)
+	}
+
 	// Write the buffer to our data file.
 	if _, err := db.ops.writeAt(buf, 0); err != nil {
 		return err
 	}
-	if err := fdatasync(db); err != nil {
+	if err := db.syncData(); err != nil {
 		return err
 	}
 
@@ -473,13 +1056,99 @@ func (db *DB) Close() error {
 	db.rwlock.Lock()
 	defer db.rwlock.Unlock()
 
+	// Compact before closing, while the writer lock keeps out new commits.
+	cerr := db.compactOnClose()
+
 	db.metalock.Lock()
 	defer db.metalock.Unlock()
 
 	db.mmaplock.Lock()
 	defer db.mmaplock.Unlock()
 
-	return db.close()
+	if err := db.close(); err != nil {
+		return err
+	}
+	return cerr
+}
+
+// compactOnCloseTxMaxSize limits the size of the transactions which copy the
+// database when it is compacted on close.
+const compactOnCloseTxMaxSize = 64 << 20
+
+// compactOnClose compacts the database into a new file next to the data file
+// if CompactOnClose is set and enough pages are free, and renames it over the
+// data file, which is still locked. The writer lock must be held.
+func (db *DB) compactOnClose() error {
+	if !db.CompactOnClose || !db.opened || db.readOnly || db.file == nil {
+		return nil
+	}
+	free := int64(db.freelist.free_count()+db.freelist.pending_count()) * int64(db.pageSize)
+	if free <= db.CompactThresholdBytes {
+		return nil
+	}
+	db.Logger().Debugf("compacting %s on close (%d bytes free)", db.path, free)
+
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(db.path), filepath.Base(db.path)+".compact-")
+	if err != nil {
+		return err
+	}
+	path := f.Name()
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	var dst *DB
+	err = db.View(func(tx *Tx) (err error) {
+		dst, err = tx.compactTo(path, info.Mode(), compactOnCloseTxMaxSize)
+		return err
+	})
+	if err == nil {
+		err = dst.Sync()
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		db.Logger().Errorf("failed to compact %s on close: %v", db.path, err)
+		_ = os.Remove(path)
+		return err
+	}
+	if err := os.Rename(path, db.path); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	return syncDir(filepath.Dir(db.path))
+}
+
+// compactTo compacts the database as seen by tx into the empty file at path,
+// committing every txMaxSize bytes, and returns the compacted database, which
+// the caller must close. It is not synced.
+func (tx *Tx) compactTo(path string, mode os.FileMode, txMaxSize int64) (*DB, error) {
+	if err := os.Chmod(path, mode); err != nil {
+		return nil, err
+	}
+	// The compacted database is written with the settings of this one, but
+	// synced only once it is complete.
+	db := tx.db
+	o := db.Options()
+	o.ReadOnly, o.NoLock, o.PreferMeta = false, false, 0
+	o.NoSync, o.SyncMode, o.SyncInterval, o.SyncBytes = true, SyncData, 0, 0
+	o.CompactOnClose, o.WALMode, o.Observer = false, false, nil
+	o.OpenFile = db.openFile
+	o.EncryptionKey = db.encryptionKey
+	dst, err := Open(path, mode, &o)
+	if err != nil {
+		return nil, err
+	}
+	if err := compactTx(dst, tx, txMaxSize); err != nil {
+		_ = dst.Close()
+		return nil, err
+	}
+	return dst, nil
 }
 
 func (db *DB) close() error {
@@ -489,7 +1158,25 @@ func (db *DB) close() error {
 
 	db.opened = false
 
+	// Wake up WaitForTxID, which fails from now on.
+	db.txidlock.Lock()
+	db.txidClosed = true
+	db.wakeTxIDWaiters()
+	db.txidlock.Unlock()
+
+	// Sync the commits left by group commit before the file is closed.
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	if db.wal != nil {
+		if err := db.closeWAL(); err != nil {
+			return err
+		}
+	}
+
 	db.freelist = nil
+	db.pageCache = nil
+	db.memory = nil
 
 	// Clear ops.
 	db.ops.writeAt = nil
@@ -520,6 +1207,58 @@ func (db *DB) close() error {
 	return nil
 }
 
+// TxID returns the id of the last committed transaction.
+func (db *DB) TxID() uint64 {
+	db.txidlock.Lock()
+	defer db.txidlock.Unlock()
+	return uint64(db.committedTxid)
+}
+
+// WaitForTxID blocks until a transaction with an id of at least id has
+// committed, so that transactions begun afterwards see its changes. It
+// returns the error of ctx if ctx is done first and ErrDatabaseNotOpen if the
+// database is closed.
+func (db *DB) WaitForTxID(ctx context.Context, id uint64) error {
+	for {
+		db.txidlock.Lock()
+		if db.txidClosed {
+			db.txidlock.Unlock()
+			return ErrDatabaseNotOpen
+		} else if uint64(db.committedTxid) >= id {
+			db.txidlock.Unlock()
+			return nil
+		}
+		if db.txidChanged == nil {
+			db.txidChanged = make(chan struct{})
+		}
+		changed := db.txidChanged
+		db.txidlock.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setTxID records id as the last committed transaction.
+func (db *DB) setTxID(id txid) {
+	db.txidlock.Lock()
+	db.committedTxid = id
+	db.wakeTxIDWaiters()
+	db.txidlock.Unlock()
+}
+
+// wakeTxIDWaiters wakes up all calls to WaitForTxID so they check again.
+// txidlock must be held.
+func (db *DB) wakeTxIDWaiters() {
+	if db.txidChanged != nil {
+		close(db.txidChanged)
+		db.txidChanged = nil
+	}
+}
+
 // Begin starts a new transaction.
 // Multiple read-only transactions can be used concurrently but only one
 // write transaction can be used at a time. Starting multiple write transactions
@@ -538,22 +1277,40 @@ func (db *DB) close() error {
 // IMPORTANT: You must close read-only transactions after you are finished or
 // else the database will not reclaim old pages.
 func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.BeginTxContext(context.Background(), writable)
+}
+
+// BeginTxContext starts a new transaction like Begin, but gives up waiting
+// for the locks needed to start it once ctx is done. In that case the error
+// of ctx is returned. Only the wait is bound to ctx; the transaction itself
+// is not cancelled when ctx is done afterwards.
+func (db *DB) BeginTxContext(ctx context.Context, writable bool) (t *Tx, err error) {
 	if writable {
-		return db.beginRWTx()
+		t, err = db.beginRWTx(ctx)
+	} else {
+		t, err = db.beginTx(ctx)
+	}
+	if err == nil {
+		db.getObserver().OnTxBegin(writable)
 	}
-	return db.beginTx()
+	return t, err
 }
 
-func (db *DB) beginTx() (*Tx, error) {
+func (db *DB) beginTx(ctx context.Context) (*Tx, error) {
 	// Lock the meta pages while we initialize the transaction. We obtain
 	// the meta lock before the mmap lock because that's the order that the
 	// write transaction will obtain them.
-	db.metalock.Lock()
+	if err := lockContext(ctx, &db.metalock); err != nil {
+		return nil, err
+	}
 
 	// Obtain a read-only lock on the mmap. When the mmap is remapped it will
 	// obtain a write lock so all transactions must finish before it can be
 	// remapped.
-	db.mmaplock.RLock()
+	if err := lockContext(ctx, db.mmaplock.RLocker()); err != nil {
+		db.metalock.Unlock()
+		return nil, err
+	}
 
 	// Exit if the database is not open yet.
 	if !db.opened {
@@ -582,7 +1339,7 @@ func (db *DB) beginTx() (*Tx, error) {
 	return t, nil
 }
 
-func (db *DB) beginRWTx() (*Tx, error) {
+func (db *DB) beginRWTx(ctx context.Context) (*Tx, error) {
 	// If the database was opened with Options.ReadOnly, return an error.
 	if db.readOnly {
 		return nil, ErrDatabaseReadOnly
@@ -590,11 +1347,16 @@ func (db *DB) beginRWTx() (*Tx, error) {
 
 	// Obtain writer lock. This is released by the transaction when it closes.
 	// This enforces only one writer transaction at a time.
-	db.rwlock.Lock()
+	if err := lockContext(ctx, &db.rwlock); err != nil {
+		return nil, err
+	}
 
 	// Once we have the writer lock then we can lock the meta pages so that
 	// we can set up the transaction.
-	db.metalock.Lock()
+	if err := lockContext(ctx, &db.metalock); err != nil {
+		db.rwlock.Unlock()
+		return nil, err
+	}
 	defer db.metalock.Unlock()
 
 	// Exit if the database is not open yet.
@@ -611,21 +1373,66 @@ func (db *DB) beginRWTx() (*Tx, error) {
 	return t, nil
 }
 
+// lockContext acquires l unless ctx is done first, in which case the error of
+// ctx is returned and l is released as soon as the pending acquisition
+// completes.
+func lockContext(ctx context.Context, l sync.Locker) error {
+	// Contexts which are never done can simply wait for the lock.
+	if ctx.Done() == nil {
+		l.Lock()
+		return nil
+	} else if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
 // freePages releases any pages associated with closed read-only transactions.
 func (db *DB) freePages() {
-	// Free all pending pages prior to earliest open transaction.
 	sort.Sort(txsById(db.txs))
+	ids := make([]txid, 0, len(db.txs)+1)
+	for _, t := range db.txs {
+		ids = append(ids, t.meta.txid)
+	}
+
+	// Until group commit syncs the meta pages written since its last sync, a
+	// power failure may leave either of the meta pages synced before, so the
+	// pages they point at are kept like those of an open transaction.
+	db.synclock.Lock()
+	if db.unsyncedBytes > 0 {
+		ids = append(ids, db.syncedTxid-1)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+	db.synclock.Unlock()
+
+	// Free all pending pages prior to earliest open transaction.
 	minid := txid(0xFFFFFFFFFFFFFFFF)
-	if len(db.txs) > 0 {
-		minid = db.txs[0].meta.txid
+	if len(ids) > 0 {
+		minid = ids[0]
 	}
 	if minid > 0 {
 		db.freelist.release(minid - 1)
 	}
 	// Release unused txid extents.
-	for _, t := range db.txs {
-		db.freelist.releaseRange(minid, t.meta.txid-1)
-		minid = t.meta.txid + 1
+	for _, id := range ids {
+		db.freelist.releaseRange(minid, id-1)
+		minid = id + 1
 	}
 	db.freelist.releaseRange(minid, txid(0xFFFFFFFFFFFFFFFF))
 	// Any page both allocated and freed in an extent is safe to release.
@@ -732,6 +1539,70 @@ func (db *DB) View(fn func(*Tx) error) error {
 	return t.Rollback()
 }
 
+// SafeView is like View, but recovers from a panic raised while fn runs and
+// returns it as a *PanicError. Decoding a corrupted page can index out of
+// bounds or fail an assertion, which View lets crash the process. Faults on
+// the memory map of the calling goroutine are turned into panics for the
+// duration of the call as well, with debug.SetPanicOnFault.
+//
+// Panics raised by fn itself are returned the same way, and panics in other
+// goroutines are not recovered. Reading the corrupted page again fails again,
+// but the rest of the database remains usable.
+func (db *DB) SafeView(fn func(*Tx) error) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+
+	var t *Tx
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{Value: r}
+			if t != nil {
+				t.cursorlock.Lock()
+				perr.PageID = uint64(t.lastPage)
+				t.cursorlock.Unlock()
+			}
+			err = perr
+		}
+	}()
+
+	return db.View(func(tx *Tx) error {
+		t = tx
+		tx.trackPages = true
+		return fn(tx)
+	})
+}
+
+// PanicError is returned by SafeView when reading the database panicked.
+type PanicError struct {
+	// PageID is the page read last before the panic, which is most likely
+	// the corrupted one.
+	PageID uint64
+
+	// Value is the value the panic was raised with.
+	Value interface{}
+}
+
+// Error returns a description of the panic.
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic reading page %d: %v", e.PageID, e.Value)
+}
+
+// Buckets returns the names of all top-level buckets in a read-only
+// transaction. Keys at the top level which are not buckets are skipped. The
+// returned names are copies and remain valid after the call.
+func (db *DB) Buckets() ([][]byte, error) {
+	var names [][]byte
+	err := db.View(func(tx *Tx) error {
+		return tx.root.ForEachBucket(func(k []byte) error {
+			names = append(names, cloneBytes(k))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
 // Batch calls fn as part of a batch. It behaves similar to Update,
 // except:
 //
@@ -746,7 +1617,8 @@ func (db *DB) View(fn func(*Tx) error) error {
 // caller.
 //
 // The maximum batch size and delay can be adjusted with DB.MaxBatchSize
-// and DB.MaxBatchDelay, respectively.
+// and DB.MaxBatchDelay, respectively, or with SetBatchParams while Batch
+// may be running.
 //
 // Batch is only useful when there are multiple goroutines calling it.
 func (db *DB) Batch(fn func(*Tx) error) error {
@@ -774,6 +1646,42 @@ func (db *DB) Batch(fn func(*Tx) error) error {
 	return err
 }
 
+// SetBatchParams sets MaxBatchSize and MaxBatchDelay. It is safe to call
+// concurrently with Batch. Batches which have already started keep the
+// delay they were started with.
+func (db *DB) SetBatchParams(size int, delay time.Duration) {
+	db.batchMu.Lock()
+	defer db.batchMu.Unlock()
+	db.MaxBatchSize = size
+	db.MaxBatchDelay = delay
+}
+
+// SetNoFreelistSync sets NoFreelistSync. It waits for the current write
+// transaction, if any, so that no commit sees the change half way through.
+//
+// Turning freelist syncing back on writes out the freelist straight away if
+// the last commit skipped it, so that the file no longer needs a full scan
+// when it is opened.
+func (db *DB) SetNoFreelistSync(noFreelistSync bool) error {
+	db.rwlock.Lock()
+	db.NoFreelistSync = noFreelistSync
+	db.rwlock.Unlock()
+
+	if noFreelistSync || db.readOnly {
+		return nil
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if tx.meta.freelist != pgidNoFreelist {
+		return tx.Rollback()
+	}
+	db.Logger().Debugf("writing out freelist of %s which was not synced", db.path)
+	return tx.Commit()
+}
+
 type call struct {
 	fn  func(*Tx) error
 	err chan<- error
@@ -860,11 +1768,82 @@ func safelyCall(fn func(*Tx) error, tx *Tx) (err error) {
 	return fn(tx)
 }
 
-// Sync executes fdatasync() against the database file handle.
+// Sync flushes the database file to disk as selected by SyncMode, which
+// executes fdatasync() by default. SyncNone does not apply.
 //
 // This is not necessary under normal operation, however, if you use NoSync
 // then it allows you to force the database file to sync against the disk.
-func (db *DB) Sync() error { return fdatasync(db) }
+func (db *DB) Sync() error { return db.syncData() }
+
+// syncData flushes written data to the file as selected by SyncMode, except
+// for in-memory databases which have no file to sync.
+func (db *DB) syncData() error {
+	if db.memory != nil {
+		return nil
+	} else if db.SyncMode == SyncFull {
+		return db.file.Sync()
+	}
+	return fdatasync(db)
+}
+
+// noSync returns whether commits skip syncing, because of NoSync or
+// SyncNone.
+func (db *DB) noSync() bool {
+	return (db.NoSync || db.SyncMode == SyncNone) && !IgnoreNoSync
+}
+
+// Flush syncs the commits which were not synced yet because of group commit,
+// see SyncInterval and SyncBytes. It does nothing if there are none.
+func (db *DB) Flush() error {
+	db.synclock.Lock()
+	defer db.synclock.Unlock()
+	return db.flush()
+}
+
+// flush syncs the pending commits of group commit. synclock must be held.
+func (db *DB) flush() error {
+	if db.syncTimer != nil {
+		db.syncTimer.Stop()
+		db.syncTimer = nil
+	}
+	if db.unsyncedBytes == 0 {
+		return nil
+	}
+	if err := db.syncData(); err != nil {
+		return err
+	}
+	db.unsyncedBytes = 0
+	return nil
+}
+
+// groupCommit returns whether commits leave syncing to group commit.
+func (db *DB) groupCommit() bool {
+	return (db.SyncInterval > 0 || db.SyncBytes > 0) && !db.noSync()
+}
+
+// deferSync records a commit of n bytes whose meta page was not synced, and
+// syncs it if SyncBytes is reached or schedules a sync after SyncInterval.
+func (db *DB) deferSync(id txid, n int) error {
+	db.synclock.Lock()
+	defer db.synclock.Unlock()
+
+	if db.unsyncedBytes == 0 {
+		// The commit before was synced.
+		db.syncedTxid = id - 1
+	}
+	db.unsyncedBytes += n
+	if db.SyncBytes > 0 && db.unsyncedBytes >= db.SyncBytes {
+		return db.flush()
+	}
+	if db.SyncInterval > 0 && db.syncTimer == nil {
+		db.syncTimer = time.AfterFunc(db.SyncInterval, func() {
+			if err := db.Flush(); err != nil {
+				db.Logger().Errorf("failed to sync %s: %v", db.path, err)
+			}
+		})
+	}
+	return nil
+}
 
 // Stats retrieves ongoing performance stats for the database.
 // This is only updated when a transaction closes.
@@ -877,15 +1856,83 @@ func (db *DB) Stats() Stats {
 // This is for internal access to the raw data bytes from the C cursor, use
 // carefully, or not at all.
 func (db *DB) Info() *Info {
+	if db.data == nil {
+		return &Info{0, db.pageSize}
+	}
 	return &Info{uintptr(unsafe.Pointer(&db.data[0])), db.pageSize}
 }
 
 // page retrieves a page reference from the mmap based on the current page size.
+// Pages of encrypted databases are decrypted into a new buffer on every call,
+// and a page which cannot be decrypted panics like a corrupted page does.
 func (db *DB) page(id pgid) *page {
+	p, err := db.openPage(id)
+	if err != nil {
+		panic(fmt.Sprintf("page %d: %s", id, err))
+	}
+	return p
+}
+
+// rawPage retrieves a page reference from the mmap as it is stored, which is
+// encrypted for encrypted databases apart from the page header.
+func (db *DB) rawPage(id pgid) *page {
+	if db.readerAt != nil {
+		p, err := db.readPage(id)
+		if err != nil {
+			panic(fmt.Sprintf("read page %d: %s", id, err))
+		}
+		return p
+	}
 	pos := id * pgid(db.pageSize)
+	if db.memory != nil {
+		return (*page)(unsafe.Pointer(&db.memory[pos]))
+	}
 	return (*page)(unsafe.Pointer(&db.data[pos]))
 }
 
+// readPage returns page id of a database opened with OpenReaderAt, reading it
+// and its overflow pages through the ReaderAt if it was not read before.
+func (db *DB) readPage(id pgid) (*page, error) {
+	db.pagelock.Lock()
+	defer db.pagelock.Unlock()
+	if buf, ok := db.pageCache[id]; ok {
+		return (*page)(unsafe.Pointer(&buf[0])), nil
+	}
+
+	off := int64(id) * int64(db.pageSize)
+	if off+int64(db.pageSize) > int64(db.datasz) {
+		return nil, fmt.Errorf("page %d beyond end of database", id)
+	}
+	buf := make([]byte, db.pageSize)
+	if err := db.readAt(buf, off); err != nil {
+		return nil, err
+	}
+	if overflow := (*page)(unsafe.Pointer(&buf[0])).overflow; overflow > 0 {
+		n := (int64(overflow) + 1) * int64(db.pageSize)
+		if off+n > int64(db.datasz) {
+			return nil, fmt.Errorf("page %d beyond end of database", id)
+		}
+		buf = append(buf, make([]byte, n-int64(db.pageSize))...)
+		if err := db.readAt(buf[db.pageSize:], off+int64(db.pageSize)); err != nil {
+			return nil, err
+		}
+	}
+	db.pageCache[id] = buf
+	return (*page)(unsafe.Pointer(&buf[0])), nil
+}
+
+// readAt fills buf from the ReaderAt of the database, which may return io.EOF
+// together with the final bytes.
+func (db *DB) readAt(buf []byte, off int64) error {
+	n, err := db.readerAt.ReadAt(buf, off)
+	if n == len(buf) {
+		return nil
+	} else if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // pageInBuffer retrieves a page reference from a given byte array based on the current page size.
 func (db *DB) pageInBuffer(b []byte, id pgid) *page {
 	return (*page)(unsafe.Pointer(&b[id*pgid(db.pageSize)]))
@@ -893,6 +1940,12 @@ func (db *DB) pageInBuffer(b []byte, id pgid) *page {
 
 // meta retrieves the current meta page reference.
 func (db *DB) meta() *meta {
+	if db.preferMeta != 0 {
+		if m := db.preferredMeta(); m != nil {
+			return m
+		}
+	}
+
 	// We have to return the meta with the highest txid which doesn't fail
 	// validation. Otherwise, we can cause errors when in fact the database is
 	// in a consistent state. metaA is the one with the higher txid.
@@ -904,7 +1957,8 @@ func (db *DB) meta() *meta {
 	}
 
 	// Use higher meta page if valid. Otherwise fallback to previous, if valid.
-	if err := metaA.validate(); err == nil {
+	errA := metaA.validate()
+	if errA == nil {
 		return metaA
 	} else if err := metaB.validate(); err == nil {
 		return metaB
@@ -915,6 +1969,24 @@ func (db *DB) meta() *meta {
 	panic("bolt.DB.meta(): invalid meta pages")
 }
 
+// Logger returns the logger used for diagnostic messages. It never returns
+// nil.
+func (db *DB) Logger() Logger {
+	if db.logger == nil {
+		return discardLogger{}
+	}
+	return db.logger
+}
+
+// getObserver returns the Observer set in Options, or one which ignores all
+// events.
+func (db *DB) getObserver() Observer {
+	if db.observer == nil {
+		return discardObserver{}
+	}
+	return db.observer
+}
+
 // allocate returns a contiguous block of memory starting at a given page.
 func (db *DB) allocate(txid txid, count int) (*page, error) {
 	// Allocate a temporary buffer for the page.
@@ -939,6 +2011,10 @@ func (db *DB) allocate(txid txid, count int) (*page, error) {
 		if err := db.mmap(minsz); err != nil {
 			return nil, fmt.Errorf("mmap allocate error: %s", err)
 		}
+		db.statlock.Lock()
+		db.stats.RemapN++
+		db.statlock.Unlock()
+		db.getObserver().OnMmapGrow(int64(db.datasz))
 	}
 
 	// Move the page id high water mark.
@@ -964,7 +2040,7 @@ func (db *DB) grow(sz int) error {
 
 	// Truncate and fsync to ensure file size metadata is flushed.
 	// https://github.com/boltdb/bolt/issues/284
-	if !db.NoGrowSync && !db.readOnly {
+	if !db.NoGrowSync && !db.readOnly && db.memory == nil {
 		if runtime.GOOS != "windows" {
 			if err := db.file.Truncate(int64(sz)); err != nil {
 				return fmt.Errorf("file resize error: %s", err)
@@ -979,12 +2055,67 @@ func (db *DB) grow(sz int) error {
 	return nil
 }
 
+// preallocate grows the data file to at least sz bytes and syncs its size.
+func (db *DB) preallocate(sz int) error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if int64(sz) <= info.Size() {
+		db.filesz = int(info.Size())
+		return nil
+	}
+
+	// Windows extends the file when mapping it instead.
+	if runtime.GOOS != "windows" {
+		if err := db.file.Truncate(int64(sz)); err != nil {
+			return fmt.Errorf("file resize error: %s", err)
+		}
+	}
+	if err := db.file.Sync(); err != nil {
+		return fmt.Errorf("file sync error: %s", err)
+	}
+	db.filesz = sz
+	return nil
+}
+
+// IsReadOnly returns true if the database was opened read-only, in which case
+// Begin(true) and Update return ErrDatabaseReadOnly.
 func (db *DB) IsReadOnly() bool {
 	return db.readOnly
 }
 
+// Options returns the options the database was opened with, updated with the
+// current values of the DB fields they set, the page size of the database and
+// whether it is read-only. EncryptionKey is not returned.
+func (db *DB) Options() Options {
+	o := db.options
+	o.ReadOnly = db.readOnly
+	o.PageSize = db.pageSize
+	o.NoSync = db.NoSync
+	o.SyncMode = db.SyncMode
+	o.SyncInterval = db.SyncInterval
+	o.SyncBytes = db.SyncBytes
+	o.NoGrowSync = db.NoGrowSync
+	o.NoFreelistSync = db.NoFreelistSync
+	o.FreelistType = db.FreelistType
+	o.MmapFlags = db.MmapFlags
+	o.AccessPattern = db.AccessPattern
+	o.CompactOnClose = db.CompactOnClose
+	o.CompactThresholdBytes = db.CompactThresholdBytes
+	o.RebalanceThreshold = db.RebalanceThreshold
+	o.PageChecksums = db.PageChecksums
+	o.ValueSafetyChecks = db.ValueSafetyChecks
+	o.Compression = db.Compression
+	o.CompressionThreshold = db.CompressionThreshold
+	o.MaxKeySize = db.MaxKeySize
+	o.MaxValueSize = db.MaxValueSize
+	o.EncryptionKey = nil
+	return o
+}
+
 func (db *DB) freepages() []pgid {
-	tx, err := db.beginTx()
+	tx, err := db.beginTx(context.Background())
 	defer func() {
 		err = tx.Rollback()
 		if err != nil {
@@ -995,20 +2126,20 @@ func (db *DB) freepages() []pgid {
 		panic("freepages: failed to open read only tx")
 	}
 
-	reachable := make(map[pgid]*page)
-	nofreed := make(map[pgid]bool)
 	ech := make(chan error)
 	go func() {
 		for e := range ech {
 			panic(fmt.Sprintf("freepages: failed to get all reachable pages (%v)", e))
 		}
 	}()
-	tx.checkBucket(&tx.root, reachable, nofreed, ech)
+	c := newChecker(context.Background(), tx, checkConfig{}, ech)
+	c.checkExtensions()
+	c.checkBucket(&tx.root, nil)
 	close(ech)
 
 	var fids []pgid
 	for i := pgid(2); i < db.meta().pgid; i++ {
-		if _, ok := reachable[i]; !ok {
+		if _, ok := c.reachable[i]; !ok {
 			fids = append(fids, i)
 		}
 	}
@@ -1034,15 +2165,36 @@ type Options struct {
 	// The alternative one is using hashmap, it is faster in almost all circumstances
 	// but it doesn't guarantee that it offers the smallest page id available. In normal case it is safe.
 	// The default type is array
+	//
+	// Both types persist the freelist in the same format, so a database may be
+	// reopened with a different type without any conversion.
 	FreelistType FreelistType
 
 	// Open database in read-only mode. Uses flock(..., LOCK_SH |LOCK_NB) to
 	// grab a shared lock (UNIX).
 	ReadOnly bool
 
+	// NoLock skips locking the data file, which allows opening files on
+	// read-only or network filesystems that do not support locking. It
+	// requires ReadOnly. This is only safe if no process can write to the
+	// file while it is open, such as when serving a static snapshot.
+	NoLock bool
+
+	// PreferMeta, if non-zero, opens the database as of the meta page written
+	// by the transaction with this id instead of the latest valid meta page.
+	// It must match the TxID of one of the two meta pages as reported by
+	// ReadMeta, usually the older one, to recover the data as it was before
+	// the latest commit. PreferMetaPage0 and PreferMetaPage1 select a meta
+	// page by its MetaInfo.ID instead. It requires ReadOnly.
+	PreferMeta int
+
 	// Sets the DB.MmapFlags flag before memory mapping the file.
 	MmapFlags int
 
+	// AccessPattern sets DB.AccessPattern, the readahead advice for the
+	// memory map. The default, AccessRandom, suits point lookups.
+	AccessPattern AccessPattern
+
 	// InitialMmapSize is the initial mmap size of the database
 	// in bytes. Read transactions won't block write transaction
 	// if the InitialMmapSize is large enough to hold database mmap
@@ -1053,7 +2205,41 @@ type Options struct {
 	// it takes no effect.
 	InitialMmapSize int
 
-	// PageSize overrides the default OS page size.
+	// PreallocateFile grows the data file to InitialMmapSize when it is
+	// opened, so that commits do not need to grow and sync it until the
+	// database outgrows InitialMmapSize. Together they avoid both remapping
+	// and resizing the file while loading a database of known size. The
+	// file keeps its size on disk even while the database is smaller.
+	PreallocateFile bool
+
+	// KeyComparator orders the keys of every bucket. It returns a negative
+	// number, zero or a positive number when a sorts before, equal to or after
+	// b. Keys comparing equal are the same key: Put replaces the stored key
+	// with the one given, and Get, Delete and Bucket find the stored key
+	// under any key comparing equal to it. If nil, keys are ordered by
+	// bytes.Compare.
+	//
+	// The ordering itself is not stored in the file, so a database must
+	// always be opened with the comparator it was created with. The file
+	// records that a comparator is in use once created or written with one,
+	// and Open returns ErrKeyComparatorRequired for such a file without it.
+	// Keys sharing a prefix need not be adjacent under a comparator, so
+	// Cursor.SeekPrefix and Bucket.ForEachPrefix check every key instead of
+	// seeking to the prefix.
+	KeyComparator func(a, b []byte) int
+
+	// Logger receives diagnostic messages such as remapping the data file or
+	// falling back to the previous meta page. If nil, messages are discarded.
+	Logger Logger
+
+	// Observer is notified of transaction and remapping events as they
+	// happen. If nil, events are discarded.
+	Observer Observer
+
+	// PageSize overrides the default OS page size when creating a new
+	// database. Existing databases keep the page size they were created
+	// with; if PageSize is set and does not match it, Open returns
+	// ErrPageSizeMismatch.
 	PageSize int
 
 	// NoSync sets the initial value of DB.NoSync. Normally this can just be
@@ -1061,6 +2247,95 @@ type Options struct {
 	// is useful in APIs which expose Options but not the underlying DB.
 	NoSync bool
 
+	// SyncMode sets DB.SyncMode.
+	SyncMode SyncMode
+
+	// SyncInterval sets DB.SyncInterval, which enables group commit.
+	SyncInterval time.Duration
+
+	// SyncBytes sets DB.SyncBytes, which enables group commit.
+	SyncBytes int
+
+	// CompactOnClose sets DB.CompactOnClose, which compacts the database
+	// when it is closed if more than CompactThresholdBytes are free.
+	CompactOnClose bool
+
+	// CompactThresholdBytes sets DB.CompactThresholdBytes.
+	CompactThresholdBytes int64
+
+	// RebalanceThreshold sets DB.RebalanceThreshold.
+	RebalanceThreshold float64
+
+	// PageChecksums sets DB.PageChecksums.
+	PageChecksums bool
+
+	// ValueSafetyChecks sets DB.ValueSafetyChecks.
+	ValueSafetyChecks bool
+
+	// Compression sets DB.Compression.
+	Compression Compression
+
+	// CompressionThreshold sets DB.CompressionThreshold.
+	CompressionThreshold int
+
+	// MaxKeySize sets DB.MaxKeySize.
+	MaxKeySize int
+
+	// MaxValueSize sets DB.MaxValueSize.
+	MaxValueSize int
+
+	// EncryptionKey encrypts the database file at rest. A new database
+	// created with it set is encrypted with a key derived from it and a
+	// random salt stored in the meta pages, and every other page is
+	// encrypted and authenticated with AES-256-GCM when it is written. Pages
+	// are decrypted when they are read, so the memory map only holds
+	// encrypted data. The key must be at least MinEncryptionKeySize bytes
+	// long, and should be random rather than a password.
+	//
+	// An encrypted database can only be opened with the key it was created
+	// with, otherwise ErrEncryptionKeyRequired or ErrEncryptionKeyMismatch
+	// is returned, and ErrNotEncrypted is returned if it is set to open a
+	// database which is not encrypted. A page which fails authentication
+	// panics when it is read, like a corrupted page, and is reported by
+	// Tx.Check. PageChecksums is ignored for encrypted databases, whose
+	// pages are authenticated anyway.
+	EncryptionKey []byte
+
+	// WALMode makes commits append their pages to a write-ahead log at the
+	// path of the data file with a "-wal" suffix and sync only the log,
+	// instead of syncing the data file twice. Small transactions commit much
+	// faster, since the log is written sequentially. The data file is synced
+	// and the log emptied by a checkpoint, which happens once the log reaches
+	// WALCheckpointBytes, on DB.Checkpoint and on Close. Open replays the
+	// commits left in the log after a crash.
+	//
+	// The log holds a copy of every page written since the last checkpoint,
+	// and each commit is buffered in memory before it is appended. Group
+	// commit does not apply to the log; NoSync skips syncing it. Read-only
+	// opens cannot replay the log, so they return ErrWALNotReplayed while it
+	// holds commits, whether WALMode is set or not: a database which crashed
+	// must be opened read-write once with WALMode to replay it.
+	WALMode bool
+
+	// WALCheckpointBytes is the size the write-ahead log may reach before it
+	// is checkpointed. If zero, DefaultWALCheckpointBytes is used.
+	WALCheckpointBytes int64
+
+	// UseArena makes writable transactions decode the nodes of the pages
+	// they change into memory reused across transactions, instead of
+	// allocating every node and its elements separately, which reduces the
+	// garbage produced by frequent writes. Read-only transactions are not
+	// affected, since they read pages without decoding them.
+	UseArena bool
+
+	// TrackChanges makes the database remember which pages every commit
+	// writes, as Tx.WriteIncrementalTo and Tx.ChangedKeysSince require. The
+	// pages are only remembered in memory, from the opening of the database
+	// until it is closed, so the base transaction of an incremental backup or
+	// change feed must have been committed by the same DB. This costs a map
+	// entry per written page, so it is disabled by default.
+	TrackChanges bool
+
 	// OpenFile is used to open files. It defaults to os.OpenFile. This option
 	// is useful for writing hermetic tests.
 	OpenFile func(string, int, os.FileMode) (*os.File, error)
@@ -1082,16 +2357,29 @@ type Stats struct {
 	FreeAlloc     int // total bytes allocated in free pages
 	FreelistInuse int // total bytes used by the freelist
 
+	// FreelistFragmentation is the number of runs of contiguous free pages
+	// divided by FreePageN. It is 1 when no free pages are adjacent and
+	// approaches 0 as free space coalesces into long runs.
+	FreelistFragmentation float64
+	FreePageLargestSpan   int // number of pages in the longest run of free pages
+
 	// Transaction stats
 	TxN     int // total number of started read transactions
 	OpenTxN int // number of currently open read transactions
 
+	// RemapN is the number of times the data file was remapped because
+	// the database outgrew the memory map. Each remap waits for the open
+	// read transactions; see Options.InitialMmapSize.
+	RemapN int
+
 	TxStats TxStats // global, ongoing stats.
 }
 
 // Sub calculates and returns the difference between two sets of database stats.
 // This is useful when obtaining stats at two different points and time and
 // you need the performance counters that occurred within that time span.
+// Counters such as TxN and all of TxStats are subtracted, while gauges such
+// as the freelist stats and OpenTxN hold the values of s.
 func (s *Stats) Sub(other *Stats) Stats {
 	if other == nil {
 		return *s
@@ -1101,11 +2389,25 @@ func (s *Stats) Sub(other *Stats) Stats {
 	diff.PendingPageN = s.PendingPageN
 	diff.FreeAlloc = s.FreeAlloc
 	diff.FreelistInuse = s.FreelistInuse
+	diff.FreelistFragmentation = s.FreelistFragmentation
+	diff.FreePageLargestSpan = s.FreePageLargestSpan
 	diff.TxN = s.TxN - other.TxN
+	diff.OpenTxN = s.OpenTxN
+	diff.RemapN = s.RemapN - other.RemapN
 	diff.TxStats = s.TxStats.Sub(&other.TxStats)
 	return diff
 }
 
+// setFreeSpans updates the fragmentation stats given the number of runs of
+// free pages, the length of the longest run and the number of free pages.
+func (s *Stats) setFreeSpans(spanN, largest, freeN int) {
+	s.FreelistFragmentation = 0
+	if freeN > 0 {
+		s.FreelistFragmentation = float64(spanN) / float64(freeN)
+	}
+	s.FreePageLargestSpan = largest
+}
+
 type Info struct {
 	Data     uintptr
 	PageSize int
@@ -1121,13 +2423,22 @@ type meta struct {
 	pgid     pgid
 	txid     txid
 	checksum uint64
+
+	// encryption is only set in the meta pages of encrypted databases. It
+	// follows the checksum so that the checksum of other databases covers
+	// the same bytes as before it was added.
+	encryption encryption
+
+	// extensions is the extension list page, or 0 if there is none. It is
+	// only covered by the checksum of databases using extension pages.
+	extensions pgid
 }
 
 // validate checks the marker bytes and version of the meta page to ensure it matches this binary.
 func (m *meta) validate() error {
 	if m.magic != magic {
 		return ErrInvalid
-	} else if m.version != version {
+	} else if m.version != version && m.version != featuresVersion {
 		return ErrVersionMismatch
 	} else if m.checksum != 0 && m.checksum != m.sum64() {
 		return ErrChecksum
@@ -1147,6 +2458,14 @@ func (m *meta) write(p *page) {
 	} else if m.freelist >= m.pgid && m.freelist != pgidNoFreelist {
 		// TODO: reject pgidNoFreeList if !NoFreelistSync
 		panic(fmt.Sprintf("freelist pgid (%d) above high water mark (%d)", m.freelist, m.pgid))
+	} else if m.extensions >= m.pgid {
+		panic(fmt.Sprintf("extension list pgid (%d) above high water mark (%d)", m.extensions, m.pgid))
+	}
+
+	// Versions of bbolt which ignore the feature flags must refuse the file
+	// once a feature is used.
+	if m.flags != 0 {
+		m.version = featuresVersion
 	}
 
 	// Page id is either going to be 0 or 1 which we can determine by the transaction ID.
@@ -1163,9 +2482,124 @@ func (m *meta) write(p *page) {
 func (m *meta) sum64() uint64 {
 	var h = fnv.New64a()
 	_, _ = h.Write((*[unsafe.Offsetof(meta{}.checksum)]byte)(unsafe.Pointer(m))[:])
+	if m.flags&featureEncryption != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(encryption{})]byte)(unsafe.Pointer(&m.encryption))[:])
+	}
+	if m.flags&featureExtensionPages != 0 {
+		_, _ = h.Write((*[unsafe.Sizeof(pgid(0))]byte)(unsafe.Pointer(&m.extensions))[:])
+	}
 	return h.Sum64()
 }
 
+// MetaInfo represents human readable information about a meta page.
+type MetaInfo struct {
+	ID       int    // 0 or 1
+	Magic    uint32 // marker identifying a bolt file
+	Version  uint32 // version of the file format
+	PageSize int
+	Flags    uint32 // features used by the database
+	Root     int    // root page of the root bucket, or 0 if it is inline
+	Freelist int    // freelist page, or -1 if the freelist is not synced
+	PageN    int    // high water mark
+	TxID     int    // id of the transaction which wrote the meta page
+	Checksum uint64 // stored checksum
+
+	// Err is the reason the meta page fails validation, or nil if it is
+	// valid.
+	Err error
+
+	// Active is set on the meta page a database opening the file would use:
+	// the valid one with the highest transaction id.
+	Active bool
+}
+
+// ReadMeta reads both meta pages of the database file at path without
+// opening it, for diagnosing files that fail to open. It returns an error
+// only if the file cannot be read; invalid meta pages are reported through
+// MetaInfo.Err.
+//
+// The page size is taken from meta page 0. If meta page 0 is invalid, meta
+// page 1 is looked for at the offsets of the OS page size and of every power
+// of two page size between 512 bytes and 64KB.
+func ReadMeta(path string) ([]MetaInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	m0, err := readMetaAt(f, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var m1 *meta
+	if m0.validate() == nil {
+		if m1, err = readMetaAt(f, int64(m0.pageSize)); err != nil {
+			return nil, err
+		}
+	} else {
+		sizes := []int{defaultPageSize}
+		for sz := 512; sz <= 64*1024; sz *= 2 {
+			sizes = append(sizes, sz)
+		}
+		for _, sz := range sizes {
+			m, err := readMetaAt(f, int64(sz))
+			if err != nil {
+				continue
+			}
+			if m.validate() == nil {
+				m1 = m
+				break
+			} else if m1 == nil {
+				m1 = m
+			}
+		}
+		if m1 == nil {
+			return nil, ErrInvalid
+		}
+	}
+
+	infos := []MetaInfo{m0.info(0), m1.info(1)}
+	switch {
+	case infos[0].Err == nil && (infos[1].Err != nil || m0.txid >= m1.txid):
+		infos[0].Active = true
+	case infos[1].Err == nil:
+		infos[1].Active = true
+	}
+	return infos, nil
+}
+
+// readMetaAt reads the meta of the page at offset off of f.
+func readMetaAt(f *os.File, off int64) (*meta, error) {
+	buf := make([]byte, pageHeaderSize+unsafe.Sizeof(meta{}))
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return nil, err
+	}
+	return (*page)(unsafe.Pointer(&buf[0])).meta(), nil
+}
+
+// info returns human readable information about the meta page id.
+func (m *meta) info(id int) MetaInfo {
+	info := MetaInfo{
+		ID:       id,
+		Magic:    m.magic,
+		Version:  m.version,
+		PageSize: int(m.pageSize),
+		Flags:    m.flags,
+		Root:     int(m.root.root),
+		Freelist: int(m.freelist),
+		PageN:    int(m.pgid),
+		TxID:     int(m.txid),
+		Checksum: m.checksum,
+		Err:      m.validate(),
+	}
+	if m.freelist == pgidNoFreelist {
+		info.Freelist = -1
+	}
+	return info
+}
+
 // _assert will panic with a given formatted message if the given condition is false.
 func _assert(condition bool, msg string, v ...interface{}) {
 	if !condition {
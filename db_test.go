@@ -2,6 +2,7 @@ package bbolt_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"flag"
@@ -12,7 +13,9 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -34,7 +37,7 @@ type meta struct {
 	magic    uint32
 	version  uint32
 	_        uint32
-	_        uint32
+	flags    uint32
 	_        [16]byte
 	_        uint64
 	pgid     uint64
@@ -211,6 +214,209 @@ func TestOpen_ErrChecksum(t *testing.T) {
 	}
 }
 
+// Ensure that the features used by a database are recorded in its meta pages
+// and that opening a database with unsupported features fails.
+func TestOpen_UnsupportedFeature(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{Compression: bolt.CompressionFlate})
+	path := db.Path()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("foo"), make([]byte, 4096)); err != nil {
+			return err
+		}
+		return b.PutWithTTL([]byte("bar"), []byte("baz"), time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := bolt.ReadMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := 0
+	if infos[1].Active {
+		active = 1
+	}
+	if flags := infos[active].Flags; flags != 0x03 {
+		t.Fatalf("unexpected flags: 0x%x", flags)
+	}
+
+	// Versions which ignore the flags refuse the file by its version, while
+	// the meta page written before any feature was used keeps the old one.
+	if v := infos[active].Version; v != 1<<16|2 {
+		t.Fatalf("unexpected version: 0x%x", v)
+	} else if v := infos[1-active].Version; v != 2 {
+		t.Fatalf("unexpected version of the previous meta page: 0x%x", v)
+	}
+
+	// Mark the active meta page as requiring an unknown feature.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (*meta)(unsafe.Pointer(&buf[active*pageSize+pageHeaderSize]))
+	m.flags |= 0x80
+	h := fnv.New64a()
+	_, _ = h.Write(buf[active*pageSize+pageHeaderSize : active*pageSize+pageHeaderSize+int(unsafe.Offsetof(m.checksum))])
+	m.checksum = h.Sum64()
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = bolt.Open(path, 0666, nil)
+	if ferr, ok := err.(*bolt.UnsupportedFeatureError); !ok || ferr.Features != 0x80 {
+		t.Fatalf("unexpected error: %v", err)
+	} else if msg := err.Error(); msg != "database requires unsupported features: 0x80" {
+		t.Fatalf("unexpected message: %s", msg)
+	}
+
+	// Restore the meta page for the consistency check on close.
+	m.flags &^= 0x80
+	h.Reset()
+	_, _ = h.Write(buf[active*pageSize+pageHeaderSize : active*pageSize+pageHeaderSize+int(unsafe.Offsetof(m.checksum))])
+	m.checksum = h.Sum64()
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+}
+
+// Ensure that ReadMeta reports both meta pages, including an invalid one.
+func TestReadMeta(t *testing.T) {
+	if pageSize != os.Getpagesize() {
+		t.Skip("page size mismatch")
+	}
+
+	db := MustOpenDB()
+	path := db.Path()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := bolt.ReadMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(infos) != 2 {
+		t.Fatalf("unexpected meta count: %d", len(infos))
+	}
+	for i, info := range infos {
+		if info.ID != i || info.Err != nil || info.PageSize != pageSize {
+			t.Fatalf("unexpected meta %d: %+v", i, info)
+		}
+	}
+	// The meta page written last is active.
+	active := 0
+	if infos[1].TxID > infos[0].TxID {
+		active = 1
+	}
+	if !infos[active].Active || infos[1-active].Active {
+		t.Fatalf("unexpected active meta: %+v", infos)
+	}
+
+	// Corrupt the active meta page so that the other one becomes active.
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (*meta)(unsafe.Pointer(&buf[active*pageSize+pageHeaderSize]))
+	m.pgid++
+	if err := ioutil.WriteFile(path, buf, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, err = bolt.ReadMeta(path); err != nil {
+		t.Fatal(err)
+	} else if infos[active].Err != bolt.ErrChecksum {
+		t.Fatalf("unexpected error: %v", infos[active].Err)
+	} else if infos[active].Active || !infos[1-active].Active {
+		t.Fatalf("unexpected active meta: %+v", infos)
+	}
+}
+
+// Ensure that a database can be opened as of its older meta page.
+func TestOpen_PreferMeta(t *testing.T) {
+	db := MustOpenDB()
+	path := db.Path()
+	defer db.MustClose()
+	for _, v := range []string{"old", "new"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), []byte(v))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := bolt.ReadMeta(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	older := infos[0]
+	if infos[1].TxID < older.TxID {
+		older = infos[1]
+	}
+
+	if _, err := bolt.Open(path, 0666, &bolt.Options{PreferMeta: older.TxID}); err != bolt.ErrPreferMetaWritable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true, PreferMeta: 1000}); err != bolt.ErrMetaNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true, PreferMeta: -3}); err != bolt.ErrMetaNotFound {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The older meta page can be selected by its txid or by its index.
+	index := bolt.PreferMetaPage0
+	if older.ID == 1 {
+		index = bolt.PreferMetaPage1
+	}
+	for _, prefer := range []int{older.TxID, index} {
+		rodb, err := bolt.Open(path, 0666, &bolt.Options{ReadOnly: true, PreferMeta: prefer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rodb.View(func(tx *bolt.Tx) error {
+			if tx.ID() != older.TxID {
+				t.Fatalf("unexpected txid: %d", tx.ID())
+			} else if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("old")) {
+				t.Fatalf("unexpected value: %q", v)
+			}
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rodb.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
 // Ensure that opening a database does not increase its size.
 // https://github.com/boltdb/bolt/issues/291
 func TestOpen_Size(t *testing.T) {
@@ -367,6 +573,68 @@ func TestOpen_Check(t *testing.T) {
 	}
 }
 
+// Ensure that Open reports diagnostic messages to Options.Logger, including
+// falling back to the previous meta page.
+func TestOpen_Logger(t *testing.T) {
+	path := tempfile()
+	defer os.RemoveAll(path)
+
+	logger := &recordingLogger{}
+	db, err := bolt.Open(path, 0666, &bolt.Options{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.contains("debug: opened ") || !logger.contains("debug: mapping ") {
+		t.Fatalf("unexpected messages: %q", logger.messages())
+	}
+
+	// The update above was written to meta page 0, so corrupting its magic
+	// makes the database fall back to meta page 1.
+	f, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0, 0, 0, 0}, 16); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The fallback is reported once, not by every transaction.
+	logger = &recordingLogger{}
+	db, err = bolt.Open(path, 0666, &bolt.Options{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var warnings int
+	for _, msg := range logger.messages() {
+		if strings.HasPrefix(msg, "warn: meta page of txid 2 is invalid") {
+			warnings++
+		}
+	}
+	if warnings != 1 {
+		t.Fatalf("unexpected messages: %q", logger.messages())
+	}
+}
+
 // Ensure that write errors to the meta file handler during initialization are returned.
 func TestOpen_MetaInitWriteError(t *testing.T) {
 	t.Skip("pending")
@@ -458,239 +726,1768 @@ func TestDB_Open_InitialMmapSize(t *testing.T) {
 	}
 }
 
-// TestDB_Open_ReadOnly checks a database in read only mode can read but not write.
-func TestDB_Open_ReadOnly(t *testing.T) {
-	// Create a writable db, write k-v and close it.
-	db := MustOpenDB()
-	defer db.MustClose()
+// Ensure that a load fitting in InitialMmapSize neither remaps the data file
+// nor grows it when it is preallocated.
+func TestDB_Open_PreallocateFile(t *testing.T) {
+	const initMmapSize = 32 << 20
 
-	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("widgets"))
-		if err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
+	load := func(db *bolt.DB) {
+		for i := 0; i < 8; i++ {
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				for j := 0; j < 1000; j++ {
+					if err := b.Put(u64tob(uint64(i*1000+j)), make([]byte, 1000)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
 		}
-		return nil
-	}); err != nil {
-		t.Fatal(err)
-	}
-	if err := db.DB.Close(); err != nil {
-		t.Fatal(err)
 	}
 
-	f := db.f
-	o := &bolt.Options{ReadOnly: true}
-	readOnlyDB, err := bolt.Open(f, 0666, o)
-	if err != nil {
-		panic(err)
-	}
-
-	if !readOnlyDB.IsReadOnly() {
-		t.Fatal("expect db in read only mode")
+	// Without InitialMmapSize the load remaps the file as it grows.
+	db := MustOpenDB()
+	load(db.DB)
+	if n := db.Stats().RemapN; n == 0 {
+		t.Fatal("expected remaps")
 	}
+	db.MustClose()
 
-	// Read from a read-only transaction.
-	if err := readOnlyDB.View(func(tx *bolt.Tx) error {
-		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
-		if !bytes.Equal(value, []byte("bar")) {
-			t.Fatal("expect value 'bar', got", value)
-		}
-		return nil
-	}); err != nil {
+	path := tempfile()
+	defer os.Remove(path)
+	pdb, err := bolt.Open(path, 0666, &bolt.Options{InitialMmapSize: initMmapSize, PreallocateFile: true})
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	// Can't launch read-write transaction.
-	if _, err := readOnlyDB.Begin(true); err != bolt.ErrDatabaseReadOnly {
-		t.Fatalf("unexpected error: %s", err)
+	defer pdb.Close()
+	if sz := fileSize(path); sz != initMmapSize {
+		t.Fatalf("unexpected file size: %d", sz)
 	}
-
-	if err := readOnlyDB.Close(); err != nil {
-		t.Fatal(err)
+	load(pdb)
+	if n := pdb.Stats().RemapN; n != 0 {
+		t.Fatalf("unexpected remap count: %d", n)
+	} else if sz := fileSize(path); sz != initMmapSize {
+		t.Fatalf("unexpected file size: %d", sz)
 	}
 }
 
-// TestOpen_BigPage checks the database uses bigger pages when
-// changing PageSize.
-func TestOpen_BigPage(t *testing.T) {
-	pageSize := os.Getpagesize()
+// testObserver records the events reported to a bolt.Observer.
+type testObserver struct {
+	mu        sync.Mutex
+	begins    []bool
+	commits   int
+	pages     int
+	rollbacks int
+	mmapSize  int64
+}
 
-	db1 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 2})
-	defer db1.MustClose()
+func (o *testObserver) OnTxBegin(writable bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.begins = append(o.begins, writable)
+}
 
-	db2 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 4})
-	defer db2.MustClose()
+func (o *testObserver) OnTxCommit(d time.Duration, pages int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.commits++
+	o.pages += pages
+}
 
-	if db1sz, db2sz := fileSize(db1.f), fileSize(db2.f); db1sz >= db2sz {
-		t.Errorf("expected %d < %d", db1sz, db2sz)
-	}
+func (o *testObserver) OnTxRollback() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.rollbacks++
 }
 
-// TestOpen_RecoverFreeList tests opening the DB with free-list
-// write-out after no free list sync will recover the free list
-// and write it out.
-func TestOpen_RecoverFreeList(t *testing.T) {
-	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+func (o *testObserver) OnMmapGrow(newSize int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.mmapSize = newSize
+}
+
+// Ensure that the observer is notified of transactions and remaps.
+func TestDB_Open_Observer(t *testing.T) {
+	o := &testObserver{}
+	db := MustOpenWithOption(&bolt.Options{Observer: o})
 	defer db.MustClose()
 
-	// Write some pages.
-	tx, err := db.Begin(true)
-	if err != nil {
-		t.Fatal(err)
-	}
-	wbuf := make([]byte, 8192)
-	for i := 0; i < 100; i++ {
-		s := fmt.Sprintf("%d", i)
-		b, err := tx.CreateBucket([]byte(s))
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err = b.Put([]byte(s), wbuf); err != nil {
-			t.Fatal(err)
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	if err = tx.Commit(); err != nil {
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != nil {
 		t.Fatal(err)
 	}
+	errFail := errors.New("fail")
+	if err := db.Update(func(tx *bolt.Tx) error { return errFail }); err != errFail {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
-	// Generate free pages.
-	if tx, err = db.Begin(true); err != nil {
-		t.Fatal(err)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !reflect.DeepEqual(o.begins, []bool{true, false, true}) {
+		t.Fatalf("unexpected begins: %v", o.begins)
 	}
-	for i := 0; i < 50; i++ {
-		s := fmt.Sprintf("%d", i)
-		b := tx.Bucket([]byte(s))
-		if b == nil {
+	if o.commits != 1 || o.pages == 0 {
+		t.Fatalf("unexpected commits: %d (%d pages)", o.commits, o.pages)
+	}
+	if o.rollbacks != 2 {
+		t.Fatalf("unexpected rollbacks: %d", o.rollbacks)
+	}
+	if o.mmapSize < 1000*1000 {
+		t.Fatalf("unexpected mmap size: %d", o.mmapSize)
+	}
+}
+
+// Ensure that commits persist under every sync mode.
+func TestDB_Open_SyncMode(t *testing.T) {
+	for _, mode := range []bolt.SyncMode{bolt.SyncData, bolt.SyncFull, bolt.SyncNone} {
+		db := MustOpenWithOption(&bolt.Options{SyncMode: mode})
+		if db.SyncMode != mode {
+			t.Fatalf("unexpected sync mode: %d", db.SyncMode)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Delete([]byte(s)); err != nil {
+		if err := db.Sync(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db.MustReopen()
+		if err := db.View(func(tx *bolt.Tx) error {
+			if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+				t.Fatalf("mode %d: unexpected key count: %d", mode, n)
+			}
+			return nil
+		}); err != nil {
 			t.Fatal(err)
 		}
+		db.MustClose()
 	}
-	if err := tx.Commit(); err != nil {
+}
+
+// Ensure that Reopen switches to the file put in place of the open one.
+func TestDB_Reopen(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	rotated := db.Path() + ".1"
+	defer os.Remove(rotated)
+
+	put := func(name string) {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucket([]byte(name))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	has := func(name string) (ok bool) {
+		if err := db.View(func(tx *bolt.Tx) error {
+			ok = tx.HasBucket([]byte(name))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	put("widgets")
+	if replaced, err := db.FileReplaced(); err != nil {
+		t.Fatal(err)
+	} else if replaced {
+		t.Fatal("expected file not to be replaced")
+	}
+	if err := db.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy of the file holds the same transaction.
+	if err := os.Rename(db.Path(), rotated); err != nil {
+		t.Fatal(err)
+	}
+	if replaced, err := db.FileReplaced(); err != nil {
+		t.Fatal(err)
+	} else if !replaced {
+		t.Fatal("expected file to be replaced")
+	}
+	data, err := ioutil.ReadFile(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(db.Path(), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	put("gadgets")
+	if !has("widgets") || !has("gadgets") {
+		t.Fatal("expected buckets in the copy")
+	}
+	db.MustCheck()
+
+	// A file which is not a database is rejected and the open one kept.
+	if err := os.Rename(db.Path(), rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(db.Path(), bytes.Repeat([]byte{0x42}, 8192), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reopen(); err == nil {
+		t.Fatal("expected error reopening an invalid file")
+	}
+	put("sprockets")
+	if !has("sprockets") {
+		t.Fatal("expected old file to stay in use")
+	}
+
+	// An empty file becomes a new database.
+	if err := ioutil.WriteFile(db.Path(), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reopen(); err != nil {
 		t.Fatal(err)
 	}
+	if has("widgets") {
+		t.Fatal("expected a new database")
+	}
+	put("widgets")
+	db.MustCheck()
+
+	// The rotated file holds the commits made before the last reopen.
 	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
+	rdb, err := bolt.Open(rotated, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+	if err := rdb.View(func(tx *bolt.Tx) error {
+		if !tx.HasBucket([]byte("gadgets")) || !tx.HasBucket([]byte("sprockets")) {
+			t.Fatal("expected buckets in the rotated file")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+}
 
-	// Record freelist count from opening with NoFreelistSync.
+// TestDB_Open_ReadOnly checks a database in read only mode can read but not write.
+func TestDB_Open_ReadOnly(t *testing.T) {
+	// Create a writable db, write k-v and close it.
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := db.f
+	o := &bolt.Options{ReadOnly: true}
+	readOnlyDB, err := bolt.Open(f, 0666, o)
+	if err != nil {
+		panic(err)
+	}
+
+	if !readOnlyDB.IsReadOnly() {
+		t.Fatal("expect db in read only mode")
+	}
+
+	// Read from a read-only transaction.
+	if err := readOnlyDB.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket([]byte("widgets")).Get([]byte("foo"))
+		if !bytes.Equal(value, []byte("bar")) {
+			t.Fatal("expect value 'bar', got", value)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Can't launch read-write transaction.
+	if _, err := readOnlyDB.Begin(true); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := readOnlyDB.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a read-only database can be opened without a lock while a
+// writer holds the file lock.
+func TestOpen_NoLock(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The exclusive lock held by db prevents locked readers.
+	if _, err := bolt.Open(db.f, 0666, &bolt.Options{ReadOnly: true, Timeout: 10 * time.Millisecond}); err != bolt.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	readOnlyDB, err := bolt.Open(db.f, 0666, &bolt.Options{ReadOnly: true, NoLock: true, Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnlyDB.Close()
+	if err := readOnlyDB.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// NoLock is refused for writable databases.
+	if _, err := bolt.Open(tempfile(), 0666, &bolt.Options{NoLock: true}); err != bolt.ErrNoLockWritable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that OpenContext stops waiting for a lock held by another handle once
+// its context is done.
+func TestOpenContext_Locked(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := bolt.OpenContext(ctx, db.f, 0666, nil); !errors.Is(err, bolt.ErrLocked) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Options.Timeout still applies.
+	if _, err := bolt.OpenContext(context.Background(), db.f, 0666, &bolt.Options{Timeout: 10 * time.Millisecond}); err != bolt.ErrTimeout {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The lock is acquired once it is released.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db2, err := bolt.OpenContext(context.Background(), db.f, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB = db2
+}
+
+// Ensure that Options returns the effective options of the database.
+func TestDB_Options(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{PageSize: 8192, NoGrowSync: true, Timeout: time.Second})
+	defer db.MustClose()
+	db.NoSync = true
+
+	o := db.Options()
+	if o.ReadOnly || o.PageSize != 8192 || !o.NoGrowSync || !o.NoSync || o.Timeout != time.Second {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+
+	// A read-only database reports the page size it was created with.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ro, err := bolt.Open(db.f, 0666, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := ro.Options(); !o.ReadOnly || o.PageSize != 8192 || o.NoGrowSync {
+		t.Fatalf("unexpected options: %+v", o)
+	}
+	if err := ro.Close(); err != nil {
+		t.Fatal(err)
+	}
 	db.MustReopen()
-	freepages := db.Stats().FreePageN
-	if freepages == 0 {
-		t.Fatalf("no free pages on NoFreelistSync reopen")
+}
+
+// Ensure that writable transactions of a database opened with UseArena reuse
+// the memory of the nodes they decode.
+func TestDB_UseArena(t *testing.T) {
+	allocs := func(useArena bool) float64 {
+		db := MustOpenWithOption(&bolt.Options{UseArena: useArena})
+		defer db.MustClose()
+		db.NoSync = true
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 10000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 10)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Change a key in every leaf, so that each transaction decodes
+		// all of them.
+		var n uint64
+		a := testing.AllocsPerRun(10, func() {
+			n++
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket([]byte("widgets"))
+				for i := 0; i < 10000; i += 50 {
+					if err := b.Put(u64tob(uint64(i)), u64tob(n)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+
+		if err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 10000; i++ {
+				v := b.Get(u64tob(uint64(i)))
+				if i%50 == 0 && !bytes.Equal(v, u64tob(n)) {
+					t.Fatalf("unexpected value for %d: %x", i, v)
+				} else if i%50 != 0 && len(v) != 10 {
+					t.Fatalf("unexpected value for %d: %x", i, v)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	without, with := allocs(false), allocs(true)
+	if with >= without {
+		t.Fatalf("expected fewer allocations with UseArena: %v, without: %v", with, without)
+	}
+}
+
+// TestOpen_BigPage checks the database uses bigger pages when
+// changing PageSize.
+func TestOpen_BigPage(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	db1 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 2})
+	defer db1.MustClose()
+
+	db2 := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 4})
+	defer db2.MustClose()
+
+	if db1sz, db2sz := fileSize(db1.f), fileSize(db2.f); db1sz >= db2sz {
+		t.Errorf("expected %d < %d", db1sz, db2sz)
 	}
+}
+
+// TestOpen_PageSizeMismatch checks that reopening a database with a
+// different PageSize fails, while the matching or default size succeeds.
+func TestOpen_PageSizeMismatch(t *testing.T) {
+	pageSize := os.Getpagesize()
+
+	db := MustOpenWithOption(&bolt.Options{PageSize: pageSize * 2})
+	defer db.MustClose()
 	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Check free page count is reconstructed when opened with freelist sync.
-	db.o = &bolt.Options{}
-	db.MustReopen()
-	// One less free page for syncing the free list on open.
-	freepages--
-	if fp := db.Stats().FreePageN; fp < freepages {
-		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	if _, err := bolt.Open(db.f, 0666, &bolt.Options{PageSize: pageSize * 4}); err != bolt.ErrPageSizeMismatch {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, o := range []*bolt.Options{{PageSize: pageSize * 2}, nil} {
+		db2, err := bolt.Open(db.f, 0666, o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sz := db2.Info().PageSize; sz != pageSize*2 {
+			t.Fatalf("unexpected page size: %d", sz)
+		}
+		if err := db2.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MustReopen()
+}
+
+// Ensure that an encrypted database is only readable with its key and does
+// not store its data in plaintext.
+func TestOpen_EncryptionKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	db := MustOpenWithOption(&bolt.Options{EncryptionKey: key})
+	defer db.MustClose()
+
+	large := bytes.Repeat([]byte("secret-large-value "), 1000)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("secret-key-%04d", i)), []byte("secret-value")); err != nil {
+				return err
+			}
+		}
+		return b.Put([]byte("large"), large)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf, err := ioutil.ReadFile(db.f); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(buf, []byte("secret")) || bytes.Contains(buf, []byte("widgets")) {
+		t.Fatal("plaintext found in encrypted database")
+	}
+
+	for _, tt := range []struct {
+		key []byte
+		err error
+	}{
+		{nil, bolt.ErrEncryptionKeyRequired},
+		{[]byte("fedcba9876543210fedcba9876543210"), bolt.ErrEncryptionKeyMismatch},
+	} {
+		if _, err := bolt.Open(db.f, 0666, &bolt.Options{EncryptionKey: tt.key}); err != tt.err {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := bolt.Open(db.f, 0666, &bolt.Options{EncryptionKey: key[:8]}); err == nil {
+		t.Fatal("expected error for short key")
+	}
+
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("secret-key-0500")); string(v) != "secret-value" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if v := b.Get([]byte("large")); !bytes.Equal(v, large) {
+			t.Fatalf("unexpected large value of %d bytes", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a key cannot be used to open a database which is not encrypted.
+func TestOpen_EncryptionKey_NotEncrypted(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bolt.Open(db.f, 0666, &bolt.Options{EncryptionKey: []byte("0123456789abcdef")}); err != bolt.ErrNotEncrypted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	db.MustReopen()
+}
+
+// Ensure that Check reports a page of an encrypted database which fails
+// authentication.
+func TestOpen_EncryptionKey_Check(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{EncryptionKey: []byte("0123456789abcdef")})
+	defer db.MustClose()
+
+	var root uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = tx.Bucket([]byte("widgets")).Root()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the root page of the bucket, after its header.
+	f, err := os.OpenFile(db.f, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(root)*int64(os.Getpagesize()) + 100
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		var found bool
+		for err := range tx.Check() {
+			if cerr, ok := err.(*bolt.CheckError); ok && cerr.Kind == bolt.KindPageChecksum && cerr.PageID == root {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatal("expected the corrupted page to be reported")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore the byte so that the database passes the check on close.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.OpenFile(db.f, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+}
+
+// Ensure that the access pattern is applied when the data file is mapped.
+func TestOpen_AccessPattern(t *testing.T) {
+	for _, p := range []bolt.AccessPattern{bolt.AccessRandom, bolt.AccessNormal, bolt.AccessSequential} {
+		db := MustOpenWithOption(&bolt.Options{AccessPattern: p})
+		if db.AccessPattern != p {
+			t.Fatalf("unexpected access pattern: %d, expected %d", db.AccessPattern, p)
+		}
+
+		// Grow the database so that it is remapped.
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 1000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.MustClose()
+	}
+}
+
+// Ensure that a database can be read through an io.ReaderAt.
+func TestOpenReaderAt(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		// Add a value spanning overflow pages.
+		return b.Put([]byte("large"), bytes.Repeat([]byte("x"), 10000))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(db.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rdb, err := bolt.OpenReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rdb.Close()
+
+	if err := rdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n := b.Stats().KeyN; n != 1001 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if v := b.Get([]byte("large")); !bytes.Equal(v, bytes.Repeat([]byte("x"), 10000)) {
+			t.Fatalf("unexpected value of length %d", len(v))
+		}
+
+		// The copy written from the reader matches the original database.
+		path := tempfile()
+		defer os.Remove(path)
+		if err := tx.CopyFile(path, 0600); err != nil {
+			t.Fatal(err)
+		}
+		copied, err := bolt.Open(path, 0600, &bolt.Options{ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer copied.Close()
+		if err := db.View(func(tx *bolt.Tx) error {
+			return copied.View(func(ctx *bolt.Tx) error {
+				compareBuckets(t, tx.Bucket([]byte("widgets")), ctx.Bucket([]byte("widgets")))
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rdb.Update(func(*bolt.Tx) error { return nil }); err != bolt.ErrDatabaseReadOnly {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A truncated database fails to open.
+	if _, err := bolt.OpenReaderAt(bytes.NewReader(data[:100]), 100, nil); err != bolt.ErrInvalid {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that an in-memory database can be written, grown and saved.
+func TestOpenInMemory(t *testing.T) {
+	db, err := bolt.OpenInMemory(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Path() != "" {
+		t.Fatalf("unexpected path: %q", db.Path())
+	}
+
+	// Read while the writer grows the data so that it is moved.
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(readErr)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.View(func(tx *bolt.Tx) error {
+				if b := tx.Bucket([]byte("widgets")); b != nil {
+					return b.ForEach(func(k, v []byte) error { return nil })
+				}
+				return nil
+			}); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 10; j++ {
+				if err := b.Put(u64tob(uint64(i*10+j)), make([]byte, 500)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The saved copy opens as a regular database with the same contents.
+	copied, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	if err := db.View(func(tx *bolt.Tx) error {
+		return copied.View(func(ctx *bolt.Tx) error {
+			compareBuckets(t, tx.Bucket([]byte("widgets")), ctx.Bucket([]byte("widgets")))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Begin(false); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that keys are ordered by Options.KeyComparator.
+func TestOpen_KeyComparator(t *testing.T) {
+	reverse := func(a, b []byte) int { return bytes.Compare(b, a) }
+	db := MustOpenWithOption(&bolt.Options{KeyComparator: reverse})
+	defer db.MustClose()
+
+	const count = 2000
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, i := range rand.Perm(count) {
+			if err := b.Put(u64tob(uint64(i)), u64tob(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		if err := db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			exp := uint64(count)
+			if err := b.ForEach(func(k, v []byte) error {
+				exp--
+				if binary.BigEndian.Uint64(k) != exp {
+					t.Fatalf("unexpected key: %x, expected %d", k, exp)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if exp != 0 {
+				t.Fatalf("unexpected key count: %d", count-exp)
+			}
+			if v := b.Get(u64tob(1234)); binary.BigEndian.Uint64(v) != 1234 {
+				t.Fatalf("unexpected value: %x", v)
+			}
+			if k, _ := b.Cursor().Seek(u64tob(count)); binary.BigEndian.Uint64(k) != count-1 {
+				t.Fatalf("unexpected seek key: %x", k)
+			}
+			for err := range tx.Check() {
+				t.Fatal(err)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check()
+
+	// Ensure that the file cannot be opened without the comparator.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bolt.Open(db.f, 0666, nil); err != bolt.ErrKeyComparatorRequired {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db.MustReopen()
+	check()
+}
+
+// Ensure that prefix lookups find every key with the prefix when
+// Options.KeyComparator does not keep them adjacent.
+func TestOpen_KeyComparator_Prefix(t *testing.T) {
+	fold := func(a, b []byte) int { return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b)) }
+	db := MustOpenWithOption(&bolt.Options{KeyComparator: fold})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"aa", "AB", "ac", "B"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		var keys []string
+		if err := b.ForEachPrefix([]byte("a"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"aa", "ac"}) {
+			t.Fatalf("unexpected keys: %v", keys)
+		}
+		if k, _ := b.Cursor().SeekPrefix([]byte("A")); string(k) != "AB" {
+			t.Fatalf("unexpected seek key: %q", k)
+		}
+		if k, _ := b.Cursor().SeekPrefix([]byte("b")); k != nil {
+			t.Fatalf("unexpected seek key: %q", k)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that keys which Options.KeyComparator considers equal are the same
+// key.
+func TestOpen_KeyComparator_Equal(t *testing.T) {
+	fold := func(a, b []byte) int { return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b)) }
+	db := MustOpenWithOption(&bolt.Options{KeyComparator: fold})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket([]byte("WIDGETS")); err != bolt.ErrBucketExists {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if tx.Bucket([]byte("Widgets")) != b {
+			t.Fatal("expected the same bucket")
+		}
+
+		if err := b.Put([]byte("foo"), []byte("1")); err != nil {
+			return err
+		}
+		if err := b.Put([]byte("FOO"), []byte("2")); err != nil {
+			return err
+		}
+		if v := b.Get([]byte("Foo")); !bytes.Equal(v, []byte("2")) {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		if err := b.Put([]byte("bar"), []byte("3")); err != nil {
+			return err
+		}
+		return b.Delete([]byte("BAR"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var keys []string
+		if err := tx.Bucket([]byte("WIDGETS")).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k)+"="+string(v))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"FOO=2"}) {
+			t.Fatalf("unexpected keys: %q", keys)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOpen_FreelistTypeSwitch checks that a database can be reopened with a
+// different freelist type and keeps its free pages.
+func TestOpen_FreelistTypeSwitch(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{FreelistType: bolt.FreelistArrayType})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 10; i++ {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("%d", i)))
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("key"), make([]byte, 8192)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 10; i += 2 {
+			if err := tx.DeleteBucket([]byte(fmt.Sprintf("%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	freeN := db.Stats().FreePageN + db.Stats().PendingPageN
+
+	for _, typ := range []bolt.FreelistType{bolt.FreelistMapType, bolt.FreelistArrayType} {
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db.o.FreelistType = typ
+		db.MustReopen()
+
+		if n := db.Stats().FreePageN; n != freeN {
+			t.Fatalf("%s: unexpected free pages: %d, expected %d", typ, n, freeN)
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("1")).Put([]byte("key"), make([]byte, 4096))
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.MustCheck()
+		freeN = db.Stats().FreePageN + db.Stats().PendingPageN
+	}
+}
+
+// TestOpen_RecoverFreeList tests opening the DB with free-list
+// write-out after no free list sync will recover the free list
+// and write it out.
+func TestOpen_RecoverFreeList(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	// Write some pages.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wbuf := make([]byte, 8192)
+	for i := 0; i < 100; i++ {
+		s := fmt.Sprintf("%d", i)
+		b, err := tx.CreateBucket([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = b.Put([]byte(s), wbuf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Generate free pages.
+	if tx, err = db.Begin(true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		s := fmt.Sprintf("%d", i)
+		b := tx.Bucket([]byte(s))
+		if b == nil {
+			t.Fatal(err)
+		}
+		if err := b.Delete([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record freelist count from opening with NoFreelistSync.
+	db.MustReopen()
+	freepages := db.Stats().FreePageN
+	if freepages == 0 {
+		t.Fatalf("no free pages on NoFreelistSync reopen")
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check free page count is reconstructed when opened with freelist sync.
+	db.o = &bolt.Options{}
+	db.MustReopen()
+	// One less free page for syncing the free list on open.
+	freepages--
+	if fp := db.Stats().FreePageN; fp < freepages {
+		t.Fatalf("closed with %d free pages, opened with %d", freepages, fp)
+	}
+}
+
+// Ensure that freelist syncing can be turned off and on while the database
+// is open.
+func TestDB_SetNoFreelistSync(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// freelistPages counts the pages holding a synced freelist.
+	freelistPages := func() int {
+		var n int
+		if err := db.View(func(tx *bolt.Tx) error {
+			for id := 2; ; id++ {
+				p, err := tx.Page(id)
+				if err != nil {
+					return err
+				} else if p == nil {
+					return nil
+				} else if p.Type == "freelist" {
+					n++
+				}
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	put := func() {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), make([]byte, 8192))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	put()
+	if n := freelistPages(); n != 1 {
+		t.Fatalf("unexpected freelist pages: %d", n)
+	}
+
+	if err := db.SetNoFreelistSync(true); err != nil {
+		t.Fatal(err)
+	}
+	put()
+	if n := freelistPages(); n != 0 {
+		t.Fatalf("unexpected freelist pages: %d", n)
+	}
+
+	// Turning syncing back on writes out the freelist without another commit.
+	if err := db.SetNoFreelistSync(false); err != nil {
+		t.Fatal(err)
+	}
+	if n := freelistPages(); n != 1 {
+		t.Fatalf("unexpected freelist pages: %d", n)
+	}
+	put()
+	if n := freelistPages(); n != 1 {
+		t.Fatalf("unexpected freelist pages: %d", n)
+	}
+}
+
+// Ensure that commits left unsynced by group commit are flushed and survive
+// reopening the database.
+func TestDB_GroupCommit(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{SyncInterval: 10 * time.Millisecond, SyncBytes: 1 << 20})
+	defer db.MustClose()
+
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put(u64tob(uint64(i)), make([]byte, 512))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is left to sync after a flush.
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave a commit for the timer to sync.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Put([]byte("last"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if n := b.Stats().KeyN; n != 11 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if v := b.Get([]byte("last")); string(v) != "bar" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that group commit does not reuse the pages freed since its last sync
+// until the next one, since a power failure may leave a meta page from before.
+func TestDB_GroupCommit_KeepsFreedPages(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{SyncInterval: time.Hour})
+	defer db.MustClose()
+
+	put := func() {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), make([]byte, 100))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		put()
+	}
+	if n := db.Stats().FreePageN; n != 0 {
+		t.Fatalf("unexpected free pages before sync: %d", n)
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	put()
+	if n := db.Stats().FreePageN; n == 0 {
+		t.Fatal("expected free pages after sync")
+	}
+}
+
+// Ensure that a database cannot open a transaction when it's not open.
+func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
+	var db bolt.DB
+	if _, err := db.Begin(false); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that a read-write transaction can be retrieved.
+func TestDB_BeginRW(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	} else if tx == nil {
+		t.Fatal("expected tx")
+	}
+
+	if tx.DB() != db.DB {
+		t.Fatal("unexpected tx database")
+	} else if !tx.Writable() {
+		t.Fatal("expected writable tx")
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDB_Concurrent_WriteTo checks that issuing WriteTo operations concurrently
+// with commits does not produce corrupted db files.
+func TestDB_Concurrent_WriteTo(t *testing.T) {
+	o := &bolt.Options{NoFreelistSync: false}
+	db := MustOpenWithOption(o)
+	defer db.MustClose()
+
+	var wg sync.WaitGroup
+	wtxs, rtxs := 5, 5
+	wg.Add(wtxs * rtxs)
+	f := func(tx *bolt.Tx) {
+		defer wg.Done()
+		f, err := ioutil.TempFile("", "bolt-")
+		if err != nil {
+			panic(err)
+		}
+		time.Sleep(time.Duration(rand.Intn(20)+1) * time.Millisecond)
+		tx.WriteTo(f)
+		tx.Rollback()
+		f.Close()
+		snap := &DB{nil, f.Name(), o}
+		snap.MustReopen()
+		defer snap.MustClose()
+		snap.MustCheck()
+	}
+
+	tx1, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx1.CreateBucket([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx1.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < wtxs; i++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Bucket([]byte("abc")).Put([]byte{0}, []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < rtxs; j++ {
+			rtx, rerr := db.Begin(false)
+			if rerr != nil {
+				t.Fatal(rerr)
+			}
+			go f(rtx)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+}
+
+// Ensure that opening a transaction while the DB is closed returns an error.
+func TestDB_BeginRW_Closed(t *testing.T) {
+	var db bolt.DB
+	if _, err := db.Begin(true); err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+// Ensure that waiting for a write transaction gives up when the context is done.
+func TestDB_BeginTxContext(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.BeginTxContext(ctx, true); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := db.BeginTxContext(ctx, false); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ensure the abandoned wait does not keep the writer lock.
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err = db.BeginTxContext(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that WaitForTxID returns once the transaction id has been committed.
+func TestDB_WaitForTxID(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	id := db.TxID()
+	if err := db.WaitForTxID(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the next commit from another goroutine.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- db.WaitForTxID(context.Background(), id+1)
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("returned before commit: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := db.TxID(); got != id+1 {
+		t.Fatalf("unexpected txid: %d, expected %d", got, id+1)
+	}
+
+	// A cancelled wait returns the error of the context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := db.WaitForTxID(ctx, id+2); err != context.DeadlineExceeded {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Closing the database fails pending waits.
+	go func() {
+		errc <- db.WaitForTxID(context.Background(), id+2)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != bolt.ErrDatabaseNotOpen {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that a database with enough free pages is compacted when closed.
+func TestDB_CompactOnClose(t *testing.T) {
+	for _, threshold := range []int64{1 << 20, 1 << 30} {
+		db := MustOpenWithOption(&bolt.Options{CompactOnClose: true, CompactThresholdBytes: threshold})
+
+		// Fill the database, then delete most of it to leave free pages.
+		for _, name := range []string{"keep", "drop"} {
+			if err := db.Update(func(tx *bolt.Tx) error {
+				b, err := tx.CreateBucket([]byte(name))
+				if err != nil {
+					return err
+				}
+				for i := 0; i < 1000; i++ {
+					if err := b.Put(u64tob(uint64(i)), make([]byte, 4000)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.DeleteBucket([]byte("drop"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		before := fileSize(db.f)
+		if err := db.DB.Close(); err != nil {
+			t.Fatal(err)
+		}
+		after := fileSize(db.f)
+		if compacted := after < before; compacted != (threshold == 1<<20) {
+			t.Fatalf("unexpected file size with threshold %d: %d => %d", threshold, before, after)
+		}
+
+		db.MustReopen()
+		if err := db.View(func(tx *bolt.Tx) error {
+			if n := tx.Bucket([]byte("keep")).Stats().KeyN; n != 1000 {
+				t.Fatalf("unexpected key count: %d", n)
+			} else if tx.Bucket([]byte("drop")) != nil {
+				t.Fatal("unexpected bucket")
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.MustClose()
+
+		// No temporary file is left behind.
+		matches, err := filepath.Glob(db.f + ".compact-*")
+		if err != nil {
+			t.Fatal(err)
+		} else if len(matches) != 0 {
+			t.Fatalf("unexpected files: %v", matches)
+		}
+	}
+}
+
+// Ensure that compacting on close keeps the settings of the database, such as
+// compression, and that the data file is replaced while it is still locked.
+func TestDB_CompactOnClose_KeepsSettings(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{CompactOnClose: true, Compression: bolt.CompressionFlate, CompressionThreshold: 100})
+	for _, name := range []string{"keep", "drop"} {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 4000)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("drop"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The values are still compressed in the compacted file.
+	if size := fileSize(db.f); size >= 1000*4000 {
+		t.Fatalf("unexpected file size: %d", size)
+	}
+	matches, err := filepath.Glob(db.f + ".compact-*")
+	if err != nil {
+		t.Fatal(err)
+	} else if len(matches) != 0 {
+		t.Fatalf("unexpected files: %v", matches)
+	}
+
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("keep")).Get(u64tob(999)); len(v) != 4000 {
+			t.Fatalf("unexpected value length: %d", len(v))
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustClose()
+}
+
+// Ensure that DB.RebalanceThreshold controls whether under-full pages are merged.
+func TestDB_RebalanceThreshold(t *testing.T) {
+	leafPages := func(threshold float64) int {
+		db := MustOpenWithOption(&bolt.Options{RebalanceThreshold: threshold})
+		defer db.MustClose()
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 1000; i++ {
+				if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Leave every page about a third full.
+		var n int
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte("widgets"))
+			for i := 0; i < 1000; i++ {
+				if i%3 == 0 {
+					continue
+				}
+				if err := b.Delete(u64tob(uint64(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.View(func(tx *bolt.Tx) error {
+			n = tx.Bucket([]byte("widgets")).Stats().LeafPageN
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		db.MustCheck()
+		return n
 	}
-}
 
-// Ensure that a database cannot open a transaction when it's not open.
-func TestDB_Begin_ErrDatabaseNotOpen(t *testing.T) {
-	var db bolt.DB
-	if _, err := db.Begin(false); err != bolt.ErrDatabaseNotOpen {
-		t.Fatalf("unexpected error: %s", err)
+	low, def, high := leafPages(0.05), leafPages(0), leafPages(0.5)
+	if low <= def {
+		t.Fatalf("expected more leaf pages with a low threshold: %d <= %d", low, def)
+	} else if def <= high {
+		t.Fatalf("expected fewer leaf pages with a high threshold: %d <= %d", def, high)
 	}
 }
 
-// Ensure that a read-write transaction can be retrieved.
-func TestDB_BeginRW(t *testing.T) {
-	db := MustOpenDB()
+// Ensure that commits in WAL mode are replayed from the log after a crash.
+func TestDB_WALMode(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WALMode: true})
 	defer db.MustClose()
+	walPath := db.f + "-wal"
 
-	tx, err := db.Begin(true)
-	if err != nil {
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
 		t.Fatal(err)
-	} else if tx == nil {
-		t.Fatal("expected tx")
 	}
-
-	if tx.DB() != db.DB {
-		t.Fatal("unexpected tx database")
-	} else if !tx.Writable() {
-		t.Fatal("expected writable tx")
+	if err := db.Checkpoint(); err != nil {
+		t.Fatal(err)
 	}
-
-	if err := tx.Commit(); err != nil {
+	if sz := fileSize(walPath); sz != 0 {
+		t.Fatalf("unexpected log size after checkpoint: %d", sz)
+	}
+	before, err := ioutil.ReadFile(db.f)
+	if err != nil {
 		t.Fatal(err)
 	}
-}
-
-// TestDB_Concurrent_WriteTo checks that issuing WriteTo operations concurrently
-// with commits does not produce corrupted db files.
-func TestDB_Concurrent_WriteTo(t *testing.T) {
-	o := &bolt.Options{NoFreelistSync: false}
-	db := MustOpenWithOption(o)
-	defer db.MustClose()
 
-	var wg sync.WaitGroup
-	wtxs, rtxs := 5, 5
-	wg.Add(wtxs * rtxs)
-	f := func(tx *bolt.Tx) {
-		defer wg.Done()
-		f, err := ioutil.TempFile("", "bolt-")
-		if err != nil {
-			panic(err)
+	for i := 0; i < 10; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put(u64tob(uint64(i)), []byte("value"))
+		}); err != nil {
+			t.Fatal(err)
 		}
-		time.Sleep(time.Duration(rand.Intn(20)+1) * time.Millisecond)
-		tx.WriteTo(f)
-		tx.Rollback()
-		f.Close()
-		snap := &DB{nil, f.Name(), o}
-		snap.MustReopen()
-		defer snap.MustClose()
-		snap.MustCheck()
 	}
-
-	tx1, err := db.Begin(true)
+	walData, err := ioutil.ReadFile(walPath)
 	if err != nil {
 		t.Fatal(err)
+	} else if len(walData) == 0 {
+		t.Fatal("expected commits in the log")
 	}
-	if _, err := tx1.CreateBucket([]byte("abc")); err != nil {
+
+	// Close checkpoints and removes the log.
+	if err := db.DB.Close(); err != nil {
 		t.Fatal(err)
 	}
-	if err := tx1.Commit(); err != nil {
+	if _, err := os.Stat(walPath); !os.IsNotExist(err) {
+		t.Fatalf("expected log to be removed: %v", err)
+	}
+
+	// Simulate a crash which lost the unsynced writes to the data file and
+	// tore the last record of the log.
+	if err := ioutil.WriteFile(db.f, before, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(walPath, append(walData, walData[:100]...), 0666); err != nil {
 		t.Fatal(err)
 	}
 
-	for i := 0; i < wtxs; i++ {
-		tx, err := db.Begin(true)
-		if err != nil {
-			t.Fatal(err)
-		}
-		if err := tx.Bucket([]byte("abc")).Put([]byte{0}, []byte{0}); err != nil {
-			t.Fatal(err)
-		}
-		for j := 0; j < rtxs; j++ {
-			rtx, rerr := db.Begin(false)
-			if rerr != nil {
-				t.Fatal(rerr)
-			}
-			go f(rtx)
-		}
-		if err := tx.Commit(); err != nil {
-			t.Fatal(err)
+	// A read-only open cannot replay the log.
+	if _, err := bolt.Open(db.f, 0666, &bolt.Options{ReadOnly: true}); err != bolt.ErrWALNotReplayed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db.MustReopen()
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("widgets")).Stats().KeyN; n != 10 {
+			t.Fatalf("unexpected key count: %d", n)
 		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-	wg.Wait()
+	if sz := fileSize(walPath); sz != 0 {
+		t.Fatalf("unexpected log size after replay: %d", sz)
+	}
+	db.MustCheck()
 }
 
-// Ensure that opening a transaction while the DB is closed returns an error.
-func TestDB_BeginRW_Closed(t *testing.T) {
-	var db bolt.DB
-	if _, err := db.Begin(true); err != bolt.ErrDatabaseNotOpen {
-		t.Fatalf("unexpected error: %s", err)
+// Ensure that the log is checkpointed once it reaches WALCheckpointBytes.
+func TestDB_WALMode_CheckpointBytes(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{WALMode: true, WALCheckpointBytes: 1})
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if sz := fileSize(db.f + "-wal"); sz != 0 {
+		t.Fatalf("unexpected log size: %d", sz)
 	}
 }
 
@@ -999,6 +2796,105 @@ func TestDB_View_Panic(t *testing.T) {
 	}
 }
 
+// Ensure that SafeView returns an error instead of panicking on a corrupted page.
+func TestDB_SafeView(t *testing.T) {
+	db := MustOpenDB()
+	// The database is corrupted on purpose, so skip the check of MustClose.
+	defer os.Remove(db.f)
+	defer db.DB.Close()
+
+	var root uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		root = tx.Bucket([]byte("widgets")).Root()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clear the flags of the root page of the bucket, so that it is neither
+	// a branch nor a leaf page.
+	f, err := os.OpenFile(db.f, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0, 0}, int64(root)*int64(db.Info().PageSize)+8); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.SafeView(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte("widgets")).Get(u64tob(50))
+		return nil
+	})
+	perr, ok := err.(*bolt.PanicError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	} else if perr.PageID != root {
+		t.Fatalf("unexpected page id: %d != %d", perr.PageID, root)
+	}
+
+	// The database remains usable.
+	if err := db.SafeView(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that the names of top-level buckets can be listed.
+func TestDB_Buckets(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if names, err := db.Buckets(); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatalf("unexpected names: %q", names)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"widgets", "foo", "bar"} {
+			b, err := tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			if _, err := b.CreateBucket([]byte("child")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := db.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := [][]byte{[]byte("bar"), []byte("foo"), []byte("widgets")}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("unexpected names: %q", names)
+	}
+}
+
 // Ensure that DB stats can be returned.
 func TestDB_Stats(t *testing.T) {
 	db := MustOpenDB()
@@ -1093,8 +2989,10 @@ func TestDBStats_Sub(t *testing.T) {
 	var a, b bolt.Stats
 	a.TxStats.PageCount = 3
 	a.FreePageN = 4
+	a.OpenTxN = 1
 	b.TxStats.PageCount = 10
 	b.FreePageN = 14
+	b.OpenTxN = 2
 	diff := b.Sub(&a)
 	if diff.TxStats.PageCount != 7 {
 		t.Fatalf("unexpected TxStats.PageCount: %d", diff.TxStats.PageCount)
@@ -1104,6 +3002,30 @@ func TestDBStats_Sub(t *testing.T) {
 	if diff.FreePageN != 14 {
 		t.Fatalf("unexpected FreePageN: %d", diff.FreePageN)
 	}
+	if diff.OpenTxN != 2 {
+		t.Fatalf("unexpected OpenTxN: %d", diff.OpenTxN)
+	}
+}
+
+// Ensure that every transaction stat is subtracted.
+func TestTxStats_Sub(t *testing.T) {
+	var a, b bolt.TxStats
+	av, bv := reflect.ValueOf(&a).Elem(), reflect.ValueOf(&b).Elem()
+	for i := 0; i < av.NumField(); i++ {
+		av.Field(i).SetInt(int64(i + 1))
+		bv.Field(i).SetInt(int64(3 * (i + 1)))
+	}
+
+	diff := b.Sub(&a)
+	dv := reflect.ValueOf(diff)
+	for i := 0; i < dv.NumField(); i++ {
+		if v := dv.Field(i).Int(); v != int64(2*(i+1)) {
+			t.Fatalf("unexpected %s: %d", dv.Type().Field(i).Name, v)
+		}
+	}
+	if diff := b.Sub(nil); diff != b {
+		t.Fatalf("unexpected diff: %+v", diff)
+	}
 }
 
 // Ensure two functions can perform updates in a single batch.
@@ -1289,6 +3211,63 @@ func TestDB_BatchTime(t *testing.T) {
 	}
 }
 
+// Ensure that batch parameters can be changed while batches are running.
+func TestDB_SetBatchParams(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 100
+	// buffered so we never leak goroutines
+	ch := make(chan error, size)
+	for i := 0; i < size; i++ {
+		go func(i int) {
+			ch <- db.Batch(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte("widgets")).Put(u64tob(uint64(i)), []byte{})
+			})
+		}(i)
+		db.SetBatchParams(i%10+1, time.Duration(i%3)*time.Millisecond)
+	}
+
+	// A batch of one must trigger without waiting for the delay.
+	db.SetBatchParams(1, time.Hour)
+	go func() {
+		ch <- db.Batch(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).Put(u64tob(size), []byte{})
+		})
+	}()
+
+	// Check all responses to make sure there's no error.
+	for i := 0; i <= size; i++ {
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for batch")
+		}
+	}
+
+	// Ensure data is correct.
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		for i := 0; i <= size; i++ {
+			if v := b.Get(u64tob(uint64(i))); v == nil {
+				t.Errorf("key not found: %d", i)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func ExampleDB_Update() {
 	// Open the database.
 	db, err := bolt.Open(tempfile(), 0666, nil)
@@ -1742,6 +3721,38 @@ func (db *DB) CopyTempFile() {
 }
 
 // tempfile returns a temporary file path.
+// recordingLogger is a bolt.Logger which records every message.
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) Debugf(format string, v ...interface{}) { l.record("debug", format, v) }
+func (l *recordingLogger) Warnf(format string, v ...interface{})  { l.record("warn", format, v) }
+func (l *recordingLogger) Errorf(format string, v ...interface{}) { l.record("error", format, v) }
+
+func (l *recordingLogger) record(level, format string, v []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, level+": "+fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+// contains returns whether any recorded message starts with prefix.
+func (l *recordingLogger) contains(prefix string) bool {
+	for _, msg := range l.messages() {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func tempfile() string {
 	f, err := ioutil.TempFile("", "bolt-")
 	if err != nil {
@@ -0,0 +1,248 @@
+package bbolt
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+// cipherVersion identifies how encrypted databases are encrypted: the page
+// key is derived from Options.EncryptionKey and the salt with HMAC-SHA256,
+// and pages are sealed with AES-256-GCM.
+const cipherVersion = 1
+
+// MinEncryptionKeySize is the minimum length of Options.EncryptionKey.
+const MinEncryptionKeySize = 16
+
+const (
+	encryptionSaltSize  = 16
+	encryptionCheckSize = 16
+	encryptionNonceSize = 12
+
+	// encryptionOverhead is the size of the authentication tag and the
+	// nonce at the end of every encrypted page.
+	encryptionOverhead = 16 + encryptionNonceSize
+)
+
+// encryption describes how an encrypted database is encrypted. It is stored
+// in its meta pages.
+type encryption struct {
+	version uint32
+	salt    [encryptionSaltSize]byte
+
+	// keyCheck is derived from the key like the page key, so that a wrong
+	// key is reported on open rather than as corrupted pages.
+	keyCheck [encryptionCheckSize]byte
+}
+
+// newEncryption returns the description of a new encrypted database, with a
+// random salt.
+func newEncryption(key []byte) (encryption, error) {
+	e := encryption{version: cipherVersion}
+	if _, err := io.ReadFull(rand.Reader, e.salt[:]); err != nil {
+		return encryption{}, err
+	}
+	copy(e.keyCheck[:], deriveKey(key, "bbolt key check", e.salt[:]))
+	return e, nil
+}
+
+// deriveKey derives a key for the given purpose from key and salt.
+func deriveKey(key []byte, label string, salt []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(label))
+	_, _ = h.Write(salt)
+	return h.Sum(nil)
+}
+
+// pageCipher encrypts and decrypts the pages of an encrypted database.
+//
+// An encrypted page, including its overflow pages, keeps its header in
+// plaintext so that its size is known before it is decrypted, and ends with
+// the authentication tag and a random nonce. The header is authenticated
+// along with the encrypted contents, so a page cannot be moved to another id.
+type pageCipher struct {
+	aead cipher.AEAD
+}
+
+// newPageCipher returns the cipher for the database described by e, or
+// ErrEncryptionKeyMismatch if it was encrypted with another key.
+func newPageCipher(key []byte, e *encryption) (*pageCipher, error) {
+	if e.version != cipherVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", e.version)
+	}
+	check := deriveKey(key, "bbolt key check", e.salt[:])
+	if !hmac.Equal(check[:encryptionCheckSize], e.keyCheck[:]) {
+		return nil, ErrEncryptionKeyMismatch
+	}
+	block, err := aes.NewCipher(deriveKey(key, "bbolt page key", e.salt[:]))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &pageCipher{aead: aead}, nil
+}
+
+// seal returns an encrypted copy of the pages in data, whose last
+// encryptionOverhead bytes are reserved for the tag and nonce.
+func (c *pageCipher) seal(data []byte) ([]byte, error) {
+	span := len(data)
+	out := make([]byte, span)
+	copy(out, data[:pageHeaderSize])
+	nonce := out[span-encryptionNonceSize:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	c.aead.Seal(out[pageHeaderSize:pageHeaderSize], nonce, data[pageHeaderSize:span-encryptionOverhead], data[:pageHeaderSize])
+	return out, nil
+}
+
+// open returns a decrypted copy of the pages in data, read as page id.
+func (c *pageCipher) open(id pgid, data []byte) (*page, error) {
+	if p := (*page)(unsafe.Pointer(&data[0])); p.id != id {
+		return nil, fmt.Errorf("stored as page %d", p.id)
+	}
+	span := len(data)
+	out := make([]byte, span)
+	copy(out, data[:pageHeaderSize])
+	nonce := data[span-encryptionNonceSize:]
+	if _, err := c.aead.Open(out[pageHeaderSize:pageHeaderSize], nonce, data[pageHeaderSize:span-encryptionNonceSize], data[:pageHeaderSize]); err != nil {
+		return nil, errors.New("decryption failed")
+	}
+	return (*page)(unsafe.Pointer(&out[0])), nil
+}
+
+// setEncryptionKey validates and keeps a copy of Options.EncryptionKey.
+func (db *DB) setEncryptionKey(key []byte) error {
+	if key == nil {
+		return nil
+	} else if len(key) < MinEncryptionKeySize {
+		return fmt.Errorf("encryption key shorter than %d bytes", MinEncryptionKeySize)
+	}
+	db.encryptionKey = append([]byte(nil), key...)
+	return nil
+}
+
+// loadEncryption sets up the cipher of an encrypted database from its meta
+// page and the key passed in Options.EncryptionKey.
+func (db *DB) loadEncryption() error {
+	m := db.meta()
+	if m.flags&featureEncryption == 0 {
+		if db.encryptionKey != nil {
+			return ErrNotEncrypted
+		}
+		db.cipher = nil
+		return nil
+	} else if db.encryptionKey == nil {
+		return ErrEncryptionKeyRequired
+	}
+	c, err := newPageCipher(db.encryptionKey, &m.encryption)
+	if err != nil {
+		return err
+	}
+	db.cipher = c
+	return nil
+}
+
+// openPage returns page id, decrypted if the database is encrypted. Unlike
+// page, it returns an error if the page cannot be decrypted.
+func (db *DB) openPage(id pgid) (*page, error) {
+	p := db.rawPage(id)
+	if db.cipher == nil || id <= 1 {
+		return p, nil
+	}
+	span := (int(p.overflow) + 1) * db.pageSize
+	if int(id)*db.pageSize+span > db.datasz {
+		return nil, errors.New("overflow beyond end of database")
+	}
+	return db.cipher.open(id, unsafeByteSlice(unsafe.Pointer(p), 0, 0, span))
+}
+
+// sealPages returns the pages in data as written to the file: encrypted if
+// the database is encrypted, and data itself otherwise.
+func (db *DB) sealPages(data []byte) ([]byte, error) {
+	if db.cipher == nil {
+		return data, nil
+	}
+	return db.cipher.seal(data)
+}
+
+// pageTrailerSize returns the number of bytes reserved at the end of the
+// pages written by commits, for the checksum or the encryption tag and nonce.
+func (db *DB) pageTrailerSize() int {
+	if db.cipher != nil {
+		return encryptionOverhead
+	} else if db.PageChecksums {
+		return pageChecksumSize
+	}
+	return 0
+}
+
+// decryptedCacheSize is the number of decrypted pages a transaction keeps.
+// Pages which are still referenced, by a cursor or through a key or value
+// returned from them, stay valid after they are evicted, and are decrypted
+// again if they are read again.
+const decryptedCacheSize = 256
+
+// pageCache holds the pages decrypted most recently, up to a limit.
+type pageCache struct {
+	max   int
+	order *list.List // of *cachedPage, most recently used first
+	pages map[pgid]*list.Element
+}
+
+type cachedPage struct {
+	id pgid
+	p  *page
+}
+
+// newPageCache returns an empty cache holding up to max pages.
+func newPageCache(max int) *pageCache {
+	return &pageCache{max: max, order: list.New(), pages: make(map[pgid]*list.Element)}
+}
+
+// get returns page id if it is cached, and marks it as used.
+func (c *pageCache) get(id pgid) (*page, bool) {
+	if c == nil {
+		return nil, false
+	}
+	e, ok := c.pages[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedPage).p, true
+}
+
+// add caches p as page id, evicting the page used least recently if the
+// cache is full.
+func (c *pageCache) add(id pgid, p *page) {
+	if e, ok := c.pages[id]; ok {
+		e.Value.(*cachedPage).p = p
+		c.order.MoveToFront(e)
+		return
+	}
+	c.pages[id] = c.order.PushFront(&cachedPage{id: id, p: p})
+	if c.order.Len() > c.max {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.pages, e.Value.(*cachedPage).id)
+	}
+}
+
+// len returns the number of cached pages.
+func (c *pageCache) len() int {
+	if c == nil {
+		return 0
+	}
+	return c.order.Len()
+}
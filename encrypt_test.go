@@ -0,0 +1,81 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Ensure that the cache of decrypted pages evicts the page used least
+// recently.
+func TestPageCache(t *testing.T) {
+	c := newPageCache(2)
+	p1, p2, p3 := &page{id: 1}, &page{id: 2}, &page{id: 3}
+	c.add(1, p1)
+	c.add(2, p2)
+	if p, ok := c.get(1); !ok || p != p1 {
+		t.Fatal("expected page 1")
+	}
+	c.add(3, p3)
+	if _, ok := c.get(2); ok {
+		t.Fatal("expected page 2 to be evicted")
+	} else if p, ok := c.get(1); !ok || p != p1 {
+		t.Fatal("expected page 1")
+	} else if p, ok := c.get(3); !ok || p != p3 {
+		t.Fatal("expected page 3")
+	} else if n := c.len(); n != 2 {
+		t.Fatalf("unexpected length: %d", n)
+	}
+}
+
+// Ensure that scanning an encrypted database keeps a bounded number of
+// decrypted pages.
+func TestTx_DecryptedPagesBounded(t *testing.T) {
+	db, err := OpenInMemory(&Options{EncryptionKey: []byte("0123456789abcdef0123456789abcdef")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = db.Close() }()
+
+	value := bytes.Repeat([]byte("x"), 200)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10000; i++ {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, uint64(i))
+			if err := b.Put(k, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var n int
+		if err := tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+			if !bytes.Equal(v, value) {
+				t.Fatalf("unexpected value for %x", k)
+			}
+			n++
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if n != 10000 {
+			t.Fatalf("unexpected key count: %d", n)
+		} else if l := tx.decrypted.len(); l != decryptedCacheSize {
+			t.Fatalf("unexpected cached pages: %d", l)
+		}
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -23,9 +23,66 @@ var (
 	// ErrChecksum is returned when either meta page checksum does not match.
 	ErrChecksum = errors.New("checksum error")
 
+	// ErrPageSizeMismatch is returned when Options.PageSize is set and the
+	// data file was created with a different page size.
+	ErrPageSizeMismatch = errors.New("page size mismatch")
+
 	// ErrTimeout is returned when a database cannot obtain an exclusive lock
 	// on the data file after the timeout passed to Open().
 	ErrTimeout = errors.New("timeout")
+
+	// ErrLocked is matched by the error OpenContext returns when its context
+	// is done while another process still holds the lock on the data file,
+	// along with the error of the context. Like ErrTimeout, it means that the
+	// database is in use.
+	ErrLocked = errors.New("database locked by another process")
+
+	// ErrIncrementalBaseTooOld is returned by Tx.WriteIncrementalTo and
+	// Tx.ChangedKeysSince when the base transaction predates the opening of
+	// the database.
+	ErrIncrementalBaseTooOld = errors.New("incremental backup base too old")
+
+	// ErrChangesNotTracked is returned by Tx.WriteIncrementalTo and
+	// Tx.ChangedKeysSince when the database was opened without
+	// Options.TrackChanges.
+	ErrChangesNotTracked = errors.New("changes not tracked")
+
+	// ErrIncrementalMismatch is returned by ApplyIncremental when the backup
+	// file is not the one the incremental backup was based on.
+	ErrIncrementalMismatch = errors.New("incremental backup does not match base")
+
+	// ErrNoLockWritable is returned when Options.NoLock is set without
+	// Options.ReadOnly.
+	ErrNoLockWritable = errors.New("NoLock requires ReadOnly")
+
+	// ErrPreferMetaWritable is returned when Options.PreferMeta is set
+	// without Options.ReadOnly.
+	ErrPreferMetaWritable = errors.New("PreferMeta requires ReadOnly")
+
+	// ErrWALNotReplayed is returned when a database is opened read-only
+	// while its write-ahead log holds commits, which only a read-write open
+	// can replay.
+	ErrWALNotReplayed = errors.New("write-ahead log not replayed")
+
+	// ErrMetaNotFound is returned when the meta page selected by
+	// Options.PreferMeta does not exist or is not valid.
+	ErrMetaNotFound = errors.New("meta page not found")
+
+	// ErrKeyComparatorRequired is returned when opening a database whose
+	// keys are ordered by an Options.KeyComparator without one.
+	ErrKeyComparatorRequired = errors.New("key comparator required")
+
+	// ErrEncryptionKeyRequired is returned when opening an encrypted
+	// database without Options.EncryptionKey.
+	ErrEncryptionKeyRequired = errors.New("encryption key required")
+
+	// ErrEncryptionKeyMismatch is returned when Options.EncryptionKey is not
+	// the key the database was encrypted with.
+	ErrEncryptionKeyMismatch = errors.New("encryption key mismatch")
+
+	// ErrNotEncrypted is returned when Options.EncryptionKey is set to open
+	// a database which is not encrypted.
+	ErrNotEncrypted = errors.New("database not encrypted")
 )
 
 // These errors can occur when beginning or committing a Tx.
@@ -34,13 +91,21 @@ var (
 	// read-only transaction.
 	ErrTxNotWritable = errors.New("tx not writable")
 
-	// ErrTxClosed is returned when committing or rolling back a transaction
-	// that has already been committed or rolled back.
+	// ErrTxClosed is returned when committing a transaction that has already
+	// been committed or rolled back.
 	ErrTxClosed = errors.New("tx closed")
 
 	// ErrDatabaseReadOnly is returned when a mutating transaction is started on a
 	// read-only database.
 	ErrDatabaseReadOnly = errors.New("database is in read-only mode")
+
+	// ErrSavepointNotFound is returned by Tx.RollbackTo when the savepoint
+	// does not exist or was released by rolling back to an earlier one.
+	ErrSavepointNotFound = errors.New("savepoint not found")
+
+	// ErrNotExtensionPage is returned by Tx.ReadPages and Tx.FreePages when
+	// the pages were not allocated by Tx.AllocatePages.
+	ErrNotExtensionPage = errors.New("page not allocated by AllocatePages")
 )
 
 // These errors can occur when putting or deleting a value or a bucket.
@@ -55,15 +120,33 @@ var (
 	// ErrBucketNameRequired is returned when creating a bucket with a blank name.
 	ErrBucketNameRequired = errors.New("bucket name required")
 
+	// ErrBucketMoveCycle is returned by Bucket.MoveBucket when the destination
+	// is the bucket being moved or nested within it.
+	ErrBucketMoveCycle = errors.New("cannot move bucket into itself")
+
 	// ErrKeyRequired is returned when inserting a zero-length key.
 	ErrKeyRequired = errors.New("key required")
 
-	// ErrKeyTooLarge is returned when inserting a key that is larger than MaxKeySize.
+	// ErrKeyTooLarge is returned when inserting a key that is larger than
+	// MaxKeySize or DB.MaxKeySize.
 	ErrKeyTooLarge = errors.New("key too large")
 
-	// ErrValueTooLarge is returned when inserting a value that is larger than MaxValueSize.
+	// ErrValueTooLarge is returned when inserting a value that is larger than
+	// MaxValueSize or DB.MaxValueSize.
 	ErrValueTooLarge = errors.New("value too large")
 
+	// ErrSequenceBatchSize is returned by Bucket.NextSequenceBatch when the
+	// batch is empty or would overflow the sequence.
+	ErrSequenceBatchSize = errors.New("invalid sequence batch size")
+
+	// ErrFillPercent is returned by Bucket.SetFillPercent when the fill
+	// percent is out of range.
+	ErrFillPercent = errors.New("fill percent out of range")
+
+	// ErrKeysOutOfOrder is returned by Bucket.BulkLoad when a key does not
+	// sort after the key before it.
+	ErrKeysOutOfOrder = errors.New("keys out of order")
+
 	// ErrIncompatibleValue is returned when trying create or delete a bucket
 	// on an existing non-bucket key or when trying to create or delete a
 	// non-bucket key on an existing bucket key.
@@ -0,0 +1,312 @@
+package bbolt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+)
+
+// exportMagic identifies a stream written by DB.Export.
+const exportMagic uint32 = 0xED0CDAEF
+
+// exportVersion is the version of the stream format written by DB.Export.
+// Version 2 added exportExpiringKeyValue records; Import reads both.
+const exportVersion uint32 = 2
+
+// Record types in an export stream. Every bucket record is followed by the
+// records of its contents and a matching exportEndBucket record.
+const (
+	exportEnd       = 0x00
+	exportKeyValue  = 0x01
+	exportBucket    = 0x02
+	exportEndBucket = 0x03
+
+	// exportExpiringKeyValue is a key/value record followed by the expiry
+	// time of the key, in nanoseconds since the Unix epoch.
+	exportExpiringKeyValue = 0x04
+)
+
+// Export writes the buckets, keys and values of the database to w as a
+// portable stream which Import rebuilds into another database. Unlike WriteTo
+// the stream does not contain pages, so it does not depend on the page size
+// or layout of the database. Bucket sequences and fill percents persisted
+// with Bucket.SetFillPercent are preserved, and keys set with PutWithTTL keep
+// their expiry time, including expired keys not yet removed by Expire.
+//
+// The stream starts with a header holding its version and ends with a
+// checksum of everything written before it. All data is read from a single
+// read-only transaction.
+func (db *DB) Export(w io.Writer) error {
+	return db.View(func(tx *Tx) error {
+		h := fnv.New64a()
+		bw := bufio.NewWriter(io.MultiWriter(w, h))
+		ew := &exportWriter{w: bw}
+
+		ew.uint32(exportMagic)
+		ew.uint32(exportVersion)
+		if err := tx.ForEach(func(name []byte, b *Bucket) error {
+			return ew.bucket(name, b)
+		}); err != nil {
+			return err
+		}
+		ew.byte(exportEnd)
+		if ew.err != nil {
+			return ew.err
+		}
+
+		// Flush before summing so the checksum covers the whole stream.
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, h.Sum64()); err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// exportWriter writes the records of an export stream, keeping the first
+// error it encounters.
+type exportWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (ew *exportWriter) byte(c byte) {
+	if ew.err == nil {
+		ew.err = ew.w.WriteByte(c)
+	}
+}
+
+func (ew *exportWriter) uint32(v uint32) {
+	if ew.err == nil {
+		ew.err = binary.Write(ew.w, binary.BigEndian, v)
+	}
+}
+
+func (ew *exportWriter) uvarint(v uint64) {
+	if ew.err == nil {
+		var buf [binary.MaxVarintLen64]byte
+		_, ew.err = ew.w.Write(buf[:binary.PutUvarint(buf[:], v)])
+	}
+}
+
+func (ew *exportWriter) bytes(b []byte) {
+	ew.uvarint(uint64(len(b)))
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(b)
+	}
+}
+
+// bucket writes b, stored under name, and its contents.
+func (ew *exportWriter) bucket(name []byte, b *Bucket) error {
+	ew.byte(exportBucket)
+	ew.bytes(name)
+	ew.uvarint(b.Sequence())
+	ew.uvarint(uint64(b.fillPercent))
+	if err := b.forEachElement(func(k, v []byte, flags uint32) error {
+		if (flags & bucketLeafFlag) != 0 {
+			return ew.bucket(k, b.Bucket(k))
+		}
+		var expires uint64
+		if (flags & expiringValueFlag) != 0 {
+			expires, v = binary.BigEndian.Uint64(v), v[expiryPrefixSize:]
+		}
+		if (flags & compressedValueFlag) != 0 {
+			v = mustDecompressValue(v)
+		}
+
+		if (flags & expiringValueFlag) != 0 {
+			ew.byte(exportExpiringKeyValue)
+		} else {
+			ew.byte(exportKeyValue)
+		}
+		ew.bytes(k)
+		ew.bytes(v)
+		if (flags & expiringValueFlag) != 0 {
+			ew.uvarint(expires)
+		}
+		return ew.err
+	}); err != nil {
+		return err
+	}
+	ew.byte(exportEndBucket)
+	return ew.err
+}
+
+// Import reads a stream written by DB.Export from r and recreates its buckets,
+// keys and values in dst. The top-level buckets in the stream must not exist
+// in dst yet.
+//
+// The stream is applied in a single transaction, which is only committed
+// once the checksum at the end of the stream has been verified.
+// ErrVersionMismatch is returned for streams written by an unsupported
+// version and ErrChecksum if the stream is corrupted.
+func Import(r io.Reader, dst *DB) error {
+	h := fnv.New64a()
+	br := bufio.NewReader(r)
+	ir := &importReader{r: br, h: h}
+
+	if magic := ir.uint32(); ir.err == nil && magic != exportMagic {
+		return ErrInvalid
+	}
+	if version := ir.uint32(); ir.err == nil && (version < 1 || version > exportVersion) {
+		return ErrVersionMismatch
+	}
+	if ir.err != nil {
+		return ir.err
+	}
+
+	return dst.Update(func(tx *Tx) error {
+		var stack []*Bucket
+		for {
+			typ := ir.byte()
+			if ir.err != nil {
+				return ir.err
+			}
+			switch typ {
+			case exportEnd:
+				if len(stack) != 0 {
+					return fmt.Errorf("export stream ended inside a bucket")
+				}
+				sum := h.Sum64()
+				var expected uint64
+				if err := binary.Read(br, binary.BigEndian, &expected); err != nil {
+					return err
+				} else if sum != expected {
+					return ErrChecksum
+				}
+				return nil
+
+			case exportBucket:
+				name := ir.bytes()
+				seq := ir.uvarint()
+				fillPercent := ir.uvarint()
+				if ir.err != nil {
+					return ir.err
+				}
+				var b *Bucket
+				var err error
+				if len(stack) == 0 {
+					b, err = tx.CreateBucket(name)
+				} else {
+					b, err = stack[len(stack)-1].CreateBucket(name)
+				}
+				if err != nil {
+					return err
+				}
+				if fillPercent != 0 {
+					if err := b.SetFillPercent(float64(fillPercent) / 100); err != nil {
+						return err
+					}
+				}
+				if err := b.SetSequence(seq); err != nil {
+					return err
+				}
+				stack = append(stack, b)
+
+			case exportKeyValue, exportExpiringKeyValue:
+				k := ir.bytes()
+				v := ir.bytes()
+				var expires uint64
+				if typ == exportExpiringKeyValue {
+					expires = ir.uvarint()
+				}
+				if ir.err != nil {
+					return ir.err
+				}
+				if len(stack) == 0 {
+					return fmt.Errorf("export stream has a key outside of a bucket")
+				}
+				var err error
+				if typ == exportExpiringKeyValue {
+					err = stack[len(stack)-1].putExpiring(k, v, int64(expires))
+				} else {
+					err = stack[len(stack)-1].Put(k, v)
+				}
+				if err != nil {
+					return err
+				}
+
+			case exportEndBucket:
+				if len(stack) == 0 {
+					return fmt.Errorf("export stream has an unmatched bucket end")
+				}
+				stack = stack[:len(stack)-1]
+
+			default:
+				return fmt.Errorf("export stream has unknown record type %#x", typ)
+			}
+		}
+	})
+}
+
+// importReader reads the records of an export stream, adding everything it
+// reads to h and keeping the first error it encounters.
+type importReader struct {
+	r   *bufio.Reader
+	h   hash.Hash64
+	err error
+}
+
+func (ir *importReader) read(n int) []byte {
+	if ir.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	if _, ir.err = io.ReadFull(ir.r, buf); ir.err != nil {
+		return nil
+	}
+	_, _ = ir.h.Write(buf)
+	return buf
+}
+
+func (ir *importReader) byte() byte {
+	if buf := ir.read(1); buf != nil {
+		return buf[0]
+	}
+	return 0
+}
+
+func (ir *importReader) uint32() uint32 {
+	if buf := ir.read(4); buf != nil {
+		return binary.BigEndian.Uint32(buf)
+	}
+	return 0
+}
+
+func (ir *importReader) uvarint() uint64 {
+	if ir.err != nil {
+		return 0
+	}
+	var buf []byte
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		c, err := ir.r.ReadByte()
+		if err != nil {
+			ir.err = err
+			return 0
+		}
+		buf = append(buf, c)
+		if c < 0x80 {
+			_, _ = ir.h.Write(buf)
+			v, _ := binary.Uvarint(buf)
+			return v
+		}
+	}
+	ir.err = fmt.Errorf("export stream has an invalid length")
+	return 0
+}
+
+func (ir *importReader) bytes() []byte {
+	n := ir.uvarint()
+	if ir.err == nil && n > uint64(MaxValueSize) {
+		ir.err = fmt.Errorf("export stream has an invalid length")
+	}
+	if ir.err != nil {
+		return nil
+	}
+	return ir.read(int(n))
+}
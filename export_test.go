@@ -0,0 +1,177 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that an exported database can be imported with a different page size.
+func TestDB_Export(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.SetFillPercent(0.9); err != nil {
+			return err
+		}
+		if err := b.SetSequence(42); err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		child, err := b.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		if err := child.Put([]byte("foo"), []byte{}); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket([]byte("empty"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempfile()
+	defer os.Remove(path)
+	dst, err := bolt.Open(path, 0600, &bolt.Options{PageSize: 8192})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := bolt.Import(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.View(func(dtx *bolt.Tx) error {
+		for err := range dtx.Check() {
+			t.Fatal(err)
+		}
+		if fp := dtx.Bucket([]byte("widgets")).FillPercent; fp != 0.9 {
+			t.Fatalf("unexpected fill percent: %v", fp)
+		}
+		return db.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				return compareBuckets(t, b, dtx.Bucket(name))
+			})
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that keys set with PutWithTTL keep their expiry through an export,
+// including keys which already expired.
+func TestDB_Export_TTL(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{Compression: bolt.CompressionFlate, CompressionThreshold: 10})
+	defer db.MustClose()
+
+	var expires time.Time
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("plain"), []byte("bar")); err != nil {
+			return err
+		}
+		if err := b.PutWithTTL([]byte("gone"), []byte("bar"), time.Nanosecond); err != nil {
+			return err
+		}
+		if err := b.PutWithTTL([]byte("live"), make([]byte, 100), time.Hour); err != nil {
+			return err
+		}
+		var ok bool
+		if expires, ok = b.ExpiresAt([]byte("live")); !ok {
+			t.Fatal("expected an expiry")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if err := bolt.Import(bytes.NewReader(buf.Bytes()), dst.DB); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if at, ok := b.ExpiresAt([]byte("live")); !ok || !at.Equal(expires) {
+			t.Fatalf("unexpected expiry: %v, %v", at, ok)
+		} else if v := b.Get([]byte("live")); !bytes.Equal(v, make([]byte, 100)) {
+			t.Fatalf("unexpected value: %x", v)
+		}
+		if _, ok := b.ExpiresAt([]byte("plain")); ok {
+			t.Fatal("unexpected expiry of a plain key")
+		}
+
+		// The expired key was kept for Expire to remove.
+		if n, err := b.Expire(time.Now()); err != nil {
+			return err
+		} else if n != 1 {
+			t.Fatalf("unexpected expired key count: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a corrupted export stream is rejected without changing dst.
+func TestImport_Checksum(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), []byte("bar"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	data[bytes.Index(data, []byte("bar"))] = 'c'
+
+	dst := MustOpenDB()
+	defer dst.MustClose()
+	if err := bolt.Import(bytes.NewReader(data), dst.DB); err != bolt.ErrChecksum {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := dst.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) != nil {
+			t.Fatal("expected import to be rolled back")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,146 @@
+package bbolt
+
+import (
+	"sort"
+	"unsafe"
+)
+
+// The allocations made by Tx.AllocatePages are not referenced by any bucket,
+// so they are recorded in the extension list, which the meta page references
+// like the freelist. Check and the freelist rebuild of NoFreelistSync find
+// them there instead of trusting the headers of unreachable pages, which may
+// hold anything once the pages are freed.
+//
+// The extension list page holds the number of allocations followed by the
+// first page and page count of each, as pgids sorted by first page.
+
+// extensionAlloc is an allocation made by AllocatePages.
+type extensionAlloc struct {
+	id pgid
+	n  int
+}
+
+// extensionListSize returns the size of an extension list page holding n
+// allocations, including its header.
+func extensionListSize(n int) int {
+	return int(pageHeaderSize) + (1+2*n)*int(unsafe.Sizeof(pgid(0)))
+}
+
+// readExtensionList returns the allocations recorded in the extension list
+// page p, by first page.
+func readExtensionList(p *page) map[pgid]int {
+	n := int(*(*pgid)(unsafeAdd(unsafe.Pointer(p), pageHeaderSize)))
+	var ids []pgid
+	unsafeSlice(unsafe.Pointer(&ids), unsafeAdd(unsafe.Pointer(p), pageHeaderSize), 1+2*n)
+	allocs := make(map[pgid]int, n)
+	for i := 1; i < len(ids); i += 2 {
+		allocs[ids[i]] = int(ids[i+1])
+	}
+	return allocs
+}
+
+// writeExtensionList writes allocs to the extension list page p.
+func writeExtensionList(p *page, allocs map[pgid]int) {
+	p.flags |= extensionListPageFlag
+	p.count = 0
+	starts := make([]pgid, 0, len(allocs))
+	for id := range allocs {
+		starts = append(starts, id)
+	}
+	sort.Sort(pgids(starts))
+
+	var ids []pgid
+	unsafeSlice(unsafe.Pointer(&ids), unsafeAdd(unsafe.Pointer(p), pageHeaderSize), 1+2*len(starts))
+	ids[0] = pgid(len(starts))
+	for i, id := range starts {
+		ids[1+2*i], ids[2+2*i] = id, pgid(allocs[id])
+	}
+}
+
+// extensionAllocs returns the allocations made by AllocatePages which are
+// visible to the transaction, by first page, loading them on first use.
+// Writable transactions change the returned map in place.
+func (tx *Tx) extensionAllocs() map[pgid]int {
+	tx.cursorlock.Lock()
+	defer tx.cursorlock.Unlock()
+	if tx.extensions == nil {
+		if tx.meta.extensions == 0 {
+			tx.extensions = make(map[pgid]int)
+		} else {
+			tx.extensions = readExtensionList(tx.page(tx.meta.extensions))
+		}
+	}
+	return tx.extensions
+}
+
+// saveExtensions records the allocations of the transaction in sp.
+func (tx *Tx) saveExtensions(sp *savepoint) {
+	sp.hwm = tx.meta.pgid
+	sp.allocatedN = len(tx.allocated)
+	sp.extensionsChanged = tx.extensionsChanged
+	if tx.extensions != nil {
+		sp.extensions = make(map[pgid]int, len(tx.extensions))
+		for id, n := range tx.extensions {
+			sp.extensions[id] = n
+		}
+	}
+	sp.pages = make(map[pgid]*page, len(tx.pages))
+	for id, p := range tx.pages {
+		sp.pages[id] = p
+	}
+}
+
+// restoreExtensions undoes the allocations made and freed by AllocatePages
+// and FreePages since sp was created. The pages freed since then must have
+// been restored on the freelist already.
+func (tx *Tx) restoreExtensions(sp *savepoint) {
+	// Return the pages allocated since then to where they came from: the
+	// freelist, or the end of the file.
+	for _, a := range tx.allocated[sp.allocatedN:] {
+		if a.id < sp.hwm {
+			tx.db.freelist.unallocate(a.id, a.n)
+		} else {
+			delete(tx.db.freelist.allocs, a.id)
+		}
+	}
+	tx.allocated = tx.allocated[:sp.allocatedN]
+	tx.meta.pgid = sp.hwm
+
+	tx.cursorlock.Lock()
+	tx.extensions = nil
+	if sp.extensions != nil {
+		tx.extensions = make(map[pgid]int, len(sp.extensions))
+		for id, n := range sp.extensions {
+			tx.extensions[id] = n
+		}
+	}
+	tx.cursorlock.Unlock()
+	tx.extensionsChanged = sp.extensionsChanged
+	tx.pages = make(map[pgid]*page, len(sp.pages))
+	for id, p := range sp.pages {
+		tx.pages[id] = p
+	}
+}
+
+// commitExtensions writes the extension list if the transaction changed it,
+// and frees the previous one.
+func (tx *Tx) commitExtensions() error {
+	if !tx.extensionsChanged {
+		return nil
+	}
+	if tx.meta.extensions != 0 {
+		tx.db.freelist.free(tx.meta.txid, tx.db.rawPage(tx.meta.extensions))
+		tx.meta.extensions = 0
+	}
+	if len(tx.extensions) == 0 {
+		return nil
+	}
+
+	p, err := tx.allocate((extensionListSize(len(tx.extensions))+tx.db.pageTrailerSize())/tx.db.pageSize + 1)
+	if err != nil {
+		return err
+	}
+	writeExtensionList(p, tx.extensions)
+	tx.meta.extensions = p.id
+	return nil
+}
@@ -0,0 +1,77 @@
+package bbolt
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The flags of the meta page record the features a database uses which
+// versions of bbolt that predate them would misread, such as element and
+// page flags they do not know. A feature is recorded by the first commit
+// using it and never cleared. Open refuses databases with features which it
+// does not support, so that such versions fail clearly instead.
+//
+// Versions of bbolt which predate the flags ignore them, so the meta pages of
+// a database using any feature also carry featuresVersion, which those
+// versions refuse with a version mismatch.
+const (
+	featureExpiringValues   = 0x01
+	featureCompressedValues = 0x02
+	featurePageChecksums    = 0x04
+	featureExtensionPages   = 0x08
+	featureEncryption       = 0x10
+	featureCustomComparator = 0x20
+
+	// supportedFeatures holds every feature this version supports.
+	supportedFeatures = featureExpiringValues | featureCompressedValues |
+		featurePageChecksums | featureExtensionPages | featureEncryption |
+		featureCustomComparator
+)
+
+// featuresVersion is the file format version of databases using any of the
+// features above. The format is otherwise that of version, which is kept in
+// the low bits.
+const featuresVersion = 1<<16 | version
+
+// UnsupportedFeatureError is returned by Open when the database uses
+// features which this version of bbolt does not support, because it was
+// written by a newer version.
+type UnsupportedFeatureError struct {
+	// Features holds the flags of the unsupported features, as found in
+	// MetaInfo.Flags.
+	Features uint32
+}
+
+// Error returns a description of the unsupported features. Their names are
+// not known to this version, so they are listed by flag.
+func (e *UnsupportedFeatureError) Error() string {
+	var flags []string
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if e.Features&bit != 0 {
+			flags = append(flags, fmt.Sprintf("0x%02x", bit))
+		}
+	}
+	return "database requires unsupported features: " + strings.Join(flags, ", ")
+}
+
+// checkFeatures returns an error if m records features which are not
+// supported.
+func (m *meta) checkFeatures() error {
+	if unsupported := m.flags &^ supportedFeatures; unsupported != 0 {
+		return &UnsupportedFeatureError{Features: unsupported}
+	}
+	return nil
+}
+
+// elementFeatures returns the features used by an element with the given
+// flags.
+func elementFeatures(flags uint32) uint32 {
+	var features uint32
+	if (flags & expiringValueFlag) != 0 {
+		features |= featureExpiringValues
+	}
+	if (flags & compressedValueFlag) != 0 {
+		features |= featureCompressedValues
+	}
+	return features
+}
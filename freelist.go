@@ -30,6 +30,7 @@ type freelist struct {
 	backwardMap    map[pgid]uint64             // key is end pgid, value is its span size
 	allocate       func(txid txid, n int) pgid // the freelist allocate func
 	free_count     func() int                  // the function which gives you free page number
+	freeSpans      func() (n, largest int)     // the function which gives you the number and largest size of free spans
 	mergeSpans     func(ids pgids)             // the mergeSpan func
 	getFreePageIDs func() []pgid               // get free pgids func
 	readIDs        func(pgids []pgid)          // readIDs func reads list of pages and init the freelist
@@ -50,12 +51,14 @@ func newFreelist(freelistType FreelistType) *freelist {
 	if freelistType == FreelistMapType {
 		f.allocate = f.hashmapAllocate
 		f.free_count = f.hashmapFreeCount
+		f.freeSpans = f.hashmapFreeSpans
 		f.mergeSpans = f.hashmapMergeSpans
 		f.getFreePageIDs = f.hashmapGetFreePageIDs
 		f.readIDs = f.hashmapReadIDs
 	} else {
 		f.allocate = f.arrayAllocate
 		f.free_count = f.arrayFreeCount
+		f.freeSpans = f.arrayFreeSpans
 		f.mergeSpans = f.arrayMergeSpans
 		f.getFreePageIDs = f.arrayGetFreePageIDs
 		f.readIDs = f.arrayReadIDs
@@ -84,6 +87,24 @@ func (f *freelist) arrayFreeCount() int {
 	return len(f.ids)
 }
 
+// arrayFreeSpans returns the number of runs of contiguous free pages and the
+// length of the longest one.
+func (f *freelist) arrayFreeSpans() (n, largest int) {
+	var size int
+	for i, id := range f.ids {
+		if i > 0 && id == f.ids[i-1]+1 {
+			size++
+		} else {
+			n++
+			size = 1
+		}
+		if size > largest {
+			largest = size
+		}
+	}
+	return n, largest
+}
+
 // pending_count returns count of pending pages
 func (f *freelist) pending_count() int {
 	var count int
@@ -255,6 +276,37 @@ func (f *freelist) rollback(txid txid) {
 	f.mergeSpans(m)
 }
 
+// rollbackTo removes the pages freed by a given pending tx after the first n.
+func (f *freelist) rollbackTo(txid txid, n int) {
+	txp := f.pending[txid]
+	if txp == nil || len(txp.ids) <= n {
+		return
+	}
+	for i := n; i < len(txp.ids); i++ {
+		delete(f.cache, txp.ids[i])
+		if tx := txp.alloctx[i]; tx != 0 {
+			f.allocs[txp.ids[i]] = tx
+		}
+	}
+	txp.ids = txp.ids[:n]
+	txp.alloctx = txp.alloctx[:n]
+	if n == 0 {
+		delete(f.pending, txid)
+	}
+}
+
+// unallocate returns the n pages starting at id, allocated by the current
+// transaction and not freed since, to the free list.
+func (f *freelist) unallocate(id pgid, n int) {
+	delete(f.allocs, id)
+	ids := make(pgids, n)
+	for i := range ids {
+		ids[i] = id + pgid(i)
+		f.cache[ids[i]] = true
+	}
+	f.mergeSpans(ids)
+}
+
 // freed returns whether a given page is in the free list.
 func (f *freelist) freed(pgid pgid) bool {
 	return f.cache[pgid]
@@ -265,17 +317,7 @@ func (f *freelist) read(p *page) {
 	if (p.flags & freelistPageFlag) == 0 {
 		panic(fmt.Sprintf("invalid freelist page: %d, page type is %s", p.id, p.typ()))
 	}
-	// If the page.count is at the max uint16 value (64k) then it's considered
-	// an overflow and the size of the freelist is stored as the first element.
-	var idx, count = 0, int(p.count)
-	if count == 0xFFFF {
-		idx = 1
-		c := *(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
-		count = int(c)
-		if count < 0 {
-			panic(fmt.Sprintf("leading element count %d overflows int", c))
-		}
-	}
+	var idx, count = p.freelistPageCount()
 
 	// Copy the list of page ids from the freelist.
 	if count == 0 {
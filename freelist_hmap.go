@@ -12,6 +12,16 @@ func (f *freelist) hashmapFreeCount() int {
 	return count
 }
 
+// hashmapFreeSpans serves the same purpose as arrayFreeSpans, but use hashmap as backend
+func (f *freelist) hashmapFreeSpans() (n, largest int) {
+	for _, size := range f.forwardMap {
+		if int(size) > largest {
+			largest = int(size)
+		}
+	}
+	return len(f.forwardMap), largest
+}
+
 // hashmapAllocate serves the same purpose as arrayAllocate, but use hashmap as backend
 func (f *freelist) hashmapAllocate(txid txid, n int) pgid {
 	if n == 0 {
@@ -349,6 +349,20 @@ func Test_freelist_ReadIDs_and_getFreePageIDs(t *testing.T) {
 
 }
 
+func Test_freelist_freeSpans(t *testing.T) {
+	for _, typ := range []FreelistType{FreelistArrayType, FreelistMapType} {
+		f := newFreelist(typ)
+		if n, largest := f.freeSpans(); n != 0 || largest != 0 {
+			t.Fatalf("%s: unexpected spans of empty freelist: %d, %d", typ, n, largest)
+		}
+
+		f.readIDs([]pgid{3, 4, 5, 6, 7, 9, 12, 13, 18})
+		if n, largest := f.freeSpans(); n != 4 || largest != 5 {
+			t.Fatalf("%s: unexpected spans: %d, %d", typ, n, largest)
+		}
+	}
+}
+
 func Test_freelist_mergeWithExist(t *testing.T) {
 	bm1 := pidSet{1: struct{}{}}
 
@@ -0,0 +1,17 @@
+package bbolt
+
+// Logger receives diagnostic messages about the internal operation of a DB,
+// such as remapping the data file or falling back to the previous meta page.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// discardLogger is the Logger used when none is set in Options.
+type discardLogger struct{}
+
+func (discardLogger) Debugf(format string, v ...interface{}) {}
+func (discardLogger) Warnf(format string, v ...interface{})  {}
+func (discardLogger) Errorf(format string, v ...interface{}) {}
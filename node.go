@@ -1,7 +1,6 @@
 package bbolt
 
 import (
-	"bytes"
 	"fmt"
 	"sort"
 	"unsafe"
@@ -79,7 +78,7 @@ func (n *node) childAt(index int) *node {
 
 // childIndex returns the index of a given child node.
 func (n *node) childIndex(child *node) int {
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, child.key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.tx.compareKeys(n.inodes[i].key, child.key) >= 0 })
 	return index
 }
 
@@ -123,10 +122,10 @@ func (n *node) put(oldKey, newKey, value []byte, pgid pgid, flags uint32) {
 	}
 
 	// Find insertion index.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, oldKey) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.tx.compareKeys(n.inodes[i].key, oldKey) >= 0 })
 
 	// Add capacity and shift nodes if we don't have an exact match and need to insert.
-	exact := (len(n.inodes) > 0 && index < len(n.inodes) && bytes.Equal(n.inodes[index].key, oldKey))
+	exact := (len(n.inodes) > 0 && index < len(n.inodes) && n.bucket.tx.sameKey(n.inodes[index].key, oldKey))
 	if !exact {
 		n.inodes = append(n.inodes, inode{})
 		copy(n.inodes[index+1:], n.inodes[index:])
@@ -143,10 +142,10 @@ func (n *node) put(oldKey, newKey, value []byte, pgid pgid, flags uint32) {
 // del removes a key from the node.
 func (n *node) del(key []byte) {
 	// Find index of key.
-	index := sort.Search(len(n.inodes), func(i int) bool { return bytes.Compare(n.inodes[i].key, key) != -1 })
+	index := sort.Search(len(n.inodes), func(i int) bool { return n.bucket.tx.compareKeys(n.inodes[i].key, key) >= 0 })
 
 	// Exit if the key isn't found.
-	if index >= len(n.inodes) || !bytes.Equal(n.inodes[index].key, key) {
+	if index >= len(n.inodes) || !n.bucket.tx.sameKey(n.inodes[index].key, key) {
 		return
 	}
 
@@ -157,11 +156,37 @@ func (n *node) del(key []byte) {
 	n.unbalanced = true
 }
 
+// delRange removes the keys within [min, max) from a leaf node, except for
+// nested buckets. A nil max leaves the range unbounded. Returns the number of
+// keys removed.
+func (n *node) delRange(min, max []byte) int {
+	compare := n.bucket.tx.compareKeys
+	inodes := n.inodes[:0]
+	for _, inode := range n.inodes {
+		if (min == nil || compare(inode.key, min) >= 0) && (max == nil || compare(inode.key, max) < 0) && (inode.flags&bucketLeafFlag) == 0 {
+			continue
+		}
+		inodes = append(inodes, inode)
+	}
+	deleted := len(n.inodes) - len(inodes)
+	n.inodes = inodes
+
+	// Mark the node as needing rebalancing.
+	if deleted > 0 {
+		n.unbalanced = true
+	}
+	return deleted
+}
+
 // read initializes the node from a page.
 func (n *node) read(p *page) {
 	n.pgid = p.id
 	n.isLeaf = ((p.flags & leafPageFlag) != 0)
-	n.inodes = make(inodes, int(p.count))
+	if n.bucket != nil {
+		n.inodes = n.bucket.tx.newInodes(int(p.count))
+	} else {
+		n.inodes = make(inodes, int(p.count))
+	}
 
 	for i := 0; i < int(p.count); i++ {
 		inode := &n.inodes[i]
@@ -360,8 +385,10 @@ func (n *node) spill() error {
 			node.pgid = 0
 		}
 
-		// Allocate contiguous space for the node.
-		p, err := tx.allocate((node.size() + tx.db.pageSize - 1) / tx.db.pageSize)
+		// Allocate contiguous space for the node, and its checksum or
+		// encryption.
+		sz := node.size() + tx.db.pageTrailerSize()
+		p, err := tx.allocate((sz + tx.db.pageSize - 1) / tx.db.pageSize)
 		if err != nil {
 			return err
 		}
@@ -372,6 +399,10 @@ func (n *node) spill() error {
 		}
 		node.pgid = p.id
 		node.write(p)
+		if tx.db.PageChecksums && tx.db.cipher == nil {
+			p.setChecksum(tx.db.pageSize)
+			tx.meta.flags |= featurePageChecksums
+		}
 		node.spilled = true
 
 		// Insert into parent inodes.
@@ -411,8 +442,14 @@ func (n *node) rebalance() {
 	// Update statistics.
 	n.bucket.tx.stats.Rebalance++
 
-	// Ignore if node is above threshold (25%) and has enough keys.
-	var threshold = n.bucket.tx.db.pageSize / 4
+	// Ignore if node is above threshold and has enough keys.
+	var rebalanceThreshold = n.bucket.tx.db.RebalanceThreshold
+	if rebalanceThreshold <= 0 {
+		rebalanceThreshold = DefaultRebalanceThreshold
+	} else if rebalanceThreshold > maxFillPercent {
+		rebalanceThreshold = maxFillPercent
+	}
+	var threshold = int(float64(n.bucket.tx.db.pageSize) * rebalanceThreshold)
 	if n.size() > threshold && len(n.inodes) > n.minKeys() {
 		return
 	}
@@ -586,7 +623,7 @@ type nodes []*node
 func (s nodes) Len() int      { return len(s) }
 func (s nodes) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
 func (s nodes) Less(i, j int) bool {
-	return bytes.Compare(s[i].inodes[0].key, s[j].inodes[0].key) == -1
+	return s[i].bucket.tx.compareKeys(s[i].inodes[0].key, s[j].inodes[0].key) < 0
 }
 
 // inode represents an internal node inside of a node.
@@ -0,0 +1,34 @@
+package bbolt
+
+import "time"
+
+// Observer is notified of transaction and memory map events as they happen,
+// for example to record tracing spans or latency histograms, which cannot be
+// derived from the cumulative counters of Stats. Methods are called inline,
+// so they must be fast, must be safe for concurrent use and must not use the
+// DB.
+type Observer interface {
+	// OnTxBegin is called when a transaction has started.
+	OnTxBegin(writable bool)
+
+	// OnTxCommit is called when a transaction has committed, with the time
+	// the commit took and the number of pages it wrote.
+	OnTxCommit(d time.Duration, pages int)
+
+	// OnTxRollback is called when a transaction is rolled back, either
+	// explicitly or because its commit failed. Read-only transactions always
+	// end with a rollback.
+	OnTxRollback()
+
+	// OnMmapGrow is called when the data file was remapped because the
+	// database outgrew the memory map, with the new size of the map.
+	OnMmapGrow(newSize int64)
+}
+
+// discardObserver is the Observer used when none is set in Options.
+type discardObserver struct{}
+
+func (discardObserver) OnTxBegin(writable bool)               {}
+func (discardObserver) OnTxCommit(d time.Duration, pages int) {}
+func (discardObserver) OnTxRollback()                         {}
+func (discardObserver) OnMmapGrow(newSize int64)              {}
@@ -2,6 +2,7 @@ package bbolt
 
 import (
 	"fmt"
+	"hash/fnv"
 	"os"
 	"sort"
 	"unsafe"
@@ -19,10 +20,42 @@ const (
 	leafPageFlag     = 0x02
 	metaPageFlag     = 0x04
 	freelistPageFlag = 0x10
+
+	// pageChecksumFlag marks branch and leaf pages which end with a checksum
+	// of the rest of the pages they span. See DB.PageChecksums.
+	pageChecksumFlag = 0x20
+
+	// extensionPageFlag marks pages handed out by Tx.AllocatePages. They are
+	// recorded in the extension list, which is marked by
+	// extensionListPageFlag; the flag itself is only informational, since it
+	// remains in pages which were freed.
+	extensionPageFlag     = 0x40
+	extensionListPageFlag = 0x80
 )
 
+// pageChecksumSize is the size of the checksum at the end of a page marked
+// with pageChecksumFlag.
+const pageChecksumSize = 8
+
 const (
 	bucketLeafFlag = 0x01
+
+	// bucketNoInlineFlag keeps a bucket on its own pages even while it is
+	// small enough to be stored inline. See BucketOptions.NoInline.
+	bucketNoInlineFlag = 0x02
+
+	// expiringValueFlag marks a value stored with the expiry time set by
+	// Bucket.PutWithTTL in front of it.
+	expiringValueFlag = 0x04
+
+	// compressedValueFlag marks a value compressed as selected by
+	// DB.Compression.
+	compressedValueFlag = 0x08
+
+	// The fill percent persisted by Bucket.SetFillPercent is stored in
+	// otherwise unused bits of the flags of the bucket's leaf element.
+	bucketFillPercentMask  = 0x7f00
+	bucketFillPercentShift = 8
 )
 
 type pgid uint64
@@ -44,15 +77,58 @@ func (p *page) typ() string {
 		return "meta"
 	} else if (p.flags & freelistPageFlag) != 0 {
 		return "freelist"
+	} else if (p.flags & extensionPageFlag) != 0 {
+		return "extension"
+	} else if (p.flags & extensionListPageFlag) != 0 {
+		return "extension list"
 	}
 	return fmt.Sprintf("unknown<%02x>", p.flags)
 }
 
+// checksum returns the FNV-1a checksum of the pages spanned by p, excluding
+// the checksum stored at their end.
+func (p *page) checksum(pageSize int) uint64 {
+	span := (int(p.overflow) + 1) * pageSize
+	h := fnv.New64a()
+	_, _ = h.Write(unsafeByteSlice(unsafe.Pointer(p), 0, 0, span-pageChecksumSize))
+	return h.Sum64()
+}
+
+// storedChecksum returns a pointer to the checksum at the end of the pages
+// spanned by p.
+func (p *page) storedChecksum(pageSize int) *uint64 {
+	span := (int(p.overflow) + 1) * pageSize
+	return (*uint64)(unsafeAdd(unsafe.Pointer(p), uintptr(span-pageChecksumSize)))
+}
+
+// setChecksum marks p as checksummed and stores its checksum.
+func (p *page) setChecksum(pageSize int) {
+	p.flags |= pageChecksumFlag
+	*p.storedChecksum(pageSize) = p.checksum(pageSize)
+}
+
 // meta returns a pointer to the metadata section of the page.
 func (p *page) meta() *meta {
 	return (*meta)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
 }
 
+// freelistPageCount returns the index of the first page id stored on a
+// freelist page and the number of page ids stored.
+func (p *page) freelistPageCount() (int, int) {
+	// If the page.count is at the max uint16 value (64k) then it's considered
+	// an overflow and the size of the freelist is stored as the first element.
+	var idx, count = 0, int(p.count)
+	if count == 0xFFFF {
+		idx = 1
+		c := *(*pgid)(unsafeAdd(unsafe.Pointer(p), unsafe.Sizeof(*p)))
+		count = int(c)
+		if count < 0 {
+			panic(fmt.Sprintf("leading element count %d overflows int", c))
+		}
+	}
+	return idx, count
+}
+
 // leafPageElement retrieves the leaf node by index
 func (p *page) leafPageElement(index uint16) *leafPageElement {
 	return (*leafPageElement)(unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p),
@@ -139,6 +215,7 @@ type PageInfo struct {
 	Type          string
 	Count         int
 	OverflowCount int
+	Children      []int // ids of the child pages of a branch page
 }
 
 type pgids []pgid
@@ -0,0 +1,152 @@
+package bbolt
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// FileReplaced reports whether Path no longer names the file the database
+// has open, because the file was renamed, removed or replaced by another.
+// The database keeps using the file it has open, so commits do not reach the
+// file now at Path until Reopen is called.
+func (db *DB) FileReplaced() (bool, error) {
+	if db.file == nil {
+		return false, ErrDatabaseNotOpen
+	}
+	info, err := db.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	pathInfo, err := os.Stat(db.path)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !os.SameFile(info, pathInfo), nil
+}
+
+// Reopen switches the database to the file now at Path, for example after
+// log rotation renamed the file and created a new one in its place. It does
+// nothing if the file open is still the one at Path.
+//
+// Reopen waits for the write transaction and all read transactions to end
+// and blocks new ones until it returns. Pending commits are synced to the old
+// file, and the write-ahead log is checkpointed into it, before the new file
+// is locked and mapped. An empty new file is initialized, unless the database
+// is read-only. The in-memory freelist is kept if the new file holds the same
+// transaction as the old one, for example because it is a copy of it, and is
+// read from the new file otherwise.
+//
+// If the new file cannot be used, for example because it is not a database
+// or has another page size, the database keeps using the old file and the
+// error is returned.
+func (db *DB) Reopen() error {
+	if db.memory != nil || db.readerAt != nil {
+		return errors.New("reopen: database has no file")
+	}
+
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+
+	if replaced, err := db.FileReplaced(); err != nil {
+		return err
+	} else if !replaced {
+		return nil
+	}
+
+	// Leave nothing of the old file unsynced.
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	if db.wal != nil {
+		if err := db.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	flag := os.O_RDWR
+	if db.readOnly {
+		flag = os.O_RDONLY
+	}
+	f, err := db.openFile(db.path, flag, 0)
+	if err != nil {
+		return err
+	}
+
+	// Block new read transactions while the file is swapped. Remapping
+	// waits for the open ones to end.
+	db.metalock.Lock()
+	prev, old, size := *db.meta(), db.file, db.datasz
+	if err := db.switchFile(f); err != nil {
+		_ = f.Close()
+		db.file = old
+		db.ops.writeAt = old.WriteAt
+		if merr := db.mmap(size); merr != nil {
+			err = merr
+		}
+		db.metalock.Unlock()
+		return err
+	}
+	db.metalock.Unlock()
+	_ = old.Close()
+
+	// The freelist of the old file only applies to an identical file.
+	m := db.meta()
+	if m.txid != prev.txid || m.checksum != prev.checksum {
+		db.readFreelist()
+		db.resetChanges(m.txid)
+		db.setTxID(m.txid)
+	}
+
+	db.Logger().Debugf("reopened %s (page size %d, tx %d)", db.path, db.pageSize, m.txid)
+	return nil
+}
+
+// switchFile locks and maps f in place of the current file, initializing it
+// if it is empty. On error, the caller must restore the old file.
+func (db *DB) switchFile(f *os.File) error {
+	db.file = f
+	db.ops.writeAt = f.WriteAt
+	if !db.noLock {
+		if err := flock(context.Background(), db, !db.readOnly, db.lockTimeout); err != nil {
+			return err
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if db.readOnly {
+			return ErrInvalid
+		} else if err := db.init(); err != nil {
+			return err
+		}
+	} else {
+		buf := make([]byte, 0x1000)
+		if n, err := f.ReadAt(buf, 0); n != len(buf) {
+			if err == nil {
+				err = ErrInvalid
+			}
+			return err
+		}
+		if m := db.pageInBuffer(buf, 0).meta(); m.validate() == nil && int(m.pageSize) != db.pageSize {
+			return ErrPageSizeMismatch
+		}
+	}
+
+	if err := db.mmap(0); err != nil {
+		return err
+	}
+	if info, err = f.Stat(); err != nil {
+		return err
+	}
+	db.filesz = int(info.Size())
+	return nil
+}
@@ -0,0 +1,141 @@
+package bbolt
+
+// SavepointID identifies a savepoint created by Tx.Savepoint.
+type SavepointID int
+
+// savepoint holds the state of a read/write transaction at the time
+// Tx.Savepoint was called.
+type savepoint struct {
+	id      SavepointID
+	buckets []savedBucket
+	pending int // number of pages freed by the transaction so far
+
+	// The state of the pages allocated by AllocatePages: the high water
+	// mark, the number of allocations made by the transaction, the
+	// allocations in the extension list and the dirty pages.
+	hwm               pgid
+	allocatedN        int
+	extensions        map[pgid]int
+	extensionsChanged bool
+	pages             map[pgid]*page
+}
+
+// savedBucket holds a copy of a bucket as it was at a savepoint.
+type savedBucket struct {
+	b     *Bucket
+	state Bucket
+}
+
+// Savepoint records the current state of the transaction, so that later
+// changes can be discarded with RollbackTo while keeping the earlier ones.
+//
+// Uncommitted changes only live in the buckets and nodes materialized by the
+// transaction, so a savepoint copies those of every bucket opened so far.
+// Creating one costs time and memory proportional to the changes made.
+func (tx *Tx) Savepoint() (SavepointID, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !tx.writable {
+		return 0, ErrTxNotWritable
+	}
+
+	tx.savepointSeq++
+	sp := &savepoint{id: tx.savepointSeq}
+	if txp := tx.db.freelist.pending[tx.meta.txid]; txp != nil {
+		sp.pending = len(txp.ids)
+	}
+	tx.saveExtensions(sp)
+	tx.root.saveTo(sp)
+	tx.savepoints = append(tx.savepoints, sp)
+	return sp.id, nil
+}
+
+// RollbackTo discards every change made since the savepoint with the given id
+// was created. The savepoint stays valid and may be rolled back to again, but
+// the savepoints created after it are released.
+//
+// Buckets obtained before the savepoint may still be used afterwards. Buckets
+// obtained after it, and all cursors, must not be used after RollbackTo.
+// Handlers registered with OnCommit and OnRollback are kept.
+//
+// Calls to AllocatePages and FreePages are undone as well, but the data
+// written to pages allocated before the savepoint is not restored.
+func (tx *Tx) RollbackTo(id SavepointID) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	for i, sp := range tx.savepoints {
+		if sp.id != id {
+			continue
+		}
+		tx.savepoints = tx.savepoints[:i+1]
+		tx.db.freelist.rollbackTo(tx.meta.txid, sp.pending)
+		tx.restoreExtensions(sp)
+		for _, saved := range sp.buckets {
+			*saved.b = saved.state.clone()
+		}
+		return nil
+	}
+	return ErrSavepointNotFound
+}
+
+// saveTo adds a copy of the bucket and of its opened subbuckets to sp.
+func (b *Bucket) saveTo(sp *savepoint) {
+	sp.buckets = append(sp.buckets, savedBucket{b: b, state: b.clone()})
+	for _, child := range b.buckets {
+		child.saveTo(sp)
+	}
+}
+
+// clone returns a copy of the bucket whose header, subbucket cache and
+// materialized nodes are not shared with b. The nodes keep pointing at the
+// bucket they were materialized for, which is where clones are restored to.
+func (b *Bucket) clone() Bucket {
+	c := *b
+	if b.bucket != nil {
+		c.bucket = &bucket{}
+		*c.bucket = *b.bucket
+	}
+	if b.buckets != nil {
+		c.buckets = make(map[string]*Bucket, len(b.buckets))
+		for name, child := range b.buckets {
+			c.buckets[name] = child
+		}
+	}
+	if b.nodes != nil {
+		clones := make(map[*node]*node, len(b.nodes))
+		c.nodes = make(map[pgid]*node, len(b.nodes))
+		for id, n := range b.nodes {
+			c.nodes[id] = n.clone(clones)
+		}
+		c.rootNode = b.rootNode.clone(clones)
+	}
+	return c
+}
+
+// clone returns a copy of the node, its parent and its children, reusing the
+// copies already made in clones.
+func (n *node) clone(clones map[*node]*node) *node {
+	if n == nil {
+		return nil
+	} else if c := clones[n]; c != nil {
+		return c
+	}
+	c := &node{}
+	*c = *n
+	clones[n] = c
+
+	c.inodes = make(inodes, len(n.inodes))
+	copy(c.inodes, n.inodes)
+	c.parent = n.parent.clone(clones)
+	if n.children != nil {
+		c.children = make(nodes, len(n.children))
+		for i, child := range n.children {
+			c.children[i] = child.clone(clones)
+		}
+	}
+	return c
+}
@@ -0,0 +1,169 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// SchemaSpec describes the buckets a database is expected to hold, for
+// validating fixtures with Tx.CheckSchema.
+type SchemaSpec struct {
+	// Buckets lists the expected buckets. The parents of a listed bucket
+	// are expected as well, without having to be listed themselves.
+	Buckets []BucketSpec
+
+	// AllowUnexpected disables reporting buckets which are not expected.
+	AllowUnexpected bool
+}
+
+// BucketSpec describes an expected bucket.
+type BucketSpec struct {
+	// Path holds the names of the bucket, outermost first.
+	Path [][]byte
+
+	// KeyN is the expected number of key/value pairs directly within the
+	// bucket, not counting nested buckets and their keys. It is not checked
+	// if negative.
+	KeyN int
+
+	// Tolerance is the fraction of KeyN by which the number of keys may
+	// differ from it, such as 0.1 for 10%.
+	Tolerance float64
+}
+
+// SchemaErrorKind identifies the kind of deviation reported by a
+// SchemaError.
+type SchemaErrorKind int
+
+const (
+	// SchemaMissingBucket means that an expected bucket does not exist.
+	SchemaMissingBucket SchemaErrorKind = iota + 1
+
+	// SchemaUnexpectedBucket means that a bucket exists which is not
+	// expected.
+	SchemaUnexpectedBucket
+
+	// SchemaKeyCount means that the number of keys in a bucket is outside
+	// the tolerance of the expected number.
+	SchemaKeyCount
+)
+
+// SchemaError describes a deviation from the schema found by
+// Tx.CheckSchema.
+type SchemaError struct {
+	// Kind identifies the deviation.
+	Kind SchemaErrorKind
+
+	// Path holds the names of the bucket concerned, outermost first.
+	Path [][]byte
+
+	// KeyN and WantKeyN are the actual and expected number of keys for
+	// SchemaKeyCount errors, and zero otherwise.
+	KeyN, WantKeyN int
+}
+
+// Error returns a description of the deviation.
+func (e *SchemaError) Error() string {
+	path := string(bytes.Join(e.Path, []byte("/")))
+	switch e.Kind {
+	case SchemaMissingBucket:
+		return fmt.Sprintf("bucket %q: missing", path)
+	case SchemaUnexpectedBucket:
+		return fmt.Sprintf("bucket %q: unexpected", path)
+	default:
+		return fmt.Sprintf("bucket %q: %d keys, expected %d", path, e.KeyN, e.WantKeyN)
+	}
+}
+
+// CheckSchema compares the buckets of the database with expected and returns
+// a *SchemaError for every missing bucket, unexpected bucket and bucket whose
+// number of keys is out of tolerance, in that order. It complements Check,
+// which validates the structure of the database but not its contents.
+// Counting keys reads every leaf page of the checked buckets.
+func (tx *Tx) CheckSchema(expected SchemaSpec) []error {
+	if tx.db == nil {
+		return []error{ErrTxClosed}
+	}
+
+	// Index the expected buckets and their parents by path.
+	specs := make(map[string]*BucketSpec)
+	parents := make(map[string]bool)
+	for i := range expected.Buckets {
+		spec := &expected.Buckets[i]
+		specs[schemaPathKey(spec.Path)] = spec
+		for n := 1; n < len(spec.Path); n++ {
+			parents[schemaPathKey(spec.Path[:n])] = true
+		}
+	}
+
+	var missing, unexpected, counts []error
+	for i := range expected.Buckets {
+		spec := &expected.Buckets[i]
+		b := tx.bucketAt(spec.Path)
+		if b == nil {
+			missing = append(missing, &SchemaError{Kind: SchemaMissingBucket, Path: spec.Path})
+		} else if spec.KeyN >= 0 {
+			n := b.directKeyN()
+			if math.Abs(float64(n-spec.KeyN)) > spec.Tolerance*float64(spec.KeyN) {
+				counts = append(counts, &SchemaError{Kind: SchemaKeyCount, Path: spec.Path, KeyN: n, WantKeyN: spec.KeyN})
+			}
+		}
+	}
+
+	if !expected.AllowUnexpected {
+		var walk func(b *Bucket, path [][]byte)
+		walk = func(b *Bucket, path [][]byte) {
+			_ = b.ForEachBucket(func(k []byte) error {
+				childPath := append(append([][]byte{}, path...), cloneBytes(k))
+				key := schemaPathKey(childPath)
+				if specs[key] == nil && !parents[key] {
+					unexpected = append(unexpected, &SchemaError{Kind: SchemaUnexpectedBucket, Path: childPath})
+					return nil
+				}
+				walk(b.Bucket(k), childPath)
+				return nil
+			})
+		}
+		walk(&tx.root, nil)
+	}
+
+	errs := append(missing, unexpected...)
+	return append(errs, counts...)
+}
+
+// bucketAt returns the bucket at path, or nil if it does not exist.
+func (tx *Tx) bucketAt(path [][]byte) *Bucket {
+	b := &tx.root
+	for _, name := range path {
+		if b = b.Bucket(name); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// directKeyN returns the number of key/value pairs directly within b.
+func (b *Bucket) directKeyN() int {
+	var n int
+	_ = b.forEachElement(func(_, v []byte, flags uint32) error {
+		if (flags&bucketLeafFlag) == 0 && !b.expired(v, flags) {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+// schemaPathKey encodes path as a map key, prefixing each name with its
+// length so that names containing separators cannot collide.
+func schemaPathKey(path [][]byte) string {
+	var buf []byte
+	var size [binary.MaxVarintLen64]byte
+	for _, name := range path {
+		buf = append(buf, size[:binary.PutUvarint(size[:], uint64(len(name)))]...)
+		buf = append(buf, name...)
+	}
+	return string(buf)
+}
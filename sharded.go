@@ -0,0 +1,158 @@
+package bbolt
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// ShardedDB spreads keys over several databases, so that writes to keys in
+// different shards are committed in parallel instead of waiting for the
+// single writer of one database. The shard owning a key is chosen by hashing
+// it, and every shard has the same buckets.
+//
+// Transactions never span shards: an Update touching several shards commits
+// each of them separately, so a failure may leave some shards updated and
+// others not. The number of shards and the hash function must stay the same
+// for the lifetime of the files, otherwise keys are looked up in the wrong
+// shard.
+type ShardedDB struct {
+	shards []*DB
+	hash   func(key []byte) uint32
+}
+
+// OpenSharded opens a database at each of paths with the given mode and
+// options, and returns a ShardedDB which routes keys to them. If hash is nil,
+// the 32-bit FNV-1a hash of the key is used. If any database fails to open,
+// the ones already opened are closed again.
+func OpenSharded(paths []string, mode os.FileMode, hash func(key []byte) uint32, options *Options) (*ShardedDB, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no shards to open")
+	}
+	if hash == nil {
+		hash = fnvHash
+	}
+
+	sdb := &ShardedDB{hash: hash}
+	for _, path := range paths {
+		db, err := Open(path, mode, options)
+		if err != nil {
+			_ = sdb.Close()
+			return nil, err
+		}
+		sdb.shards = append(sdb.shards, db)
+	}
+	return sdb, nil
+}
+
+// fnvHash is the default hash function of a ShardedDB.
+func fnvHash(key []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return h.Sum32()
+}
+
+// Shards returns the databases of the shards, in the order of their paths.
+func (sdb *ShardedDB) Shards() []*DB {
+	return sdb.shards
+}
+
+// Shard returns the database which owns key.
+func (sdb *ShardedDB) Shard(key []byte) *DB {
+	return sdb.shards[sdb.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard which owns key.
+func (sdb *ShardedDB) shardIndex(key []byte) int {
+	return int(sdb.hash(key) % uint32(len(sdb.shards)))
+}
+
+// Close closes every shard and returns the first error encountered.
+func (sdb *ShardedDB) Close() error {
+	var err error
+	for _, db := range sdb.shards {
+		if e := db.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Put sets the value of key in the named bucket of the shard owning the key,
+// creating the bucket if it does not exist.
+func (sdb *ShardedDB) Put(bucket, key, value []byte) error {
+	return sdb.Shard(key).Update(func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, value)
+	})
+}
+
+// Get returns a copy of the value of key in the named bucket of the shard
+// owning the key. It returns nil if the bucket or key does not exist.
+func (sdb *ShardedDB) Get(bucket, key []byte) ([]byte, error) {
+	var v []byte
+	err := sdb.Shard(key).View(func(tx *Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			if val := b.Get(key); val != nil {
+				v = cloneBytes(val)
+			}
+		}
+		return nil
+	})
+	return v, err
+}
+
+// Update groups keys by the shard owning them and calls fn within a
+// read-write transaction on each of those shards, in parallel, with the keys
+// of that shard. Shards owning none of the keys are skipped. The first error
+// returned by a shard is returned once all of them are done; the other
+// shards are still committed.
+func (sdb *ShardedDB) Update(keys [][]byte, fn func(tx *Tx, keys [][]byte) error) error {
+	return sdb.fanOut(keys, func(db *DB, keys [][]byte) error {
+		return db.Update(func(tx *Tx) error { return fn(tx, keys) })
+	})
+}
+
+// View groups keys by the shard owning them and calls fn within a read-only
+// transaction on each of those shards, in parallel, with the keys of that
+// shard. The first error returned by a shard is returned once all of them
+// are done.
+func (sdb *ShardedDB) View(keys [][]byte, fn func(tx *Tx, keys [][]byte) error) error {
+	return sdb.fanOut(keys, func(db *DB, keys [][]byte) error {
+		return db.View(func(tx *Tx) error { return fn(tx, keys) })
+	})
+}
+
+// fanOut calls fn concurrently for every shard owning some of keys.
+func (sdb *ShardedDB) fanOut(keys [][]byte, fn func(db *DB, keys [][]byte) error) error {
+	groups := make([][][]byte, len(sdb.shards))
+	for _, k := range keys {
+		i := sdb.shardIndex(k)
+		groups[i] = append(groups[i], k)
+	}
+
+	errs := make([]error, len(sdb.shards))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, group [][]byte) {
+			defer wg.Done()
+			errs[i] = fn(sdb.shards[i], group)
+		}(i, group)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
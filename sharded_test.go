@@ -0,0 +1,102 @@
+package bbolt_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Ensure that keys are routed to their shard and written in parallel.
+func TestShardedDB(t *testing.T) {
+	paths := []string{tempfile(), tempfile(), tempfile()}
+	for _, path := range paths {
+		defer os.Remove(path)
+	}
+	sdb, err := bolt.OpenSharded(paths, 0666, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	if err := sdb.Put([]byte("widgets"), []byte("foo"), []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := sdb.Get([]byte("widgets"), []byte("foo")); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(v, []byte("bar")) {
+		t.Fatalf("unexpected value: %q", v)
+	}
+	if v, err := sdb.Get([]byte("widgets"), []byte("missing")); err != nil || v != nil {
+		t.Fatalf("unexpected value: %q, %v", v, err)
+	}
+
+	var keys [][]byte
+	for i := 0; i < 100; i++ {
+		keys = append(keys, u64tob(uint64(i)))
+	}
+	if err := sdb.Update(keys, func(tx *bolt.Tx, keys [][]byte) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Put(k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every key is in exactly the shard which owns it.
+	var total int
+	for i, db := range sdb.Shards() {
+		if err := db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("widgets")).ForEach(func(k, v []byte) error {
+				if sdb.Shard(k) != db {
+					t.Fatalf("key %x in wrong shard %d", k, i)
+				}
+				total++
+				return nil
+			})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if total != 101 {
+		t.Fatalf("unexpected key count: %d", total)
+	}
+
+	if err := sdb.View(keys, func(tx *bolt.Tx, keys [][]byte) error {
+		for _, k := range keys {
+			if v := tx.Bucket([]byte("widgets")).Get(k); !bytes.Equal(v, k) {
+				t.Errorf("unexpected value for %x: %x", k, v)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that OpenSharded uses the given hash function.
+func TestShardedDB_Hash(t *testing.T) {
+	paths := []string{tempfile(), tempfile()}
+	for _, path := range paths {
+		defer os.Remove(path)
+	}
+	sdb, err := bolt.OpenSharded(paths, 0666, func(key []byte) uint32 { return uint32(key[0]) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sdb.Close()
+
+	if sdb.Shard([]byte{0}) != sdb.Shards()[0] {
+		t.Fatal("expected even key in first shard")
+	} else if sdb.Shard([]byte{1}) != sdb.Shards()[1] {
+		t.Fatal("expected odd key in second shard")
+	}
+}
@@ -0,0 +1,125 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// expiryPrefixSize is the size of the expiry time stored in front of the
+// values of elements marked with expiringValueFlag, in nanoseconds since the
+// Unix epoch.
+const expiryPrefixSize = 8
+
+// PutWithTTL sets the value for a key in the bucket like Put, but the key
+// expires once ttl has passed. Expired keys are skipped by Get and by
+// cursors as if they had been deleted, and are removed by Expire. Until then
+// they still take up space and count towards Stats and Cursor.Count.
+//
+// Expiry is judged against the time at which the transaction first needed
+// it, so a key does not disappear in the middle of a transaction. Putting a
+// key again with Put removes its expiry. Returns the errors of Put, or an
+// error if ttl is not positive.
+func (b *Bucket) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("non-positive ttl %s", ttl)
+	}
+	return b.putExpiring(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// putExpiring sets the value for a key which expires at the given time.
+func (b *Bucket) putExpiring(key []byte, value []byte, expires int64) error {
+	if b.tx.db == nil {
+		return ErrTxClosed
+	} else if b.valueTooLarge(len(value)) {
+		return ErrValueTooLarge
+	}
+	value, flags := b.compressValue(value)
+	v := make([]byte, expiryPrefixSize+len(value))
+	binary.BigEndian.PutUint64(v, uint64(expires))
+	copy(v[expiryPrefixSize:], value)
+	return b.put(key, v, expiringValueFlag|flags)
+}
+
+// ExpiresAt returns the time at which a key set with PutWithTTL expires. It
+// returns false if the key does not exist, has expired, has no expiry or is a
+// nested bucket.
+func (b *Bucket) ExpiresAt(key []byte) (time.Time, bool) {
+	expires, ok := b.expiry(key)
+	if !ok || expires <= b.tx.now() {
+		return time.Time{}, false
+	}
+	return time.Unix(0, expires), true
+}
+
+// expiry returns the expiry time of a key, whether expired or not, and
+// whether it has one.
+func (b *Bucket) expiry(key []byte) (int64, bool) {
+	k, v, flags := b.seekOnce(key)
+	if (flags&expiringValueFlag) == 0 || !b.tx.sameKey(key, k) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(v)), true
+}
+
+// Expire deletes the keys of the bucket which expired at or before now and
+// returns the number of keys deleted. Nested buckets are not swept.
+// Returns an error if the bucket was created from a read-only transaction.
+func (b *Bucket) Expire(now time.Time) (int, error) {
+	if b.tx.db == nil {
+		return 0, ErrTxClosed
+	} else if !b.Writable() {
+		return 0, ErrTxNotWritable
+	}
+
+	// Collect the keys first, since deleting them shifts the elements under
+	// the cursor.
+	var expired [][]byte
+	_ = b.forEachElement(func(k, v []byte, flags uint32) error {
+		if (flags&expiringValueFlag) != 0 && int64(binary.BigEndian.Uint64(v)) <= now.UnixNano() {
+			expired = append(expired, cloneBytes(k))
+		}
+		return nil
+	})
+
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
+
+// liveValue returns the value of an element as seen by users: nil for a
+// nested bucket, without the expiry time for an expiring value and
+// decompressed for a compressed value. It returns false if the value has
+// expired.
+func (b *Bucket) liveValue(v []byte, flags uint32) ([]byte, bool) {
+	if (flags & bucketLeafFlag) != 0 {
+		return nil, true
+	}
+	if (flags & expiringValueFlag) != 0 {
+		if b.expired(v, flags) {
+			return nil, false
+		}
+		v = v[expiryPrefixSize:]
+	}
+	if (flags & compressedValueFlag) != 0 {
+		v = mustDecompressValue(v)
+	}
+	return v, true
+}
+
+// expired reports whether the stored value of an element has expired.
+func (b *Bucket) expired(v []byte, flags uint32) bool {
+	return (flags&expiringValueFlag) != 0 && int64(binary.BigEndian.Uint64(v)) <= b.tx.now()
+}
+
+// copyValue sets the value v of key k, read from src, in dst, keeping its
+// expiry if it has one.
+func copyValue(dst, src *Bucket, k, v []byte) error {
+	if expires, ok := src.expiry(k); ok {
+		return dst.putExpiring(k, v, expires)
+	}
+	return dst.Put(k, v)
+}
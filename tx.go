@@ -1,11 +1,13 @@
 package bbolt
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 	"unsafe"
 )
@@ -22,14 +24,72 @@ type txid uint64
 // are using them. A long running read transaction can cause the database to
 // quickly grow.
 type Tx struct {
-	writable       bool
-	managed        bool
-	db             *DB
-	meta           *meta
-	root           Bucket
-	pages          map[pgid]*page
-	stats          TxStats
-	commitHandlers []func()
+	writable         bool
+	managed          bool
+	db               *DB
+	meta             *meta
+	root             Bucket
+	pages            map[pgid]*page
+	stats            TxStats
+	commitStats      CommitStats
+	commitHandlers   []func()
+	rollbackHandlers []func()
+
+	// written is the number of bytes of pages written by the commit, which
+	// group commit counts towards SyncBytes.
+	written int
+
+	// bucketStats caches the stats of buckets with a root page by their root
+	// pgid. Pages do not change during a transaction, so neither do the stats.
+	bucketStats map[pgid]BucketStats
+
+	// cursorlock protects the state which cursors update while reading, so
+	// that cursors of a read-only transaction can be used concurrently: the
+	// cursor count in stats, bucketStats, verified, decrypted, keyCounts,
+	// extensions, lastPage, expiryNow and lent.
+	cursorlock sync.Mutex
+
+	// verified holds the pages whose checksum has been verified.
+	verified map[pgid]struct{}
+
+	// decrypted holds the pages of an encrypted database decrypted most
+	// recently, so that pages read repeatedly are not decrypted every time.
+	decrypted *pageCache
+
+	// keyCounts caches the number of keys below branch pages, which do not
+	// change during a transaction, for Cursor.Count and SeekIndex.
+	keyCounts map[pgid]int64
+
+	// extensions holds the allocations made by AllocatePages, by first page,
+	// once loaded from the extension list. extensionsChanged is set if the
+	// transaction changed them, so that commit writes a new list.
+	extensions        map[pgid]int
+	extensionsChanged bool
+
+	// allocated holds the allocations made by AllocatePages in this
+	// transaction, in order, so that RollbackTo can undo them.
+	allocated []extensionAlloc
+
+	// lastPage is the page read last, tracked for SafeView if trackPages is
+	// set.
+	trackPages bool
+	lastPage   pgid
+
+	// expiryNow is the time, in nanoseconds since the Unix epoch, against
+	// which the expiry of values is judged, or 0 until first needed.
+	expiryNow int64
+
+	// arena holds the nodes and inodes decoded by a writable transaction of
+	// a database opened with UseArena, and is returned to it on close.
+	arena *arena
+
+	// savepoints holds the savepoints which can still be rolled back to.
+	savepoints   []*savepoint
+	savepointSeq SavepointID
+
+	// lent holds the copies of values returned while DB.ValueSafetyChecks
+	// is set, which are overwritten when the transaction is closed.
+	lent [][]byte
 
 	// WriteFlag specifies the flag for write-related methods like WriteTo().
 	// Tx opens the database file with the specified flag to copy the data.
@@ -44,6 +104,11 @@ type Tx struct {
 func (tx *Tx) init(db *DB) {
 	tx.db = db
 	tx.pages = nil
+	tx.bucketStats = nil
+	tx.verified = nil
+	tx.decrypted = nil
+	tx.keyCounts = nil
+	tx.extensions = nil
 
 	// Copy the meta page since it can be changed by the writer.
 	tx.meta = &meta{}
@@ -58,15 +123,31 @@ func (tx *Tx) init(db *DB) {
 	if tx.writable {
 		tx.pages = make(map[pgid]*page)
 		tx.meta.txid += txid(1)
+		if db.compare != nil {
+			tx.meta.flags |= featureCustomComparator
+		}
+		if db.useArena {
+			if tx.arena, _ = db.arenas.Get().(*arena); tx.arena == nil {
+				tx.arena = &arena{}
+			}
+		}
 	}
 }
 
+// Closed reports whether the transaction was committed or rolled back.
+func (tx *Tx) Closed() bool {
+	return tx.db == nil
+}
+
 // ID returns the transaction id.
 func (tx *Tx) ID() int {
 	return int(tx.meta.txid)
 }
 
-// DB returns a reference to the database that created the transaction.
+// DB returns a reference to the database that created the transaction, or
+// nil once the transaction is closed. Beginning another writable transaction
+// on it from within a writable transaction deadlocks, and so does a read-only
+// one if the writable transaction then has to grow the database.
 func (tx *Tx) DB() *DB {
 	return tx.db
 }
@@ -76,6 +157,59 @@ func (tx *Tx) Size() int64 {
 	return int64(tx.meta.pgid) * int64(tx.db.pageSize)
 }
 
+// FreeSize returns the size in bytes of the free pages which can be reused
+// without growing the database. For writable transactions this is the free
+// space that is currently available to the transaction. Read-only
+// transactions cannot access the freelist safely, so they report the free
+// space as of the last committed write transaction.
+func (tx *Tx) FreeSize() int64 {
+	var n int
+	if tx.writable {
+		n = tx.db.freelist.free_count()
+	} else {
+		tx.db.statlock.RLock()
+		n = tx.db.stats.FreePageN
+		tx.db.statlock.RUnlock()
+	}
+	return int64(n) * int64(tx.db.pageSize)
+}
+
+// DirtyPages returns the number of pages the transaction has modified so far,
+// which are written when it commits. It counts the nodes materialized by
+// writes, each of which is written as at least one page. Commit writes more
+// pages than that: nodes which grew past the page size are split, the pages
+// of parent buckets are updated to reference changed buckets, and the
+// freelist and meta pages are written. Read-only transactions have no dirty
+// pages.
+func (tx *Tx) DirtyPages() int {
+	if !tx.writable {
+		return 0
+	}
+	return len(tx.pages) + tx.root.dirtyNodes()
+}
+
+// compareKeys orders two keys with the comparator of the database.
+func (tx *Tx) compareKeys(a, b []byte) int {
+	if tx.db == nil || tx.db.compare == nil {
+		return bytes.Compare(a, b)
+	}
+	return tx.db.compare(a, b)
+}
+
+// customOrder reports whether keys are ordered by an Options.KeyComparator.
+func (tx *Tx) customOrder() bool {
+	return tx.db != nil && tx.db.compare != nil
+}
+
+// sameKey reports whether a and b are the same key for the comparator of
+// the database.
+func (tx *Tx) sameKey(a, b []byte) bool {
+	if tx.db == nil || tx.db.compare == nil {
+		return bytes.Equal(a, b)
+	}
+	return tx.db.compare(a, b) == 0
+}
+
 // Writable returns whether the transaction can perform write operations.
 func (tx *Tx) Writable() bool {
 	return tx.writable
@@ -91,6 +225,8 @@ func (tx *Tx) Cursor() *Cursor {
 
 // Stats retrieves a copy of the current transaction statistics.
 func (tx *Tx) Stats() TxStats {
+	tx.cursorlock.Lock()
+	defer tx.cursorlock.Unlock()
 	return tx.stats
 }
 
@@ -101,6 +237,11 @@ func (tx *Tx) Bucket(name []byte) *Bucket {
 	return tx.root.Bucket(name)
 }
 
+// HasBucket reports whether a bucket exists, without opening it.
+func (tx *Tx) HasBucket(name []byte) bool {
+	return tx.root.HasBucket(name)
+}
+
 // CreateBucket creates a new bucket.
 // Returns an error if the bucket already exists, if the bucket name is blank, or if the bucket name is too long.
 // The bucket instance is only valid for the lifetime of the transaction.
@@ -115,13 +256,50 @@ func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
 	return tx.root.CreateBucketIfNotExists(name)
 }
 
+// CreateBucketIfNotExistsWithOptions creates a new bucket configured by opts
+// if it doesn't already exist. See Bucket.CreateBucketIfNotExistsWithOptions.
+// The bucket instance is only valid for the lifetime of the transaction.
+func (tx *Tx) CreateBucketIfNotExistsWithOptions(name []byte, opts *BucketOptions) (*Bucket, error) {
+	return tx.root.CreateBucketIfNotExistsWithOptions(name, opts)
+}
+
 // DeleteBucket deletes a bucket.
 // Returns an error if the bucket cannot be found or if the key represents a non-bucket value.
 func (tx *Tx) DeleteBucket(name []byte) error {
 	return tx.root.DeleteBucket(name)
 }
 
-// ForEach executes a function for each bucket in the root.
+// CanCreateBucket returns the error CreateBucket would return for name,
+// without creating the bucket. See Bucket.CanCreateBucket.
+func (tx *Tx) CanCreateBucket(name []byte) error {
+	return tx.root.CanCreateBucket(name)
+}
+
+// CanDeleteBucket returns the error DeleteBucket would return for name,
+// without deleting the bucket. See Bucket.CanDeleteBucket.
+func (tx *Tx) CanDeleteBucket(name []byte) error {
+	return tx.root.CanDeleteBucket(name)
+}
+
+// CanMoveBucket returns the error MoveBucket would return for name and dst,
+// without moving the bucket. See Bucket.CanMoveBucket.
+func (tx *Tx) CanMoveBucket(name []byte, dst *Bucket) error {
+	return tx.root.CanMoveBucket(name, dst)
+}
+
+// RenameBucket moves the bucket at oldName to newName without copying its
+// contents. See Bucket.RenameBucket.
+func (tx *Tx) RenameBucket(oldName, newName []byte) error {
+	return tx.root.RenameBucket(oldName, newName)
+}
+
+// MoveBucket moves the top-level bucket name to dst without copying its
+// contents. See Bucket.MoveBucket.
+func (tx *Tx) MoveBucket(name []byte, dst *Bucket) error {
+	return tx.root.MoveBucket(name, dst)
+}
+
+// ForEach executes a function for each bucket in the root, in key order.
 // If the provided function returns an error then the iteration is stopped and
 // the error is returned to the caller.
 func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
@@ -130,29 +308,108 @@ func (tx *Tx) ForEach(fn func(name []byte, b *Bucket) error) error {
 	})
 }
 
+// ReverseForEach executes a function for each bucket in the root, in reverse
+// key order. If the provided function returns an error then the iteration is
+// stopped and the error is returned to the caller.
+func (tx *Tx) ReverseForEach(fn func(name []byte, b *Bucket) error) error {
+	return tx.root.ReverseForEach(func(k, v []byte) error {
+		return fn(k, tx.root.Bucket(k))
+	})
+}
+
+// Walk executes a function for every key in every bucket, depth first and in
+// sorted order. path holds the names of the buckets leading to the bucket
+// which contains k, and is nil for top-level buckets. Nested buckets are
+// passed with a nil value before their contents.
+// If the provided function returns an error then the walk is stopped and the
+// error is returned to the caller.
+func (tx *Tx) Walk(fn func(path [][]byte, k, v []byte) error) error {
+	return tx.ForEach(func(name []byte, b *Bucket) error {
+		return walkBucket(b, nil, name, func(path [][]byte, k, v []byte, _ *Bucket) error {
+			return fn(path, k, v)
+		})
+	})
+}
+
+// walkFunc is called by walkBucket for each key in the bucket at path.
+// child is the nested bucket stored under k, or nil if k holds the value v.
+type walkFunc func(path [][]byte, k, v []byte, child *Bucket) error
+
+// walkBucket calls fn for bucket b stored under name in the bucket at path,
+// and then for every key in b, recursing into nested buckets.
+func walkBucket(b *Bucket, path [][]byte, name []byte, fn walkFunc) error {
+	if err := fn(path, name, nil, b); err != nil {
+		return err
+	}
+
+	path = append(path[:len(path):len(path)], name)
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return walkBucket(b.Bucket(k), path, k, fn)
+		}
+		return fn(path, k, v, nil)
+	})
+}
+
 // OnCommit adds a handler function to be executed after the transaction successfully commits.
 func (tx *Tx) OnCommit(fn func()) {
 	tx.commitHandlers = append(tx.commitHandlers, fn)
 }
 
+// OnRollback adds a handler function to be executed after the transaction is
+// rolled back, either explicitly or because its commit failed.
+func (tx *Tx) OnRollback(fn func()) {
+	tx.rollbackHandlers = append(tx.rollbackHandlers, fn)
+}
+
 // Commit writes all changes to disk and updates the meta page.
 // Returns an error if a disk write error occurs, or if Commit is
 // called on a read-only transaction.
 func (tx *Tx) Commit() error {
+	_, err := tx.CommitWithStats()
+	return err
+}
+
+// CommitWithStats commits the transaction like Commit and returns how long
+// each phase of the commit took. If the commit fails, the phases which ran
+// before the failure are reported.
+func (tx *Tx) CommitWithStats() (CommitStats, error) {
 	_assert(!tx.managed, "managed tx commit not allowed")
 	if tx.db == nil {
-		return ErrTxClosed
+		return CommitStats{}, ErrTxClosed
 	} else if !tx.writable {
-		return ErrTxNotWritable
+		return CommitStats{}, ErrTxNotWritable
+	}
+	db := tx.db
+	startTime := time.Now()
+	err := tx.commit()
+	tx.commitStats.TotalTime = time.Since(startTime)
+	if err != nil {
+		return tx.commitStats, err
+	}
+	db.getObserver().OnTxCommit(tx.commitStats.TotalTime, tx.stats.PageCount)
+
+	// Execute commit handlers now that the locks have been removed.
+	for _, fn := range tx.commitHandlers {
+		fn()
 	}
 
+	return tx.commitStats, nil
+}
+
+// commit writes the transaction and closes it, recording the time taken by
+// each phase in tx.commitStats.
+func (tx *Tx) commit() error {
+	cs := &tx.commitStats
+
 	// TODO(benbjohnson): Use vectorized I/O to write out dirty pages.
 
 	// Rebalance nodes which have had deletions.
 	var startTime = time.Now()
 	tx.root.rebalance()
+	cs.RebalanceTime = time.Since(startTime)
 	if tx.stats.Rebalance > 0 {
-		tx.stats.RebalanceTime += time.Since(startTime)
+		tx.stats.RebalanceTime += cs.RebalanceTime
 	}
 
 	// spill data onto dirty pages.
@@ -161,18 +418,27 @@ func (tx *Tx) Commit() error {
 		tx.rollback()
 		return err
 	}
-	tx.stats.SpillTime += time.Since(startTime)
+	cs.SpillTime = time.Since(startTime)
+	tx.stats.SpillTime += cs.SpillTime
 
 	// Free the old root bucket.
 	tx.meta.root.root = tx.root.root
 
+	// Write the extension list before the freelist, since it allocates.
+	if err := tx.commitExtensions(); err != nil {
+		tx.rollback()
+		return err
+	}
+
 	// Free the old freelist because commit writes out a fresh freelist.
 	if tx.meta.freelist != pgidNoFreelist {
-		tx.db.freelist.free(tx.meta.txid, tx.db.page(tx.meta.freelist))
+		tx.db.freelist.free(tx.meta.txid, tx.db.rawPage(tx.meta.freelist))
 	}
 
 	if !tx.db.NoFreelistSync {
+		startTime = time.Now()
 		err := tx.commitFreelist()
+		cs.FreelistTime = time.Since(startTime)
 		if err != nil {
 			return err
 		}
@@ -183,9 +449,11 @@ func (tx *Tx) Commit() error {
 	// Write dirty pages to disk.
 	startTime = time.Now()
 	if err := tx.write(); err != nil {
+		tx.db.Logger().Errorf("failed to write pages of tx %d: %v", tx.meta.txid, err)
 		tx.rollback()
 		return err
 	}
+	cs.WriteTime = time.Since(startTime) - cs.SyncTime
 
 	// If strict mode is enabled then perform a consistency check.
 	// Only the first consistency error is reported in the panic.
@@ -205,20 +473,19 @@ func (tx *Tx) Commit() error {
 	}
 
 	// Write meta to disk.
+	metaStart, dataSyncTime := time.Now(), cs.SyncTime
 	if err := tx.writeMeta(); err != nil {
+		tx.db.Logger().Errorf("failed to write meta page of tx %d: %v", tx.meta.txid, err)
 		tx.rollback()
 		return err
 	}
+	cs.MetaTime = time.Since(metaStart) - (cs.SyncTime - dataSyncTime)
 	tx.stats.WriteTime += time.Since(startTime)
+	tx.db.setTxID(tx.meta.txid)
 
 	// Finalize the transaction.
 	tx.close()
 
-	// Execute commit handlers now that the locks have been removed.
-	for _, fn := range tx.commitHandlers {
-		fn()
-	}
-
 	return nil
 }
 
@@ -226,7 +493,7 @@ func (tx *Tx) commitFreelist() error {
 	// Allocate new pages for the new free list. This will overestimate
 	// the size of the freelist but not underestimate the size (which would be bad).
 	opgid := tx.meta.pgid
-	p, err := tx.allocate((tx.db.freelist.size() / tx.db.pageSize) + 1)
+	p, err := tx.allocate(((tx.db.freelist.size() + tx.db.pageTrailerSize()) / tx.db.pageSize) + 1)
 	if err != nil {
 		tx.rollback()
 		return err
@@ -249,10 +516,15 @@ func (tx *Tx) commitFreelist() error {
 
 // Rollback closes the transaction and ignores all previous updates. Read-only
 // transactions must be rolled back and not committed.
+//
+// Rolling back a transaction which is already closed, for example by a
+// deferred call after Commit, does nothing and returns nil, so that
+// "defer tx.Rollback()" is always safe. Only transactions managed by
+// DB.Update or DB.View must not be rolled back; Rollback panics for those.
 func (tx *Tx) Rollback() error {
 	_assert(!tx.managed, "managed tx rollback not allowed")
 	if tx.db == nil {
-		return ErrTxClosed
+		return nil
 	}
 	tx.nonPhysicalRollback()
 	return nil
@@ -264,9 +536,13 @@ func (tx *Tx) nonPhysicalRollback() {
 		return
 	}
 	if tx.writable {
+		tx.db.Logger().Debugf("rolling back tx %d", tx.meta.txid)
 		tx.db.freelist.rollback(tx.meta.txid)
 	}
+	db := tx.db
 	tx.close()
+	db.getObserver().OnTxRollback()
+	tx.runRollbackHandlers()
 }
 
 // rollback needs to reload the free pages from disk in case some system error happens like fsync error.
@@ -275,6 +551,7 @@ func (tx *Tx) rollback() {
 		return
 	}
 	if tx.writable {
+		tx.db.Logger().Warnf("rolling back tx %d after a failed commit, reloading freelist", tx.meta.txid)
 		tx.db.freelist.rollback(tx.meta.txid)
 		if !tx.db.hasSyncedFreelist() {
 			// Reconstruct free page list by scanning the DB to get the whole free page list.
@@ -285,7 +562,18 @@ func (tx *Tx) rollback() {
 			tx.db.freelist.reload(tx.db.page(tx.db.meta().freelist))
 		}
 	}
+	db := tx.db
 	tx.close()
+	db.getObserver().OnTxRollback()
+	tx.runRollbackHandlers()
+}
+
+// runRollbackHandlers executes the rollback handlers once the locks have been
+// removed.
+func (tx *Tx) runRollbackHandlers() {
+	for _, fn := range tx.rollbackHandlers {
+		fn()
+	}
 }
 
 func (tx *Tx) close() {
@@ -297,6 +585,7 @@ func (tx *Tx) close() {
 		var freelistFreeN = tx.db.freelist.free_count()
 		var freelistPendingN = tx.db.freelist.pending_count()
 		var freelistAlloc = tx.db.freelist.size()
+		var freelistSpanN, freelistLargestSpan = tx.db.freelist.freeSpans()
 
 		// Remove transaction ref & writer lock.
 		tx.db.rwtx = nil
@@ -308,17 +597,34 @@ func (tx *Tx) close() {
 		tx.db.stats.PendingPageN = freelistPendingN
 		tx.db.stats.FreeAlloc = (freelistFreeN + freelistPendingN) * tx.db.pageSize
 		tx.db.stats.FreelistInuse = freelistAlloc
+		tx.db.stats.setFreeSpans(freelistSpanN, freelistLargestSpan, freelistFreeN)
 		tx.db.stats.TxStats.add(&tx.stats)
 		tx.db.statlock.Unlock()
 	} else {
 		tx.db.removeTx(tx)
 	}
 
+	// Make values used after the transaction recognizable.
+	for _, v := range tx.lent {
+		for i := range v {
+			v[i] = poisonedValueByte
+		}
+	}
+
+	tx.releaseArena()
+
 	// Clear all references.
 	tx.db = nil
 	tx.meta = nil
 	tx.root = Bucket{tx: tx}
 	tx.pages = nil
+	tx.bucketStats = nil
+	tx.verified = nil
+	tx.decrypted = nil
+	tx.keyCounts = nil
+	tx.extensions = nil
+	tx.savepoints = nil
+	tx.lent = nil
 }
 
 // Copy writes the entire database to a writer.
@@ -333,16 +639,26 @@ func (tx *Tx) Copy(w io.Writer) error {
 // WriteTo writes the entire database to a writer.
 // If err == nil then exactly tx.Size() bytes will be written into the writer.
 func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
-	// Attempt to open reader with WriteFlag
-	f, err := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
-	if err != nil {
-		return 0, err
-	}
-	defer func() {
-		if cerr := f.Close(); err == nil {
-			err = cerr
+	// Read pages through the ReaderAt of a database opened with
+	// OpenReaderAt or from the data of an in-memory database, otherwise
+	// attempt to open reader with WriteFlag.
+	var r io.ReadSeeker
+	if tx.db.readerAt != nil {
+		r = io.NewSectionReader(tx.db.readerAt, 0, tx.Size())
+	} else if tx.db.memory != nil {
+		r = bytes.NewReader(tx.db.memory[:tx.Size()])
+	} else {
+		f, ferr := tx.db.openFile(tx.db.path, os.O_RDONLY|tx.WriteFlag, 0)
+		if ferr != nil {
+			return 0, ferr
 		}
-	}()
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		r = f
+	}
 
 	// Generate a meta page. We use the same page data for both meta pages.
 	buf := make([]byte, tx.db.pageSize)
@@ -370,12 +686,12 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 	}
 
 	// Move past the meta pages in the file.
-	if _, err := f.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
+	if _, err := r.Seek(int64(tx.db.pageSize*2), io.SeekStart); err != nil {
 		return n, fmt.Errorf("seek: %s", err)
 	}
 
 	// Copy data pages.
-	wn, err := io.CopyN(w, f, tx.Size()-int64(tx.db.pageSize*2))
+	wn, err := io.CopyN(w, r, tx.Size()-int64(tx.db.pageSize*2))
 	n += wn
 	if err != nil {
 		return n, err
@@ -384,6 +700,32 @@ func (tx *Tx) WriteTo(w io.Writer) (n int64, err error) {
 	return n, nil
 }
 
+// WriteToWithProgress writes the entire database to a writer like WriteTo,
+// calling progress after each write to w with the number of bytes written so
+// far and the total number of bytes, which is tx.Size(). A nil progress
+// function is ignored.
+func (tx *Tx) WriteToWithProgress(w io.Writer, progress func(bytesWritten, totalBytes int64)) (n int64, err error) {
+	if progress != nil {
+		w = &progressWriter{w: w, total: tx.Size(), fn: progress}
+	}
+	return tx.WriteTo(w)
+}
+
+// progressWriter reports the bytes written to w to fn.
+type progressWriter struct {
+	w     io.Writer
+	n     int64
+	total int64
+	fn    func(bytesWritten, totalBytes int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.fn(p.n, p.total)
+	return n, err
+}
+
 // CopyFile copies the entire database to file at the given path.
 // A reader transaction is maintained during the copy so it is safe to continue
 // using the database while a copy is in progress.
@@ -401,98 +743,6 @@ func (tx *Tx) CopyFile(path string, mode os.FileMode) error {
 	return f.Close()
 }
 
-// Check performs several consistency checks on the database for this transaction.
-// An error is returned if any inconsistency is found.
-//
-// It can be safely run concurrently on a writable transaction. However, this
-// incurs a high cost for large databases and databases with a lot of subbuckets
-// because of caching. This overhead can be removed if running on a read-only
-// transaction, however, it is not safe to execute other writer transactions at
-// the same time.
-func (tx *Tx) Check() <-chan error {
-	ch := make(chan error)
-	go tx.check(ch)
-	return ch
-}
-
-func (tx *Tx) check(ch chan error) {
-	// Force loading free list if opened in ReadOnly mode.
-	tx.db.loadFreelist()
-
-	// Check if any pages are double freed.
-	freed := make(map[pgid]bool)
-	all := make([]pgid, tx.db.freelist.count())
-	tx.db.freelist.copyall(all)
-	for _, id := range all {
-		if freed[id] {
-			ch <- fmt.Errorf("page %d: already freed", id)
-		}
-		freed[id] = true
-	}
-
-	// Track every reachable page.
-	reachable := make(map[pgid]*page)
-	reachable[0] = tx.page(0) // meta0
-	reachable[1] = tx.page(1) // meta1
-	if tx.meta.freelist != pgidNoFreelist {
-		for i := uint32(0); i <= tx.page(tx.meta.freelist).overflow; i++ {
-			reachable[tx.meta.freelist+pgid(i)] = tx.page(tx.meta.freelist)
-		}
-	}
-
-	// Recursively check buckets.
-	tx.checkBucket(&tx.root, reachable, freed, ch)
-
-	// Ensure all pages below high water mark are either reachable or freed.
-	for i := pgid(0); i < tx.meta.pgid; i++ {
-		_, isReachable := reachable[i]
-		if !isReachable && !freed[i] {
-			ch <- fmt.Errorf("page %d: unreachable unfreed", int(i))
-		}
-	}
-
-	// Close the channel to signal completion.
-	close(ch)
-}
-
-func (tx *Tx) checkBucket(b *Bucket, reachable map[pgid]*page, freed map[pgid]bool, ch chan error) {
-	// Ignore inline buckets.
-	if b.root == 0 {
-		return
-	}
-
-	// Check every page used by this bucket.
-	b.tx.forEachPage(b.root, 0, func(p *page, _ int) {
-		if p.id > tx.meta.pgid {
-			ch <- fmt.Errorf("page %d: out of bounds: %d", int(p.id), int(b.tx.meta.pgid))
-		}
-
-		// Ensure each page is only referenced once.
-		for i := pgid(0); i <= pgid(p.overflow); i++ {
-			var id = p.id + i
-			if _, ok := reachable[id]; ok {
-				ch <- fmt.Errorf("page %d: multiple references", int(id))
-			}
-			reachable[id] = p
-		}
-
-		// We should only encounter un-freed leaf and branch pages.
-		if freed[p.id] {
-			ch <- fmt.Errorf("page %d: reachable freed", int(p.id))
-		} else if (p.flags&branchPageFlag) == 0 && (p.flags&leafPageFlag) == 0 {
-			ch <- fmt.Errorf("page %d: invalid type: %s", int(p.id), p.typ())
-		}
-	})
-
-	// Check each bucket within this bucket.
-	_ = b.ForEach(func(k, v []byte) error {
-		if child := b.Bucket(k); child != nil {
-			tx.checkBucket(child, reachable, freed, ch)
-		}
-		return nil
-	})
-}
-
 // allocate returns a contiguous block of memory starting at a given page.
 func (tx *Tx) allocate(count int) (*page, error) {
 	p, err := tx.db.allocate(tx.meta.txid, count)
@@ -522,10 +772,22 @@ func (tx *Tx) write() error {
 	sort.Sort(pages)
 
 	// Write pages to disk in order.
+	var size int
+	if tx.db.wal != nil {
+		tx.db.wal.buf = tx.db.wal.buf[:0]
+	}
 	for _, p := range pages {
 		rem := (uint64(p.overflow) + 1) * uint64(tx.db.pageSize)
+		data, err := tx.db.sealPages(unsafeByteSlice(unsafe.Pointer(p), 0, 0, int(rem)))
+		if err != nil {
+			return err
+		}
+		if tx.db.wal != nil {
+			tx.db.walAppend(p.id, data)
+		}
+		size += int(rem)
 		offset := int64(p.id) * int64(tx.db.pageSize)
-		var written uintptr
+		var written uint64
 
 		// Write out page in "max allocation" sized chunks.
 		for {
@@ -533,7 +795,7 @@ func (tx *Tx) write() error {
 			if sz > maxAllocSize-1 {
 				sz = maxAllocSize - 1
 			}
-			buf := unsafeByteSlice(unsafe.Pointer(p), written, 0, int(sz))
+			buf := data[written : written+sz]
 
 			if _, err := tx.db.ops.writeAt(buf, offset); err != nil {
 				return err
@@ -550,17 +812,32 @@ func (tx *Tx) write() error {
 
 			// Otherwise move offset forward and move pointer to next chunk.
 			offset += int64(sz)
-			written += uintptr(sz)
+			written += sz
 		}
 	}
 
-	// Ignore file sync if flag is set on DB.
-	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
+	// Ignore file sync if flag is set on DB. The pages are synced even under
+	// group commit, so that the meta page never reaches the disk before the
+	// pages it points at. The write-ahead log is synced with the meta page
+	// instead.
+	tx.written = size
+	if tx.db.wal == nil {
+		if err := tx.sync(false); err != nil {
 			return err
 		}
 	}
 
+	// Remember which pages were written for incremental backups.
+	if tx.db.options.TrackChanges {
+		tx.db.changedlock.Lock()
+		for _, p := range pages {
+			for i := pgid(0); i <= pgid(p.overflow); i++ {
+				tx.db.changed[p.id+i] = tx.meta.txid
+			}
+		}
+		tx.db.changedlock.Unlock()
+	}
+
 	// Put small pages back to page pool.
 	for _, p := range pages {
 		// Ignore page sizes over 1 page.
@@ -588,14 +865,32 @@ func (tx *Tx) writeMeta() error {
 	p := tx.db.pageInBuffer(buf, 0)
 	tx.meta.write(p)
 
+	// Make the commit durable in the write-ahead log before the meta page
+	// points the data file at it.
+	if tx.db.wal != nil {
+		tx.db.walAppend(p.id, buf)
+		startTime := time.Now()
+		err := tx.db.walCommit()
+		tx.commitStats.SyncTime += time.Since(startTime)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Write the meta page to file.
 	if _, err := tx.db.ops.writeAt(buf, int64(p.id)*int64(tx.db.pageSize)); err != nil {
 		return err
 	}
-	if !tx.db.NoSync || IgnoreNoSync {
-		if err := fdatasync(tx.db); err != nil {
-			return err
+	if tx.db.wal != nil {
+		// The commit is already durable, so a failed checkpoint only leaves
+		// the log to grow until the next one.
+		if tx.db.wal.size >= tx.db.wal.checkpointBytes {
+			if err := tx.db.checkpoint(); err != nil {
+				tx.db.Logger().Warnf("failed to checkpoint the write-ahead log of %s: %v", tx.db.path, err)
+			}
 		}
+	} else if err := tx.sync(true); err != nil {
+		return err
 	}
 
 	// Update statistics.
@@ -604,18 +899,147 @@ func (tx *Tx) writeMeta() error {
 	return nil
 }
 
+// now returns the time against which the expiry of values is judged. It is
+// fixed on first use, so that the keys visible to the transaction do not
+// change as it runs.
+func (tx *Tx) now() int64 {
+	tx.cursorlock.Lock()
+	defer tx.cursorlock.Unlock()
+	if tx.expiryNow == 0 {
+		tx.expiryNow = time.Now().UnixNano()
+	}
+	return tx.expiryNow
+}
+
+// sync syncs the pages or meta page just written unless NoSync or SyncNone is
+// set. Group commit only defers the sync of the meta page. The time taken is
+// added to the commit stats.
+func (tx *Tx) sync(meta bool) error {
+	startTime := time.Now()
+	defer func() { tx.commitStats.SyncTime += time.Since(startTime) }()
+
+	if meta && tx.db.groupCommit() {
+		return tx.db.deferSync(tx.meta.txid, tx.written+tx.db.pageSize)
+	} else if !tx.db.noSync() {
+		return tx.db.syncData()
+	}
+	return nil
+}
+
+// verifyPage panics if PageChecksums is set and p carries a checksum which
+// does not match its contents. Each page is verified once per transaction.
+func (tx *Tx) verifyPage(p *page) {
+	if !tx.db.PageChecksums || (p.flags&pageChecksumFlag) == 0 {
+		return
+	}
+	tx.cursorlock.Lock()
+	_, ok := tx.verified[p.id]
+	tx.cursorlock.Unlock()
+	if ok {
+		return
+	}
+
+	// The page is hashed without holding the lock, so that cursors reading
+	// in parallel do not wait for each other. Two of them may both verify a
+	// page which neither had verified yet, which is harmless.
+	if end := p.id + pgid(p.overflow); end >= tx.meta.pgid {
+		panic(fmt.Sprintf("page %d: overflow ends at page %d beyond high water mark %d", p.id, end, tx.meta.pgid))
+	} else if *p.storedChecksum(tx.db.pageSize) != p.checksum(tx.db.pageSize) {
+		panic(fmt.Sprintf("page %d: checksum mismatch", p.id))
+	}
+
+	tx.cursorlock.Lock()
+	if tx.verified == nil {
+		tx.verified = make(map[pgid]struct{})
+	}
+	tx.verified[p.id] = struct{}{}
+	tx.cursorlock.Unlock()
+}
+
+// countCursor counts a cursor created in the transaction stats.
+func (tx *Tx) countCursor() {
+	tx.cursorlock.Lock()
+	tx.stats.CursorCount++
+	tx.cursorlock.Unlock()
+}
+
+// poisonedValueByte fills the values returned by a transaction with
+// DB.ValueSafetyChecks set once it is closed.
+const poisonedValueByte = 0xDB
+
+// lend returns v to be handed to the caller for the life of the transaction.
+// If DB.ValueSafetyChecks is set, a copy is returned instead, to be poisoned
+// when the transaction is closed.
+func (tx *Tx) lend(v []byte) []byte {
+	if len(v) == 0 || !tx.db.ValueSafetyChecks {
+		return v
+	}
+	c := append([]byte{}, v...)
+	tx.cursorlock.Lock()
+	tx.lent = append(tx.lent, c)
+	tx.cursorlock.Unlock()
+	return c
+}
+
 // page returns a reference to the page with a given id.
 // If page has been written to then a temporary buffered page is returned.
+// A page of an encrypted database which cannot be decrypted panics.
 func (tx *Tx) page(id pgid) *page {
+	p, err := tx.openPage(id)
+	if err != nil {
+		panic(fmt.Sprintf("page %d: %s", id, err))
+	}
+	return p
+}
+
+// openPage is like page, but returns an error if the page cannot be
+// decrypted.
+func (tx *Tx) openPage(id pgid) (*page, error) {
+	if tx.trackPages {
+		tx.cursorlock.Lock()
+		tx.lastPage = id
+		tx.cursorlock.Unlock()
+	}
+
 	// Check the dirty pages first.
 	if tx.pages != nil {
 		if p, ok := tx.pages[id]; ok {
-			return p
+			return p, nil
 		}
 	}
 
-	// Otherwise return directly from the mmap.
-	return tx.db.page(id)
+	// Otherwise return directly from the mmap, or decrypted from it.
+	if tx.db.cipher == nil || id <= 1 {
+		return tx.db.rawPage(id), nil
+	}
+	tx.cursorlock.Lock()
+	p, ok := tx.decrypted.get(id)
+	tx.cursorlock.Unlock()
+	if ok {
+		return p, nil
+	}
+
+	// Decrypt without the lock, so that concurrent cursors are not held up.
+	p, err := tx.db.openPage(id)
+	if err != nil {
+		return nil, err
+	}
+	tx.cursorlock.Lock()
+	if tx.decrypted == nil {
+		tx.decrypted = newPageCache(decryptedCacheSize)
+	}
+	tx.decrypted.add(id, p)
+	tx.cursorlock.Unlock()
+	return p, nil
+}
+
+// pageHeader returns the page with a given id without decrypting it, for
+// reading its header only.
+func (tx *Tx) pageHeader(id pgid) *page {
+	if p, ok := tx.pages[id]; ok {
+		return p
+	}
+	return tx.db.rawPage(id)
 }
 
 // forEachPage iterates over every page within a given page and executes a function.
@@ -644,7 +1068,7 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 	}
 
 	// Build the page info.
-	p := tx.db.page(pgid(id))
+	p := tx.db.rawPage(pgid(id))
 	info := &PageInfo{
 		ID:            id,
 		Count:         int(p.count),
@@ -658,9 +1082,123 @@ func (tx *Tx) Page(id int) (*PageInfo, error) {
 		info.Type = p.typ()
 	}
 
+	// List the children of branch pages.
+	if info.Type == "branch" {
+		info.Children = make([]int, p.count)
+		for i := range info.Children {
+			info.Children[i] = int(p.branchPageElement(uint16(i)).pgid)
+		}
+	}
+
 	return info, nil
 }
 
+// AllocatePages allocates n contiguous pages for use outside of any bucket,
+// such as a custom index stored alongside the database, and returns the id
+// of the first page and a buffer spanning all of them. The buffer excludes
+// the page header, and the space taken by encryption in encrypted databases,
+// and is written to disk when the transaction commits, so it must not be
+// used after the transaction is closed.
+//
+// The pages are owned by the caller until they are released with FreePages;
+// Check reports them as neither leaked nor free. They are not copied by
+// Compact, so callers must keep their own reference to startPgid and should
+// treat the pages as immutable once committed, allocating new pages to make
+// changes.
+func (tx *Tx) AllocatePages(n int) (startPgid uint64, buf []byte, err error) {
+	if tx.db == nil {
+		return 0, nil, ErrTxClosed
+	} else if !tx.writable {
+		return 0, nil, ErrTxNotWritable
+	} else if n <= 0 {
+		return 0, nil, fmt.Errorf("invalid page count: %d", n)
+	}
+
+	p, err := tx.allocate(n)
+	if err != nil {
+		return 0, nil, err
+	}
+	p.flags = extensionPageFlag
+	p.count = 0
+	tx.meta.flags |= featureExtensionPages
+	tx.extensionAllocs()[p.id] = n
+	tx.extensionsChanged = true
+	tx.allocated = append(tx.allocated, extensionAlloc{id: p.id, n: n})
+
+	size := n*tx.db.pageSize - int(pageHeaderSize)
+	if tx.db.cipher != nil {
+		size -= encryptionOverhead
+	}
+	return uint64(p.id), unsafeByteSlice(unsafe.Pointer(p), pageHeaderSize, 0, size), nil
+}
+
+// ReadPages returns the contents of the pages starting at startPgid which
+// were allocated by AllocatePages. The returned memory is only valid for the
+// life of the transaction and must not be modified unless the pages were
+// allocated by this transaction.
+func (tx *Tx) ReadPages(startPgid uint64) ([]byte, error) {
+	p, n, err := tx.extensionPage(startPgid)
+	if err != nil {
+		return nil, err
+	}
+	size := n*tx.db.pageSize - int(pageHeaderSize)
+	if tx.db.cipher != nil {
+		size -= encryptionOverhead
+	}
+	return unsafeByteSlice(unsafe.Pointer(p), pageHeaderSize, 0, size), nil
+}
+
+// FreePages releases the n pages starting at startPgid, which must have been
+// allocated together by AllocatePages. The pages are returned to the freelist
+// and become reusable once no open transaction can still read them.
+func (tx *Tx) FreePages(startPgid uint64, n int) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+
+	id := pgid(startPgid)
+	allocs := tx.extensionAllocs()
+	if count, ok := allocs[id]; !ok {
+		return ErrNotExtensionPage
+	} else if count != n {
+		return fmt.Errorf("page %d: allocated %d pages, not %d", startPgid, count, n)
+	}
+
+	tx.db.freelist.free(tx.meta.txid, &page{id: id, overflow: uint32(n - 1)})
+	delete(tx.pages, id)
+	delete(allocs, id)
+	tx.extensionsChanged = true
+	return nil
+}
+
+// extensionPage returns the first page and the page count of an allocation
+// made by AllocatePages.
+func (tx *Tx) extensionPage(id uint64) (*page, int, error) {
+	if tx.db == nil {
+		return nil, 0, ErrTxClosed
+	}
+	n, ok := tx.extensionAllocs()[pgid(id)]
+	if !ok {
+		return nil, 0, ErrNotExtensionPage
+	}
+	return tx.page(pgid(id)), n, nil
+}
+
+// CommitStats breaks down the time taken by a commit, as returned by
+// Tx.CommitWithStats. WriteTime and MetaTime exclude the time spent syncing,
+// which is reported in SyncTime.
+type CommitStats struct {
+	RebalanceTime time.Duration // merging nodes which had deletions
+	SpillTime     time.Duration // splitting and serializing dirty nodes
+	FreelistTime  time.Duration // allocating and serializing the freelist
+	WriteTime     time.Duration // writing dirty pages
+	MetaTime      time.Duration // writing the meta page
+	SyncTime      time.Duration // syncing the dirty pages and the meta page
+	TotalTime     time.Duration // the whole commit, excluding commit handlers
+}
+
 // TxStats represents statistics about the actions performed by the transaction.
 type TxStats struct {
 	// Page statistics.
@@ -707,6 +1245,9 @@ func (s *TxStats) add(other *TxStats) {
 // This is useful when obtaining stats at two different points and time and
 // you need the performance counters that occurred within that time span.
 func (s *TxStats) Sub(other *TxStats) TxStats {
+	if other == nil {
+		return *s
+	}
 	var diff TxStats
 	diff.PageCount = s.PageCount - other.PageCount
 	diff.PageAlloc = s.PageAlloc - other.PageAlloc
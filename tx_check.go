@@ -0,0 +1,1090 @@
+package bbolt
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// CheckOption configures a consistency check started with Tx.CheckWithOptions.
+type CheckOption func(*checkConfig)
+
+// checkConfig holds the settings applied by a set of CheckOptions.
+type checkConfig struct {
+	maxErrors   int
+	kvStringer  KeyValueStringer
+	parallelism int
+	statsFn     func(CheckStats)
+}
+
+// WithParallelism checks the pages of each bucket using up to n goroutines.
+// The subtrees below a branch page are handed to idle goroutines and checked
+// independently, which speeds up checking large databases on multi-core
+// machines. A value of n <= 1 checks pages sequentially, which is the default.
+// The order in which errors are reported is not deterministic when n > 1.
+func WithParallelism(n int) CheckOption {
+	return func(c *checkConfig) {
+		c.parallelism = n
+	}
+}
+
+// WithKVStringer sets the KeyValueStringer used to render keys and values in
+// the messages of reported errors. Keys are rendered as hex by default.
+// Bucket names are rendered as they are if printable, and with kv otherwise.
+func WithKVStringer(kv KeyValueStringer) CheckOption {
+	return func(c *checkConfig) {
+		c.kvStringer = kv
+	}
+}
+
+// WithMaxErrors limits a check to reporting at most n errors. Once the limit
+// is reached the check stops, sends one final error saying so and closes the
+// channel. A value of n <= 0 means no limit, which is the default.
+func WithMaxErrors(n int) CheckOption {
+	return func(c *checkConfig) {
+		c.maxErrors = n
+	}
+}
+
+// WithStats registers fn to receive a summary of what the check examined.
+// fn is called once, just before the channel returned by CheckWithOptions is
+// closed. If the check was cancelled or aborted the summary is partial.
+func WithStats(fn func(CheckStats)) CheckOption {
+	return func(c *checkConfig) {
+		c.statsFn = fn
+	}
+}
+
+// CheckStats summarizes the pages and keys examined by a consistency check.
+type CheckStats struct {
+	PageN       int // number of bucket pages visited, including overflow pages
+	BranchPageN int // number of branch pages visited
+	LeafPageN   int // number of leaf pages visited
+	FreePageN   int // number of distinct pages on the freelist
+	BucketN     int // number of buckets checked, including the root bucket
+	KeyN        int // number of keys scanned on leaf pages
+
+	CompressedValueN int // number of compressed values decompressed
+}
+
+// Check performs several consistency checks on the database for this transaction.
+// An error is returned if any inconsistency is found.
+//
+// It can be safely run concurrently on a writable transaction. However, this
+// incurs a high cost for large databases and databases with a lot of subbuckets
+// because of caching. This overhead can be removed if running on a read-only
+// transaction, however, it is not safe to execute other writer transactions at
+// the same time.
+func (tx *Tx) Check() <-chan error {
+	return tx.CheckWithOptions(context.Background())
+}
+
+// CheckWithOptions performs the same consistency checks as Check, configured
+// by the given options.
+//
+// The check stops as soon as ctx is cancelled and the returned channel is
+// closed, even if the caller is no longer receiving from it. A closed channel
+// therefore does not imply that the whole database was checked; callers that
+// cancel ctx should consult ctx.Err() to tell an aborted check from a clean one.
+func (tx *Tx) CheckWithOptions(ctx context.Context, options ...CheckOption) <-chan error {
+	var config checkConfig
+	for _, opt := range options {
+		opt(&config)
+	}
+
+	ch := make(chan error)
+	go tx.check(ctx, config, ch)
+	return ch
+}
+
+// Check performs the consistency checks of Tx.Check that apply to the pages
+// of this bucket and of its nested buckets: page types, multiple references
+// and key ordering. Unlike Tx.Check it does not load the freelist or sweep the
+// whole database for unreachable pages, so its cost is proportional to the
+// size of the bucket. Keys in error messages are rendered with kv, or as hex
+// if kv is nil.
+func (b *Bucket) Check(kv KeyValueStringer) <-chan error {
+	ch := make(chan error)
+	go func() {
+		defer close(ch)
+		newChecker(context.Background(), b.tx, checkConfig{kvStringer: kv}, ch).checkBucket(b, nil)
+	}()
+	return ch
+}
+
+// HealthCheck runs a bounded subset of the checks of Tx.Check within a
+// read-only transaction and returns the first inconsistency found, or nil.
+// It verifies the meta page in use, the freelist page and the root pages of
+// the root bucket and of the top-level buckets, without walking the keys of
+// the whole database, so it is cheap enough to run periodically, for example
+// from a liveness probe. Unlike Tx.Check it reads the freelist page rather
+// than the in-memory freelist, so it is safe to run alongside writers.
+//
+// It returns ctx.Err() if ctx is done before the check completes.
+func (db *DB) HealthCheck(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tx, err := db.BeginTxContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err := tx.meta.validate(); err != nil {
+		return err
+	}
+
+	// Stop at the first error, which the buffered channel holds along with
+	// the message announcing the abort.
+	ch := make(chan error, 2)
+	c := newChecker(ctx, tx, checkConfig{maxErrors: 1}, ch)
+	c.checkFreelistPage()
+	c.checkTopPage(tx.meta.root.root, nil)
+	if !c.stopped() {
+		_ = tx.root.ForEachBucket(func(name []byte) error {
+			if child := tx.root.Bucket(name); child.root != 0 {
+				c.checkTopPage(child.root, [][]byte{name})
+			}
+			if c.stopped() {
+				return errCheckStopped
+			}
+			return nil
+		})
+	}
+
+	select {
+	case err := <-ch:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// ReclaimLeakedPages returns the pages which Tx.Check reports as unreachable
+// unfreed to the freelist and returns how many were reclaimed. Such pages are
+// neither used by a bucket nor free, so without this they are only
+// recovered by compacting the database.
+//
+// It runs Tx.Check within a write transaction, which it commits with the
+// reclaimed pages freed. Nothing is reclaimed if the check finds any other
+// inconsistency, since freeing pages of a damaged database could make the
+// damage worse; the first such error is returned instead.
+func (db *DB) ReclaimLeakedPages() (int, error) {
+	var leaked []pgid
+	err := db.Update(func(tx *Tx) error {
+		// Read the whole channel, so that the check is done with the
+		// transaction before it is committed.
+		var failed error
+		for err := range tx.Check() {
+			if cerr, ok := err.(*CheckError); ok && cerr.Kind == KindUnreachable {
+				leaked = append(leaked, pgid(cerr.PageID))
+			} else if failed == nil {
+				failed = err
+			}
+		}
+		if failed != nil {
+			leaked = nil
+			return failed
+		}
+
+		// Unreachable pages are reported one by one, including the
+		// overflow of a leaked page, so they are freed one by one as well.
+		for _, id := range leaked {
+			tx.db.freelist.free(tx.meta.txid, &page{id: id})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(leaked) > 0 {
+		db.Logger().Warnf("reclaimed %d leaked pages", len(leaked))
+	}
+	return len(leaked), nil
+}
+
+// checkFreelistPage verifies that the freelist page referenced by the meta is
+// well formed and only holds distinct ids below the high water mark.
+func (c *checker) checkFreelistPage() {
+	tx := c.tx
+	if tx.meta.freelist == pgidNoFreelist {
+		return
+	}
+	ids, ok := c.freelistPageIDs(tx.meta.freelist)
+	if !ok {
+		return
+	}
+	seen := make(map[pgid]bool, len(ids))
+	for _, fid := range ids {
+		if fid <= 1 || fid >= tx.meta.pgid {
+			c.report(newCheckError(KindOutOfBounds, fid, nil, "page %d: freed page out of bounds: %d", int(fid), int(tx.meta.pgid)))
+			return
+		} else if seen[fid] {
+			c.report(newCheckError(KindDoubleFree, fid, nil, "page %d: already freed", int(fid)))
+			return
+		}
+		seen[fid] = true
+	}
+}
+
+// checkExtensions verifies that the extension list page referenced by the
+// meta is well formed, and marks it and the allocations it records as
+// reachable. Allocations must be below the high water mark and not freed.
+func (c *checker) checkExtensions() {
+	tx := c.tx
+	id := tx.meta.extensions
+	if id == 0 {
+		return
+	}
+	loc := &location{id: id}
+	if id <= 1 || id >= tx.meta.pgid {
+		c.reportAt(loc, KindOutOfBounds, nil, "extension list out of bounds: %d", int(tx.meta.pgid))
+		return
+	}
+	p := c.page(loc, id)
+	if p == nil {
+		return
+	} else if (p.flags & extensionListPageFlag) == 0 {
+		c.reportAt(loc, KindInvalidPageType, nil, "invalid extension list page type: %s", p.typ())
+		return
+	}
+	for _, dup := range c.visit(p) {
+		c.reportAt(&location{id: dup}, KindMultipleReferences, nil, "multiple references")
+	}
+	span := (int(p.overflow) + 1) * tx.db.pageSize
+	n := int(*(*pgid)(unsafeAdd(unsafe.Pointer(p), pageHeaderSize)))
+	if need := extensionListSize(n); n < 0 || need > span {
+		c.reportAt(loc, KindMalformedPage, nil, "extension list of %d allocations needs %d bytes but spans %d", n, need, span)
+		return
+	}
+
+	for start, count := range readExtensionList(p) {
+		if start <= 1 || count <= 0 || start+pgid(count) > tx.meta.pgid {
+			c.reportAt(&location{id: start}, KindOutOfBounds, nil, "extension of %d pages out of bounds: %d", count, int(tx.meta.pgid))
+			continue
+		}
+		for _, dup := range c.visit(&page{id: start, flags: extensionPageFlag, overflow: uint32(count - 1)}) {
+			c.reportAt(&location{id: dup}, KindMultipleReferences, nil, "multiple references")
+		}
+		for i := start; i < start+pgid(count); i++ {
+			if c.freed[i] {
+				c.reportAt(&location{id: i}, KindReachableFreed, nil, "reachable freed")
+			}
+		}
+	}
+}
+
+// checkTopPage verifies the bounds, type and header of the root page of the
+// bucket at path, without descending into its children.
+func (c *checker) checkTopPage(id pgid, path [][]byte) {
+	tx := c.tx
+	loc := &location{id: id, bucket: path}
+	if id >= tx.meta.pgid {
+		c.reportAt(loc, KindOutOfBounds, nil, "out of bounds: %d", int(tx.meta.pgid))
+		return
+	}
+	p := c.page(loc, id)
+	if p == nil {
+		return
+	}
+	if (p.flags & (branchPageFlag | leafPageFlag)) == 0 {
+		c.reportAt(loc, KindInvalidPageType, nil, "invalid type: %s", p.typ())
+		return
+	}
+	c.checkPageHeader(loc, p)
+}
+
+// errCheckStopped is used internally to break out of iterations once a check
+// has been cancelled or aborted.
+var errCheckStopped = errors.New("check stopped")
+
+// CheckErrorKind identifies the kind of inconsistency reported by a CheckError.
+type CheckErrorKind int
+
+const (
+	// KindDoubleFree means that a page appears more than once on the freelist.
+	KindDoubleFree CheckErrorKind = iota + 1
+
+	// KindUnreachable means that a page below the high water mark is neither
+	// reachable from the root bucket nor on the freelist.
+	KindUnreachable
+
+	// KindOutOfBounds means that a page is referenced beyond the high water mark.
+	KindOutOfBounds
+
+	// KindMultipleReferences means that a page is reachable more than once.
+	KindMultipleReferences
+
+	// KindReachableFreed means that a reachable page is also on the freelist.
+	KindReachableFreed
+
+	// KindInvalidPageType means that a bucket references a page which is
+	// neither a branch nor a leaf page.
+	KindInvalidPageType
+
+	// KindKeyOrder means that a key is out of order with respect to its
+	// siblings or to the key range its parent branch page assigns to it.
+	KindKeyOrder
+
+	// KindFreelistMismatch means that the freelist page on disk and the
+	// in-memory freelist disagree, or that the freelist page is malformed.
+	KindFreelistMismatch
+
+	// KindMalformedPage means that the header of a branch or leaf page is
+	// inconsistent: its overflow pages extend beyond the high water mark, or
+	// its element count needs more element headers than fit in its pages.
+	KindMalformedPage
+
+	// KindPageChecksum means that a page written with DB.PageChecksums set
+	// does not match its checksum, or that a page of an encrypted database
+	// fails authentication.
+	KindPageChecksum
+
+	// KindCompressedValue means that a compressed value cannot be
+	// decompressed or does not have the size recorded in its header.
+	KindCompressedValue
+
+	// KindBranchChild means that a branch page references itself, or the
+	// same child page from more than one element. Such children are not
+	// descended into.
+	KindBranchChild
+)
+
+// String returns a human readable name for the kind.
+func (k CheckErrorKind) String() string {
+	switch k {
+	case KindDoubleFree:
+		return "double free"
+	case KindUnreachable:
+		return "unreachable"
+	case KindOutOfBounds:
+		return "out of bounds"
+	case KindMultipleReferences:
+		return "multiple references"
+	case KindReachableFreed:
+		return "reachable freed"
+	case KindInvalidPageType:
+		return "invalid page type"
+	case KindKeyOrder:
+		return "key order"
+	case KindFreelistMismatch:
+		return "freelist mismatch"
+	case KindMalformedPage:
+		return "malformed page"
+	case KindPageChecksum:
+		return "page checksum"
+	case KindCompressedValue:
+		return "compressed value"
+	case KindBranchChild:
+		return "branch child"
+	}
+	return fmt.Sprintf("CheckErrorKind(%d)", int(k))
+}
+
+// CheckError describes an inconsistency found by Tx.Check. Every error sent
+// on the channel returned by Check is a *CheckError, except for the final
+// error sent when a check is aborted by WithMaxErrors.
+type CheckError struct {
+	// Kind identifies the inconsistency.
+	Kind CheckErrorKind
+
+	// PageID is the page the inconsistency was found on.
+	PageID uint64
+
+	// Key is a copy of the offending key for KindKeyOrder and
+	// KindCompressedValue errors, and nil otherwise.
+	Key []byte
+
+	// Bucket holds the names of the bucket the page belongs to, outermost
+	// first. It is nil for pages of the bucket the check started from and
+	// for errors which do not concern a bucket, such as freelist errors.
+	Bucket [][]byte
+
+	msg string
+}
+
+// Error returns a description of the inconsistency.
+func (e *CheckError) Error() string {
+	return e.msg
+}
+
+// newCheckError returns a CheckError of the given kind for page id.
+func newCheckError(kind CheckErrorKind, id pgid, key []byte, format string, a ...interface{}) *CheckError {
+	if key != nil {
+		key = cloneBytes(key)
+	}
+	return &CheckError{Kind: kind, PageID: uint64(id), Key: key, msg: fmt.Sprintf(format, a...)}
+}
+
+// checker holds the state of a single consistency check run.
+type checker struct {
+	tx     *Tx
+	ctx    context.Context
+	config checkConfig
+	ch     chan error
+
+	freed map[pgid]bool // every page on the freelist, read-only once built
+
+	// sem limits the number of goroutines checking pages in parallel and wg
+	// tracks them. sem is nil if pages are checked sequentially.
+	sem chan struct{}
+	wg  sync.WaitGroup
+
+	// sending tracks the errors being sent on ch.
+	sending sync.WaitGroup
+
+	mu        sync.Mutex     // protects the fields below
+	reachable map[pgid]*page // every page reached so far
+	stats     CheckStats     // summary of what was examined so far
+	errorN    int            // number of errors reported so far
+	unreadN   int            // number of pages whose elements could not be read
+	aborted   bool           // set once the error limit has been reached
+}
+
+// newChecker returns a checker for tx which reports errors on ch.
+func newChecker(ctx context.Context, tx *Tx, config checkConfig, ch chan error) *checker {
+	if config.kvStringer == nil {
+		config.kvStringer = HexKeyValueStringer()
+	}
+	c := &checker{
+		tx:        tx,
+		ctx:       ctx,
+		config:    config,
+		ch:        ch,
+		reachable: make(map[pgid]*page),
+		freed:     make(map[pgid]bool),
+	}
+	if config.parallelism > 1 {
+		// The goroutine walking the buckets checks pages too.
+		c.sem = make(chan struct{}, config.parallelism-1)
+	}
+	return c
+}
+
+func (tx *Tx) check(ctx context.Context, config checkConfig, ch chan error) {
+	// Close the channel to signal completion.
+	defer close(ch)
+
+	// Force loading free list if opened in ReadOnly mode.
+	tx.db.loadFreelist()
+
+	c := newChecker(ctx, tx, config, ch)
+	if config.statsFn != nil {
+		defer func() {
+			c.stats.FreePageN = len(c.freed)
+			config.statsFn(c.stats)
+		}()
+	}
+
+	// Check if any pages are double freed.
+	all := make([]pgid, tx.db.freelist.count())
+	tx.db.freelist.copyall(all)
+	for _, id := range all {
+		if c.freed[id] {
+			if !c.report(newCheckError(KindDoubleFree, id, nil, "page %d: already freed", id)) {
+				return
+			}
+		}
+		c.freed[id] = true
+	}
+
+	// Ensure the freelist agrees with itself and with its page on disk.
+	if !c.checkFreelist(all) {
+		return
+	}
+
+	// Track every reachable page.
+	c.reachable[0] = tx.page(0) // meta0
+	c.reachable[1] = tx.page(1) // meta1
+	if tx.meta.freelist != pgidNoFreelist {
+		p := tx.pageHeader(tx.meta.freelist)
+		for i := uint32(0); i <= p.overflow; i++ {
+			c.reachable[tx.meta.freelist+pgid(i)] = p
+		}
+	}
+
+	// The allocations made by AllocatePages are reachable through the
+	// extension list.
+	c.checkExtensions()
+
+	// Recursively check buckets.
+	c.checkBucket(&tx.root, nil)
+	if c.stopped() {
+		return
+	}
+
+	// Ensure all pages below high water mark are either reachable or freed.
+	for i := pgid(0); i < tx.meta.pgid; i++ {
+		_, isReachable := c.reachable[i]
+		if !isReachable && !c.freed[i] {
+			if !c.report(newCheckError(KindUnreachable, i, nil, "page %d: unreachable unfreed", int(i))) {
+				return
+			}
+		}
+	}
+}
+
+// checkFreelist verifies that the ids returned by copyall match the count
+// declared by the freelist, and that the freelist page referenced by the meta
+// is well formed and agrees with the in-memory freelist. It returns false if
+// the check should stop.
+func (c *checker) checkFreelist(all []pgid) bool {
+	tx, f := c.tx, c.tx.db.freelist
+
+	// Pages 0 and 1 hold the meta and can never be free, so any such id
+	// means copyall produced fewer ids than the freelist declared.
+	var valid int
+	for _, id := range all {
+		if id > 1 {
+			valid++
+		}
+	}
+	if valid != f.count() {
+		if !c.report(newCheckError(KindFreelistMismatch, tx.meta.freelist, nil, "freelist: declared %d pages but copyall returned %d",
+			f.count(), valid)) {
+			return false
+		}
+	}
+
+	if tx.meta.freelist == pgidNoFreelist {
+		return true
+	}
+
+	id := tx.meta.freelist
+	ids, ok := c.freelistPageIDs(id)
+	if !ok {
+		return !c.stopped()
+	}
+	count := len(ids)
+
+	// The in-memory freelist only reflects the freelist page if no later
+	// transaction has committed and this transaction has not changed it,
+	// unless it has just written the page itself during commit.
+	inSync := tx.meta.txid == tx.db.meta().txid
+	if tx.writable {
+		inSync = id != tx.db.meta().freelist ||
+			(len(tx.pages) == 0 && f.pending[tx.meta.txid] == nil)
+	}
+	if inSync && count != f.count() {
+		return c.report(newCheckError(KindFreelistMismatch, id, nil, "page %d: freelist page holds %d ids but freelist holds %d",
+			int(id), count, f.count()))
+	}
+	return true
+}
+
+// freelistPageIDs returns the ids held by freelist page id, after verifying
+// that the page is below the high water mark, is a freelist page and spans
+// enough pages for the ids it declares. It reports the first problem found
+// and returns false if the ids cannot be read.
+func (c *checker) freelistPageIDs(id pgid) ([]pgid, bool) {
+	tx := c.tx
+	if id >= tx.meta.pgid {
+		c.report(newCheckError(KindOutOfBounds, id, nil, "page %d: freelist out of bounds: %d", int(id), int(tx.meta.pgid)))
+		return nil, false
+	}
+
+	p := c.page(&location{id: id}, id)
+	if p == nil {
+		return nil, false
+	}
+	if (p.flags & freelistPageFlag) == 0 {
+		c.report(newCheckError(KindFreelistMismatch, id, nil, "page %d: invalid freelist page type: %s", int(id), p.typ()))
+		return nil, false
+	}
+	if end := id + pgid(p.overflow); end >= tx.meta.pgid {
+		c.report(newCheckError(KindFreelistMismatch, id, nil, "page %d: freelist overflow ends at page %d beyond high water mark %d",
+			int(id), int(end), int(tx.meta.pgid)))
+		return nil, false
+	}
+	idx, count := p.freelistPageCount()
+	span := (int(p.overflow) + 1) * tx.db.pageSize
+	if need := int(pageHeaderSize) + (idx+count)*int(unsafe.Sizeof(pgid(0))); need > span {
+		c.report(newCheckError(KindFreelistMismatch, id, nil, "page %d: freelist of %d ids needs %d bytes but spans %d",
+			int(id), count, need, span))
+		return nil, false
+	}
+	if count == 0 {
+		return nil, true
+	}
+
+	var ids []pgid
+	data := unsafeIndex(unsafe.Pointer(p), unsafe.Sizeof(*p), unsafe.Sizeof(ids[0]), idx)
+	unsafeSlice(unsafe.Pointer(&ids), data, count)
+	return ids, true
+}
+
+// report sends err to the consumer of the check. It returns false if the
+// check has been cancelled or has reached its error limit, in which case the
+// caller should stop checking.
+func (c *checker) report(err error) bool {
+	c.mu.Lock()
+	if c.aborted {
+		c.mu.Unlock()
+		return false
+	}
+	c.errorN++
+	n := c.errorN
+	c.aborted = c.config.maxErrors > 0 && n >= c.config.maxErrors
+	last := c.aborted
+	c.sending.Add(1)
+	c.mu.Unlock()
+
+	// Send without holding mu, so that a slow consumer only blocks the
+	// goroutines reporting errors rather than every one checking pages.
+	sent := c.send(err)
+	c.sending.Done()
+	if !last {
+		return sent
+	}
+
+	// Report the abort once the errors counted before it are delivered.
+	c.sending.Wait()
+	c.send(fmt.Errorf("check aborted after %d errors", n))
+	return false
+}
+
+// send delivers err to the consumer unless the check is cancelled first.
+func (c *checker) send(err error) bool {
+	select {
+	case c.ch <- err:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// stopped returns whether the check has been cancelled or aborted.
+func (c *checker) stopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.aborted || c.ctx.Err() != nil
+}
+
+// checkBucket verifies the pages of b and of every bucket nested in it. path
+// holds the names of b and its parents, and is nil for the bucket the check
+// started from.
+func (c *checker) checkBucket(b *Bucket, path [][]byte) {
+	if c.stopped() {
+		return
+	}
+
+	c.mu.Lock()
+	c.stats.BucketN++
+	c.mu.Unlock()
+
+	// Inline buckets own no pages but still hold keys in the page embedded
+	// in their value.
+	if b.root == 0 {
+		if b.page != nil {
+			c.checkInlinePage(b.page, path)
+		}
+		return
+	}
+
+	// Check every page used by this bucket.
+	c.mu.Lock()
+	unreadN := c.unreadN
+	c.mu.Unlock()
+	c.checkPages(b.root, path, nil, nil)
+	c.wg.Wait()
+
+	// Nested buckets are found by iterating over the bucket, which is not
+	// safe if any of its pages could not be read.
+	c.mu.Lock()
+	unread := c.unreadN != unreadN
+	c.mu.Unlock()
+	if unread {
+		return
+	}
+
+	// Check each bucket within this bucket.
+	_ = b.ForEachBucket(func(k []byte) error {
+		c.checkBucket(b.Bucket(k), append(path[:len(path):len(path)], k))
+		if c.stopped() {
+			return errCheckStopped
+		}
+		return nil
+	})
+}
+
+// checkPages verifies the page with the given id of the bucket at path and, if
+// it is a branch page, every page below it. All keys in the subtree must fall
+// within the range [minKey, maxKey), where a nil bound is unbounded.
+func (c *checker) checkPages(id pgid, path [][]byte, minKey, maxKey []byte) {
+	if c.stopped() {
+		return
+	}
+
+	tx := c.tx
+	p := tx.pageHeader(id)
+	loc := &location{id: p.id, bucket: path}
+	if p.id > tx.meta.pgid {
+		c.reportAt(loc, KindOutOfBounds, nil, "out of bounds: %d", int(tx.meta.pgid))
+	}
+
+	// Ensure each page is only referenced once.
+	for _, id := range c.visit(p) {
+		c.reportAt(&location{id: id, bucket: path}, KindMultipleReferences, nil, "multiple references")
+	}
+
+	// We should only encounter un-freed leaf and branch pages.
+	if c.freed[p.id] {
+		c.reportAt(loc, KindReachableFreed, nil, "reachable freed")
+	}
+
+	// Pages of encrypted databases are only decrypted once they are known
+	// to be reachable.
+	if p = c.page(loc, id); p == nil {
+		return
+	}
+
+	// Do not read the elements if their headers run past the page.
+	if !c.checkPageHeader(loc, p) {
+		return
+	}
+
+	switch {
+	case (p.flags & branchPageFlag) != 0:
+		// Each child covers the range between its own key and the key of
+		// the next element, so the children can be checked independently.
+		children := make(map[pgid]int, p.count)
+		for i := 0; i < int(p.count); i++ {
+			elem := p.branchPageElement(uint16(i))
+			var previousKey = minKey
+			if i > 0 {
+				previousKey = p.branchPageElement(uint16(i - 1)).key()
+			}
+			c.checkKeyOrder(loc, "branch", i, elem.key(), previousKey, maxKey)
+
+			// Descending into the branch itself or into a child twice would
+			// check pages more than once, or never end. Iterating over the
+			// bucket would not end either, so its pages count as unread.
+			j, seen := children[elem.pgid]
+			if self := elem.pgid >= p.id && elem.pgid <= p.id+pgid(p.overflow); self || seen {
+				if self {
+					c.reportAt(loc, KindBranchChild, nil, "element %d: references the branch page itself", i)
+				} else {
+					c.reportAt(loc, KindBranchChild, nil, "element %d: references page %d, already referenced by element %d", i, int(elem.pgid), j)
+				}
+				c.mu.Lock()
+				c.unreadN++
+				c.mu.Unlock()
+				continue
+			}
+			children[elem.pgid] = i
+
+			childMax := maxKey
+			if i < int(p.count)-1 {
+				childMax = p.branchPageElement(uint16(i + 1)).key()
+			}
+			c.checkChildPages(elem.pgid, path, elem.key(), childMax)
+		}
+
+	case (p.flags & leafPageFlag) != 0:
+		previousKey := minKey
+		for i := 0; i < int(p.count); i++ {
+			elem := p.leafPageElement(uint16(i))
+			c.checkKeyOrder(loc, "leaf", i, elem.key(), previousKey, maxKey)
+			c.checkValue(loc, elem)
+			previousKey = elem.key()
+		}
+
+	default:
+		c.reportAt(loc, KindInvalidPageType, nil, "invalid type: %s", p.typ())
+	}
+}
+
+// page returns page id of the transaction, or reports it and returns nil if
+// it cannot be decrypted.
+func (c *checker) page(loc *location, id pgid) *page {
+	p, err := c.tx.openPage(id)
+	if err != nil {
+		c.reportAt(loc, KindPageChecksum, nil, "%s", err)
+		c.mu.Lock()
+		c.unreadN++
+		c.mu.Unlock()
+		return nil
+	}
+	return p
+}
+
+// checkPageHeader verifies that the overflow pages of p end below the high
+// water mark, that its checksum matches if it has one and that its element
+// headers fit in the pages it spans. It returns false if the elements of p
+// cannot be read safely.
+func (c *checker) checkPageHeader(loc *location, p *page) bool {
+	tx := c.tx
+	if p.id < tx.meta.pgid {
+		if end := p.id + pgid(p.overflow); end >= tx.meta.pgid {
+			c.reportAt(loc, KindMalformedPage, nil, "overflow ends at page %d beyond high water mark %d",
+				int(end), int(tx.meta.pgid))
+		} else if (p.flags&pageChecksumFlag) != 0 && *p.storedChecksum(tx.db.pageSize) != p.checksum(tx.db.pageSize) {
+			c.reportAt(loc, KindPageChecksum, nil, "checksum mismatch")
+			c.mu.Lock()
+			c.unreadN++
+			c.mu.Unlock()
+			return false
+		}
+	}
+
+	var elemSize uintptr
+	switch {
+	case (p.flags & branchPageFlag) != 0:
+		elemSize = branchPageElementSize
+	case (p.flags & leafPageFlag) != 0:
+		elemSize = leafPageElementSize
+	default:
+		return true
+	}
+	span := (uintptr(p.overflow) + 1) * uintptr(tx.db.pageSize)
+	if need := pageHeaderSize + uintptr(p.count)*elemSize; need > span {
+		c.reportAt(loc, KindMalformedPage, nil, "%d elements need %d bytes but the page spans %d",
+			int(p.count), int(need), int(span))
+		c.mu.Lock()
+		c.unreadN++
+		c.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// checkInlinePage verifies the keys on the page embedded in the value of the
+// inline bucket at path.
+func (c *checker) checkInlinePage(p *page, path [][]byte) {
+	loc := &location{bucket: path, inline: true}
+	if (p.flags & leafPageFlag) == 0 {
+		c.reportAt(loc, KindInvalidPageType, nil, "invalid type: %s", p.typ())
+		return
+	}
+
+	var previousKey []byte
+	for i := 0; i < int(p.count); i++ {
+		elem := p.leafPageElement(uint16(i))
+		c.checkKeyOrder(loc, "leaf", i, elem.key(), previousKey, nil)
+		c.checkValue(loc, elem)
+		previousKey = elem.key()
+	}
+}
+
+// location identifies the page an inconsistency was found on.
+type location struct {
+	id     pgid
+	bucket [][]byte
+	inline bool
+}
+
+// reportAt reports an inconsistency found at loc, prefixing the message with
+// the bucket path and page.
+func (c *checker) reportAt(loc *location, kind CheckErrorKind, key []byte, format string, a ...interface{}) bool {
+	var desc string
+	switch {
+	case loc.inline && len(loc.bucket) > 0:
+		desc = fmt.Sprintf("bucket %s inline page", c.bucketPath(loc.bucket))
+	case loc.inline:
+		desc = "inline page"
+	case len(loc.bucket) > 0:
+		desc = fmt.Sprintf("bucket %s page %d", c.bucketPath(loc.bucket), int(loc.id))
+	default:
+		desc = fmt.Sprintf("page %d", int(loc.id))
+	}
+
+	err := newCheckError(kind, loc.id, key, desc+": "+format, a...)
+	if loc.bucket != nil {
+		err.Bucket = make([][]byte, len(loc.bucket))
+		for i, name := range loc.bucket {
+			err.Bucket[i] = cloneBytes(name)
+		}
+	}
+	return c.report(err)
+}
+
+// bucketPath renders the bucket names in path separated by slashes. Names
+// are usually text, so printable names are rendered as they are, and only
+// other names, or names holding a slash, are rendered like keys.
+func (c *checker) bucketPath(path [][]byte) string {
+	names := make([]string, len(path))
+	for i, name := range path {
+		if isPrintableName(name) {
+			names[i] = string(name)
+		} else {
+			names[i] = c.config.kvStringer.KeyToString(name)
+		}
+	}
+	return strings.Join(names, "/")
+}
+
+// isPrintableName reports whether name is printable UTF-8 which cannot be
+// confused with a separator or an escape sequence in a bucket path.
+func isPrintableName(name []byte) bool {
+	if len(name) == 0 || !utf8.Valid(name) {
+		return false
+	}
+	for _, r := range string(name) {
+		if !unicode.IsPrint(r) || r == '/' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkChildPages calls checkPages on a new goroutine if one is available,
+// and on the current goroutine otherwise.
+func (c *checker) checkChildPages(id pgid, path [][]byte, minKey, maxKey []byte) {
+	select {
+	case c.sem <- struct{}{}:
+		c.wg.Add(1)
+		go func() {
+			defer func() {
+				<-c.sem
+				c.wg.Done()
+			}()
+			c.checkPages(id, path, minKey, maxKey)
+		}()
+	default:
+		c.checkPages(id, path, minKey, maxKey)
+	}
+}
+
+// visit records p and its overflow pages as reachable, counts them in the
+// stats and returns the ids of those which were already reachable.
+func (c *checker) visit(p *page) []pgid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.PageN += int(p.overflow) + 1
+	if (p.flags & branchPageFlag) != 0 {
+		c.stats.BranchPageN++
+	} else if (p.flags & leafPageFlag) != 0 {
+		c.stats.LeafPageN++
+		c.stats.KeyN += int(p.count)
+	}
+
+	var dups []pgid
+	for i := pgid(0); i <= pgid(p.overflow); i++ {
+		var id = p.id + i
+		if _, ok := c.reachable[id]; ok {
+			dups = append(dups, id)
+		}
+		c.reachable[id] = p
+	}
+	return dups
+}
+
+// checkKeyOrder verifies that the key at the given index of a page sorts after
+// previousKey and before maxKey. For the first element of a page previousKey
+// is the lower bound inherited from the parent, which the key may equal.
+func (c *checker) checkKeyOrder(loc *location, pageType string, index int, key, previousKey, maxKey []byte) {
+	str := c.config.kvStringer.KeyToString
+	compare := c.tx.compareKeys
+	if index == 0 {
+		if previousKey != nil && compare(previousKey, key) > 0 {
+			c.reportAt(loc, KindKeyOrder, key, "first key[%d]=%s on %s page needs to be >= the key in the ancestor (%s)",
+				index, str(key), pageType, str(previousKey))
+		}
+	} else if cmp := compare(previousKey, key); cmp > 0 {
+		c.reportAt(loc, KindKeyOrder, key, "key[%d]=%s on %s page needs to be > (found <) than previous element (%s)",
+			index, str(key), pageType, str(previousKey))
+	} else if cmp == 0 {
+		c.reportAt(loc, KindKeyOrder, key, "key[%d]=%s on %s page needs to be > (found =) than previous element (%s)",
+			index, str(key), pageType, str(previousKey))
+	}
+
+	if maxKey != nil && compare(key, maxKey) >= 0 {
+		c.reportAt(loc, KindKeyOrder, key, "key[%d]=%s on %s page needs to be < than key of the next element in ancestor (%s)",
+			index, str(key), pageType, str(maxKey))
+	}
+}
+
+// checkValue verifies that the value of a leaf element decompresses to the
+// size recorded for it if it is compressed.
+func (c *checker) checkValue(loc *location, elem *leafPageElement) {
+	if (elem.flags & compressedValueFlag) == 0 {
+		return
+	}
+	v := elem.value()
+	if (elem.flags & expiringValueFlag) != 0 {
+		if len(v) < expiryPrefixSize {
+			c.reportAt(loc, KindCompressedValue, cloneBytes(elem.key()), "key %s: value too short for expiry time",
+				c.config.kvStringer.KeyToString(elem.key()))
+			return
+		}
+		v = v[expiryPrefixSize:]
+	}
+
+	c.mu.Lock()
+	c.stats.CompressedValueN++
+	c.mu.Unlock()
+	if _, err := decompressValue(v); err != nil {
+		c.reportAt(loc, KindCompressedValue, cloneBytes(elem.key()), "key %s: %s",
+			c.config.kvStringer.KeyToString(elem.key()), err)
+	}
+}
+
+// KeyValueStringer renders keys and values in diagnostic messages, such as
+// the errors reported by Tx.Check.
+type KeyValueStringer interface {
+	KeyToString([]byte) string
+	ValueToString([]byte) string
+}
+
+// HexKeyValueStringer returns a KeyValueStringer which renders both keys and
+// values as hex.
+func HexKeyValueStringer() KeyValueStringer {
+	return hexKeyValueStringer{}
+}
+
+type hexKeyValueStringer struct{}
+
+func (hexKeyValueStringer) KeyToString(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+func (hexKeyValueStringer) ValueToString(value []byte) string {
+	return hex.EncodeToString(value)
+}
+
+// StringKeyValueStringer returns a KeyValueStringer which renders keys and
+// values as text. Printable UTF-8 is kept verbatim, while every other byte is
+// escaped as \xNN and backslashes are escaped as \\, so the output is legible
+// for text keys and still unambiguous for binary ones.
+func StringKeyValueStringer() KeyValueStringer {
+	return stringKeyValueStringer{}
+}
+
+type stringKeyValueStringer struct{}
+
+func (stringKeyValueStringer) KeyToString(key []byte) string {
+	return escapeNonPrintable(key)
+}
+
+func (stringKeyValueStringer) ValueToString(value []byte) string {
+	return escapeNonPrintable(value)
+}
+
+// escapeNonPrintable returns b as a string with non-printable bytes escaped.
+func escapeNonPrintable(b []byte) string {
+	var sb strings.Builder
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case (r == utf8.RuneError && size <= 1) || !unicode.IsPrint(r):
+			// Escape every byte of invalid or non-printable sequences.
+			for _, c := range b[:size] {
+				fmt.Fprintf(&sb, `\x%02x`, c)
+			}
+		default:
+			sb.Write(b[:size])
+		}
+		b = b[size:]
+	}
+	return sb.String()
+}
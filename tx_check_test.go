@@ -0,0 +1,913 @@
+package bbolt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// beginUnreachableTx returns a read-only transaction whose copy of the meta
+// page claims n more pages than the file has, so that Check reports n
+// "unreachable unfreed" errors.
+func beginUnreachableTx(t *testing.T, db *DB, n int) *Tx {
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.meta.pgid += pgid(n)
+	return tx
+}
+
+// Ensure that a check with a cancelled context closes its channel without
+// reporting anything.
+func TestTx_CheckWithOptions_Cancelled(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	tx := beginUnreachableTx(t, db, 10)
+	defer func() { _ = tx.Rollback() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for err := range tx.CheckWithOptions(ctx) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that cancelling a check stops it even when the consumer has stopped
+// receiving from the channel.
+func TestTx_CheckWithOptions_CancelMidway(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	tx := beginUnreachableTx(t, db, 1000)
+	defer func() { _ = tx.Rollback() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := tx.CheckWithOptions(ctx)
+	if err := <-ch; err == nil {
+		t.Fatal("expected an error")
+	}
+	cancel()
+
+	// The checker may have been blocked on a send when the context was
+	// cancelled; the channel must still be closed promptly.
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("check did not stop after cancellation")
+		}
+	}
+}
+
+// Ensure that Check reports every error when the context is not cancelled.
+func TestTx_CheckWithOptions_Unreachable(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	tx := beginUnreachableTx(t, db, 10)
+	defer func() { _ = tx.Rollback() }()
+
+	var n int
+	for range tx.Check() {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("unexpected error count: %d", n)
+	}
+}
+
+// Ensure that a check stops after the configured number of errors.
+func TestTx_CheckWithOptions_MaxErrors(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	tx := beginUnreachableTx(t, db, 100)
+	defer func() { _ = tx.Rollback() }()
+
+	for _, opts := range [][]CheckOption{
+		{WithMaxErrors(5)},
+		{WithMaxErrors(5), WithParallelism(4)},
+	} {
+		var errs []error
+		for err := range tx.CheckWithOptions(context.Background(), opts...) {
+			errs = append(errs, err)
+		}
+		if len(errs) != 6 {
+			t.Fatalf("unexpected error count: %d", len(errs))
+		}
+		if msg := errs[5].Error(); msg != "check aborted after 5 errors" {
+			t.Fatalf("unexpected final error: %s", msg)
+		}
+	}
+}
+
+// Ensure that the errors reported by Check carry their kind and page.
+func TestTx_Check_CheckError(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	tx := beginUnreachableTx(t, db, 1)
+	defer func() { _ = tx.Rollback() }()
+
+	var errs []error
+	for err := range tx.Check() {
+		errs = append(errs, err)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected error count: %d", len(errs))
+	}
+	cerr, ok := errs[0].(*CheckError)
+	if !ok {
+		t.Fatalf("unexpected error type: %T", errs[0])
+	}
+	if cerr.Kind != KindUnreachable {
+		t.Fatalf("unexpected kind: %s", cerr.Kind)
+	} else if cerr.PageID != uint64(tx.meta.pgid-1) {
+		t.Fatalf("unexpected page: %d", cerr.PageID)
+	} else if cerr.Key != nil {
+		t.Fatalf("unexpected key: %x", cerr.Key)
+	}
+}
+
+// createOutOfOrderDb returns a database whose "widgets" bucket has its own
+// leaf page holding the keys "d", "b" and "c", in that order.
+func createOutOfOrderDb(t *testing.T) (*DB, func()) {
+	db, cleanup := createDb(t)
+
+	var root pgid
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		// Use large values so that the bucket is not inlined.
+		value := make([]byte, db.pageSize/4)
+		for _, k := range []string{"a", "b", "c"} {
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the first key on the leaf page directly in the file.
+	elem := db.page(root).leafPageElement(0)
+	off := int64(root)*int64(db.pageSize) + int64(pageHeaderSize) + int64(elem.pos)
+	if _, err := db.file.WriteAt([]byte("d"), off); err != nil {
+		t.Fatal(err)
+	}
+	return db, cleanup
+}
+
+// Ensure that Check reports keys which are out of order on a page.
+func TestTx_Check_KeyOrder(t *testing.T) {
+	db, cleanup := createOutOfOrderDb(t)
+	defer cleanup()
+
+	if err := db.View(func(tx *Tx) error {
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		cerr, ok := errs[0].(*CheckError)
+		if !ok {
+			t.Fatalf("unexpected error type: %T", errs[0])
+		}
+		if cerr.Kind != KindKeyOrder {
+			t.Fatalf("unexpected kind: %s", cerr.Kind)
+		} else if cerr.PageID != uint64(tx.Bucket([]byte("widgets")).root) {
+			t.Fatalf("unexpected page: %d", cerr.PageID)
+		} else if string(cerr.Key) != "b" {
+			t.Fatalf("unexpected key: %q", cerr.Key)
+		} else if !reflect.DeepEqual(cerr.Bucket, [][]byte{[]byte("widgets")}) {
+			t.Fatalf("unexpected bucket: %q", cerr.Bucket)
+		}
+		prefix := "bucket widgets page " + strconv.Itoa(int(cerr.PageID)) + ": "
+		if !strings.HasPrefix(cerr.Error(), prefix) {
+			t.Fatalf("unexpected error: %v", cerr)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Check reports branch pages which reference themselves or the
+// same child twice, without descending into them again.
+func TestTx_Check_BranchChild(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	var root pgid
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%04d", i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		if p := tx.page(root); (p.flags&branchPageFlag) == 0 || p.count < 3 {
+			t.Fatalf("unexpected root page: %s with %d elements", p.typ(), p.count)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Point the second element at the first child and the third at the
+	// branch page itself.
+	child := db.page(root).branchPageElement(0).pgid
+	for i, id := range []pgid{child, root} {
+		var buf [8]byte
+		*(*pgid)(unsafe.Pointer(&buf[0])) = id
+		off := int64(root)*int64(db.pageSize) + int64(pageHeaderSize) + int64(i+1)*int64(branchPageElementSize) + int64(unsafe.Offsetof(branchPageElement{}.pgid))
+		if _, err := db.file.WriteAt(buf[:], off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var msgs []string
+		for err := range tx.Check() {
+			if cerr, ok := err.(*CheckError); ok && cerr.Kind == KindBranchChild {
+				if cerr.PageID != uint64(root) {
+					t.Fatalf("unexpected page: %d", cerr.PageID)
+				}
+				msgs = append(msgs, cerr.Error())
+			}
+		}
+		prefix := "bucket widgets page " + strconv.Itoa(int(root)) + ": "
+		exp := []string{
+			prefix + "element 1: references page " + strconv.Itoa(int(child)) + ", already referenced by element 0",
+			prefix + "element 2: references the branch page itself",
+		}
+		if !reflect.DeepEqual(msgs, exp) {
+			t.Fatalf("unexpected errors: %q", msgs)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Check reports keys which are out of order in an inline bucket.
+func TestTx_Check_InlineKeyOrder(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		child, err := b.CreateBucket([]byte("inline"))
+		if err != nil {
+			return err
+		}
+		for _, k := range []string{"a", "b", "c"} {
+			if err := child.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the first key of the inline page directly in the file.
+	var off int64
+	if err := db.View(func(tx *Tx) error {
+		_, v, _ := tx.Bucket([]byte("widgets")).Cursor().seek([]byte("inline"))
+		p := (*page)(unsafe.Pointer(&v[bucketHeaderSize]))
+		key := p.leafPageElement(0).key()
+		off = int64(uintptr(unsafe.Pointer(&key[0])) - uintptr(unsafe.Pointer(&db.data[0])))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.file.WriteAt([]byte("d"), off); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var errs []error
+		for err := range tx.CheckWithOptions(context.Background(), WithKVStringer(StringKeyValueStringer())) {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		cerr := errs[0].(*CheckError)
+		if cerr.Kind != KindKeyOrder {
+			t.Fatalf("unexpected kind: %s", cerr.Kind)
+		} else if string(cerr.Key) != "b" {
+			t.Fatalf("unexpected key: %q", cerr.Key)
+		} else if !strings.HasPrefix(cerr.Error(), "bucket widgets/inline inline page: ") {
+			t.Fatalf("unexpected error: %v", cerr)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Check decompresses compressed values and reports those which
+// are corrupted.
+func TestTx_Check_CompressedValue(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	value := bytes.Repeat([]byte("widget"), 1000)
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		// Use a large uncompressed value so that the bucket is not inlined.
+		if err := b.Put([]byte("0"), make([]byte, db.pageSize/2)); err != nil {
+			return err
+		}
+		db.Compression = CompressionFlate
+		for _, k := range []string{"a", "b"} {
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the uncompressed size recorded for "b" directly in the file.
+	var off int64
+	if err := db.View(func(tx *Tx) error {
+		_, v, flags := tx.Bucket([]byte("widgets")).Cursor().seek([]byte("b"))
+		if (flags & compressedValueFlag) == 0 {
+			t.Fatal("value not compressed")
+		}
+		off = int64(uintptr(unsafe.Pointer(&v[1])) - uintptr(unsafe.Pointer(&db.data[0])))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.file.WriteAt([]byte{0x81}, off); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats CheckStats
+	if err := db.View(func(tx *Tx) error {
+		var errs []error
+		for err := range tx.CheckWithOptions(context.Background(), WithStats(func(s CheckStats) { stats = s })) {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		cerr := errs[0].(*CheckError)
+		if cerr.Kind != KindCompressedValue {
+			t.Fatalf("unexpected kind: %s", cerr.Kind)
+		} else if string(cerr.Key) != "b" {
+			t.Fatalf("unexpected key: %q", cerr.Key)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stats.CompressedValueN != 2 {
+		t.Fatalf("unexpected compressed value count: %d", stats.CompressedValueN)
+	}
+}
+
+// Ensure that Check reports pages whose overflow extends beyond the high water
+// mark or whose element count does not fit in the page.
+func TestTx_Check_MalformedPage(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		corrupt func(p *page, hwm pgid) (off uintptr, b []byte)
+	}{
+		{"overflow", func(p *page, hwm pgid) (uintptr, []byte) {
+			b := make([]byte, 4)
+			*(*uint32)(unsafe.Pointer(&b[0])) = uint32(hwm - p.id)
+			return unsafe.Offsetof(p.overflow), b
+		}},
+		{"count", func(p *page, hwm pgid) (uintptr, []byte) {
+			return unsafe.Offsetof(p.count), []byte{0xff, 0xff}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			db, cleanup := createDb(t)
+			defer cleanup()
+
+			var root, hwm pgid
+			if err := db.Update(func(tx *Tx) error {
+				b, err := tx.CreateBucket([]byte("widgets"))
+				if err != nil {
+					return err
+				}
+				// Use large values so that the bucket is not inlined.
+				value := make([]byte, db.pageSize/4)
+				for _, k := range []string{"a", "b", "c"} {
+					if err := b.Put([]byte(k), value); err != nil {
+						return err
+					}
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.View(func(tx *Tx) error {
+				root, hwm = tx.Bucket([]byte("widgets")).root, tx.meta.pgid
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// Overwrite the header of the leaf page directly in the file.
+			off, b := tc.corrupt(db.page(root), hwm)
+			if _, err := db.file.WriteAt(b, int64(root)*int64(db.pageSize)+int64(off)); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.View(func(tx *Tx) error {
+				// The overflow also covers pages used elsewhere, which are
+				// reported as multiple references.
+				var errs []error
+				var found bool
+				for err := range tx.Check() {
+					errs = append(errs, err)
+					if cerr, ok := err.(*CheckError); ok && cerr.Kind == KindMalformedPage && cerr.PageID == uint64(root) {
+						found = true
+					}
+				}
+				if !found {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Ensure that corrupting a page written with PageChecksums is detected by
+// Check and by reading the page.
+func TestTx_Check_PageChecksum(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+	db.PageChecksums = true
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		// Use large values so that the bucket is not inlined.
+		value := make([]byte, db.pageSize/4)
+		for _, k := range []string{"a", "b", "c"} {
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var root pgid
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		if p := tx.page(root); (p.flags & pageChecksumFlag) == 0 {
+			t.Fatalf("expected page %d to have a checksum", root)
+		}
+		for err := range tx.Check() {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of a value directly in the file.
+	if _, err := db.file.WriteAt([]byte{0xff}, int64(root)*int64(db.pageSize)+int64(db.pageSize/2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var found bool
+		for err := range tx.Check() {
+			if cerr, ok := err.(*CheckError); ok && cerr.Kind == KindPageChecksum && cerr.PageID == uint64(root) {
+				found = true
+			} else {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if !found {
+			t.Fatal("expected checksum error")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("expected panic reading corrupted page")
+			}
+		}()
+		_ = db.View(func(tx *Tx) error {
+			tx.Bucket([]byte("widgets")).Get([]byte("b"))
+			return nil
+		})
+	}()
+}
+
+// Ensure that Check reports a freelist page whose count disagrees with the
+// in-memory freelist.
+func TestTx_Check_FreelistCountMismatch(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	// Create and then delete a bucket so that the freelist is not empty.
+	for _, fn := range []func(tx *Tx) error{
+		func(tx *Tx) error {
+			b, err := tx.CreateBucket([]byte("widgets"))
+			if err != nil {
+				return err
+			}
+			return b.Put([]byte("foo"), make([]byte, db.pageSize))
+		},
+		func(tx *Tx) error { return tx.DeleteBucket([]byte("widgets")) },
+	} {
+		if err := db.Update(fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Overwrite the count in the freelist page header.
+	id := db.meta().freelist
+	count := db.page(id).count
+	buf := []byte{byte(count + 1), byte((count + 1) >> 8)}
+	off := int64(id)*int64(db.pageSize) + int64(unsafe.Offsetof(page{}.count))
+	if _, err := db.file.WriteAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var errs []error
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if cerr, ok := errs[0].(*CheckError); !ok || cerr.Kind != KindFreelistMismatch || cerr.PageID != uint64(id) {
+			t.Fatalf("unexpected error: %v", errs[0])
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// quotedKeyValueStringer renders keys and values as quoted strings.
+type quotedKeyValueStringer struct{}
+
+func (quotedKeyValueStringer) KeyToString(key []byte) string     { return strconv.Quote(string(key)) }
+func (quotedKeyValueStringer) ValueToString(value []byte) string { return strconv.Quote(string(value)) }
+
+// Ensure that Bucket.Check reports errors within the bucket using the given
+// KeyValueStringer.
+func TestBucket_Check(t *testing.T) {
+	db, cleanup := createOutOfOrderDb(t)
+	defer cleanup()
+
+	if err := db.View(func(tx *Tx) error {
+		var errs []error
+		for err := range tx.Bucket([]byte("widgets")).Check(quotedKeyValueStringer{}) {
+			errs = append(errs, err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		if cerr, ok := errs[0].(*CheckError); !ok || cerr.Kind != KindKeyOrder {
+			t.Fatalf("unexpected error: %v", errs[0])
+		}
+		if msg := errs[0].Error(); !strings.Contains(msg, `key[1]="b"`) || !strings.Contains(msg, `("d")`) {
+			t.Fatalf("unexpected message: %s", msg)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Bucket.Check descends into nested buckets and reports nothing
+// for a consistent bucket.
+func TestBucket_Check_Nested(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			child, err := b.CreateBucket([]byte(strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 100; j++ {
+				if err := child.Put([]byte(strconv.Itoa(j)), make([]byte, 100)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Bucket([]byte("widgets")).Check(nil) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that a parallel check reports the same errors as a sequential one.
+func TestTx_CheckWithOptions_Parallelism(t *testing.T) {
+	db, cleanup := createOutOfOrderDb(t)
+	defer cleanup()
+
+	// Add enough data for buckets to span several levels of branch pages.
+	if err := db.Update(func(tx *Tx) error {
+		for i := 0; i < 4; i++ {
+			b, err := tx.CreateBucket([]byte("bucket" + strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j < 5000; j++ {
+				if err := b.Put([]byte(strconv.Itoa(j)), make([]byte, 64)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		collect := func(options ...CheckOption) map[string]bool {
+			errs := make(map[string]bool)
+			for err := range tx.CheckWithOptions(context.Background(), options...) {
+				errs[err.Error()] = true
+			}
+			return errs
+		}
+
+		sequential, parallel := collect(), collect(WithParallelism(4))
+		if len(sequential) != 1 {
+			t.Fatalf("unexpected errors: %v", sequential)
+		} else if !reflect.DeepEqual(sequential, parallel) {
+			t.Fatalf("unexpected errors: %v != %v", parallel, sequential)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that StringKeyValueStringer keeps printable text and escapes
+// everything else.
+func TestStringKeyValueStringer(t *testing.T) {
+	kv := StringKeyValueStringer()
+	for _, tt := range []struct {
+		in  []byte
+		exp string
+	}{
+		{nil, ""},
+		{[]byte{}, ""},
+		{[]byte("users/42"), "users/42"},
+		{[]byte("héllo wörld"), "héllo wörld"},
+		{[]byte("a\x00b\n"), `a\x00b\x0a`},
+		{[]byte{0xff, 'a', 0xc3}, `\xffa\xc3`},
+		{[]byte(`a\x00`), `a\\x00`},
+	} {
+		if s := kv.KeyToString(tt.in); s != tt.exp {
+			t.Errorf("KeyToString(%q) = %q, expected %q", tt.in, s, tt.exp)
+		}
+		if s := kv.ValueToString(tt.in); s != tt.exp {
+			t.Errorf("ValueToString(%q) = %q, expected %q", tt.in, s, tt.exp)
+		}
+	}
+}
+
+// Ensure that WithStats summarizes what the check examined.
+func TestTx_CheckWithOptions_Stats(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put([]byte(strconv.Itoa(i)), make([]byte, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *Tx) error {
+		var stats *CheckStats
+		for err := range tx.CheckWithOptions(context.Background(), WithStats(func(s CheckStats) { stats = &s })) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if stats == nil {
+			t.Fatal("expected stats")
+		}
+
+		bs := tx.Bucket([]byte("widgets")).Stats()
+		exp := CheckStats{
+			PageN:       1 + bs.BranchPageN + bs.BranchOverflowN + bs.LeafPageN + bs.LeafOverflowN,
+			BranchPageN: bs.BranchPageN,
+			LeafPageN:   1 + bs.LeafPageN,
+			FreePageN:   tx.db.freelist.count(),
+			BucketN:     2,
+			KeyN:        1 + bs.KeyN,
+		}
+		if *stats != exp {
+			t.Fatalf("unexpected stats: %+v, expected %+v", *stats, exp)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDB_HealthCheck(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	if err := db.Update(func(tx *Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		// Use large values so that the bucket is not inlined.
+		value := make([]byte, db.pageSize/4)
+		for _, k := range []string{"a", "b", "c"} {
+			if err := b.Put([]byte(k), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.HealthCheck(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := db.HealthCheck(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var root pgid
+	if err := db.View(func(tx *Tx) error {
+		root = tx.Bucket([]byte("widgets")).root
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clear the flags of the root page of the bucket directly in the file.
+	if _, err := db.file.WriteAt([]byte{0, 0}, int64(root)*int64(db.pageSize)+int64(unsafe.Offsetof(page{}.flags))); err != nil {
+		t.Fatal(err)
+	}
+	err := db.HealthCheck(context.Background())
+	if cerr, ok := err.(*CheckError); !ok || cerr.Kind != KindInvalidPageType || cerr.PageID != uint64(root) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that ReclaimLeakedPages frees pages which are neither reachable nor
+// free.
+func TestDB_ReclaimLeakedPages(t *testing.T) {
+	db, cleanup := createDb(t)
+	defer cleanup()
+
+	// Allocate pages without referencing them.
+	if err := db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			return err
+		}
+		_, err := tx.allocate(2)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := db.ReclaimLeakedPages(); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("unexpected reclaimed page count: %d", n)
+	}
+	if err := db.View(func(tx *Tx) error {
+		for err := range tx.Check() {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.ReclaimLeakedPages(); err != nil || n != 0 {
+		t.Fatalf("unexpected second reclaim: %d, %v", n, err)
+	}
+
+	// Other inconsistencies prevent reclaiming anything.
+	db, cleanup = createOutOfOrderDb(t)
+	defer cleanup()
+	if err := db.Update(func(tx *Tx) error {
+		_, err := tx.allocate(1)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.ReclaimLeakedPages(); n != 0 {
+		t.Fatalf("unexpected reclaimed page count: %d", n)
+	} else if cerr, ok := err.(*CheckError); !ok || cerr.Kind != KindKeyOrder {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that bucket paths render printable names as they are and other
+// names as hex.
+func TestChecker_BucketPath(t *testing.T) {
+	c := newChecker(context.Background(), nil, checkConfig{}, nil)
+	for _, tt := range []struct {
+		path [][]byte
+		exp  string
+	}{
+		{[][]byte{[]byte("users"), []byte("sessions")}, "users/sessions"},
+		{[][]byte{[]byte("users"), {0x00, 0xff}}, "users/00ff"},
+		{[][]byte{[]byte("a/b")}, "612f62"},
+		{[][]byte{[]byte("naïve")}, "naïve"},
+	} {
+		if s := c.bucketPath(tt.path); s != tt.exp {
+			t.Fatalf("unexpected path for %q: %s, expected %s", tt.path, s, tt.exp)
+		}
+	}
+}
@@ -83,8 +83,8 @@ func TestTx_Commit_ErrTxClosed(t *testing.T) {
 	}
 }
 
-// Ensure that rolling back a closed transaction returns an error.
-func TestTx_Rollback_ErrTxClosed(t *testing.T) {
+// Ensure that rolling back a closed transaction does nothing.
+func TestTx_Rollback_Closed(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 
@@ -96,11 +96,85 @@ func TestTx_Rollback_ErrTxClosed(t *testing.T) {
 	if err := tx.Rollback(); err != nil {
 		t.Fatal(err)
 	}
-	if err := tx.Rollback(); err != bolt.ErrTxClosed {
+	if err := tx.Rollback(); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
 
+// Ensure that a deferred rollback after a commit keeps the commit.
+func TestTx_Commit_DeferredRollback(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	update := func() (err error) {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if rerr := tx.Rollback(); err == nil {
+				err = rerr
+			}
+		}()
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if err := update(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected committed bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Closed reports whether a transaction is closed and that
+// rolling back a committed transaction does nothing.
+func TestTx_Closed(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.Closed() {
+		t.Fatal("expected open tx")
+	}
+	if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if !tx.Closed() {
+		t.Fatal("expected closed tx")
+	}
+	for i := 0; i < 2; i++ {
+		if err := tx.Rollback(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if tx.Closed() {
+			t.Fatal("expected open tx")
+		} else if tx.Bucket([]byte("widgets")) == nil {
+			t.Fatal("expected committed bucket")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // Ensure that committing a read-only transaction returns an error.
 func TestTx_Commit_ErrTxNotWritable(t *testing.T) {
 	db := MustOpenDB()
@@ -116,6 +190,46 @@ func TestTx_Commit_ErrTxNotWritable(t *testing.T) {
 	tx.Rollback()
 }
 
+// Ensure that CommitWithStats reports the time taken by each phase.
+func TestTx_CommitWithStats(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("widgets"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var handled bool
+	tx.OnCommit(func() { handled = true })
+
+	stats, err := tx.CommitWithStats()
+	if err != nil {
+		t.Fatal(err)
+	} else if !handled {
+		t.Fatal("expected commit handler to run")
+	}
+	if stats.SpillTime <= 0 || stats.WriteTime <= 0 || stats.TotalTime <= 0 {
+		t.Fatalf("expected spill, write and total time: %+v", stats)
+	}
+	sum := stats.RebalanceTime + stats.SpillTime + stats.FreelistTime + stats.WriteTime + stats.MetaTime + stats.SyncTime
+	if sum > stats.TotalTime {
+		t.Fatalf("phases exceed total time: %v > %v", sum, stats.TotalTime)
+	}
+
+	if _, err := tx.CommitWithStats(); err != bolt.ErrTxClosed {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 // Ensure that a transaction can retrieve a cursor on the root bucket.
 func TestTx_Cursor(t *testing.T) {
 	db := MustOpenDB()
@@ -308,6 +422,54 @@ func TestTx_CreateBucketIfNotExists_ErrBucketNameRequired(t *testing.T) {
 	}
 }
 
+// Ensure that the options of a bucket created with options are persisted.
+func TestTx_CreateBucketIfNotExistsWithOptions(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		opts := &bolt.BucketOptions{FillPercent: 0.95, NoInline: true}
+		b, err := tx.CreateBucketIfNotExistsWithOptions([]byte("widgets"), opts)
+		if err != nil {
+			t.Fatal(err)
+		} else if b.FillPercent != 0.95 {
+			t.Fatalf("unexpected fill percent: %v", b.FillPercent)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.CreateBucketIfNotExistsWithOptions([]byte("woojits"), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.CreateBucketIfNotExistsWithOptions([]byte("gadgets"), &bolt.BucketOptions{FillPercent: 2}); err != bolt.ErrFillPercent {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later transactions see the options, and existing buckets keep them.
+	for i := 0; i < 2; i++ {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExistsWithOptions([]byte("widgets"), &bolt.BucketOptions{FillPercent: 0.5})
+			if err != nil {
+				t.Fatal(err)
+			} else if b.FillPercent != 0.95 {
+				t.Fatalf("unexpected fill percent: %v", b.FillPercent)
+			} else if n := b.Stats().InlineBucketN; n != 0 {
+				t.Fatalf("unexpected inline bucket count: %d", n)
+			}
+			if n := tx.Bucket([]byte("woojits")).Stats().InlineBucketN; n != 1 {
+				t.Fatalf("unexpected inline bucket count: %d", n)
+			}
+			return b.Put([]byte("baz"), []byte("bat"))
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.MustCheck()
+}
+
 // Ensure that a bucket cannot be created twice.
 func TestTx_CreateBucket_ErrBucketExists(t *testing.T) {
 	db := MustOpenDB()
@@ -489,61 +651,59 @@ func TestTx_ForEach_WithError(t *testing.T) {
 	}
 }
 
-// Ensure that Tx commit handlers are called after a transaction successfully commits.
-func TestTx_OnCommit(t *testing.T) {
+// Ensure that Tx.ReverseForEach visits the top-level buckets in reverse order.
+func TestTx_ReverseForEach(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
-
-	var x int
 	if err := db.Update(func(tx *bolt.Tx) error {
-		tx.OnCommit(func() { x += 1 })
-		tx.OnCommit(func() { x += 2 })
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+		for _, name := range []string{"b", "c", "a"} {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var names []string
+		if err := tx.ReverseForEach(func(name []byte, b *bolt.Bucket) error {
+			if b == nil {
+				t.Fatalf("expected bucket %s", name)
+			}
+			names = append(names, string(name))
+			return nil
+		}); err != nil {
 			t.Fatal(err)
 		}
+		if fmt.Sprint(names) != "[c b a]" {
+			t.Fatalf("unexpected names: %v", names)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
-	} else if x != 3 {
-		t.Fatalf("unexpected x: %d", x)
 	}
 }
 
-// Ensure that Tx commit handlers are NOT called after a transaction rolls back.
-func TestTx_OnCommit_Rollback(t *testing.T) {
+// Ensure that CheckSchema reports missing and unexpected buckets and key
+// counts out of tolerance.
+func TestTx_CheckSchema(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
-
-	var x int
 	if err := db.Update(func(tx *bolt.Tx) error {
-		tx.OnCommit(func() { x += 1 })
-		tx.OnCommit(func() { x += 2 })
-		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+		widgets, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
 			t.Fatal(err)
 		}
-		return errors.New("rollback this commit")
-	}); err == nil || err.Error() != "rollback this commit" {
-		t.Fatalf("unexpected error: %s", err)
-	} else if x != 0 {
-		t.Fatalf("unexpected x: %d", x)
-	}
-}
-
-// Ensure that the database can be copied to a file path.
-func TestTx_CopyFile(t *testing.T) {
-	db := MustOpenDB()
-	defer db.MustClose()
-
-	path := tempfile()
-	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("widgets"))
+		for i := 0; i < 100; i++ {
+			if err := widgets.Put(u64tob(uint64(i)), []byte{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sub, err := widgets.CreateBucket([]byte("sub"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+		if _, err := sub.CreateBucket([]byte("extra")); err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+		if _, err := tx.CreateBucket([]byte("gadgets")); err != nil {
 			t.Fatal(err)
 		}
 		return nil
@@ -552,83 +712,102 @@ func TestTx_CopyFile(t *testing.T) {
 	}
 
 	if err := db.View(func(tx *bolt.Tx) error {
-		return tx.CopyFile(path, 0600)
-	}); err != nil {
-		t.Fatal(err)
-	}
-
-	db2, err := bolt.Open(path, 0600, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if err := db2.View(func(tx *bolt.Tx) error {
-		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
-			t.Fatalf("unexpected value: %v", v)
-		}
-		if v := tx.Bucket([]byte("widgets")).Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
-			t.Fatalf("unexpected value: %v", v)
+		spec := bolt.SchemaSpec{Buckets: []bolt.BucketSpec{
+			{Path: [][]byte{[]byte("widgets")}, KeyN: 95, Tolerance: 0.1},
+			{Path: [][]byte{[]byte("widgets"), []byte("sub"), []byte("extra")}, KeyN: 0},
+			{Path: [][]byte{[]byte("gadgets")}, KeyN: -1},
+		}}
+		if errs := tx.CheckSchema(spec); len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+
+		spec = bolt.SchemaSpec{Buckets: []bolt.BucketSpec{
+			{Path: [][]byte{[]byte("widgets")}, KeyN: 50, Tolerance: 0.1},
+			{Path: [][]byte{[]byte("widgets"), []byte("sub")}, KeyN: 0},
+			{Path: [][]byte{[]byte("sprockets")}, KeyN: -1},
+		}}
+		errs := tx.CheckSchema(spec)
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Error())
+		}
+		want := []string{
+			`bucket "sprockets": missing`,
+			`bucket "gadgets": unexpected`,
+			`bucket "widgets/sub/extra": unexpected`,
+			`bucket "widgets": 100 keys, expected 50`,
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+			t.Fatalf("unexpected errors: %q", got)
+		}
+		if e, ok := errs[3].(*bolt.SchemaError); !ok || e.Kind != bolt.SchemaKeyCount || e.KeyN != 100 {
+			t.Fatalf("unexpected error: %#v", errs[3])
+		}
+
+		spec.AllowUnexpected = true
+		if errs := tx.CheckSchema(spec); len(errs) != 2 {
+			t.Fatalf("unexpected errors: %v", errs)
 		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
-
-	if err := db2.Close(); err != nil {
-		t.Fatal(err)
-	}
-}
-
-type failWriterError struct{}
-
-func (failWriterError) Error() string {
-	return "error injected for tests"
-}
-
-type failWriter struct {
-	// fail after this many bytes
-	After int
-}
-
-func (f *failWriter) Write(p []byte) (n int, err error) {
-	n = len(p)
-	if n > f.After {
-		n = f.After
-		err = failWriterError{}
-	}
-	f.After -= n
-	return n, err
 }
 
-// Ensure that Copy handles write errors right.
-func TestTx_CopyFile_Error_Meta(t *testing.T) {
+// Ensure that Tx.Walk visits every key in nested buckets with its path.
+func TestTx_Walk(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 	if err := db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucket([]byte("widgets"))
+		a, err := tx.CreateBucket([]byte("a"))
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+		if err := a.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		b, err := a.CreateBucket([]byte("b"))
+		if err != nil {
 			t.Fatal(err)
 		}
 		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
 			t.Fatal(err)
 		}
+		if _, err := tx.CreateBucket([]byte("c")); err != nil {
+			t.Fatal(err)
+		}
 		return nil
 	}); err != nil {
 		t.Fatal(err)
 	}
 
 	if err := db.View(func(tx *bolt.Tx) error {
-		return tx.Copy(&failWriter{})
-	}); err == nil || err.Error() != "meta 0 copy: error injected for tests" {
-		t.Fatalf("unexpected error: %v", err)
+		var visited []string
+		if err := tx.Walk(func(path [][]byte, k, v []byte) error {
+			visited = append(visited, fmt.Sprintf("%s:%s=%s", bytes.Join(path, []byte("/")), k, v))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		exp := []string{":a=", "a:b=", "a/b:baz=bat", "a:foo=bar", ":c="}
+		if fmt.Sprint(visited) != fmt.Sprint(exp) {
+			t.Fatalf("unexpected keys: %q", visited)
+		}
+
+		marker := errors.New("marker")
+		if err := tx.Walk(func(path [][]byte, k, v []byte) error {
+			return marker
+		}); err != marker {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-// Ensure that Copy handles write errors right.
-func TestTx_CopyFile_Error_Normal(t *testing.T) {
+// Ensure that Tx.Page lists the children of branch pages.
+func TestTx_Page_Children(t *testing.T) {
 	db := MustOpenDB()
 	defer db.MustClose()
 	if err := db.Update(func(tx *bolt.Tx) error {
@@ -636,11 +815,10 @@ func TestTx_CopyFile_Error_Normal(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
-			t.Fatal(err)
-		}
-		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
-			t.Fatal(err)
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
 		}
 		return nil
 	}); err != nil {
@@ -648,26 +826,413 @@ func TestTx_CopyFile_Error_Normal(t *testing.T) {
 	}
 
 	if err := db.View(func(tx *bolt.Tx) error {
-		return tx.Copy(&failWriter{3 * db.Info().PageSize})
-	}); err == nil || err.Error() != "error injected for tests" {
-		t.Fatalf("unexpected error: %v", err)
+		var branchN int
+		for id := 2; ; id++ {
+			p, err := tx.Page(id)
+			if err != nil {
+				t.Fatal(err)
+			} else if p == nil {
+				break
+			} else if p.Type != "branch" {
+				if p.Children != nil {
+					t.Fatalf("unexpected children of %s page %d", p.Type, id)
+				}
+				continue
+			}
+
+			branchN++
+			if len(p.Children) != p.Count {
+				t.Fatalf("unexpected child count: %d, expected %d", len(p.Children), p.Count)
+			}
+			for _, child := range p.Children {
+				if c, err := tx.Page(child); err != nil {
+					t.Fatal(err)
+				} else if c == nil || (c.Type != "leaf" && c.Type != "branch") {
+					t.Fatalf("unexpected child page %d of page %d: %+v", child, id, c)
+				}
+			}
+		}
+		if branchN == 0 {
+			t.Fatal("expected a branch page")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
 }
 
-// TestTx_Rollback ensures there is no error when tx rollback whether we sync freelist or not.
-func TestTx_Rollback(t *testing.T) {
-	for _, isSyncFreelist := range []bool{false, true} {
-		// Open the database.
-		db, err := bolt.Open(tempfile(), 0666, nil)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer os.Remove(db.Path())
-		db.NoFreelistSync = isSyncFreelist
+// Ensure that Tx.FreeSize reports the pages freed by earlier transactions.
+func TestTx_FreeSize(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
 
-		tx, err := db.Begin(true)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
 		if err != nil {
-			t.Fatalf("Error starting tx: %v", err)
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte("widgets"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	pageSize := int64(db.Info().PageSize)
+	var free int64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		free = tx.FreeSize()
+		if free == 0 || free%pageSize != 0 || free >= tx.Size() {
+			t.Fatalf("unexpected free size: %d of %d", free, tx.Size())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.FreeSize(); n != int64(db.Stats().FreePageN)*pageSize {
+			t.Fatalf("unexpected free size: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that the dirty pages of a transaction grow with its writes.
+func TestTx_DirtyPages(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if n := tx.DirtyPages(); n != 0 {
+			t.Fatalf("unexpected dirty pages: %d", n)
+		}
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := tx.DirtyPages(); n != 1 {
+			t.Fatalf("unexpected dirty pages after creating an inline bucket: %d", n)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if n := tx.DirtyPages(); n != 2 {
+			t.Fatalf("unexpected dirty pages before split: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updating a few keys of a large bucket dirties only their leaves and the
+	// branch above them.
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = tx.Rollback() }()
+	b := tx.Bucket([]byte("widgets"))
+	for _, i := range []uint64{0, 999} {
+		if err := b.Put(u64tob(i), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tx.DirtyPages(); n != 3 {
+		t.Fatalf("unexpected dirty pages: %d", n)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		if n := tx.DirtyPages(); n != 0 {
+			t.Fatalf("unexpected dirty pages of read-only tx: %d", n)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Tx.WriteToWithProgress reports the bytes written.
+func TestTx_WriteToWithProgress(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		var buf bytes.Buffer
+		var calls int
+		var last int64
+		n, err := tx.WriteToWithProgress(&buf, func(written, total int64) {
+			if total != tx.Size() {
+				t.Fatalf("unexpected total: %d, expected %d", total, tx.Size())
+			} else if written <= last || written > total {
+				t.Fatalf("unexpected progress: %d after %d of %d", written, last, total)
+			}
+			calls++
+			last = written
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tx.Size() || last != n || int64(buf.Len()) != n {
+			t.Fatalf("unexpected size: %d, reported %d, buffered %d", n, last, buf.Len())
+		}
+		if calls < 3 {
+			t.Fatalf("unexpected progress calls: %d", calls)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that Tx commit handlers are called after a transaction successfully commits.
+func TestTx_OnCommit(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var x int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		tx.OnCommit(func() { x += 1 })
+		tx.OnCommit(func() { x += 2 })
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if x != 3 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+}
+
+// Ensure that Tx commit handlers are NOT called after a transaction rolls back.
+func TestTx_OnCommit_Rollback(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var x int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		tx.OnCommit(func() { x += 1 })
+		tx.OnCommit(func() { x += 2 })
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback this commit")
+	}); err == nil || err.Error() != "rollback this commit" {
+		t.Fatalf("unexpected error: %s", err)
+	} else if x != 0 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+}
+
+// Ensure that Tx rollback handlers are called after a transaction rolls back
+// and NOT after it commits.
+func TestTx_OnRollback(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	var x int
+	if err := db.Update(func(tx *bolt.Tx) error {
+		tx.OnRollback(func() { x += 1 })
+		tx.OnRollback(func() { x += 2 })
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return errors.New("rollback this commit")
+	}); err == nil || err.Error() != "rollback this commit" {
+		t.Fatalf("unexpected error: %s", err)
+	} else if x != 3 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+
+	x = 0
+	if err := db.Update(func(tx *bolt.Tx) error {
+		tx.OnRollback(func() { x += 1 })
+		_, err := tx.CreateBucket([]byte("widgets"))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	} else if x != 0 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.OnRollback(func() { x += 1 })
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	} else if x != 1 {
+		t.Fatalf("unexpected x: %d", x)
+	}
+}
+
+// Ensure that the database can be copied to a file path.
+func TestTx_CopyFile(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	path := tempfile()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db2.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		if v := tx.Bucket([]byte("widgets")).Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
+			t.Fatalf("unexpected value: %v", v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failWriterError struct{}
+
+func (failWriterError) Error() string {
+	return "error injected for tests"
+}
+
+type failWriter struct {
+	// fail after this many bytes
+	After int
+}
+
+func (f *failWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if n > f.After {
+		n = f.After
+		err = failWriterError{}
+	}
+	f.After -= n
+	return n, err
+}
+
+// Ensure that Copy handles write errors right.
+func TestTx_CopyFile_Error_Meta(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.Copy(&failWriter{})
+	}); err == nil || err.Error() != "meta 0 copy: error injected for tests" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure that Copy handles write errors right.
+func TestTx_CopyFile_Error_Normal(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("baz"), []byte("bat")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.Copy(&failWriter{3 * db.Info().PageSize})
+	}); err == nil || err.Error() != "error injected for tests" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// TestTx_Rollback ensures there is no error when tx rollback whether we sync freelist or not.
+func TestTx_Rollback(t *testing.T) {
+	for _, isSyncFreelist := range []bool{false, true} {
+		// Open the database.
+		db, err := bolt.Open(tempfile(), 0666, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(db.Path())
+		db.NoFreelistSync = isSyncFreelist
+
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatalf("Error starting tx: %v", err)
 		}
 		bucket := []byte("mybucket")
 		if _, err := tx.CreateBucket(bucket); err != nil {
@@ -705,6 +1270,313 @@ func TestTx_Rollback(t *testing.T) {
 	}
 }
 
+// Ensure that RollbackTo discards the changes made after a savepoint only.
+func TestTx_Savepoint(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("large"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(u64tob(uint64(i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Put([]byte("foo"), []byte("bar")); err != nil {
+			t.Fatal(err)
+		}
+		sp, err := tx.Savepoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Change every kind of state, then discard it twice.
+		for i := 0; i < 2; i++ {
+			if err := b.Put([]byte("foo"), []byte("baz")); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Put([]byte("bat"), []byte("man")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.CreateBucket([]byte("gadgets")); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.DeleteBucket([]byte("large")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.Savepoint(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tx.RollbackTo(sp); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if v := b.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("bat")); v != nil {
+			t.Fatalf("unexpected value: %q", v)
+		} else if tx.Bucket([]byte("gadgets")) != nil {
+			t.Fatal("expected bucket to be discarded")
+		} else if tx.Bucket([]byte("large")) == nil {
+			t.Fatal("expected bucket to be restored")
+		}
+		if err := tx.RollbackTo(sp + 1); err != bolt.ErrSavepointNotFound {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return b.Put([]byte("baz"), []byte("bat"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("widgets"))
+		if v := b.Get([]byte("foo")); !bytes.Equal(v, []byte("bar")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if v := b.Get([]byte("baz")); !bytes.Equal(v, []byte("bat")) {
+			t.Fatalf("unexpected value: %q", v)
+		} else if n := tx.Bucket([]byte("large")).Stats().KeyN; n != 1000 {
+			t.Fatalf("unexpected key count: %d", n)
+		}
+		if _, err := tx.Savepoint(); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure that pages allocated outside of buckets survive a reopen, pass
+// Check, and can be freed.
+func TestTx_AllocatePages(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	var start uint64
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if _, _, err := tx.AllocatePages(0); err == nil {
+			t.Fatal("expected error allocating zero pages")
+		}
+		id, buf, err := tx.AllocatePages(3)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(buf) < len(data) {
+			t.Fatalf("unexpected buffer size: %d", len(buf))
+		}
+		copy(buf, data)
+		start = id
+
+		if _, err := tx.CreateBucket([]byte("widgets")); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		if _, _, err := tx.AllocatePages(1); err != bolt.ErrTxNotWritable {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	// The freelist is rebuilt on open without claiming the pages.
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	db.MustCheck()
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		buf, err := tx.ReadPages(start)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buf[:len(data)], data) {
+			t.Fatal("unexpected page contents")
+		}
+		if _, err := tx.ReadPages(start + 1); err != bolt.ErrNotExtensionPage {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := tx.FreePages(start, 2); err == nil {
+			t.Fatal("expected error freeing a partial allocation")
+		}
+		if err := tx.FreePages(start, 3); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.ReadPages(start); err != bolt.ErrNotExtensionPage {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
+// Ensure that the freelist rebuild finds freed pages whose contents look like
+// the header of an extension allocation.
+func TestTx_AllocatePages_FreedLookalike(t *testing.T) {
+	db := MustOpenWithOption(&bolt.Options{NoFreelistSync: true})
+	defer db.MustClose()
+
+	var start uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		id, buf, err := tx.AllocatePages(2)
+		if err != nil {
+			return err
+		}
+		start = id
+		copy(buf, "data")
+
+		// The pages of a large value hold its bytes in place of headers.
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), bytes.Repeat([]byte{0x40}, 5*os.Getpagesize()))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if err := tx.FreePages(start, 2); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("widgets")).Delete([]byte("foo"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var free int
+	countFree := func() int {
+		if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		return db.Stats().FreePageN + db.Stats().PendingPageN
+	}
+	free = countFree()
+	if free < 7 {
+		t.Fatalf("unexpected free pages: %d", free)
+	}
+
+	if err := db.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db.MustReopen()
+	if n := countFree(); n != free {
+		t.Fatalf("unexpected free pages after reopen: %d, expected %d", n, free)
+	}
+	db.MustCheck()
+}
+
+// Ensure that RollbackTo undoes AllocatePages and FreePages calls made after
+// the savepoint.
+func TestTx_AllocatePages_RollbackTo(t *testing.T) {
+	db := MustOpenDB()
+	defer db.MustClose()
+
+	// Leave free pages behind, so that allocations come from both the
+	// freelist and the end of the file.
+	var start uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		id, _, err := tx.AllocatePages(2)
+		if err != nil {
+			return err
+		}
+		start = id
+		b, err := tx.CreateBucket([]byte("widgets"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("foo"), make([]byte, 4*os.Getpagesize()))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("widgets")).Delete([]byte("foo"))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pages freed after the savepoint are allocated again.
+	if err := db.Update(func(tx *bolt.Tx) error {
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		if err := tx.FreePages(start, 2); err != nil {
+			return err
+		}
+		return tx.RollbackTo(sp)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		_, err := tx.ReadPages(start)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+
+	// Pages allocated after the savepoint are released, including ones
+	// freed again before rolling back.
+	var ids []uint64
+	if err := db.Update(func(tx *bolt.Tx) error {
+		sp, err := tx.Savepoint()
+		if err != nil {
+			return err
+		}
+		for _, n := range []int{1, 2, 100} {
+			id, _, err := tx.AllocatePages(n)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := tx.FreePages(ids[1], 2); err != nil {
+			return err
+		}
+		return tx.RollbackTo(sp)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.View(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			if _, err := tx.ReadPages(id); err != bolt.ErrNotExtensionPage {
+				t.Fatalf("unexpected error for page %d: %v", id, err)
+			}
+		}
+		if _, err := tx.ReadPages(start); err != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.MustCheck()
+}
+
 // TestTx_releaseRange ensures db.freePages handles page releases
 // correctly when there are transaction that are no longer reachable
 // via any read/write transactions and are "between" ongoing read
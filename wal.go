@@ -0,0 +1,228 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+// walMagic identifies a commit record in the write-ahead log.
+const walMagic uint32 = 0xED0CDAF0
+
+// walHeaderSize is the size of the header of a commit record: the magic, the
+// page size and the length of the pages which follow.
+const walHeaderSize = 4 + 4 + 8
+
+// walPageHeaderSize is the size of the id and length preceding each page in
+// a commit record.
+const walPageHeaderSize = 8 + 4
+
+// DefaultWALCheckpointBytes is the size the write-ahead log may reach before
+// it is checkpointed into the data file, if Options.WALCheckpointBytes is not
+// set.
+const DefaultWALCheckpointBytes = 64 * 1024 * 1024
+
+// wal is the write-ahead log of a database opened with Options.WALMode.
+//
+// Every commit appends one record holding its pages and meta page to the log
+// and syncs only the log. The pages are still written to the data file, but
+// without syncing it, so readers find them in the mmap as usual. A checkpoint
+// syncs the data file and empties the log. Since pages written to the data
+// file may be lost in a crash until the next checkpoint, Open replays the
+// records left in the log onto the data file.
+//
+// Each record consists of its header, the id, length and contents of every
+// page, and the FNV-1a checksum of the pages. A record which is cut short or
+// fails its checksum was never acknowledged, so replaying stops there.
+type wal struct {
+	file            *os.File
+	size            int64  // bytes of complete records in file
+	buf             []byte // pages of the commit being written
+	checkpointBytes int64
+}
+
+// openWAL opens the write-ahead log next to the data file, replays the
+// records left in it and empties it.
+func (db *DB) openWAL(mode os.FileMode, checkpointBytes int64) (err error) {
+	f, err := db.openFile(db.path+"-wal", os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return err
+	}
+	if checkpointBytes <= 0 {
+		checkpointBytes = DefaultWALCheckpointBytes
+	}
+	db.wal = &wal{file: f, checkpointBytes: checkpointBytes}
+
+	// Keep the log for the next open if it could not be replayed.
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			db.wal = nil
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	n, err := db.replayWAL()
+	if err != nil {
+		return fmt.Errorf("replay wal: %s", err)
+	} else if n > 0 {
+		db.Logger().Warnf("replayed %d commits from the write-ahead log of %s", n, db.path)
+	}
+
+	// Drop the replayed records along with any torn record at the end.
+	db.wal.size = info.Size()
+	return db.checkpoint()
+}
+
+// checkWAL returns ErrWALNotReplayed if a write-ahead log holding commits
+// exists next to the data file.
+func (db *DB) checkWAL() error {
+	info, err := os.Stat(db.path + "-wal")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if info.Size() > 0 {
+		return ErrWALNotReplayed
+	}
+	return nil
+}
+
+// replayWAL writes the pages of the complete records in the log to the data
+// file, in order, and returns the number of records replayed.
+func (db *DB) replayWAL() (int, error) {
+	r := io.NewSectionReader(db.wal.file, 0, 1<<62)
+	var n int
+	for {
+		var hdr [walHeaderSize]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return n, nil
+		}
+		if binary.BigEndian.Uint32(hdr[0:4]) != walMagic {
+			return n, nil
+		}
+		pageSize := int64(binary.BigEndian.Uint32(hdr[4:8]))
+		body := make([]byte, binary.BigEndian.Uint64(hdr[8:16]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return n, nil
+		}
+		var sum [8]byte
+		if _, err := io.ReadFull(r, sum[:]); err != nil {
+			return n, nil
+		}
+		h := fnv.New64a()
+		_, _ = h.Write(body)
+		if h.Sum64() != binary.BigEndian.Uint64(sum[:]) {
+			return n, nil
+		}
+
+		for len(body) > 0 {
+			if len(body) < walPageHeaderSize {
+				return n, fmt.Errorf("record %d: truncated page header", n)
+			}
+			id := binary.BigEndian.Uint64(body[0:8])
+			sz := int(binary.BigEndian.Uint32(body[8:12]))
+			body = body[walPageHeaderSize:]
+			if len(body) < sz {
+				return n, fmt.Errorf("record %d: truncated page %d", n, id)
+			}
+			if _, err := db.file.WriteAt(body[:sz], int64(id)*pageSize); err != nil {
+				return n, err
+			}
+			body = body[sz:]
+		}
+		n++
+	}
+}
+
+// walAppend adds the data of page id, as written to the data file, to the
+// commit record being written.
+func (db *DB) walAppend(id pgid, data []byte) {
+	var hdr [walPageHeaderSize]byte
+	binary.BigEndian.PutUint64(hdr[0:8], uint64(id))
+	binary.BigEndian.PutUint32(hdr[8:12], uint32(len(data)))
+	db.wal.buf = append(db.wal.buf, hdr[:]...)
+	db.wal.buf = append(db.wal.buf, data...)
+}
+
+// walCommit appends the commit record to the log and syncs it, unless NoSync
+// or SyncNone is set.
+func (db *DB) walCommit() error {
+	w := db.wal
+	defer func() { w.buf = w.buf[:0] }()
+
+	rec := make([]byte, walHeaderSize, walHeaderSize+len(w.buf)+8)
+	binary.BigEndian.PutUint32(rec[0:4], walMagic)
+	binary.BigEndian.PutUint32(rec[4:8], uint32(db.pageSize))
+	binary.BigEndian.PutUint64(rec[8:16], uint64(len(w.buf)))
+	rec = append(rec, w.buf...)
+	h := fnv.New64a()
+	_, _ = h.Write(w.buf)
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	rec = append(rec, sum[:]...)
+
+	// A failed write leaves size untouched, so the next record overwrites it.
+	if _, err := w.file.WriteAt(rec, w.size); err != nil {
+		return err
+	}
+	if !db.noSync() {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	}
+	w.size += int64(len(rec))
+	return nil
+}
+
+// Checkpoint syncs the data file and empties the write-ahead log of a
+// database opened with Options.WALMode. Checkpoints happen automatically once
+// the log reaches Options.WALCheckpointBytes and when the database is closed,
+// so calling it is only needed to bound the time replaying takes after a
+// crash. It does nothing if WALMode is not set.
+func (db *DB) Checkpoint() error {
+	db.rwlock.Lock()
+	defer db.rwlock.Unlock()
+	if !db.opened {
+		return ErrDatabaseNotOpen
+	}
+	return db.checkpoint()
+}
+
+// checkpoint syncs the data file and empties the log. The writer lock must be
+// held, so that no commit writes the data file after it is synced.
+func (db *DB) checkpoint() error {
+	w := db.wal
+	if w == nil || w.size == 0 {
+		return nil
+	}
+	if err := db.syncData(); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size = 0
+	return nil
+}
+
+// closeWAL checkpoints the log, then closes and removes it.
+func (db *DB) closeWAL() error {
+	if err := db.checkpoint(); err != nil {
+		return err
+	}
+	path := db.wal.file.Name()
+	if err := db.wal.file.Close(); err != nil {
+		return err
+	}
+	db.wal = nil
+	return os.Remove(path)
+}